@@ -11,6 +11,7 @@ func CreateApp() *fiber.App {
 	app.Use(fiberzap.New(fiberzap.Config{
 		Logger: logger,
 	}))
+	app.Use(Authenticate)
 	Use(app)
 	// logger.Info("main", zap.Any("routes", app.GetRoutes()))
 	for _, r := range app.GetRoutes() {
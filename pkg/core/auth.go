@@ -0,0 +1,64 @@
+package core
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/everpan/idig/pkg/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// AnonymousPrincipal 未认证请求写入系统列（如 created_by）时使用的身份
+const AnonymousPrincipal = "anonymous"
+
+// AuthToken 配置项 auth.tokens 中的一项，持有 Token 的请求以 Principal 的身份访问
+type AuthToken struct {
+	Token     string `mapstructure:"token"`
+	Principal string `mapstructure:"principal"`
+}
+
+var (
+	muAuth     sync.RWMutex
+	authTokens = map[string]string{}
+)
+
+func init() {
+	config.RegisterReloadConfigFunc(ReloadAuthConfig)
+}
+
+// ReloadAuthConfig 读取 auth.tokens；以列表而非 map 配置，避免 viper 将令牌转为小写
+func ReloadAuthConfig() error {
+	var tokens []*AuthToken
+	if err := viper.UnmarshalKey("auth.tokens", &tokens); err != nil {
+		return err
+	}
+	m := make(map[string]string, len(tokens))
+	for _, t := range tokens {
+		if t.Token != "" && t.Principal != "" {
+			m[t.Token] = t.Principal
+		}
+	}
+	muAuth.Lock()
+	defer muAuth.Unlock()
+	authTokens = m
+	return nil
+}
+
+// Authenticate 认证中间件：将 Authorization: Bearer <token> 对应的身份写入 PrincipalKey；
+// 未携带令牌的请求以未认证身份继续，令牌无效时返回 401
+func Authenticate(c *fiber.Ctx) error {
+	auth := c.Get(fiber.HeaderAuthorization)
+	if auth == "" {
+		return c.Next()
+	}
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	muAuth.RLock()
+	principal := authTokens[strings.TrimSpace(token)]
+	muAuth.RUnlock()
+	if !ok || principal == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(NewIDigResp(-99, "invalid authorization token", nil))
+	}
+	c.Locals(PrincipalKey, principal)
+	return c.Next()
+}
@@ -71,3 +71,15 @@ func IDigHandlerExec(fb *fiber.Ctx, handler IDigHandleFunc) error {
 func (c *Context) FromFiberOnly(fb *fiber.Ctx) {
 	c.fb = fb
 }
+
+// PrincipalKey 认证中间件（见 Authenticate）将当前身份（字符串）写入 fiber.Ctx.Locals 的键
+const PrincipalKey = "idig.principal"
+
+// Principal 返回认证中间件写入的当前身份，未认证时为空
+func (c *Context) Principal() string {
+	if c.fb == nil {
+		return ""
+	}
+	s, _ := c.fb.Locals(PrincipalKey).(string)
+	return s
+}
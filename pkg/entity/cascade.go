@@ -0,0 +1,408 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+// cascadeChunk 按主键 IN 查询或更新时每条语句的主键数
+const cascadeChunk = 500
+
+// ErrRestricted 存在 restrict 策略的从属记录，删除或关联键变更被拒绝
+var ErrRestricted = errors.New("restricted by relation")
+
+// CascadeEffect 级联对某个关系的从属记录产生的影响
+type CascadeEffect struct {
+	Relation string `json:"relation"`
+	Entity   string `json:"entity"`          // 从属实体
+	Policy   string `json:"policy"`          // 级联策略
+	Column   string `json:"column"`          // 从属实体的关联键
+	Value    any    `json:"value,omitempty"` // 关联键变更时的新值
+	Keys     []any  `json:"keys"`            // 从属记录的主键
+
+	meta   *meta.EntityMeta
+	update bool // 由关联键变更产生，cascade 时更新关联键而不是删除
+}
+
+// CascadePlan 删除或关联键变更前计算出的级联影响，按执行顺序排列（深层的从属记录在前）
+type CascadePlan struct {
+	Effects []*CascadeEffect `json:"effects"`
+}
+
+// KeyChange 主实体一条记录的关联键从 Old 变为 New
+type KeyChange struct {
+	Column string
+	Old    any
+	New    any
+}
+
+// dependency 以 parent 为主实体的一个关系
+type dependency struct {
+	relation  *Relation
+	parentKey string
+	childKey  string
+	child     *meta.EntityMeta
+}
+
+// Restricted 返回因 restrict 策略而阻止操作的影响
+func (p *CascadePlan) Restricted() []*CascadeEffect {
+	var ret []*CascadeEffect
+	for _, e := range p.Effects {
+		if e.Policy == CascadeRestrict {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// Check 存在 restrict 的从属记录时返回 ErrRestricted
+func (p *CascadePlan) Check() error {
+	restricted := p.Restricted()
+	if len(restricted) == 0 {
+		return nil
+	}
+	msg := make([]string, len(restricted))
+	for i, e := range restricted {
+		msg[i] = fmt.Sprintf("%d %s record(s) by relation '%s'", len(e.Keys), e.Entity, e.Relation)
+	}
+	return fmt.Errorf("%w: %s", ErrRestricted, strings.Join(msg, ", "))
+}
+
+// Apply 在 sess 的事务中执行级联，调用前应先 Check
+func (p *CascadePlan) Apply(sess *xorm.Session, now time.Time) error {
+	for _, e := range p.Effects {
+		var err error
+		switch {
+		case e.Policy == CascadeRestrict:
+			continue
+		case e.Policy == CascadeDelete && !e.update:
+			_, err = DeleteEntities(sess, e.meta, e.Keys)
+		case e.Policy == CascadeDelete, e.Policy == CascadeSetNull:
+			err = setEntityColumn(sess, e.meta, e.Column, e.Value, e.Keys)
+		case e.Policy == CascadeSoftDelete:
+			col := e.meta.DeletedColumn()
+			var v any
+			if v, err = softDeletedValue(col, now); err == nil {
+				err = setEntityColumn(sess, e.meta, col.Name, v, e.Keys)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("cascade %s on relation '%s' error: %w", e.Policy, e.Relation, err)
+		}
+	}
+	return nil
+}
+
+// PlanDelete 计算删除实体 m 中主键为 pks 的记录时的级联影响，cascade 策略会递归到从属实体的从属记录
+func PlanDelete(sess *xorm.Session, m *meta.EntityMeta, pks []any) (*CascadePlan, error) {
+	p := &CascadePlan{}
+	return p, p.planDelete(sess, m, pks, map[string]bool{})
+}
+
+func (p *CascadePlan) planDelete(sess *xorm.Session, m *meta.EntityMeta, pks []any, visited map[string]bool) error {
+	for _, pk := range pks {
+		visited[m.Entity.EntityName+":"+keyString(pk)] = true
+	}
+	deps, err := dependencies(sess, m)
+	if err != nil {
+		return err
+	}
+	for _, d := range deps {
+		vals, err1 := columnValues(sess, m, d.parentKey, pks)
+		if err1 != nil {
+			return err1
+		}
+		keys, err1 := dependentKeys(sess, d, vals)
+		if err1 != nil {
+			return err1
+		}
+		// 自关联时跳过已在删除集合中的记录
+		keys = slices.DeleteFunc(keys, func(k any) bool { return visited[d.child.Entity.EntityName+":"+keyString(k)] })
+		if len(keys) == 0 {
+			continue
+		}
+		e, err1 := d.effect(keys)
+		if err1 != nil {
+			return err1
+		}
+		if e.Policy == CascadeDelete {
+			if err1 = p.planDelete(sess, d.child, keys, visited); err1 != nil {
+				return err1
+			}
+		}
+		p.Effects = append(p.Effects, e)
+	}
+	return nil
+}
+
+// PlanKeyUpdate 计算实体 m 的关联键按 changes 变更时的级联影响，值未变化的不产生影响
+func PlanKeyUpdate(sess *xorm.Session, m *meta.EntityMeta, changes []*KeyChange) (*CascadePlan, error) {
+	p := &CascadePlan{}
+	if len(changes) == 0 {
+		return p, nil
+	}
+	deps, err := dependencies(sess, m)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deps {
+		for _, c := range changes {
+			if c.Column != d.parentKey || c.Old == nil || keyString(c.Old) == keyString(c.New) {
+				continue
+			}
+			keys, err1 := dependentKeys(sess, d, []any{c.Old})
+			if err1 != nil {
+				return nil, err1
+			}
+			if len(keys) == 0 {
+				continue
+			}
+			e, err1 := d.effect(keys)
+			if err1 != nil {
+				return nil, err1
+			}
+			if e.Policy == CascadeDelete {
+				e.update, e.Value = true, c.New
+			}
+			p.Effects = append(p.Effects, e)
+		}
+	}
+	return p, nil
+}
+
+// KeyColumns 返回实体 m 作为主实体被引用的非主键关联键，这些列变更时需要级联
+func KeyColumns(sess *xorm.Session, m *meta.EntityMeta) ([]string, error) {
+	deps, err := dependencies(sess, m)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, d := range deps {
+		if d.parentKey != m.Entity.PkAttrColumn && !slices.Contains(ret, d.parentKey) {
+			ret = append(ret, d.parentKey)
+		}
+	}
+	return ret, nil
+}
+
+// effect 按关系的策略生成对从属记录 keys 的影响
+func (d *dependency) effect(keys []any) (*CascadeEffect, error) {
+	e := &CascadeEffect{Relation: d.relation.RelationName, Entity: d.child.Entity.EntityName,
+		Policy: d.relation.CascadePolicy, Column: d.childKey, Keys: keys, meta: d.child}
+	switch e.Policy {
+	case "":
+		e.Policy = CascadeRestrict
+	case CascadeRestrict, CascadeDelete:
+	case CascadeSetNull:
+		if d.childKey == d.child.Entity.PkAttrColumn {
+			return nil, fmt.Errorf("relation '%s': primary key '%s' can not be set null", e.Relation, d.childKey)
+		}
+	case CascadeSoftDelete:
+		if d.child.DeletedColumn() == nil {
+			return nil, fmt.Errorf("relation '%s': entity '%s' has no deleted column", e.Relation, e.Entity)
+		}
+	default:
+		return nil, fmt.Errorf("relation '%s': unknown cascade policy '%s'", e.Relation, e.Policy)
+	}
+	return e, nil
+}
+
+// dependencies 在 sess 中查询以 m 为主实体的关系，不使用缓存，保证事务内看到的是最新的关系；
+// m:n 时链接实体是左右实体的从属实体
+func dependencies(sess *xorm.Session, m *meta.EntityMeta) ([]*dependency, error) {
+	idx := m.Entity.EntityIdx
+	var rels []*Relation
+	if err := sess.Where("entity_left = ? OR entity_right = ?", idx, idx).OrderBy("relation_idx").
+		Find(&rels); err != nil {
+		return nil, err
+	}
+	var ret []*dependency
+	for _, r := range rels {
+		if r.RelationType == ManyToMany {
+			for _, end := range r.linkEnds() {
+				if end.entity != idx {
+					continue
+				}
+				d, err := newDependency(sess, r, m, end.key, r.EntityLink, end.linkKey)
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, d)
+			}
+			continue
+		}
+		parent, child, parentKey, childKey, err := r.ends()
+		if err != nil {
+			return nil, err
+		}
+		if parent != idx {
+			continue
+		}
+		d, err := newDependency(sess, r, m, parentKey, child, childKey)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// newDependency 取从属实体的元数据并确认两端的关联键存在
+func newDependency(sess *xorm.Session, r *Relation, m *meta.EntityMeta, parentKey string, child uint32,
+	childKey string) (*dependency, error) {
+	d := &dependency{relation: r, parentKey: parentKey, childKey: childKey}
+	e := &meta.Entity{}
+	has, err := sess.ID(child).Get(e)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("relation '%s': entity %d not found", r.RelationName, child)
+	}
+	if d.child, err = meta.AcquireMeta(e.EntityName, sess.Engine()); err != nil {
+		return nil, err
+	}
+	if _, ok := m.ColumnIndex[parentKey]; !ok {
+		return nil, fmt.Errorf("relation '%s': column '%s' not found in entity '%s'",
+			r.RelationName, parentKey, m.Entity.EntityName)
+	}
+	if _, ok := d.child.ColumnIndex[childKey]; !ok {
+		return nil, fmt.Errorf("relation '%s': column '%s' not found in entity '%s'",
+			r.RelationName, childKey, e.EntityName)
+	}
+	return d, nil
+}
+
+// columnValues 查询实体 m 中主键为 pks 的记录的 col 列的非空值，col 为主键时直接返回 pks
+func columnValues(sess *xorm.Session, m *meta.EntityMeta, col string, pks []any) ([]any, error) {
+	pk := m.Entity.PkAttrColumn
+	if col == pk {
+		return pks, nil
+	}
+	table := m.FetchTableNameByColumn(col)
+	var ret []any
+	for start := 0; start < len(pks); start += cascadeChunk {
+		chunk := pks[start:min(start+cascadeChunk, len(pks))]
+		rows, err := queryRows(sess, dialect(sess).Select(col).From(table).
+			Where(builder.In(pk, chunk...).And(builder.NotNull{col})))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			ret = append(ret, r[col])
+		}
+	}
+	return ret, nil
+}
+
+// dependentKeys 查询从属实体中关联键取值在 vals 中的记录主键
+func dependentKeys(sess *xorm.Session, d *dependency, vals []any) ([]any, error) {
+	pk := d.child.Entity.PkAttrColumn
+	table := d.child.FetchTableNameByColumn(d.childKey)
+	var ret []any
+	for start := 0; start < len(vals); start += cascadeChunk {
+		chunk := vals[start:min(start+cascadeChunk, len(vals))]
+		rows, err := queryRows(sess, dialect(sess).Select(pk).From(table).Where(builder.In(d.childKey, chunk...)).OrderBy(pk))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			ret = append(ret, r[pk])
+		}
+	}
+	return ret, nil
+}
+
+// DeleteEntities 删除实体 m 中主键为 pks 的记录，先删除各属性表再删除主表，返回主表删除的行数
+func DeleteEntities(sess *xorm.Session, m *meta.EntityMeta, pks []any) (int64, error) {
+	pkTable, pk := m.PrimaryTable(), m.Entity.PkAttrColumn
+	tables := make([]string, 0, len(m.AttrTables))
+	for t := range m.AttrTables {
+		if t != pkTable {
+			tables = append(tables, t)
+		}
+	}
+	sort.Strings(tables)
+	tables = append(tables, pkTable)
+	var deleted int64
+	for _, t := range tables {
+		for start := 0; start < len(pks); start += cascadeChunk {
+			chunk := pks[start:min(start+cascadeChunk, len(pks))]
+			af, err := execBuilder(sess, dialect(sess).Delete(builder.In(pk, chunk...)).From(t))
+			if err != nil {
+				return deleted, err
+			}
+			if t == pkTable {
+				deleted += af
+			}
+		}
+	}
+	return deleted, meta.SyncSearchIndex(sess, m, pks)
+}
+
+// setEntityColumn 把实体 m 中主键为 pks 的记录的 col 列设为 v
+func setEntityColumn(sess *xorm.Session, m *meta.EntityMeta, col string, v any, pks []any) error {
+	table, pk := m.FetchTableNameByColumn(col), m.Entity.PkAttrColumn
+	for start := 0; start < len(pks); start += cascadeChunk {
+		chunk := pks[start:min(start+cascadeChunk, len(pks))]
+		if _, err := execBuilder(sess, dialect(sess).Update(builder.Eq{col: v}).From(table).
+			Where(builder.In(pk, chunk...))); err != nil {
+			return err
+		}
+	}
+	return meta.SyncSearchIndex(sess, m, pks)
+}
+
+// softDeletedValue 软删除标记的值：时间列为 now，数值列为 1，布尔列为 true
+func softDeletedValue(col *schemas.Column, now time.Time) (any, error) {
+	switch {
+	case col.SQLType.IsTime():
+		return query.CoerceValue(col, now)
+	case col.SQLType.IsBool():
+		return true, nil
+	}
+	return query.CoerceValue(col, 1)
+}
+
+// dialect 返回 sess 的驱动对应的 builder
+func dialect(sess *xorm.Session) *builder.Builder {
+	return builder.Dialect(sess.Engine().DriverName())
+}
+
+func queryRows(sess *xorm.Session, bld *builder.Builder) ([]map[string]any, error) {
+	sqlStr, args, err := bld.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	return sess.QueryInterface(append([]any{sqlStr}, args...)...)
+}
+
+func execBuilder(sess *xorm.Session, bld *builder.Builder) (int64, error) {
+	sqlStr, args, err := bld.ToSQL()
+	if err != nil {
+		return 0, err
+	}
+	result, err := sess.Exec(append([]any{sqlStr}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// keyString 用于比较不同类型的键值，如请求中的 float64 与查询出的 int64
+func keyString(v any) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,78 @@
+package entity
+
+import (
+	"fmt"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// LinkRelation 返回名为 name 的 m:n 关系及其链接实体
+func LinkRelation(engine *xorm.Engine, name string) (*Relation, *meta.EntityMeta, error) {
+	r, err := GetRelation(engine, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.RelationType != ManyToMany {
+		return nil, nil, fmt.Errorf("relation '%s' is not m:n", name)
+	}
+	link, err := meta.AcquireMeta(r.LinkEntity, engine)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, link, nil
+}
+
+// CheckLinkEnds 链接的每一行都必须给出左右两端，且两端的记录存在，违规记录在 #result 中
+func CheckLinkEnds(sess *xorm.Session, r *Relation, dt *query.DataTable) ([]*query.CellError, error) {
+	var errs []*query.CellError
+	for _, end := range r.linkEnds() {
+		e := &meta.Entity{}
+		if _, err := sess.ID(end.entity).Get(e); err != nil {
+			return nil, err
+		}
+		m, err := meta.AcquireMeta(e.EntityName, sess.Engine())
+		if err != nil {
+			return nil, err
+		}
+		idx := dt.FetchColumnIndex(end.linkKey)
+		table := m.FetchTableNameByColumn(end.key)
+		for i, row := range dt.Values() {
+			if idx < 0 || row[idx] == nil {
+				errs = append(errs, &query.CellError{Row: i, Col: end.linkKey, Message: "required"})
+				continue
+			}
+			has, err1 := sess.Table(table).Where(builder.Eq{end.key: row[idx]}).Exist()
+			if err1 != nil {
+				return nil, err1
+			}
+			if !has {
+				errs = append(errs, &query.CellError{Row: i, Col: end.linkKey,
+					Message: fmt.Sprintf("%s '%v' not found", e.EntityName, row[idx])})
+			}
+		}
+	}
+	return errs, nil
+}
+
+// FindLinks 查询链接实体中与 dt 第 row 行左右两端相同的链接主键；dt 中没有某一端的列时不限制该端
+func FindLinks(sess *xorm.Session, r *Relation, link *meta.EntityMeta, dt *query.DataTable, row int) ([]any, error) {
+	cond := builder.NewCond()
+	for _, k := range []string{r.LinkLeftKey, r.LinkRightKey} {
+		if idx := dt.FetchColumnIndex(k); idx >= 0 {
+			cond = cond.And(builder.Eq{k: dt.Values()[row][idx]})
+		}
+	}
+	pk := link.Entity.PkAttrColumn
+	rows, err := queryRows(sess, dialect(sess).Select(pk).From(link.PrimaryTable()).Where(cond).OrderBy(pk))
+	if err != nil {
+		return nil, err
+	}
+	pks := make([]any, len(rows))
+	for i, r := range rows {
+		pks[i] = r[pk]
+	}
+	return pks, nil
+}
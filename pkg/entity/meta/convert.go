@@ -2,6 +2,7 @@ package meta
 
 import (
 	"github.com/goccy/go-json"
+	"sort"
 	"strings"
 	"xorm.io/xorm/schemas"
 )
@@ -18,6 +19,8 @@ type Attr struct {
 	IndexName   string         `json:"index_name,omitempty"`
 	UniqueName  string         `json:"unique_name,omitempty"`
 	Comment     string         `json:"comment,omitempty"`
+	Expr        string         `json:"expr,omitempty"`      // 虚拟属性的表达式
+	ReadOnly    bool           `json:"read_only,omitempty"` // 虚拟属性只读
 }
 
 type JMeta struct {
@@ -26,6 +29,9 @@ type JMeta struct {
 	EntryInfo   *Entity            `json:"entry_info"`
 	GroupInfo   []*AttrGroup       `json:"group_info"`
 	PrimaryKeys []string           `json:"primary_keys"`
+	Rules       []*Rule            `json:"rules,omitempty"`
+	Virtual     []*Attr            `json:"virtual,omitempty"`
+	Defaults    []*ColumnDefault   `json:"defaults,omitempty"`
 }
 
 func (jm *JMeta) ToJson() []byte {
@@ -65,6 +71,8 @@ func (m *EntityMeta) ToJMeta() *JMeta {
 		GroupInfo:   m.AttrGroups,
 		PrimaryKeys: m.AttrTables[m.Entity.PkAttrTable].PrimaryKeys,
 		Attrs:       make(map[string][]*Attr),
+		Rules:       m.Rules,
+		Defaults:    m.Defaults,
 	}
 	for table, schema := range m.AttrTables {
 		for _, col := range schema.Columns() {
@@ -73,6 +81,11 @@ func (m *EntityMeta) ToJMeta() *JMeta {
 			mj.Attrs[table] = append(mj.Attrs[table], attr)
 		}
 	}
+	for _, v := range m.Virtuals {
+		mj.Virtual = append(mj.Virtual, &Attr{Name: v.Name, Type: v.Type, Comment: v.Comment,
+			Expr: v.Expr, Nullable: true, ReadOnly: true})
+	}
+	sort.Slice(mj.Virtual, func(i, j int) bool { return mj.Virtual[i].Name < mj.Virtual[j].Name })
 	return mj
 }
 
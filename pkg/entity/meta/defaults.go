@@ -0,0 +1,187 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// 默认值生成器
+const (
+	GenConst     = "const"     // 常量 Value
+	GenNow       = "now"       // 当前时间，数值列为 unix 秒
+	GenUUID      = "uuid"      // 随机 UUID
+	GenSequence  = "sequence"  // 序列的下一个值，Value 为序列名，为空时为 <entity>.<column>
+	GenPrincipal = "principal" // 当前请求的身份
+	GenTenant    = "tenant"    // 当前租户的 tenant_idx
+)
+
+var ErrColumnDefaultNotFound = errors.New("column default not found")
+
+// ColumnDefault 实体列的默认值或系统列配置，在写入前填充到数据中。
+// 非覆盖的默认值只填充未提供的列和值为 NULL 的单元格；Override 为 true 的系统列
+// （如 created_at、updated_by）总是由服务端生成，忽略请求中的值
+type ColumnDefault struct {
+	DefaultIdx uint32    `json:"default_idx" xorm:"pk autoincr"`
+	EntityIdx  uint32    `json:"entity_idx" xorm:"unique(entity_col) index"`
+	Column     string    `json:"column" xorm:"'col' unique(entity_col) not null"`
+	Generator  string    `json:"generator" xorm:"not null"`
+	Value      string    `json:"value,omitempty"`
+	OnInsert   bool      `json:"on_insert"`
+	OnUpdate   bool      `json:"on_update"`
+	Override   bool      `json:"override,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at" xorm:"updated"`
+}
+
+func (d *ColumnDefault) TableName() string {
+	return "idig_entity_column_default"
+}
+
+// SequenceName 序列生成器使用的序列名
+func (d *ColumnDefault) SequenceName(m *EntityMeta) string {
+	if d.Value != "" {
+		return d.Value
+	}
+	return m.Entity.EntityName + "." + d.Column
+}
+
+// Verify 校验配置：列必须属于实体；未指定写入时机时为插入；
+// uuid、sequence 不可覆盖请求中的值，主键列只能在插入时生成
+func (d *ColumnDefault) Verify(m *EntityMeta) error {
+	if _, ok := m.ColumnIndex[d.Column]; !ok {
+		return fmt.Errorf("column '%s' not found in entity '%s'", d.Column, m.Entity.EntityName)
+	}
+	switch d.Generator {
+	case GenConst, GenNow, GenPrincipal, GenTenant:
+	case GenUUID, GenSequence:
+		if d.Override {
+			return fmt.Errorf("column '%s': generator '%s' can not override", d.Column, d.Generator)
+		}
+	default:
+		return fmt.Errorf("column '%s': unknown generator '%s'", d.Column, d.Generator)
+	}
+	if !d.OnInsert && !d.OnUpdate {
+		d.OnInsert = true
+	}
+	for _, pk := range m.PrimaryColumn() {
+		if pk == d.Column && (d.OnUpdate || d.Override) {
+			return fmt.Errorf("column '%s': primary key can only be generated on insert", d.Column)
+		}
+	}
+	return nil
+}
+
+// attachColumnDefaults 读取实体的列默认值；已失效的配置（如列被删除）忽略
+func attachColumnDefaults(m *EntityMeta, engine *xorm.Engine) error {
+	var defs []*ColumnDefault
+	if err := engine.Where("entity_idx = ?", m.Entity.EntityIdx).Asc("default_idx").Find(&defs); err != nil {
+		return err
+	}
+	m.Defaults = make([]*ColumnDefault, 0, len(defs))
+	for _, d := range defs {
+		if err := d.Verify(m); err != nil {
+			continue
+		}
+		m.Defaults = append(m.Defaults, d)
+	}
+	return nil
+}
+
+// ListColumnDefaults 列出实体的列默认值
+func ListColumnDefaults(engine *xorm.Engine, entity string) ([]*ColumnDefault, error) {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return nil, err
+	}
+	var defs []*ColumnDefault
+	err = engine.Where("entity_idx = ?", m.Entity.EntityIdx).Asc("default_idx").Find(&defs)
+	return defs, err
+}
+
+// SetColumnDefault 设置实体列的默认值，已存在时替换
+func SetColumnDefault(engine *xorm.Engine, entity string, d *ColumnDefault) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	d.DefaultIdx, d.EntityIdx = 0, m.Entity.EntityIdx
+	if err = d.Verify(m); err != nil {
+		return err
+	}
+	old := &ColumnDefault{}
+	has, err := engine.Where("entity_idx = ? AND col = ?", d.EntityIdx, d.Column).Get(old)
+	if err != nil {
+		return err
+	}
+	if has {
+		d.DefaultIdx = old.DefaultIdx
+		_, err = engine.ID(d.DefaultIdx).AllCols().Update(d)
+	} else {
+		_, err = engine.Insert(d)
+	}
+	if err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
+
+// DeleteColumnDefault 删除实体列的默认值
+func DeleteColumnDefault(engine *xorm.Engine, entity, column string) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	n, err := engine.Where("entity_idx = ? AND col = ?", m.Entity.EntityIdx, column).Delete(&ColumnDefault{})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: '%s'", ErrColumnDefaultNotFound, column)
+	}
+	InvalidateMeta(entity)
+	return nil
+}
+
+// Sequence 命名序列，供 sequence 生成器使用
+type Sequence struct {
+	SeqName   string    `json:"seq_name" xorm:"pk varchar(128)"`
+	Value     int64     `json:"value" xorm:"not null default 0"`
+	UpdatedAt time.Time `json:"updated_at" xorm:"updated"`
+}
+
+func (s *Sequence) TableName() string {
+	return "idig_entity_sequence"
+}
+
+// NextSequence 递增并返回序列的值，序列不存在时从 1 开始；在事务中调用时随事务回滚
+func NextSequence(db xorm.Interface, name string) (int64, error) {
+	for retry := 0; ; retry++ {
+		ret, err := db.Exec("UPDATE "+(&Sequence{}).TableName()+" SET value = value + 1 WHERE seq_name = ?", name)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := ret.RowsAffected(); n > 0 {
+			break
+		}
+		if _, err = db.Insert(&Sequence{SeqName: name, Value: 1}); err == nil {
+			return 1, nil
+		} else if retry > 0 || !isDuplicateErr(err) {
+			return 0, err
+		}
+		// 并发创建同名序列，重试递增
+	}
+	s := &Sequence{}
+	if _, err := db.Where("seq_name = ?", name).Get(s); err != nil {
+		return 0, err
+	}
+	return s.Value, nil
+}
+
+func isDuplicateErr(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique") || strings.Contains(msg, "duplicate")
+}
@@ -0,0 +1,71 @@
+package meta
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColumnDefaultCRUD(t *testing.T) {
+	_, err := engine.Exec("CREATE TABLE emp_default (id INTEGER PRIMARY KEY AUTOINCREMENT, code TEXT, " +
+		"created_at DATETIME, updated_by TEXT)")
+	require.NoError(t, err)
+	_, err = RegisterEntity(engine, "emp_default", "", "emp_default", "id")
+	require.NoError(t, err)
+	require.NoError(t, refreshTableCache(engine))
+
+	tests := []struct {
+		name string
+		def  *ColumnDefault
+		err  string
+	}{
+		{"now", &ColumnDefault{Column: "created_at", Generator: GenNow, Override: true}, ""},
+		{"principal", &ColumnDefault{Column: "updated_by", Generator: GenPrincipal, OnInsert: true, OnUpdate: true, Override: true}, ""},
+		{"sequence", &ColumnDefault{Column: "code", Generator: GenSequence}, ""},
+		{"bad column", &ColumnDefault{Column: "nope", Generator: GenNow}, "column 'nope' not found"},
+		{"bad generator", &ColumnDefault{Column: "code", Generator: "random"}, "unknown generator"},
+		{"override sequence", &ColumnDefault{Column: "code", Generator: GenSequence, Override: true}, "can not override"},
+		{"pk on update", &ColumnDefault{Column: "id", Generator: GenUUID, OnUpdate: true}, "primary key"},
+	}
+	for _, tt := range tests {
+		err = SetColumnDefault(engine, "emp_default", tt.def)
+		if tt.err == "" {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.ErrorContains(t, err, tt.err, tt.name)
+		}
+	}
+
+	m, err := AcquireMeta("emp_default", engine)
+	require.NoError(t, err)
+	require.Len(t, m.Defaults, 3)
+	assert.True(t, m.Defaults[0].OnInsert, "insert by default")
+	assert.False(t, m.Defaults[0].OnUpdate)
+	assert.Equal(t, "emp_default.code", m.Defaults[2].SequenceName(m))
+	assert.Len(t, m.ToJMeta().Defaults, 3)
+
+	// 再次设置同一列时替换
+	require.NoError(t, SetColumnDefault(engine, "emp_default", &ColumnDefault{Column: "code", Generator: GenConst, Value: "N/A"}))
+	defs, err := ListColumnDefaults(engine, "emp_default")
+	require.NoError(t, err)
+	require.Len(t, defs, 3)
+	assert.Equal(t, GenConst, defs[2].Generator)
+
+	require.NoError(t, DeleteColumnDefault(engine, "emp_default", "code"))
+	assert.ErrorIs(t, DeleteColumnDefault(engine, "emp_default", "code"), ErrColumnDefaultNotFound)
+	m, err = AcquireMeta("emp_default", engine)
+	require.NoError(t, err)
+	assert.Len(t, m.Defaults, 2)
+}
+
+func TestNextSequence(t *testing.T) {
+	for i := int64(1); i <= 3; i++ {
+		n, err := NextSequence(engine, "test.seq")
+		require.NoError(t, err)
+		assert.Equal(t, i, n)
+	}
+	n, err := NextSequence(engine, "test.other")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
@@ -0,0 +1,51 @@
+package meta
+
+import (
+	"fmt"
+
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+// DeletedColumn 返回实体声明的软删除标记列，未声明或列已不存在时为 nil
+func (m *EntityMeta) DeletedColumn() *schemas.Column {
+	if m.Entity == nil || m.Entity.DeletedColumn == "" {
+		return nil
+	}
+	return m.ColumnIndex[m.Entity.DeletedColumn]
+}
+
+// verifyDeletedColumn 软删除标记列必须是实体的非主键列，且为时间列（设为删除时间）或数值列（设为 1）
+func verifyDeletedColumn(m *EntityMeta, column string) error {
+	col, ok := m.ColumnIndex[column]
+	if !ok {
+		return fmt.Errorf("column '%s' not found in entity '%s'", column, m.Entity.EntityName)
+	}
+	for _, pk := range m.PrimaryColumn() {
+		if pk == column {
+			return fmt.Errorf("primary key '%s' can not be the deleted column", column)
+		}
+	}
+	if !col.SQLType.IsNumeric() && !col.SQLType.IsTime() && !col.SQLType.IsBool() {
+		return fmt.Errorf("deleted column '%s' must be numeric, bool or time, got %s", column, col.SQLType.Name)
+	}
+	return nil
+}
+
+// SetDeletedColumn 设置实体的软删除标记列，column 为空时取消
+func SetDeletedColumn(engine *xorm.Engine, entity, column string) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	if column != "" {
+		if err = verifyDeletedColumn(m, column); err != nil {
+			return err
+		}
+	}
+	if _, err = engine.ID(m.Entity.EntityIdx).Cols("deleted_col").Update(&Entity{DeletedColumn: column}); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
@@ -43,6 +43,12 @@ type Entity struct {
 	PkAttrTable  string `json:"pk_attr_table" xorm:"not null"`
 	PkAttrColumn string `json:"pk_attr_column" xorm:"not null"`
 	Status       int    `json:"status" xorm:"default 1"` // EntityStatusNormal or EntityStatusDeleted
+	// VersionColumn 乐观锁版本列，整数列或时间列（如 updated_at），为空时不检查
+	VersionColumn string `json:"version_column,omitempty" xorm:"'version_col'"`
+	// DeletedColumn 软删除标记列，时间列（如 deleted_at）或数值列，关系级联软删除时设置
+	DeletedColumn string `json:"deleted_column,omitempty" xorm:"'deleted_col'"`
+	// SearchColumns 全文检索的文本列，可分布在多个属性表中
+	SearchColumns []string `json:"search_columns,omitempty" xorm:"'search_cols' json"`
 }
 
 // AttrGroup represents a group of attributes for an entity
@@ -60,6 +66,9 @@ type EntityMeta struct {
 	AttrGroups  []*AttrGroup               `json:"attr_groups"`
 	AttrTables  map[string]*schemas.Table  `json:"attr_tables"`
 	ColumnIndex map[string]*schemas.Column `json:"-"`
+	Rules       []*Rule                    `json:"rules,omitempty"`
+	Virtuals    map[string]*VirtualAttr    `json:"virtuals,omitempty"`
+	Defaults    []*ColumnDefault           `json:"defaults,omitempty"`
 	UpdatedAt   time.Time                  `json:"-"`
 }
 
@@ -67,6 +76,7 @@ type IEntityMeta interface {
 	FetchTableNameByColumn(col string) string
 	PrimaryColumn() []string
 	UniqueColumns(table string) [][]string
+	IsVirtual(col string) bool
 }
 
 // MCache manages the caching of entity metadata
@@ -127,12 +137,31 @@ func InitEntityTable(engine *xorm.Engine) error {
 		return fmt.Errorf("failed to sync attr group table: %w", err)
 	}
 
+	if err := engine.Sync2(new(Rule)); err != nil {
+		return fmt.Errorf("failed to sync rule table: %w", err)
+	}
+
+	if err := engine.Sync2(new(VirtualAttr)); err != nil {
+		return fmt.Errorf("failed to sync virtual attr table: %w", err)
+	}
+
+	if err := engine.Sync2(new(ColumnDefault)); err != nil {
+		return fmt.Errorf("failed to sync column default table: %w", err)
+	}
+
+	if err := engine.Sync2(new(Sequence)); err != nil {
+		return fmt.Errorf("failed to sync sequence table: %w", err)
+	}
+
 	// Register basic entities
 	entities := []struct {
 		name, desc, table, pk string
 	}{
 		{"entity", "实体信息", (&Entity{}).TableName(), "entity_idx"},
 		{"entity_attr_group", "实体属性组信息", (&AttrGroup{}).TableName(), "group_idx"},
+		{"entity_rule", "实体校验规则", (&Rule{}).TableName(), "rule_idx"},
+		{"entity_virtual_attr", "实体虚拟属性", (&VirtualAttr{}).TableName(), "attr_idx"},
+		{"entity_column_default", "实体列默认值", (&ColumnDefault{}).TableName(), "default_idx"},
 		{"tenant", "租户信息", (&core.Tenant{}).TableName(), "tenant_idx"},
 	}
 
@@ -171,6 +200,51 @@ func RegisterEntity(engine *xorm.Engine, name, desc, pkAttrTable, pkAttrColumn s
 	return engine.Insert(e)
 }
 
+// AddEntityAttrGroupByName 为实体添加属性组，attrTable 必须是已存在的表，且以实体主键列关联主表
+func AddEntityAttrGroupByName(engine *xorm.Engine, entity, group, attrTable string) (int64, error) {
+	if entity == "" || attrTable == "" {
+		return 0, ErrNilParameter
+	}
+	e := &Entity{EntityName: entity, Status: EntityStatusNormal}
+	exists, err := engine.Get(e)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get entity: %w", err)
+	}
+	if !exists {
+		return 0, ErrEntityNotFound
+	}
+	// 属性表可能在表结构缓存之后创建
+	if err = refreshTableCache(engine); err != nil {
+		return 0, err
+	}
+	metaCache.RLock()
+	tables, _ := metaCache.tableCache.Get(DataSourceHash(engine.DataSourceName()))
+	metaCache.RUnlock()
+	t, ok := tables.(map[string]*schemas.Table)[attrTable]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrTableNotFound, attrTable)
+	}
+	if t.GetColumn(e.PkAttrColumn) == nil {
+		return 0, fmt.Errorf("attr table %s has no column %s", attrTable, e.PkAttrColumn)
+	}
+	n, err := engine.Insert(&AttrGroup{EntityIdx: e.EntityIdx, AttrTable: attrTable, GroupName: group})
+	if err != nil {
+		return 0, err
+	}
+	InvalidateMeta(entity)
+	return n, nil
+}
+
+// InvalidateMeta 移除实体元数据缓存，元数据变更后调用
+func InvalidateMeta(entity string) {
+	if metaCache == nil {
+		return
+	}
+	metaCache.Lock()
+	defer metaCache.Unlock()
+	metaCache.entityCache.Remove(entity)
+}
+
 // AcquireMeta retrieves entity metadata with caching
 func AcquireMeta(entity string, engine *xorm.Engine) (*EntityMeta, error) {
 	if entity == "" {
@@ -251,6 +325,18 @@ func getMetaFromDB(entityName string, engine *xorm.Engine) (*EntityMeta, error)
 		return nil, fmt.Errorf("failed to attach schema: %w", err)
 	}
 
+	if meta.Rules, err = queryRulesFromDB(e.EntityIdx, engine); err != nil {
+		return nil, fmt.Errorf("failed to query rules: %w", err)
+	}
+
+	if err = attachVirtualAttrs(meta, engine); err != nil {
+		return nil, fmt.Errorf("failed to query virtual attrs: %w", err)
+	}
+
+	if err = attachColumnDefaults(meta, engine); err != nil {
+		return nil, fmt.Errorf("failed to query column defaults: %w", err)
+	}
+
 	return meta, nil
 }
 
@@ -266,24 +352,21 @@ func queryAttrGroupFromDB(entityIdx uint32, engine *xorm.Engine) ([]*AttrGroup,
 
 // attachSchemaToMeta attaches table schemas to entity metadata
 func attachSchemaToMeta(m *EntityMeta, engine *xorm.Engine) error {
-	key := DataSourceHash(engine.DataSourceName())
-
-	metaCache.RLock()
-	tables, exists := metaCache.tableCache.Get(key)
-	metaCache.RUnlock()
-
-	if !exists {
-		if err := refreshTableCache(engine); err != nil {
-			return err
-		}
-		metaCache.RLock()
-		tables, _ = metaCache.tableCache.Get(key)
-		metaCache.RUnlock()
+	tableMap, err := cachedTables(engine, false)
+	if err != nil {
+		return err
 	}
-
-	tableMap := tables.(map[string]*schemas.Table)
+	refreshed := false
 	for _, g := range m.AttrGroups {
 		t, ok := tableMap[g.AttrTable]
+		if !ok && !refreshed {
+			// 缓存之后新建的表（如运行时建表并注册的实体），重新读取一次表结构
+			if tableMap, err = cachedTables(engine, true); err != nil {
+				return err
+			}
+			refreshed = true
+			t, ok = tableMap[g.AttrTable]
+		}
 		if !ok {
 			return fmt.Errorf("%w: %s", ErrTableNotFound, g.AttrTable)
 		}
@@ -294,6 +377,26 @@ func attachSchemaToMeta(m *EntityMeta, engine *xorm.Engine) error {
 	return nil
 }
 
+// cachedTables 返回数据源的表结构缓存，未缓存或 refresh 为 true 时从数据库读取
+func cachedTables(engine *xorm.Engine, refresh bool) (map[string]*schemas.Table, error) {
+	key := DataSourceHash(engine.DataSourceName())
+	if !refresh {
+		metaCache.RLock()
+		tables, exists := metaCache.tableCache.Get(key)
+		metaCache.RUnlock()
+		if exists {
+			return tables.(map[string]*schemas.Table), nil
+		}
+	}
+	if err := refreshTableCache(engine); err != nil {
+		return nil, err
+	}
+	metaCache.RLock()
+	defer metaCache.RUnlock()
+	tables, _ := metaCache.tableCache.Get(key)
+	return tables.(map[string]*schemas.Table), nil
+}
+
 // refreshTableCache refreshes the table schema cache
 func refreshTableCache(engine *xorm.Engine) error {
 	sc, err := engine.DBMetas()
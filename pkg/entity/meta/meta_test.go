@@ -267,6 +267,25 @@ func TestAttachSchemaToMeta(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestAttachSchemaToMeta_NewTable(t *testing.T) {
+	_, err := cachedTables(engine, false)
+	assert.NoError(t, err)
+	// 缓存表结构之后新建的表
+	_, _ = engine.Exec("DROP TABLE IF EXISTS user_late")
+	_, err = engine.Exec("CREATE TABLE user_late (user_idx INTEGER PRIMARY KEY, nick TEXT)")
+	assert.NoError(t, err)
+	m := &EntityMeta{
+		Entity:     &Entity{PkAttrTable: "user_late", PkAttrColumn: "user_idx"},
+		AttrGroups: []*AttrGroup{{AttrTable: "user_late"}},
+		AttrTables: map[string]*schemas.Table{},
+	}
+	assert.NoError(t, attachSchemaToMeta(m, engine))
+	assert.Contains(t, m.ColumnIndex, "nick")
+
+	m.AttrGroups = append(m.AttrGroups, &AttrGroup{AttrTable: "not_exist"})
+	assert.ErrorIs(t, attachSchemaToMeta(m, engine), ErrTableNotFound)
+}
+
 func TestRefreshTableCache(t *testing.T) {
 	err := refreshTableCache(engine)
 	assert.NoError(t, err)
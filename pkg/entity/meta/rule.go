@@ -0,0 +1,221 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// 规则类型
+const (
+	RuleRegex   = "regex"   // Column 的文本值须匹配 Pattern
+	RuleRange   = "range"   // Column 的数值须在 [Min, Max] 内，Min/Max 可只给一个
+	RuleCompare = "compare" // Column Op Other，如 end_date gte start_date
+	RuleUnique  = "unique"  // Column 在 Scope 列取值相同的范围内唯一
+)
+
+// 规则状态
+const (
+	RuleStatusEnabled  = 1
+	RuleStatusDisabled = 2
+)
+
+var ErrRuleNotFound = errors.New("rule not found")
+
+// Rule 实体的声明式校验规则，GroupIdx 为 0 时属于实体，否则属于对应属性组
+type Rule struct {
+	RuleIdx   uint32    `json:"rule_idx" xorm:"pk autoincr"`
+	EntityIdx uint32    `json:"entity_idx" xorm:"unique(entity_rule) index"`
+	GroupIdx  uint32    `json:"group_idx,omitempty" xorm:"default 0"`
+	RuleName  string    `json:"rule_name" xorm:"unique(entity_rule) not null"`
+	Kind      string    `json:"kind" xorm:"not null"`
+	Column    string    `json:"column" xorm:"'col' not null"`
+	Pattern   string    `json:"pattern,omitempty"`
+	Min       *float64  `json:"min,omitempty"`
+	Max       *float64  `json:"max,omitempty"`
+	Op        string    `json:"op,omitempty"`    // compare 的操作符 eq ne lt lte gt gte
+	Other     string    `json:"other,omitempty"` // compare 的另一列
+	Scope     []string  `json:"scope,omitempty" xorm:"text"`
+	Message   string    `json:"msg,omitempty" xorm:"'msg'"`
+	Status    int       `json:"status" xorm:"default 1"` // RuleStatusEnabled or RuleStatusDisabled
+	UpdatedAt time.Time `json:"updated_at" xorm:"updated"`
+
+	re *regexp.Regexp
+}
+
+func (r *Rule) TableName() string {
+	return "idig_entity_rule"
+}
+
+// Enabled 规则是否启用
+func (r *Rule) Enabled() bool {
+	return r.Status != RuleStatusDisabled
+}
+
+// Regexp 返回编译后的 Pattern
+func (r *Rule) Regexp() *regexp.Regexp {
+	if r.re == nil && r.Pattern != "" {
+		r.re, _ = regexp.Compile(r.Pattern)
+	}
+	return r.re
+}
+
+// Verify 校验规则定义，引用的列必须属于实体，属于属性组时列必须在该属性组的表中
+func (r *Rule) Verify(m *EntityMeta) error {
+	if r.RuleName == "" {
+		return errors.New("rule name required")
+	}
+	if r.Status == 0 {
+		r.Status = RuleStatusEnabled
+	}
+	if r.Status != RuleStatusEnabled && r.Status != RuleStatusDisabled {
+		return fmt.Errorf("invalid rule status %d", r.Status)
+	}
+	col, ok := m.ColumnIndex[r.Column]
+	if !ok {
+		return fmt.Errorf("rule '%s': column '%s' not found", r.RuleName, r.Column)
+	}
+	if r.GroupIdx != 0 {
+		var g *AttrGroup
+		for _, ag := range m.AttrGroups {
+			if ag.GroupIdx == r.GroupIdx {
+				g = ag
+				break
+			}
+		}
+		if g == nil {
+			return fmt.Errorf("rule '%s': attr group %d not found", r.RuleName, r.GroupIdx)
+		}
+		if col.TableName != g.AttrTable {
+			return fmt.Errorf("rule '%s': column '%s' is not in attr group '%s'", r.RuleName, r.Column, g.GroupName)
+		}
+	}
+	switch r.Kind {
+	case RuleRegex:
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule '%s': %w", r.RuleName, err)
+		}
+		r.re = re
+	case RuleRange:
+		if r.Min == nil && r.Max == nil {
+			return fmt.Errorf("rule '%s': min or max required", r.RuleName)
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return fmt.Errorf("rule '%s': min greater than max", r.RuleName)
+		}
+	case RuleCompare:
+		switch r.Op {
+		case "eq", "ne", "lt", "lte", "gt", "gte":
+		default:
+			return fmt.Errorf("rule '%s': unknown op '%s'", r.RuleName, r.Op)
+		}
+		if _, ok = m.ColumnIndex[r.Other]; !ok {
+			return fmt.Errorf("rule '%s': column '%s' not found", r.RuleName, r.Other)
+		}
+	case RuleUnique:
+		for _, s := range r.Scope {
+			sc, ok1 := m.ColumnIndex[s]
+			if !ok1 {
+				return fmt.Errorf("rule '%s': scope column '%s' not found", r.RuleName, s)
+			}
+			if sc.TableName != col.TableName {
+				return fmt.Errorf("rule '%s': scope column '%s' must be in table '%s'", r.RuleName, s, col.TableName)
+			}
+		}
+	default:
+		return fmt.Errorf("rule '%s': unknown kind '%s'", r.RuleName, r.Kind)
+	}
+	return nil
+}
+
+// queryRulesFromDB 读取实体的所有规则
+func queryRulesFromDB(entityIdx uint32, engine *xorm.Engine) ([]*Rule, error) {
+	var rules []*Rule
+	err := engine.Where("entity_idx = ?", entityIdx).Asc("rule_idx").Find(&rules)
+	return rules, err
+}
+
+// ListRules 列出实体的规则
+func ListRules(engine *xorm.Engine, entity string) ([]*Rule, error) {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return nil, err
+	}
+	return queryRulesFromDB(m.Entity.EntityIdx, engine)
+}
+
+// GetRule 获取实体的指定规则
+func GetRule(engine *xorm.Engine, entity, name string) (*Rule, error) {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rule{}
+	has, err := engine.Where("entity_idx = ? AND rule_name = ?", m.Entity.EntityIdx, name).Get(r)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("%w: '%s'", ErrRuleNotFound, name)
+	}
+	return r, nil
+}
+
+// AddRule 为实体添加规则
+func AddRule(engine *xorm.Engine, entity string, r *Rule) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	r.RuleIdx = 0
+	r.EntityIdx = m.Entity.EntityIdx
+	if err = r.Verify(m); err != nil {
+		return err
+	}
+	if _, err = engine.Insert(r); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
+
+// UpdateRule 按名称更新实体的规则，规则名不可修改
+func UpdateRule(engine *xorm.Engine, entity, name string, r *Rule) error {
+	old, err := GetRule(engine, entity, name)
+	if err != nil {
+		return err
+	}
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	r.RuleIdx, r.EntityIdx, r.RuleName = old.RuleIdx, old.EntityIdx, old.RuleName
+	if r.Status == 0 {
+		r.Status = old.Status
+	}
+	if err = r.Verify(m); err != nil {
+		return err
+	}
+	if _, err = engine.ID(r.RuleIdx).AllCols().Update(r); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
+
+// DeleteRule 删除实体的规则
+func DeleteRule(engine *xorm.Engine, entity, name string) error {
+	r, err := GetRule(engine, entity, name)
+	if err != nil {
+		return err
+	}
+	if _, err = engine.ID(r.RuleIdx).Delete(&Rule{}); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
@@ -0,0 +1,65 @@
+package meta
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleCRUD(t *testing.T) {
+	_, err := engine.Exec("CREATE TABLE emp_rule (id INTEGER PRIMARY KEY AUTOINCREMENT, mobile TEXT, salary INT, dept TEXT)")
+	require.NoError(t, err)
+	_, err = RegisterEntity(engine, "emp_rule", "", "emp_rule", "id")
+	require.NoError(t, err)
+	require.NoError(t, refreshTableCache(engine))
+
+	min := 1000.0
+	tests := []struct {
+		name string
+		rule *Rule
+		err  string
+	}{
+		{"regex", &Rule{RuleName: "mobile", Kind: RuleRegex, Column: "mobile", Pattern: `^1\d{10}$`}, ""},
+		{"range", &Rule{RuleName: "salary", Kind: RuleRange, Column: "salary", Min: &min}, ""},
+		{"unique", &Rule{RuleName: "mobile_in_dept", Kind: RuleUnique, Column: "mobile", Scope: []string{"dept"}}, ""},
+		{"bad regex", &Rule{RuleName: "bad", Kind: RuleRegex, Column: "mobile", Pattern: `(`}, "missing closing"},
+		{"bad column", &Rule{RuleName: "bad", Kind: RuleRegex, Column: "nope"}, "column 'nope' not found"},
+		{"bad compare", &Rule{RuleName: "bad", Kind: RuleCompare, Column: "salary", Op: "gte", Other: "nope"}, "column 'nope' not found"},
+		{"empty range", &Rule{RuleName: "bad", Kind: RuleRange, Column: "salary"}, "min or max required"},
+		{"duplicate", &Rule{RuleName: "mobile", Kind: RuleRegex, Column: "mobile", Pattern: `.`}, "UNIQUE"},
+	}
+	for _, tt := range tests {
+		err = AddRule(engine, "emp_rule", tt.rule)
+		if tt.err == "" {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.ErrorContains(t, err, tt.err, tt.name)
+		}
+	}
+
+	m, err := AcquireMeta("emp_rule", engine)
+	require.NoError(t, err)
+	require.Len(t, m.Rules, 3)
+	assert.Equal(t, []string{"dept"}, m.Rules[2].Scope)
+	assert.Len(t, m.ToJMeta().Rules, 3)
+
+	max := 500.0
+	err = UpdateRule(engine, "emp_rule", "salary", &Rule{Kind: RuleRange, Column: "salary", Min: &min, Max: &max})
+	assert.ErrorContains(t, err, "min greater than max")
+	max = 9000
+	require.NoError(t, UpdateRule(engine, "emp_rule", "salary",
+		&Rule{Kind: RuleRange, Column: "salary", Max: &max, Status: RuleStatusDisabled}))
+	r, err := GetRule(engine, "emp_rule", "salary")
+	require.NoError(t, err)
+	assert.Nil(t, r.Min)
+	assert.Equal(t, 9000.0, *r.Max)
+	assert.False(t, r.Enabled())
+
+	require.NoError(t, DeleteRule(engine, "emp_rule", "mobile"))
+	_, err = GetRule(engine, "emp_rule", "mobile")
+	assert.ErrorIs(t, err, ErrRuleNotFound)
+	m, err = AcquireMeta("emp_rule", engine)
+	require.NoError(t, err)
+	assert.Len(t, m.Rules, 2)
+}
@@ -0,0 +1,216 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// ErrSearchUnsupported 数据库不支持全文检索
+var ErrSearchUnsupported = errors.New("full-text search is not supported")
+
+// searchSyncChunk 同步影子表时每条 SQL 的主键数，避免超出 SQLite 的参数个数限制
+const searchSyncChunk = 500
+
+// SearchColumns 返回实体声明的全文检索列中仍存在的列
+func (m *EntityMeta) SearchColumns() []string {
+	if m.Entity == nil {
+		return nil
+	}
+	var cols []string
+	for _, c := range m.Entity.SearchColumns {
+		if _, ok := m.ColumnIndex[c]; ok {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// SearchTable SQLite 中维护全文检索的 FTS5 影子表，列为主键（不索引）及各检索列，
+// 汇集所有属性表中的检索列，由 DML 按主键同步
+func (m *EntityMeta) SearchTable() string {
+	return "idig_fts_" + m.Entity.EntityName
+}
+
+// SearchIndex MySQL 中检索列所在各表的 FULLTEXT 索引名
+func (m *EntityMeta) SearchIndex() string {
+	return "idig_ft_" + m.Entity.EntityName
+}
+
+// SearchTables 检索列按所在的表分组，表名有序
+func (m *EntityMeta) SearchTables() ([]string, map[string][]string) {
+	groups := map[string][]string{}
+	for _, c := range m.SearchColumns() {
+		t := m.FetchTableNameByColumn(c)
+		groups[t] = append(groups[t], c)
+	}
+	tables := make([]string, 0, len(groups))
+	for t := range groups {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	return tables, groups
+}
+
+// IsSQLite 驱动是否为 SQLite
+func IsSQLite(driver string) bool {
+	return driver == "sqlite3" || driver == "sqlite"
+}
+
+// verifySearchColumns 检索列必须是实体的非主键文本列，且不重复
+func verifySearchColumns(m *EntityMeta, cols []string) error {
+	for i, c := range cols {
+		col, ok := m.ColumnIndex[c]
+		if !ok {
+			return fmt.Errorf("column '%s' not found in entity '%s'", c, m.Entity.EntityName)
+		}
+		if slices.Contains(m.PrimaryColumn(), c) {
+			return fmt.Errorf("primary key '%s' can not be a search column", c)
+		}
+		if !col.SQLType.IsText() {
+			return fmt.Errorf("search column '%s' must be text, got %s", c, col.SQLType.Name)
+		}
+		if slices.Contains(cols[:i], c) {
+			return fmt.Errorf("duplicate search column '%s'", c)
+		}
+	}
+	return nil
+}
+
+// SetSearchColumns 设置实体的全文检索列并重建索引，cols 为空时取消检索并删除索引；
+// SQLite 需要 FTS5（mattn/go-sqlite3 以 sqlite_fts5 构建标签编译），MySQL 使用 InnoDB 的 FULLTEXT 索引
+func SetSearchColumns(engine *xorm.Engine, entity string, cols []string) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	driver := engine.DriverName()
+	if !IsSQLite(driver) && driver != "mysql" {
+		return fmt.Errorf("%w on %s", ErrSearchUnsupported, driver)
+	}
+	if err = verifySearchColumns(m, cols); err != nil {
+		return err
+	}
+	if err = dropSearchIndex(engine, m); err != nil {
+		return err
+	}
+	if _, err = engine.ID(m.Entity.EntityIdx).Cols("search_cols").Update(&Entity{SearchColumns: cols}); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	if len(cols) == 0 {
+		return nil
+	}
+	if m, err = AcquireMeta(entity, engine); err != nil {
+		return err
+	}
+	if err = createSearchIndex(engine, m); err != nil {
+		// 索引建立失败时不保留声明，避免查询与写入引用不存在的索引
+		_, _ = engine.ID(m.Entity.EntityIdx).Cols("search_cols").Update(&Entity{})
+		InvalidateMeta(entity)
+		return err
+	}
+	return nil
+}
+
+func dropSearchIndex(engine *xorm.Engine, m *EntityMeta) error {
+	if IsSQLite(engine.DriverName()) {
+		_, err := engine.Exec("DROP TABLE IF EXISTS " + m.SearchTable())
+		return err
+	}
+	tables, _ := m.SearchTables()
+	for _, t := range tables {
+		exist, err := engine.SQL("SELECT 1 FROM information_schema.statistics WHERE table_schema = DATABASE() "+
+			"AND table_name = ? AND index_name = ? LIMIT 1", t, m.SearchIndex()).Exist()
+		if err != nil {
+			return err
+		}
+		if !exist {
+			continue
+		}
+		if _, err = engine.Exec(fmt.Sprintf("ALTER TABLE %s DROP INDEX %s", t, m.SearchIndex())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createSearchIndex(engine *xorm.Engine, m *EntityMeta) error {
+	tables, groups := m.SearchTables()
+	if !IsSQLite(engine.DriverName()) {
+		for _, t := range tables {
+			sql := fmt.Sprintf("ALTER TABLE %s ADD FULLTEXT INDEX %s (%s)", t, m.SearchIndex(),
+				strings.Join(groups[t], ", "))
+			if _, err := engine.Exec(sql); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	cols := append([]string{m.Entity.PkAttrColumn + " UNINDEXED"}, m.SearchColumns()...)
+	sql := fmt.Sprintf("CREATE VIRTUAL TABLE %s USING fts5(%s)", m.SearchTable(), strings.Join(cols, ", "))
+	if _, err := engine.Exec(sql); err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return fmt.Errorf("%w: sqlite is built without fts5, build with tag sqlite_fts5", ErrSearchUnsupported)
+		}
+		return err
+	}
+	sess := engine.NewSession()
+	defer func() { _ = sess.Close() }()
+	return fillSearchTable(sess, m, nil)
+}
+
+// SyncSearchIndex 按主键 pks 重新写入 SQLite 影子表中的行，记录已删除时只删除；
+// 写入实体的任一属性表后调用，使索引与各属性表一致。MySQL 的 FULLTEXT 索引由数据库维护
+func SyncSearchIndex(sess *xorm.Session, m *EntityMeta, pks []any) error {
+	if len(pks) == 0 || len(m.SearchColumns()) == 0 || !IsSQLite(sess.Engine().DriverName()) {
+		return nil
+	}
+	pk := m.Entity.PkAttrColumn
+	for start := 0; start < len(pks); start += searchSyncChunk {
+		chunk := pks[start:min(start+searchSyncChunk, len(pks))]
+		sql, args, err := builder.Delete(builder.In(pk, chunk...)).From(m.SearchTable()).ToSQL()
+		if err != nil {
+			return err
+		}
+		if _, err = sess.Exec(append([]any{sql}, args...)...); err != nil {
+			return err
+		}
+		if err = fillSearchTable(sess, m, builder.In(m.PrimaryTable()+"."+pk, chunk...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillSearchTable 从主表和检索列所在的属性表取满足 cond 的实体写入影子表
+func fillSearchTable(sess *xorm.Session, m *EntityMeta, cond builder.Cond) error {
+	pkTable, pk := m.PrimaryTable(), m.Entity.PkAttrColumn
+	items := []string{pkTable + "." + pk}
+	for _, c := range m.SearchColumns() {
+		items = append(items, m.FetchTableNameByColumn(c)+"."+c)
+	}
+	bld := builder.Dialect(builder.SQLITE).Select(items...).From(pkTable)
+	tables, _ := m.SearchTables()
+	for _, t := range tables {
+		if t != pkTable {
+			bld.LeftJoin(t, fmt.Sprintf("%s.%s = %s.%s", pkTable, pk, t, pk))
+		}
+	}
+	if cond != nil {
+		bld.Where(cond)
+	}
+	sql, args, err := bld.ToSQL()
+	if err != nil {
+		return err
+	}
+	cols := append([]string{pk}, m.SearchColumns()...)
+	sql = fmt.Sprintf("INSERT INTO %s (%s) %s", m.SearchTable(), strings.Join(cols, ", "), sql)
+	_, err = sess.Exec(append([]any{sql}, args...)...)
+	return err
+}
@@ -0,0 +1,54 @@
+package meta
+
+import (
+	"fmt"
+
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+// UpdatedAtColumn 实体未声明版本列时，更新给出了此时间列的值则以其为期望的版本
+const UpdatedAtColumn = "updated_at"
+
+// VersionColumn 返回实体声明的乐观锁版本列，未声明或列已不存在时为 nil
+func (m *EntityMeta) VersionColumn() *schemas.Column {
+	if m.Entity == nil || m.Entity.VersionColumn == "" {
+		return nil
+	}
+	return m.ColumnIndex[m.Entity.VersionColumn]
+}
+
+// verifyVersionColumn 版本列必须是实体的非主键列，且为数值列（每次更新加 1）或时间列（每次更新设为当前时间）
+func verifyVersionColumn(m *EntityMeta, column string) error {
+	col, ok := m.ColumnIndex[column]
+	if !ok {
+		return fmt.Errorf("column '%s' not found in entity '%s'", column, m.Entity.EntityName)
+	}
+	for _, pk := range m.PrimaryColumn() {
+		if pk == column {
+			return fmt.Errorf("primary key '%s' can not be the version column", column)
+		}
+	}
+	if !col.SQLType.IsNumeric() && !col.SQLType.IsTime() {
+		return fmt.Errorf("version column '%s' must be numeric or time, got %s", column, col.SQLType.Name)
+	}
+	return nil
+}
+
+// SetVersionColumn 设置实体的乐观锁版本列，column 为空时取消
+func SetVersionColumn(engine *xorm.Engine, entity, column string) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	if column != "" {
+		if err = verifyVersionColumn(m, column); err != nil {
+			return err
+		}
+	}
+	if _, err = engine.ID(m.Entity.EntityIdx).Cols("version_col").Update(&Entity{VersionColumn: column}); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
@@ -0,0 +1,184 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+var (
+	ErrVirtualAttrNotFound = errors.New("virtual attr not found")
+	ErrReadOnlyAttr        = errors.New("attr is computed and read-only")
+)
+
+// VirtualAttr 由 SQL 表达式计算的实体属性，如 full_name = concat(first, ' ', last)；
+// 可在查询中选择、过滤和排序，不可写入
+type VirtualAttr struct {
+	AttrIdx   uint32    `json:"attr_idx" xorm:"pk autoincr"`
+	EntityIdx uint32    `json:"entity_idx" xorm:"unique(entity_attr) index"`
+	Name      string    `json:"name" xorm:"unique(entity_attr) not null"`
+	Expr      string    `json:"expr" xorm:"text not null"`
+	Type      string    `json:"type,omitempty"` // 结果类型，仅用于展示
+	Comment   string    `json:"comment,omitempty"`
+	UpdatedAt time.Time `json:"updated_at" xorm:"updated"`
+
+	deps []string
+}
+
+func (v *VirtualAttr) TableName() string {
+	return "idig_entity_virtual_attr"
+}
+
+// Deps 表达式引用的实体列，用于确定需要关联的属性表
+func (v *VirtualAttr) Deps() []string {
+	return v.deps
+}
+
+var (
+	identRe  = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+	quotedRe = regexp.MustCompile(`'(?:[^']|'')*'`)
+	nameRe   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Verify 校验定义并解析依赖列：名称不能与实体列冲突，表达式至少引用一个实体列，
+// 不允许出现语句分隔符和注释
+func (v *VirtualAttr) Verify(m *EntityMeta) error {
+	if !nameRe.MatchString(v.Name) {
+		return fmt.Errorf("invalid virtual attr name '%s'", v.Name)
+	}
+	if _, ok := m.ColumnIndex[v.Name]; ok {
+		return fmt.Errorf("virtual attr '%s' conflicts with column", v.Name)
+	}
+	expr := strings.TrimSpace(v.Expr)
+	if expr == "" {
+		return fmt.Errorf("virtual attr '%s': expr required", v.Name)
+	}
+	stripped := quotedRe.ReplaceAllString(expr, "''")
+	if strings.ContainsAny(stripped, ";") || strings.Contains(stripped, "--") || strings.Contains(stripped, "/*") {
+		return fmt.Errorf("virtual attr '%s': expr must be a single expression", v.Name)
+	}
+	if strings.Count(stripped, "(") != strings.Count(stripped, ")") {
+		return fmt.Errorf("virtual attr '%s': unbalanced parentheses", v.Name)
+	}
+	set := map[string]struct{}{}
+	for _, id := range identRe.FindAllString(stripped, -1) {
+		if _, ok := m.ColumnIndex[id]; ok {
+			set[id] = struct{}{}
+		}
+	}
+	if len(set) == 0 {
+		return fmt.Errorf("virtual attr '%s': expr references no column of entity '%s'", v.Name, m.Entity.EntityName)
+	}
+	v.deps = make([]string, 0, len(set))
+	for id := range set {
+		v.deps = append(v.deps, id)
+	}
+	sort.Strings(v.deps)
+	v.Expr = expr
+	return nil
+}
+
+// IsVirtual col 是否为虚拟属性
+func (m *EntityMeta) IsVirtual(col string) bool {
+	_, ok := m.Virtuals[col]
+	return ok
+}
+
+// attachVirtualAttrs 读取实体的虚拟属性；定义已失效（如依赖列被删除）的属性忽略
+func attachVirtualAttrs(m *EntityMeta, engine *xorm.Engine) error {
+	var attrs []*VirtualAttr
+	if err := engine.Where("entity_idx = ?", m.Entity.EntityIdx).Asc("attr_idx").Find(&attrs); err != nil {
+		return err
+	}
+	m.Virtuals = make(map[string]*VirtualAttr, len(attrs))
+	for _, v := range attrs {
+		if err := v.Verify(m); err != nil {
+			continue
+		}
+		m.Virtuals[v.Name] = v
+	}
+	return nil
+}
+
+// ListVirtualAttrs 列出实体的虚拟属性
+func ListVirtualAttrs(engine *xorm.Engine, entity string) ([]*VirtualAttr, error) {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return nil, err
+	}
+	var attrs []*VirtualAttr
+	err = engine.Where("entity_idx = ?", m.Entity.EntityIdx).Asc("attr_idx").Find(&attrs)
+	return attrs, err
+}
+
+func getVirtualAttr(engine *xorm.Engine, m *EntityMeta, name string) (*VirtualAttr, error) {
+	v := &VirtualAttr{}
+	has, err := engine.Where("entity_idx = ? AND name = ?", m.Entity.EntityIdx, name).Get(v)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("%w: '%s'", ErrVirtualAttrNotFound, name)
+	}
+	return v, nil
+}
+
+// AddVirtualAttr 为实体添加虚拟属性
+func AddVirtualAttr(engine *xorm.Engine, entity string, v *VirtualAttr) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	v.AttrIdx, v.EntityIdx = 0, m.Entity.EntityIdx
+	if err = v.Verify(m); err != nil {
+		return err
+	}
+	if _, err = engine.Insert(v); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
+
+// UpdateVirtualAttr 按名称更新虚拟属性，名称不可修改
+func UpdateVirtualAttr(engine *xorm.Engine, entity, name string, v *VirtualAttr) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	old, err := getVirtualAttr(engine, m, name)
+	if err != nil {
+		return err
+	}
+	v.AttrIdx, v.EntityIdx, v.Name = old.AttrIdx, old.EntityIdx, old.Name
+	if err = v.Verify(m); err != nil {
+		return err
+	}
+	if _, err = engine.ID(v.AttrIdx).AllCols().Update(v); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
+
+// DeleteVirtualAttr 删除虚拟属性
+func DeleteVirtualAttr(engine *xorm.Engine, entity, name string) error {
+	m, err := AcquireMeta(entity, engine)
+	if err != nil {
+		return err
+	}
+	v, err := getVirtualAttr(engine, m, name)
+	if err != nil {
+		return err
+	}
+	if _, err = engine.ID(v.AttrIdx).Delete(&VirtualAttr{}); err != nil {
+		return err
+	}
+	InvalidateMeta(entity)
+	return nil
+}
@@ -0,0 +1,155 @@
+package query
+
+import (
+	"errors"
+	"strings"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// Builder 以 Go API 构造实体查询，与查询 DSL 等价，供以库的方式嵌入 idig 的服务使用：
+//
+//	rows, err := query.NewBuilder(engine, "emp").
+//		Select("idx", "name").
+//		Join(query.JoinOf("emp_dept").As("dept").Select("name")).
+//		Where("age", "gt", 30).
+//		OrderBy("idx", "desc").
+//		Find()
+type Builder struct {
+	q        *Query
+	relation string
+}
+
+// NewBuilder 返回实体 entity 的查询构造器
+func NewBuilder(engine *xorm.Engine, entity string) *Builder {
+	q := NewQuery(0, engine)
+	q.From.EntityAlias = []*EntityOrSubQuery{{Entity: entity}}
+	return &Builder{q: q}
+}
+
+// Select 选择实体的列或虚拟属性
+func (b *Builder) Select(cols ...string) *Builder {
+	for _, c := range cols {
+		b.q.SelectItems = append(b.q.SelectItems, &SelectItem{Col: c})
+	}
+	return b
+}
+
+// SelectAs 以别名 alias 选择列 col
+func (b *Builder) SelectAs(col, alias string) *Builder {
+	b.q.SelectItems = append(b.q.SelectItems, &SelectItem{Col: col, Alias: alias})
+	return b
+}
+
+// Where 增加条件，op 同查询的 where，为空时为 eq
+func (b *Builder) Where(col, op string, val any) *Builder {
+	b.q.Wheres = append(b.q.Wheres, &Where{Col: col, Op: op, Val: val})
+	return b
+}
+
+// Join 按实体关系关联另一端实体
+func (b *Builder) Join(joins ...*Join) *Builder {
+	b.q.Joins = append(b.q.Joins, joins...)
+	return b
+}
+
+// IncludeOf 返回按关系 relation 嵌入关联实体的子查询构造器，用于 Builder.Include，未选择列时为全部列
+func IncludeOf(relation string) *Builder {
+	return &Builder{q: &Query{From: &From{}}, relation: relation}
+}
+
+// Include 以字段 name 嵌入子查询 sub 的关联实体，sub 由 IncludeOf 构造
+func (b *Builder) Include(name string, sub *Builder) *Builder {
+	if b.q.Includes == nil {
+		b.q.Includes = map[string]*Include{}
+	}
+	b.q.Includes[name] = &Include{Relation: sub.relation, Query: sub.q}
+	return b
+}
+
+// Search 全文检索实体声明的检索列，输出相关度列 search_rank
+func (b *Builder) Search(text string) *Builder {
+	if b.q.Search == nil {
+		b.q.Search = &Search{}
+	}
+	b.q.Search.Text = text
+	return b
+}
+
+// Highlight 检索时高亮 cols 中的检索词，cols 为空时为所有检索列，pre 与 post 为空时为 <b> 与 </b>
+func (b *Builder) Highlight(pre, post string, cols ...string) *Builder {
+	if b.q.Search == nil {
+		b.q.Search = &Search{}
+	}
+	b.q.Search.Highlight = &Highlight{Cols: cols, Pre: pre, Post: post}
+	return b
+}
+
+// OrderBy 增加排序，opt 为 asc 或 desc，为空时为 asc
+func (b *Builder) OrderBy(col, opt string) *Builder {
+	if opt == "" {
+		opt = "ASC"
+	}
+	b.q.Orders = append(b.q.Orders, &Order{Col: col, Option: strings.ToUpper(opt)})
+	return b
+}
+
+// Limit 限制返回的行数
+func (b *Builder) Limit(num, offset int) *Builder {
+	b.q.Limit = &Limit{Num: num, Offset: offset}
+	return b
+}
+
+// Query 返回构造的查询
+func (b *Builder) Query() *Query {
+	return b.q
+}
+
+// ToSQL 按引擎的方言生成 SQL 及参数
+func (b *Builder) ToSQL() (string, []any, error) {
+	bld, err := b.build()
+	if err != nil {
+		return "", nil, err
+	}
+	return bld.ToSQL()
+}
+
+// Find 执行查询，嵌入 Include 的关联实体
+func (b *Builder) Find() ([]map[string]any, error) {
+	if err := b.verify(); err != nil {
+		return nil, err
+	}
+	return b.q.Find()
+}
+
+func (b *Builder) verify() error {
+	if len(b.q.SelectItems) == 0 {
+		return errors.New("query does not contain select items")
+	}
+	for _, o := range b.q.Orders {
+		if err := o.Verify(); err != nil {
+			return err
+		}
+	}
+	if b.q.Search != nil {
+		if err := b.q.Search.Verify(); err != nil {
+			return err
+		}
+	}
+	if len(b.q.Wheres) > 0 {
+		return VerifyWhere(b.q.Wheres)
+	}
+	return nil
+}
+
+func (b *Builder) build() (*builder.Builder, error) {
+	if err := b.verify(); err != nil {
+		return nil, err
+	}
+	bld := builder.Dialect(b.q.engine.DriverName())
+	if err := b.q.BuildSQL(bld); err != nil {
+		return nil, err
+	}
+	return bld, nil
+}
@@ -0,0 +1,240 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"xorm.io/xorm/schemas"
+)
+
+// CellError 单元格转换或校验错误，Row 为数据行下标（从 0 开始）
+type CellError struct {
+	Row     int    `json:"row"`
+	Col     string `json:"col"`
+	Message string `json:"msg"`
+}
+
+func (e *CellError) Error() string {
+	return fmt.Sprintf("row %d column '%s': %s", e.Row, e.Col, e.Message)
+}
+
+// 支持的时间输入格式，按顺序尝试
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	time.DateTime,
+	"2006-01-02 15:04",
+	time.DateOnly,
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+	"2006/1/2",
+	time.TimeOnly,
+	"15:04",
+}
+
+var decimalRe = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+func isIntType(name string) bool {
+	switch name {
+	case schemas.Bit, schemas.TinyInt, schemas.SmallInt, schemas.MediumInt, schemas.Int,
+		schemas.Integer, schemas.BigInt, schemas.Serial, schemas.BigSerial, "INT8":
+		return true
+	}
+	return isUnsignedIntType(name)
+}
+
+func isUnsignedIntType(name string) bool {
+	switch name {
+	case schemas.UnsignedBit, schemas.UnsignedTinyInt, schemas.UnsignedSmallInt,
+		schemas.UnsignedMediumInt, schemas.UnsignedInt, schemas.UnsignedBigInt:
+		return true
+	}
+	return false
+}
+
+func isDecimalType(name string) bool {
+	switch name {
+	case schemas.Decimal, schemas.Numeric, schemas.Money, schemas.SmallMoney, schemas.Number:
+		return true
+	}
+	return false
+}
+
+// CoerceValue 按列的 SQL 类型转换值：整数为 int64，浮点为 float64，定点数为规范化的字符串，
+// 时间为数据库可接受的字符串，布尔为 bool；nil 原样返回
+func CoerceValue(col *schemas.Column, v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	st := col.SQLType
+	name := strings.ToUpper(st.Name)
+	switch {
+	case isIntType(name):
+		n, err := toInt64(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 && isUnsignedIntType(name) {
+			return nil, fmt.Errorf("value %d must not be negative", n)
+		}
+		return n, nil
+	case isDecimalType(name):
+		s := strings.TrimSpace(toText(v))
+		if !decimalRe.MatchString(s) {
+			return nil, fmt.Errorf("'%s' is not a decimal", s)
+		}
+		return s, nil
+	case st.IsNumeric():
+		f, ok := toNumber(v)
+		if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("'%v' is not a number", v)
+		}
+		return f, nil
+	case st.IsBool():
+		return toBool(v)
+	case st.IsTime():
+		return toTimeText(name, v)
+	case st.IsBlob():
+		if b, ok := v.([]byte); ok {
+			return b, nil
+		}
+		return []byte(toText(v)), nil
+	case st.IsText():
+		switch t := v.(type) {
+		case string:
+			return t, nil
+		case float64:
+			return strconv.FormatFloat(t, 'f', -1, 64), nil
+		case map[string]any, []any:
+			return nil, fmt.Errorf("'%v' is not a scalar value", v)
+		}
+		return toText(v), nil
+	}
+	return v, nil
+}
+
+func toInt64(v any) (int64, error) {
+	switch t := v.(type) {
+	case string:
+		s := strings.TrimSpace(t)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		// 表格中的整数可能带有 .0
+		if f, err := strconv.ParseFloat(s, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f), nil
+		}
+		return 0, fmt.Errorf("'%s' is not an integer", t)
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	case float64:
+		if t != math.Trunc(t) || math.Abs(t) >= 1<<63 {
+			return 0, fmt.Errorf("'%v' is not an integer", t)
+		}
+		return int64(t), nil
+	case float32:
+		return toInt64(float64(t))
+	case uint64:
+		if t > math.MaxInt64 {
+			return 0, fmt.Errorf("'%d' overflows int64", t)
+		}
+		return int64(t), nil
+	}
+	if f, ok := toNumber(v); ok {
+		return toInt64(f)
+	}
+	return 0, fmt.Errorf("'%v' is not an integer", v)
+}
+
+func toBool(v any) (bool, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(t)) {
+		case "1", "true", "t", "yes", "y", "on":
+			return true, nil
+		case "0", "false", "f", "no", "n", "off":
+			return false, nil
+		}
+	default:
+		if f, ok := toNumber(v); ok && (f == 0 || f == 1) {
+			return f == 1, nil
+		}
+	}
+	return false, fmt.Errorf("'%v' is not a boolean", v)
+}
+
+// ParseTime 按支持的格式解析时间，带时区的时间转换为本地时间
+func ParseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.Local(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not a valid time", s)
+}
+
+func toTimeText(name string, v any) (any, error) {
+	var t time.Time
+	switch tv := v.(type) {
+	case time.Time:
+		t = tv
+	case string:
+		var err error
+		if t, err = ParseTime(tv); err != nil {
+			return nil, err
+		}
+	default:
+		if name == schemas.Year {
+			return toInt64(v)
+		}
+		return nil, fmt.Errorf("'%v' is not a valid time", v)
+	}
+	switch name {
+	case schemas.Date:
+		return t.Format(time.DateOnly), nil
+	case schemas.Time:
+		return t.Format(time.TimeOnly), nil
+	case schemas.Year:
+		return int64(t.Year()), nil
+	case schemas.TimeStampz:
+		return t.Format(time.RFC3339Nano), nil
+	}
+	return t.Format(time.DateTime), nil
+}
+
+// Coerce 按实体列类型原地转换 dt 中的值，返回所有无法转换的单元格；
+// 不属于实体的列与 #result 列不处理
+func (dt *DataTable) Coerce(m *meta.EntityMeta) []*CellError {
+	cols := make([]*schemas.Column, len(dt.cols))
+	for j, name := range dt.cols {
+		if j != dt.resultIdx {
+			cols[j] = m.ColumnIndex[name]
+		}
+	}
+	var errs []*CellError
+	for i, row := range dt.data {
+		for j, col := range cols {
+			if col == nil {
+				continue
+			}
+			v, err := CoerceValue(col, row[j])
+			if err != nil {
+				errs = append(errs, &CellError{Row: i, Col: dt.cols[j], Message: err.Error()})
+				continue
+			}
+			row[j] = v
+		}
+	}
+	return errs
+}
@@ -0,0 +1,48 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"xorm.io/xorm/schemas"
+)
+
+func TestCoerceValue(t *testing.T) {
+	col := func(name string) *schemas.Column {
+		return &schemas.Column{Name: "c", SQLType: schemas.SQLType{Name: name}}
+	}
+	tests := []struct {
+		typ  string
+		in   any
+		want any
+		err  bool
+	}{
+		{schemas.Int, "12", int64(12), false},
+		{schemas.BigInt, "3.0", int64(3), false},
+		{schemas.BigInt, 4.0, int64(4), false},
+		{schemas.Int, "1.5", nil, true},
+		{schemas.UnsignedInt, "-1", nil, true},
+		{schemas.Decimal, " 12.50 ", "12.50", false},
+		{schemas.Decimal, "12,5", nil, true},
+		{schemas.Double, "1.25", 1.25, false},
+		{schemas.Double, "abc", nil, true},
+		{schemas.Boolean, "yes", true, false},
+		{schemas.Boolean, "0", false, false},
+		{schemas.Boolean, "maybe", nil, true},
+		{schemas.Date, "2024/1/2", "2024-01-02", false},
+		{schemas.DateTime, "2024-01-02T03:04:05", "2024-01-02 03:04:05", false},
+		{schemas.DateTime, "yesterday", nil, true},
+		{schemas.Varchar, 1.5, "1.5", false},
+		{schemas.Varchar, []any{1}, nil, true},
+		{schemas.Int, nil, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := CoerceValue(col(tt.typ), tt.in)
+		if tt.err {
+			assert.Error(t, err, "%s %v", tt.typ, tt.in)
+			continue
+		}
+		assert.NoError(t, err, "%s %v", tt.typ, tt.in)
+		assert.Equal(t, tt.want, got, "%s %v", tt.typ, tt.in)
+	}
+}
@@ -11,8 +11,9 @@ import (
 
 // 定义常量，避免魔法字符串
 const (
-	KeyCols = "cols"
-	KeyVals = "vals"
+	KeyCols      = "cols"
+	KeyVals      = "vals"
+	ResultColumn = "#result" // 记录每行插入、更新结果的列
 )
 
 // DataTable 表示一个二维数据表结构
@@ -88,8 +89,9 @@ func (jd *JDataTable) FromArrayMap(am []map[string]any) {
 // NewDataTable 创建新的DataTable实例
 func NewDataTable() *DataTable {
 	return &DataTable{
-		cols: make([]string, 0),
-		data: make([][]any, 0),
+		cols:      make([]string, 0),
+		data:      make([][]any, 0),
+		resultIdx: -1,
 	}
 }
 
@@ -245,6 +247,42 @@ func (dt *DataTable) AddRow(row []any) error {
 	return nil
 }
 
+// SubTable 按行号取子表，子表与原表共享行数据，对子表的更新（包括 #result）会反映到原表
+func (dt *DataTable) SubTable(rows []int) (*DataTable, error) {
+	sub := &DataTable{
+		cols:      dt.cols,
+		data:      make([][]any, 0, len(rows)),
+		resultIdx: dt.resultIdx,
+	}
+	for _, r := range rows {
+		if err := dt.CheckRowId(r); err != nil {
+			return nil, err
+		}
+		sub.data = append(sub.data, dt.data[r])
+	}
+	return sub, nil
+}
+
+// WithColumn 复制数据表并把列 col 的值设为 v（没有该列时追加），原表不受影响
+func (dt *DataTable) WithColumn(col string, v any) *DataTable {
+	cp := &DataTable{
+		cols:      append([]string(nil), dt.cols...),
+		data:      make([][]any, len(dt.data)),
+		resultIdx: dt.resultIdx,
+	}
+	idx := slices.Index(cp.cols, col)
+	if idx < 0 {
+		idx = len(cp.cols)
+		cp.cols = append(cp.cols, col)
+	}
+	for i, row := range dt.data {
+		cp.data[i] = make([]any, len(cp.cols))
+		copy(cp.data[i], row)
+		cp.data[i][idx] = v
+	}
+	return cp
+}
+
 // Columns 获取列名列表
 func (dt *DataTable) Columns() []string {
 	return dt.cols
@@ -409,14 +447,25 @@ func (dt *DataTable) UpdateData(rowId, colId int, d any) error {
 	return nil
 }
 
+// AddResultColumn 添加记录每行执行结果的 #result 列
+func (dt *DataTable) AddResultColumn() {
+	dt.resultIdx = dt.AddColumn(ResultColumn)
+}
+
 // UpdateResult 更新指定位置的数据
 func (dt *DataTable) UpdateResult(rowId int, r any) error {
+	if dt.resultIdx < 0 {
+		return nil
+	}
 	dt.data[rowId][dt.resultIdx] = r
 	return nil
 }
 
 // UpdateAllWithResult 更新所有列结果值为同一个值，用于批量失败
 func (dt *DataTable) UpdateAllWithResult(r any) error {
+	if dt.resultIdx < 0 {
+		return nil
+	}
 	for _, row := range dt.data {
 		row[dt.resultIdx] = r
 	}
@@ -424,6 +473,9 @@ func (dt *DataTable) UpdateAllWithResult(r any) error {
 }
 
 func (dt *DataTable) UpdateAffectedResult(rowId int, affected int64) error {
+	if dt.resultIdx < 0 {
+		return nil
+	}
 	row := dt.data[rowId]
 	oldVal := row[dt.resultIdx]
 	if oldVal == nil {
@@ -456,9 +508,15 @@ func (dt *DataTable) DivisionColumnsKeyVal(m meta.IEntityMeta) (map[string]*Colu
 	pkCols := m.PrimaryColumn()
 	// 为了处理简单，先将pk列添加到数据中
 	dt.AddColumns(pkCols)
-	for _, col := range dt.cols {
+	for i, col := range dt.cols {
+		if i == dt.resultIdx {
+			continue
+		}
 		table := m.FetchTableNameByColumn(col)
 		if table == "" {
+			if m.IsVirtual(col) {
+				return nil, fmt.Errorf("column '%s': %w", col, meta.ErrReadOnlyAttr)
+			}
 			return nil, fmt.Errorf("column '%s' not found", col)
 		}
 		ckv, ok1 := ret[table]
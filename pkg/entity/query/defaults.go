@@ -0,0 +1,190 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/google/uuid"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+// WriteContext 写入时生成系统列所需的上下文
+type WriteContext struct {
+	Principal string    // 当前身份，principal 生成器使用
+	TenantIdx uint32    // 当前租户，tenant 生成器使用
+	Now       time.Time // 本次写入的时间，为零时取当前时间；同一批数据使用同一时间
+	// Written 每行写入成功后调用（仍在事务中），op 为 OpInserted、OpUpdated 或 OpDeleted，row 为写入的列值；
+	// 请求处理以此收集实体事件，在事务提交后发布
+	Written func(m *meta.EntityMeta, op string, row map[string]any)
+}
+
+// 写入操作，WriteContext.Written 的 op
+const (
+	OpInserted = "inserted"
+	OpUpdated  = "updated"
+	OpDeleted  = "deleted"
+)
+
+// RowWritten 以写入的一行调用 Written
+func (wc *WriteContext) RowWritten(m *meta.EntityMeta, op string, row map[string]any) {
+	if wc != nil && wc.Written != nil {
+		wc.Written(m, op, row)
+	}
+}
+
+// RowsWritten 以 dt 的每一行（不含 #result 列）调用 Written
+func (wc *WriteContext) RowsWritten(m *meta.EntityMeta, op string, dt *DataTable) {
+	if wc == nil || wc.Written == nil {
+		return
+	}
+	for _, vals := range dt.Values() {
+		row := make(map[string]any, len(vals))
+		for i, c := range dt.Columns() {
+			if c != ResultColumn {
+				row[c] = vals[i]
+			}
+		}
+		wc.Written(m, op, row)
+	}
+}
+
+// ApplyDefaults 写入前按实体的列默认值配置填充 dt，mode 为 ValidateInsert 或 ValidateUpdate：
+// 未提供的列会被添加；Override 的系统列覆盖所有行，其余只填充 NULL 单元格。
+// 插入时还用表结构中的默认值填充非空列中显式为 NULL 的单元格，并初始化为空的版本列；
+// 更新时版本列由写入逻辑维护，不按默认值填充。
+// db 用于 sequence 生成器，应与写入使用同一事务；必须在 DivisionColumnsKeyVal 之前调用
+func (dt *DataTable) ApplyDefaults(db xorm.Interface, m *meta.EntityMeta, mode int, wc *WriteContext) error {
+	if wc == nil {
+		wc = &WriteContext{}
+	}
+	now := wc.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	ver := m.VersionColumn()
+	// 更新时版本列由按版本更新设置
+	checked := dt.VersionColumn(m)
+	configured := map[string]bool{}
+	for _, d := range m.Defaults {
+		if (mode == ValidateInsert && !d.OnInsert) || (mode == ValidateUpdate && !d.OnUpdate) {
+			continue
+		}
+		if mode == ValidateUpdate && checked != nil && d.Column == checked.Name {
+			continue
+		}
+		col := m.ColumnIndex[d.Column]
+		if col == nil {
+			continue
+		}
+		configured[d.Column] = true
+		j := dt.FetchColumnIndex(d.Column)
+		if j < 0 {
+			j = dt.AddColumn(d.Column)
+		}
+		for _, row := range dt.data {
+			if row[j] != nil && !d.Override {
+				continue
+			}
+			v, err := generateDefault(db, m, d, col, wc, now)
+			if err != nil {
+				return fmt.Errorf("default of column '%s': %w", d.Column, err)
+			}
+			row[j] = v
+		}
+	}
+	if mode != ValidateInsert {
+		return nil
+	}
+	if ver != nil {
+		j := dt.AddColumn(ver.Name)
+		for _, row := range dt.data {
+			if row[j] == nil {
+				row[j] = initialVersion(ver, now)
+			}
+		}
+		configured[ver.Name] = true
+	}
+	for j, name := range dt.cols {
+		col := m.ColumnIndex[name]
+		if j == dt.resultIdx || col == nil || col.Nullable || configured[name] {
+			continue
+		}
+		v, ok := schemaDefault(col, now)
+		if !ok {
+			continue
+		}
+		for _, row := range dt.data {
+			if row[j] == nil {
+				row[j] = v
+			}
+		}
+	}
+	return nil
+}
+
+func generateDefault(db xorm.Interface, m *meta.EntityMeta, d *meta.ColumnDefault, col *schemas.Column,
+	wc *WriteContext, now time.Time) (any, error) {
+	switch d.Generator {
+	case meta.GenConst:
+		return d.Value, nil
+	case meta.GenNow:
+		return nowValue(col, now), nil
+	case meta.GenUUID:
+		return uuid.NewString(), nil
+	case meta.GenSequence:
+		if db == nil {
+			return nil, fmt.Errorf("sequence requires a database")
+		}
+		return meta.NextSequence(db, d.SequenceName(m))
+	case meta.GenPrincipal:
+		if wc.Principal == "" {
+			return nil, nil
+		}
+		return wc.Principal, nil
+	case meta.GenTenant:
+		if wc.TenantIdx == 0 {
+			return nil, nil
+		}
+		return int64(wc.TenantIdx), nil
+	}
+	return nil, fmt.Errorf("unknown generator '%s'", d.Generator)
+}
+
+// nowValue 时间列为时间，数值列为 unix 秒，其余为 "2006-01-02 15:04:05"
+func nowValue(col *schemas.Column, now time.Time) any {
+	switch {
+	case col.SQLType.IsTime():
+		return now
+	case col.SQLType.IsNumeric():
+		return now.Unix()
+	}
+	return now.Format(time.DateTime)
+}
+
+// schemaDefault 解析表结构中的默认值：引号中的字面量去掉引号，当前时间函数取 now；
+// NULL 和其他表达式无法在写入前求值，返回 false
+func schemaDefault(col *schemas.Column, now time.Time) (any, bool) {
+	d := strings.TrimSpace(col.Default)
+	for len(d) > 1 && d[0] == '(' && d[len(d)-1] == ')' {
+		d = strings.TrimSpace(d[1 : len(d)-1])
+	}
+	if d == "" {
+		return nil, false
+	}
+	upper := strings.ToUpper(d)
+	switch {
+	case upper == "NULL":
+		return nil, false
+	case strings.HasPrefix(upper, "CURRENT_TIMESTAMP") || strings.HasPrefix(upper, "CURRENT_DATE") ||
+		strings.HasPrefix(upper, "LOCALTIMESTAMP") || upper == "NOW()" || strings.HasPrefix(upper, "DATETIME('NOW'"):
+		return nowValue(col, now), true
+	case len(d) > 1 && d[0] == '\'' && d[len(d)-1] == '\'':
+		return strings.ReplaceAll(d[1:len(d)-1], "''", "'"), true
+	case strings.ContainsAny(d, "()"):
+		return nil, false
+	}
+	return d, true
+}
@@ -0,0 +1,134 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+func newDefaultsMeta() *meta.EntityMeta {
+	m := newValidateMeta()
+	t0 := m.AttrTables["emp"]
+	for _, c := range []*schemas.Column{
+		schemas.NewColumn("created_at", "created_at", schemas.SQLType{Name: schemas.DateTime}, 0, 0, false),
+		schemas.NewColumn("updated_by", "updated_by", schemas.SQLType{Name: schemas.Varchar}, 32, 0, true),
+		schemas.NewColumn("code", "code", schemas.SQLType{Name: schemas.Varchar}, 32, 0, true),
+		schemas.NewColumn("tenant_id", "tenant_id", schemas.SQLType{Name: schemas.Int}, 0, 0, true),
+	} {
+		c.TableName = "emp"
+		t0.AddColumn(c)
+		m.ColumnIndex[c.Name] = c
+	}
+	m.Defaults = []*meta.ColumnDefault{
+		{Column: "created_at", Generator: meta.GenNow, Override: true},
+		{Column: "updated_by", Generator: meta.GenPrincipal, OnUpdate: true, Override: true},
+		{Column: "code", Generator: meta.GenSequence},
+		{Column: "tenant_id", Generator: meta.GenTenant, Override: true},
+		{Column: "level", Generator: meta.GenConst, Value: "junior"},
+	}
+	for _, d := range m.Defaults {
+		if err := d.Verify(m); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+func TestDataTable_ApplyDefaults(t *testing.T) {
+	m := newDefaultsMeta()
+	db, err := xorm.NewEngine("sqlite3", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	require.NoError(t, db.Sync2(new(meta.Sequence)))
+
+	now := time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local)
+	wc := &WriteContext{Principal: "alice", TenantIdx: 7, Now: now}
+
+	t.Run("insert", func(t *testing.T) {
+		dt := NewDataTable()
+		require.NoError(t, dt.ParseValues([]byte(`{"cols":["name","level","active","created_at","code"],"vals":[
+			["tom",null,null,"1999-01-01",null],
+			["bob","senior",false,null,"B-1"]
+		]}`)))
+		require.NoError(t, dt.ApplyDefaults(db, m, ValidateInsert, wc))
+
+		rows := rowMaps(dt)
+		// 系统列覆盖请求中的值
+		assert.Equal(t, now, rows[0]["created_at"])
+		assert.Equal(t, now, rows[1]["created_at"])
+		// 只在更新时生成
+		_, ok := rows[0]["updated_by"]
+		assert.False(t, ok)
+		assert.Equal(t, int64(7), rows[0]["tenant_id"])
+		// 非覆盖的默认值只填充 NULL
+		assert.Equal(t, "junior", rows[0]["level"])
+		assert.Equal(t, "senior", rows[1]["level"])
+		assert.Equal(t, int64(1), rows[0]["code"])
+		assert.Equal(t, "B-1", rows[1]["code"])
+		// 表结构中的默认值
+		assert.Equal(t, "1", rows[0]["active"])
+		assert.Equal(t, false, rows[1]["active"])
+
+		assert.Empty(t, dt.Validate(m, ValidateInsert))
+	})
+
+	t.Run("update", func(t *testing.T) {
+		dt := NewDataTable()
+		require.NoError(t, dt.ParseValues([]byte(`{"cols":["id","name","updated_by"],"vals":[[1,"tom","mallory"]]}`)))
+		require.NoError(t, dt.ApplyDefaults(db, m, ValidateUpdate, wc))
+		assert.Equal(t, []string{"id", "name", "updated_by"}, dt.Columns())
+		assert.Equal(t, "alice", dt.Values()[0][2])
+	})
+
+	t.Run("no principal", func(t *testing.T) {
+		dt := NewDataTable()
+		require.NoError(t, dt.ParseValues([]byte(`{"cols":["id"],"vals":[[1]]}`)))
+		require.NoError(t, dt.ApplyDefaults(db, m, ValidateUpdate, nil))
+		assert.Equal(t, []string{"id", "updated_by"}, dt.Columns())
+		assert.Nil(t, dt.Values()[0][1])
+	})
+}
+
+func TestSchemaDefault(t *testing.T) {
+	now := time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local)
+	text := schemas.NewColumn("c", "c", schemas.SQLType{Name: schemas.Varchar}, 16, 0, false)
+	ts := schemas.NewColumn("t", "t", schemas.SQLType{Name: schemas.TimeStamp}, 0, 0, false)
+	tests := []struct {
+		col  *schemas.Column
+		def  string
+		want any
+		ok   bool
+	}{
+		{text, "'it''s'", "it's", true},
+		{text, "0", "0", true},
+		{text, "NULL", nil, false},
+		{text, "(lower('A'))", nil, false},
+		{ts, "CURRENT_TIMESTAMP", now, true},
+		{ts, "(datetime('now','localtime'))", now, true},
+	}
+	for _, tt := range tests {
+		tt.col.Default = tt.def
+		v, ok := schemaDefault(tt.col, now)
+		assert.Equal(t, tt.ok, ok, tt.def)
+		assert.Equal(t, tt.want, v, tt.def)
+	}
+}
+
+func rowMaps(dt *DataTable) []map[string]any {
+	var ret []map[string]any
+	for _, row := range dt.Values() {
+		r := map[string]any{}
+		for j, c := range dt.Columns() {
+			r[c] = row[j]
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
@@ -2,6 +2,7 @@ package query
 
 import (
 	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/goccy/go-json"
 	"xorm.io/builder"
 )
 
@@ -47,9 +48,25 @@ func (cv *ColumnValue) ParseValues(data []byte) error {
 	if err != nil {
 		return err
 	}
+	// 按条件更新时的条件，与查询的 where 相同，也接受 wheres
+	raw := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &raw); err == nil {
+		w, ok := raw["where"]
+		if !ok {
+			w = raw["wheres"]
+		}
+		if cv.wheres, err = parseWhere(w); err != nil {
+			return err
+		}
+	}
 	// 记录插入删除结果 --result缩写
-	cv.data.resultIdx = cv.data.AddColumn("#result")
-	return err
+	cv.data.AddResultColumn()
+	return nil
+}
+
+// Wheres 请求中的更新条件，没有时为 nil
+func (cv *ColumnValue) Wheres() []*Where {
+	return cv.wheres
 }
 
 func BuildInsertSQL(dialect, table string, cols []string, vals []any) *builder.Builder {
@@ -114,6 +114,20 @@ func TestAddRow(t *testing.T) {
 	assert.NotNil(t, dt.AddRow([]any{"only_one_value"}))
 }
 
+func TestWithColumn(t *testing.T) {
+	dt := NewDataTable()
+	dt.AddColumns([]string{"a", "b"})
+	_ = dt.AddRow([]any{1, 2})
+
+	cp := dt.WithColumn("c", 3)
+	assert.Equal(t, []string{"a", "b", "c"}, cp.Columns())
+	assert.Equal(t, [][]any{{1, 2, 3}}, cp.Values())
+	assert.Equal(t, 9, dt.WithColumn("a", 9).Values()[0][0])
+	// 原表不受影响
+	assert.Equal(t, []string{"a", "b"}, dt.Columns())
+	assert.Equal(t, [][]any{{1, 2}}, dt.Values())
+}
+
 func TestFetchRowData(t *testing.T) {
 	dt := NewDataTable()
 	dt.AddColumn("column1")
@@ -0,0 +1,311 @@
+package query
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/goccy/go-json"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// Include 嵌入关联实体：{"include": {"dept": {"relation": "emp_dept", "select": [...], "where": [...], "order": [...], "limit": {...}}}}。
+// 键为嵌入的字段名，relation 缺省为键；另一端为多时嵌入数组，否则嵌入对象或 null。
+// 子查询支持与查询相同的 select/where/order/limit/join/include，未选择列时为全部列；
+// 每个关系只执行一次子查询，limit 作用于每条记录嵌入的关联记录：
+// 数据库支持窗口函数时在子查询中按关联键分组截取，否则子查询最多取 MaxIncludeRows 行
+type Include struct {
+	Relation string
+	Query    *Query
+}
+
+func (q *Query) parseIncludes(data []byte) (map[string]*Include, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var raws map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return nil, err
+	}
+	includes := make(map[string]*Include, len(raws))
+	for name, raw := range raws {
+		inc := &Include{Relation: name, Query: q.NewQuery()}
+		if v, ok := raw["relation"]; ok {
+			if err := json.Unmarshal(v, &inc.Relation); err != nil {
+				return nil, fmt.Errorf("include '%s' relation: %w", name, err)
+			}
+		}
+		sub := inc.Query
+		var errs [6]error
+		if v, ok := raw["select"]; ok {
+			sub.SelectItems, errs[0] = parseSelectItems(v)
+		}
+		sub.Wheres, errs[1] = parseWhere(raw["where"])
+		sub.Orders, errs[2] = parseOrder(raw["order"])
+		sub.Limit, errs[3] = parseLimit(raw["limit"])
+		sub.Joins, errs[4] = parseJoins(raw["join"])
+		sub.Includes, errs[5] = sub.parseIncludes(raw["include"])
+		for _, e := range errs {
+			if e != nil {
+				return nil, fmt.Errorf("include '%s': %w", name, e)
+			}
+		}
+		includes[name] = inc
+	}
+	return includes, nil
+}
+
+// Find 执行查询并嵌入 include 的关联实体
+func (q *Query) Find() ([]map[string]any, error) {
+	m, err := q.fromMeta()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, name := range slices.Sorted(maps.Keys(q.Includes)) {
+		rel, err1 := q.resolveRelated(m, q.Includes[name].Relation)
+		if err1 != nil {
+			return nil, fmt.Errorf("include '%s': %w", name, err1)
+		}
+		keys = append(keys, rel.Key)
+	}
+	vq, hidden := q.withOutputs(keys)
+	bld := builder.Dialect(q.engine.DriverName())
+	if err = vq.BuildSQL(bld); err != nil {
+		return nil, err
+	}
+	sql, args, err := bld.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	if p := q.partition; p != nil {
+		sql, args = p.wrap(sql, args, q.Orders)
+		hidden = append(hidden, rowNumberColumn)
+	}
+	rows, err := q.engine.QueryInterface(append([]any{sql}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err = q.loadIncludes(m, rows); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for _, k := range hidden {
+			delete(row, k)
+		}
+	}
+	return rows, nil
+}
+
+// MaxIncludeRows 不能按关联键分组截取时，一个 include 子查询最多返回的行数
+const MaxIncludeRows = 10000
+
+// rowNumberColumn 分组截取时的行号列，不输出
+const rowNumberColumn = "idig_include_rn"
+
+// partitionLimit 按 Col 分组，每组按查询的排序只取前 Num 行
+type partitionLimit struct {
+	Col string
+	Num int
+}
+
+// wrap 以 ROW_NUMBER() 包装 sql，结果按行号排序，同一组内的顺序与排序一致
+func (p *partitionLimit) wrap(sql string, args []any, orders []*Order) (string, []any) {
+	over := "PARTITION BY " + p.Col
+	if len(orders) > 0 {
+		os := make([]string, len(orders))
+		for i, o := range orders {
+			os[i] = o.String()
+		}
+		over += " ORDER BY " + strings.Join(os, ",")
+	}
+	return fmt.Sprintf("SELECT * FROM (SELECT t.*, ROW_NUMBER() OVER (%s) AS %s FROM (%s) t) w WHERE %s <= ? ORDER BY %s",
+		over, rowNumberColumn, sql, rowNumberColumn, rowNumberColumn), append(args, p.Num)
+}
+
+// partitionable 子查询能否按关联键分组截取：非 m:n，有 num，排序都是简单列，且数据库支持窗口函数
+func (q *Query) partitionable(rel *Related, l *Limit, sub *Query) bool {
+	if l == nil || l.Num <= 0 || rel.Link != nil || sub.Search != nil {
+		return false
+	}
+	for _, o := range sub.Orders {
+		if strings.Contains(o.Col, ".") {
+			return false
+		}
+	}
+	return supportsWindow(q.engine)
+}
+
+// supportsWindow sqlite、postgres 及 MySQL 8、MariaDB 10.2 以上支持窗口函数
+func supportsWindow(engine *xorm.Engine) bool {
+	switch engine.DriverName() {
+	case "sqlite3", "sqlite", "postgres", "pgx":
+		return true
+	case "mysql":
+		rows, err := engine.QueryString("SELECT VERSION() AS version")
+		if err != nil || len(rows) == 0 {
+			return false
+		}
+		v := rows[0]["version"]
+		var major, minor int
+		_, _ = fmt.Sscanf(v, "%d.%d", &major, &minor)
+		if strings.Contains(strings.ToLower(v), "mariadb") {
+			return major > 10 || (major == 10 && minor >= 2)
+		}
+		return major >= 8
+	}
+	return false
+}
+
+func (q *Query) fromMeta() (*meta.EntityMeta, error) {
+	if q.From == nil || len(q.From.EntityAlias) != 1 || q.From.EntityAlias[0].Entity == "" {
+		return nil, fmt.Errorf("query with include requires a single entity in 'from'")
+	}
+	return meta.AcquireMeta(q.From.EntityAlias[0].Entity, q.engine)
+}
+
+// withOutputs 返回输出中包括列 cols 的查询，hidden 为因此增加的输出列
+func (q *Query) withOutputs(cols []string) (*Query, []string) {
+	vq := *q
+	for _, item := range q.SelectItems {
+		if item.Col == "*" && item.Opt == "" {
+			return &vq, nil
+		}
+	}
+	var hidden []string
+	for _, c := range cols {
+		if !vq.selects(c) {
+			vq.SelectItems = append(slices.Clone(vq.SelectItems), &SelectItem{Col: c})
+			hidden = append(hidden, c)
+		}
+	}
+	return &vq, hidden
+}
+
+// loadIncludes 每个关系以一次子查询取出所有记录关联的记录，按关联键分组后嵌入
+func (q *Query) loadIncludes(m *meta.EntityMeta, rows []map[string]any) error {
+	for _, name := range slices.Sorted(maps.Keys(q.Includes)) {
+		inc := q.Includes[name]
+		rel, err := q.resolveRelated(m, inc.Relation)
+		if err != nil {
+			return fmt.Errorf("include '%s': %w", name, err)
+		}
+		children, err := q.includeRows(rel, inc, rows)
+		if err != nil {
+			return fmt.Errorf("include '%s': %w", name, err)
+		}
+		for _, row := range rows {
+			var kids []map[string]any
+			if v := row[rel.Key]; v != nil {
+				kids = children[keyString(v)]
+			}
+			// 分组截取时子查询已只取前 offset+num 行，这里仍需跳过 offset
+			if l := inc.Query.Limit; l != nil {
+				kids = kids[min(l.Offset, len(kids)):]
+				if l.Num > 0 {
+					kids = kids[:min(l.Num, len(kids))]
+				}
+			}
+			switch {
+			case rel.Many:
+				row[name] = append([]map[string]any{}, kids...)
+			case len(kids) > 0:
+				row[name] = kids[0]
+			default:
+				row[name] = nil
+			}
+		}
+	}
+	return nil
+}
+
+// includeRows 查询 rows 关联的记录，以 rows 中关联键的值为键分组；m:n 先经由链接表取得另一端的键
+func (q *Query) includeRows(rel *Related, inc *Include, rows []map[string]any) (map[string][]map[string]any, error) {
+	var vals []any
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if v := row[rel.Key]; v != nil && !seen[keyString(v)] {
+			seen[keyString(v)] = true
+			vals = append(vals, v)
+		}
+	}
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	// owners 另一端关联键的值对应的 rows 关联键的值
+	owners := map[string][]string{}
+	if l := rel.Link; l != nil {
+		sql, args, err := builder.Dialect(q.engine.DriverName()).Select(l.Near, l.Far).From(l.Table).
+			Where(builder.In(l.Near, vals...)).ToSQL()
+		if err != nil {
+			return nil, err
+		}
+		links, err := q.engine.QueryInterface(append([]any{sql}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		vals, seen = nil, map[string]bool{}
+		for _, link := range links {
+			far := keyString(link[l.Far])
+			if !seen[far] {
+				seen[far] = true
+				vals = append(vals, link[l.Far])
+			}
+			owners[far] = append(owners[far], keyString(link[l.Near]))
+		}
+		if len(vals) == 0 {
+			return nil, nil
+		}
+	}
+	sub := *inc.Query
+	sub.engine = q.engine
+	sub.From = &From{EntityAlias: []*EntityOrSubQuery{{Entity: rel.Meta.Entity.EntityName}}}
+	if len(sub.SelectItems) == 0 {
+		sub.SelectItems = []*SelectItem{{Col: "*"}}
+	}
+	sub.Wheres = append(slices.Clone(sub.Wheres), &Where{Col: rel.RelatedKey, Op: "in", Val: vals})
+	outputs := []string{rel.RelatedKey}
+	if l := inc.Query.Limit; q.partitionable(rel, l, &sub) {
+		sub.Limit, sub.partition = nil, &partitionLimit{Col: rel.RelatedKey, Num: l.Offset + l.Num}
+		// 窗口的排序引用子查询的输出列
+		for _, o := range sub.Orders {
+			outputs = append(outputs, o.Col)
+		}
+	} else {
+		sub.Limit = &Limit{Num: MaxIncludeRows + 1}
+	}
+	sq, hidden := sub.withOutputs(outputs)
+	found, err := sq.Find()
+	if err != nil {
+		return nil, err
+	}
+	if sub.partition == nil && len(found) > MaxIncludeRows {
+		return nil, fmt.Errorf("more than %d related rows, narrow the condition", MaxIncludeRows)
+	}
+	children := map[string][]map[string]any{}
+	for _, child := range found {
+		k := keyString(child[rel.RelatedKey])
+		for _, h := range hidden {
+			delete(child, h)
+		}
+		if rel.Link == nil {
+			children[k] = append(children[k], child)
+			continue
+		}
+		for _, owner := range owners[k] {
+			children[owner] = append(children[owner], child)
+		}
+	}
+	return children, nil
+}
+
+// keyString 用于比较不同类型的键值，如 []byte 与 string
+func keyString(v any) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,337 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/goccy/go-json"
+	"xorm.io/builder"
+)
+
+// 关联方式
+const (
+	JoinLeft  = "left"
+	JoinInner = "inner"
+)
+
+// opCond 已解析为 builder.Cond 的条件，Col 仅用于说明
+const opCond = "$cond"
+
+var identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Join 按实体关系关联另一端实体：{"relation": "emp_dept", "alias": "dept", "select": [...], "where": [...], "type": "inner"}。
+// 另一端的表以 alias 为别名，alias 缺省为关系名，选择的列以 <alias>_<col> 输出。
+// type 缺省时另一端有条件为 inner，否则为 left；left 时条件放在关联条件中，不过滤主实体的行。
+// 另一端为多（1:m、m:n）、有条件且未选择其列时，条件以子查询表达，主实体的行不会重复
+type Join struct {
+	Relation    string        `json:"relation"`
+	Alias       string        `json:"alias,omitempty"`
+	SelectItems []*SelectItem `json:"select,omitempty"`
+	Wheres      []*Where      `json:"where,omitempty"`
+	Type        string        `json:"type,omitempty"`
+}
+
+// JoinOf 返回按关系 relation 的关联，用于 Builder.Join
+func JoinOf(relation string) *Join {
+	return &Join{Relation: relation}
+}
+
+// As 设置另一端的别名
+func (j *Join) As(alias string) *Join {
+	j.Alias = alias
+	return j
+}
+
+// Select 选择另一端的列
+func (j *Join) Select(cols ...string) *Join {
+	for _, c := range cols {
+		j.SelectItems = append(j.SelectItems, &SelectItem{Col: c})
+	}
+	return j
+}
+
+// Where 增加另一端的条件，op 同查询的 where
+func (j *Join) Where(col, op string, val any) *Join {
+	j.Wheres = append(j.Wheres, &Where{Col: col, Op: op, Val: val})
+	return j
+}
+
+// Inner 以 inner join 关联，另一端没有匹配记录的行不返回
+func (j *Join) Inner() *Join {
+	j.Type = JoinInner
+	return j
+}
+
+// Left 以 left join 关联
+func (j *Join) Left() *Join {
+	j.Type = JoinLeft
+	return j
+}
+
+func (j *Join) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Relation string          `json:"relation"`
+		Alias    string          `json:"alias"`
+		Select   json.RawMessage `json:"select"`
+		Where    json.RawMessage `json:"where"`
+		Type     string          `json:"type"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	j.Relation, j.Alias, j.Type = raw.Relation, raw.Alias, raw.Type
+	var err error
+	if len(raw.Select) > 0 {
+		if j.SelectItems, err = parseSelectItems(raw.Select); err != nil {
+			return fmt.Errorf("join '%s' select: %w", j.Relation, err)
+		}
+	}
+	if len(raw.Where) > 0 {
+		if j.Wheres, err = parseWhere(raw.Where); err != nil {
+			return fmt.Errorf("join '%s' where: %w", j.Relation, err)
+		}
+	}
+	return nil
+}
+
+func parseJoins(data []byte) ([]*Join, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var joins []*Join
+	if err := json.Unmarshal(data, &joins); err != nil {
+		return nil, err
+	}
+	for _, j := range joins {
+		if err := j.Verify(); err != nil {
+			return nil, err
+		}
+	}
+	return joins, nil
+}
+
+func (j *Join) Verify() error {
+	if j == nil {
+		return fmt.Errorf("join is nil")
+	}
+	if j.Relation == "" {
+		return fmt.Errorf("join relation is required")
+	}
+	if !identRegexp.MatchString(j.name()) {
+		return fmt.Errorf("join '%s': invalid alias '%s'", j.Relation, j.name())
+	}
+	if j.Type != "" && j.Type != JoinLeft && j.Type != JoinInner {
+		return fmt.Errorf("join '%s': type must be 'left' or 'inner'", j.Relation)
+	}
+	for _, item := range j.SelectItems {
+		if item.Opt != "" || item.Col == "*" {
+			return fmt.Errorf("join '%s': only columns can be selected", j.Relation)
+		}
+	}
+	return nil
+}
+
+func (j *Join) name() string {
+	if j.Alias != "" {
+		return j.Alias
+	}
+	return j.Relation
+}
+
+func (j *Join) joinType() string {
+	if j.Type != "" {
+		return j.Type
+	}
+	if len(j.Wheres) > 0 {
+		return JoinInner
+	}
+	return JoinLeft
+}
+
+// headers 另一端选择列的输出列名
+func (j *Join) headers() []string {
+	var headers []string
+	for _, item := range j.SelectItems {
+		if item.Alias != "" {
+			headers = append(headers, item.Alias)
+		} else {
+			headers = append(headers, j.name()+"_"+item.Col)
+		}
+	}
+	return headers
+}
+
+// joinPlan 解析后的关联：tables 为另一端用到的表，第一个为关联键所在的表
+type joinPlan struct {
+	*Join
+	rel    *Related
+	key    string
+	tables []string
+}
+
+// resolveJoins 解析关联，校验另一端的列
+func (q *Query) resolveJoins(m *meta.EntityMeta) ([]*joinPlan, error) {
+	plans := make([]*joinPlan, 0, len(q.Joins))
+	names := map[string]bool{}
+	for _, j := range q.Joins {
+		if err := j.Verify(); err != nil {
+			return nil, err
+		}
+		if names[j.name()] {
+			return nil, fmt.Errorf("duplicate join alias '%s'", j.name())
+		}
+		names[j.name()] = true
+		rel, err := q.resolveRelated(m, j.Relation)
+		if err != nil {
+			return nil, err
+		}
+		p := &joinPlan{Join: j, rel: rel, key: qualifyColumn(m, rel.Key)}
+		rm := rel.Meta
+		anchor := rm.FetchTableNameByColumn(rel.RelatedKey)
+		cols := []string{rel.RelatedKey}
+		for _, item := range j.SelectItems {
+			cols = append(cols, item.Col)
+		}
+		for _, w := range j.Wheres {
+			if w.Op != "expr" {
+				cols = append(cols, w.Col)
+			}
+		}
+		for _, c := range cols {
+			if _, ok := rm.ColumnIndex[c]; !ok {
+				return nil, fmt.Errorf("join '%s': column '%s' not found in entity '%s'", j.Relation, c, rm.Entity.EntityName)
+			}
+		}
+		tables, err := rm.GetAttrGroupTablesNameFromCols(cols)
+		if err != nil {
+			return nil, err
+		}
+		p.tables = append(p.tables, anchor)
+		for _, t := range tables {
+			if t != anchor {
+				p.tables = append(p.tables, t)
+			}
+		}
+		if j.joinType() == JoinLeft {
+			// 条件放在关联条件中，只能使用关联键所在表的列
+			for _, w := range j.Wheres {
+				if w.Op != "expr" && rm.FetchTableNameByColumn(w.Col) != anchor {
+					return nil, fmt.Errorf("join '%s': where column '%s' of a left join must be in table '%s'",
+						j.Relation, w.Col, anchor)
+				}
+			}
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+// semi 另一端为多且只用于过滤时以子查询表达
+func (p *joinPlan) semi() bool {
+	return p.rel.Many && len(p.SelectItems) == 0 && len(p.Wheres) > 0 && p.joinType() == JoinInner
+}
+
+func (p *joinPlan) alias(table string) string {
+	if table == p.tables[0] {
+		return p.name()
+	}
+	return p.name() + "_" + table
+}
+
+func (p *joinPlan) column(col string) string {
+	return p.alias(p.rel.Meta.FetchTableNameByColumn(col)) + "." + col
+}
+
+func (p *joinPlan) selectItems() []string {
+	headers := p.headers()
+	items := make([]string, len(p.SelectItems))
+	for i, item := range p.SelectItems {
+		items[i] = fmt.Sprintf("%s AS %s", p.column(item.Col), headers[i])
+	}
+	return items
+}
+
+// cond 另一端的条件，列限定为另一端表的别名
+func (p *joinPlan) cond() (builder.Cond, error) {
+	cond := builder.NewCond()
+	for _, w := range p.Wheres {
+		cp := *w
+		if cp.Op != "expr" {
+			cp.Col = p.column(w.Col)
+		}
+		c, err := cp.ToCond()
+		if err != nil {
+			return nil, fmt.Errorf("join '%s': %w", p.Relation, err)
+		}
+		cond = cond.And(c)
+	}
+	return cond, nil
+}
+
+// build 关联另一端的表，返回需要放在 where 中的条件：semi 时为子查询条件，inner 时为另一端的条件，
+// left 时条件已在关联条件中，返回 nil
+func (p *joinPlan) build(bld *builder.Builder) (builder.Cond, error) {
+	cond, err := p.cond()
+	if err != nil {
+		return nil, err
+	}
+	if p.semi() {
+		sub := builder.Select(p.subSelect())
+		p.joinTables(sub, JoinInner, nil, true)
+		return builder.In(p.key, sub.Where(cond)), nil
+	}
+	if p.joinType() == JoinLeft {
+		p.joinTables(bld, JoinLeft, cond, false)
+		return nil, nil
+	}
+	p.joinTables(bld, JoinInner, nil, false)
+	return cond, nil
+}
+
+func (p *joinPlan) subSelect() string {
+	if p.rel.Link != nil {
+		return p.name() + "_link." + p.rel.Link.Near
+	}
+	return p.column(p.rel.RelatedKey)
+}
+
+// joinTables 依次关联链接表、关联键所在表和其余的表；from 为真时第一个表作为子查询的 from，不需要关联条件
+func (p *joinPlan) joinTables(bld *builder.Builder, joinType string, cond builder.Cond, from bool) {
+	join := func(table, alias string, on builder.Cond) {
+		if from {
+			bld.From(table, alias)
+			from = false
+			return
+		}
+		if joinType == JoinInner {
+			bld.InnerJoin(table+" "+alias, on)
+		} else {
+			bld.LeftJoin(table+" "+alias, on)
+		}
+	}
+	anchor := p.name()
+	near, far := p.key, anchor+"."+p.rel.RelatedKey
+	if l := p.rel.Link; l != nil {
+		lnk := anchor + "_link"
+		join(l.Table, lnk, builder.Expr(fmt.Sprintf("%s = %s.%s", p.key, lnk, l.Near)))
+		near = lnk + "." + l.Far
+	}
+	on := builder.Cond(builder.Expr(fmt.Sprintf("%s = %s", near, far)))
+	if cond != nil && cond.IsValid() {
+		on = on.And(cond)
+	}
+	join(p.tables[0], anchor, on)
+	pk := p.rel.Meta.Entity.PkAttrColumn
+	for _, t := range p.tables[1:] {
+		join(t, p.alias(t), builder.Expr(fmt.Sprintf("%s.%s = %s.%s", anchor, pk, p.alias(t), pk)))
+	}
+}
+
+// qualifyColumn 实体的列限定为其所在的表
+func qualifyColumn(m *meta.EntityMeta, col string) string {
+	if t := m.FetchTableNameByColumn(col); t != "" {
+		return t + "." + col
+	}
+	return col
+}
@@ -0,0 +1,98 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/goccy/go-json"
+	"xorm.io/builder"
+)
+
+// OpLink 按多对多关系过滤：{"col": "<关系名>", "op": "link", "val": ...}。
+// val 为另一端关联键的值或数组；也可以是 {"keys": [...], "where": [...]}，where 为链接属性的条件；
+// val 为空时匹配至少有一个链接的记录
+const OpLink = "link"
+
+// Link 多对多关系在当前实体一侧的展开：实体的 Key 列取值出现在链接表 Table 的 Near 列中，
+// 同一链接行的 Far 列引用另一端实体
+type Link struct {
+	Key   string
+	Table string
+	Near  string
+	Far   string
+	// Meta 链接实体，链接属性的条件只能使用其主表的列
+	Meta *meta.EntityMeta
+}
+
+// resolveLinks 将 link 条件替换为以子查询表达的条件，Col 改为实体的关联键，便于关联其属性表
+func (q *Query) resolveLinks(m *meta.EntityMeta) ([]*Where, error) {
+	wheres := make([]*Where, len(q.Wheres))
+	for i, w := range q.Wheres {
+		wheres[i] = w
+		if w.Op != OpLink {
+			continue
+		}
+		rel, err := q.resolveRelated(m, w.Col)
+		if err != nil {
+			return nil, err
+		}
+		if rel.Link == nil {
+			return nil, fmt.Errorf("relation '%s' is not m:n", w.Col)
+		}
+		l := rel.Link
+		cond, err := l.Cond(m, w.Val)
+		if err != nil {
+			return nil, fmt.Errorf("link condition on '%s': %w", w.Col, err)
+		}
+		wheres[i] = &Where{Col: l.Key, Op: OpLink, Val: cond, Tie: w.Tie}
+	}
+	return wheres, nil
+}
+
+// Cond 构建 key IN (SELECT near FROM link WHERE ...) 条件，主键列限定为主表的列
+func (l *Link) Cond(m *meta.EntityMeta, val any) (builder.Cond, error) {
+	var (
+		keys   any
+		wheres []*Where
+	)
+	switch v := val.(type) {
+	case map[string]any:
+		keys = v["keys"]
+		if raw, ok := v["where"]; ok {
+			data, err := json.Marshal(raw)
+			if err != nil {
+				return nil, err
+			}
+			if wheres, err = parseWhere(data); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		keys = v
+	}
+	sub := builder.Select(l.Near).From(l.Table)
+	cond := builder.NewCond()
+	switch k := keys.(type) {
+	case nil:
+		cond = cond.And(builder.NotNull{l.Far})
+	case []any:
+		cond = cond.And(builder.In(l.Far, k...))
+	default:
+		cond = cond.And(builder.Eq{l.Far: k})
+	}
+	for _, w := range wheres {
+		if w.Op != "expr" && l.Meta.FetchTableNameByColumn(w.Col) != l.Table {
+			return nil, fmt.Errorf("link attribute '%s' not found", w.Col)
+		}
+		c, err := w.ToCond()
+		if err != nil {
+			return nil, err
+		}
+		cond = cond.And(c)
+	}
+	key := l.Key
+	if key == m.Entity.PkAttrColumn {
+		key = m.Entity.PkAttrTable + "." + key
+	}
+	return builder.In(key, sub.Where(cond)), nil
+}
@@ -0,0 +1,236 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseWheres 解析 where 条件列表
+func ParseWheres(data []byte) ([]*Where, error) {
+	return parseWhere(data)
+}
+
+// MatchWheres 在内存中对 data 求值 where 条件列表，操作符与 ToCond 保持一致；
+// 多个条件按 Tie 从左至右组合，Tie 为空时视为 and。col 支持以 '.' 访问嵌套对象。
+func MatchWheres(ws []*Where, data map[string]any) (bool, error) {
+	result := true
+	for i, w := range ws {
+		ok, err := w.Match(data)
+		if err != nil {
+			return false, err
+		}
+		if i == 0 {
+			result = ok
+			continue
+		}
+		if w.Tie == "or" {
+			result = result || ok
+		} else {
+			result = result && ok
+		}
+	}
+	return result, nil
+}
+
+// Match 对单个条件求值
+func (w *Where) Match(data map[string]any) (bool, error) {
+	v, exists := lookupPath(data, w.Col)
+	switch w.Op {
+	case "", "eq":
+		return exists && compareEq(v, w.Val), nil
+	case "ne":
+		return !exists || !compareEq(v, w.Val), nil
+	case "lt", "lte", "gt", "gte":
+		if !exists || v == nil || w.Val == nil {
+			return false, nil
+		}
+		c, err := compareOrder(v, w.Val)
+		if err != nil {
+			return false, fmt.Errorf("where '%s': %w", w.Col, err)
+		}
+		switch w.Op {
+		case "lt":
+			return c < 0, nil
+		case "lte":
+			return c <= 0, nil
+		case "gt":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case "like":
+		if !exists || v == nil {
+			return false, nil
+		}
+		re, err := likeToRegexp(fmt.Sprintf("%v", w.Val))
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(fmt.Sprintf("%v", v)), nil
+	case "in", "notin":
+		in := false
+		if exists {
+			rv := reflect.ValueOf(w.Val)
+			if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+				return false, fmt.Errorf("where '%s': %s vals must be array", w.Col, w.Op)
+			}
+			for i := 0; i < rv.Len(); i++ {
+				if compareEq(v, rv.Index(i).Interface()) {
+					in = true
+					break
+				}
+			}
+		}
+		if w.Op == "in" {
+			return in, nil
+		}
+		return !in, nil
+	case "isnull":
+		return !exists || v == nil, nil
+	case "notnull":
+		return exists && v != nil, nil
+	case "between":
+		bv, ok := w.Val.([]any)
+		if !ok || len(bv) < 2 {
+			return false, fmt.Errorf("between vals must be array,and len gte two")
+		}
+		if !exists || v == nil {
+			return false, nil
+		}
+		c1, err := compareOrder(v, bv[0])
+		if err != nil {
+			return false, err
+		}
+		c2, err := compareOrder(v, bv[1])
+		if err != nil {
+			return false, err
+		}
+		return c1 >= 0 && c2 <= 0, nil
+	case "expr":
+		return false, fmt.Errorf("where op 'expr' can not be evaluated in memory")
+	}
+	return false, fmt.Errorf("unknown where op '%s'", w.Op)
+}
+
+func lookupPath(data map[string]any, path string) (any, bool) {
+	if v, ok := data[path]; ok {
+		return v, true
+	}
+	parts := strings.Split(path, ".")
+	var cur any = data
+	for _, p := range parts {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func toNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func isNumeric(v any) bool {
+	switch v.(type) {
+	case string, nil:
+		return false
+	}
+	_, ok := toNumber(v)
+	return ok
+}
+
+func toText(v any) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	case time.Time:
+		return t.Format(time.DateTime)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func compareEq(a, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if isNumeric(a) || isNumeric(b) {
+		fa, ok1 := toNumber(a)
+		fb, ok2 := toNumber(b)
+		if ok1 && ok2 {
+			return fa == fb
+		}
+	}
+	return toText(a) == toText(b)
+}
+
+// compareOrder 数值按大小比较，其余按字符串比较
+func compareOrder(a, b any) (int, error) {
+	if isNumeric(a) || isNumeric(b) {
+		fa, ok1 := toNumber(a)
+		fb, ok2 := toNumber(b)
+		if !ok1 || !ok2 {
+			return 0, fmt.Errorf("can not compare %v with %v", a, b)
+		}
+		switch {
+		case fa < fb:
+			return -1, nil
+		case fa > fb:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return strings.Compare(toText(a), toText(b)), nil
+}
+
+// likeToRegexp 将 SQL LIKE 模式转换为正则；与 builder.Like 一致，首尾都没有 '%' 时按包含匹配
+func likeToRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return regexp.Compile("^$")
+	}
+	if pattern[0] != '%' && pattern[len(pattern)-1] != '%' {
+		pattern = "%" + pattern + "%"
+	}
+	var sb strings.Builder
+	sb.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
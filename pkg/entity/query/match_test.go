@@ -0,0 +1,55 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchWheres(t *testing.T) {
+	data := map[string]any{
+		"name":   "Tom Smith",
+		"age":    float64(30),
+		"salary": "1200.5",
+		"dept":   map[string]any{"code": "RD"},
+		"leader": nil,
+	}
+	tests := []struct {
+		name  string
+		where string
+		want  bool
+		err   string
+	}{
+		{"eq", `[{"col":"name","val":"Tom Smith"}]`, true, ""},
+		{"eq number", `[{"col":"age","op":"eq","val":30}]`, true, ""},
+		{"ne", `[{"col":"age","op":"ne","val":30}]`, false, ""},
+		{"gt numeric string", `[{"col":"salary","op":"gt","val":1000}]`, true, ""},
+		{"lte", `[{"col":"age","op":"lte","val":29}]`, false, ""},
+		{"like", `[{"col":"name","op":"like","val":"smith"}]`, true, ""},
+		{"like prefix", `[{"col":"name","op":"like","val":"Tom%"}]`, true, ""},
+		{"like no match", `[{"col":"name","op":"like","val":"%Jerry"}]`, false, ""},
+		{"in", `[{"col":"dept.code","op":"in","val":["HR","RD"]}]`, true, ""},
+		{"notin", `[{"col":"dept.code","op":"notin","val":["HR","RD"]}]`, false, ""},
+		{"isnull", `[{"col":"leader","op":"isnull"}]`, true, ""},
+		{"isnull missing", `[{"col":"missing","op":"isnull"}]`, true, ""},
+		{"notnull", `[{"col":"name","op":"notnull"}]`, true, ""},
+		{"between", `[{"col":"age","op":"between","val":[18,60]}]`, true, ""},
+		{"and", `[{"col":"age","op":"gt","val":18},{"col":"name","op":"eq","val":"x"}]`, false, ""},
+		{"or", `[{"col":"age","op":"gt","val":18},{"col":"name","op":"eq","val":"x","tie":"or"}]`, true, ""},
+		{"expr", `[{"col":"age","op":"expr","val":{"sql":"age > ?","args":[1]}}]`, false, "can not be evaluated"},
+		{"unknown op", `[{"col":"age","op":"nope","val":1}]`, false, "unknown where op"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, err := ParseWheres([]byte(tt.where))
+			assert.NoError(t, err)
+			got, err := MatchWheres(ws, data)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package query
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// 参数占位符：where 的值（或值中的数组元素、对象字段）整体为 "${name}" 时由参数替换，
+// 替换后作为绑定参数传给数据库，不拼接进 SQL；expr 条件只替换 args，sql 不替换
+var paramRe = regexp.MustCompile(`^\$\{([A-Za-z][A-Za-z0-9_]*)\}$`)
+
+// Params 查询（包括关联和嵌入的子查询）的 where 值中引用的参数名，有序
+func (q *Query) Params() []string {
+	set := map[string]bool{}
+	q.walkWheres(func(w *Where) {
+		collectParams(paramValue(w), set)
+	})
+	return slices.Sorted(maps.Keys(set))
+}
+
+// paramValue 条件中可以引用参数的值：expr 条件为其 args，其余为整个值
+func paramValue(w *Where) any {
+	if w.Op != "expr" {
+		return w.Val
+	}
+	if e, ok := w.Val.(map[string]any); ok {
+		return e["args"]
+	}
+	return nil
+}
+
+// VerifyParams expr 条件的 sql 中不能出现参数占位符，参数只能通过 args 绑定
+func (q *Query) VerifyParams() error {
+	var err error
+	q.walkWheres(func(w *Where) {
+		if w.Op != "expr" || err != nil {
+			return
+		}
+		if e, ok := w.Val.(map[string]any); ok {
+			if sql, ok1 := e["sql"].(string); ok1 && strings.Contains(sql, "${") {
+				err = fmt.Errorf("expr sql '%s' can not contain parameters, pass them in args", sql)
+			}
+		}
+	})
+	return err
+}
+
+func collectParams(v any, set map[string]bool) {
+	switch t := v.(type) {
+	case string:
+		if m := paramRe.FindStringSubmatch(t); m != nil {
+			set[m[1]] = true
+		}
+	case []any:
+		for _, e := range t {
+			collectParams(e, set)
+		}
+	case map[string]any:
+		for _, e := range t {
+			collectParams(e, set)
+		}
+	}
+}
+
+// walkWheres 依次访问查询、关联及嵌入子查询的条件
+func (q *Query) walkWheres(fn func(w *Where)) {
+	for _, w := range q.Wheres {
+		fn(w)
+	}
+	for _, j := range q.Joins {
+		for _, w := range j.Wheres {
+			fn(w)
+		}
+	}
+	for _, inc := range q.Includes {
+		inc.Query.walkWheres(fn)
+	}
+}
+
+// Bind 返回以 vals 替换参数后的查询副本，原查询不变，可以缓存后并发绑定；引用的参数缺少值时报错
+func (q *Query) Bind(vals map[string]any) (*Query, error) {
+	for _, p := range q.Params() {
+		if _, ok := vals[p]; !ok {
+			return nil, fmt.Errorf("parameter '%s' has no value", p)
+		}
+	}
+	return q.bind(vals), nil
+}
+
+func (q *Query) bind(vals map[string]any) *Query {
+	bq := *q
+	bq.Wheres = bindWheres(q.Wheres, vals)
+	if q.Joins != nil {
+		bq.Joins = make([]*Join, len(q.Joins))
+		for i, j := range q.Joins {
+			bj := *j
+			bj.Wheres = bindWheres(j.Wheres, vals)
+			bq.Joins[i] = &bj
+		}
+	}
+	if q.Includes != nil {
+		bq.Includes = make(map[string]*Include, len(q.Includes))
+		for name, inc := range q.Includes {
+			bq.Includes[name] = &Include{Relation: inc.Relation, Query: inc.Query.bind(vals)}
+		}
+	}
+	return &bq
+}
+
+func bindWheres(wheres []*Where, vals map[string]any) []*Where {
+	if wheres == nil {
+		return nil
+	}
+	bound := make([]*Where, len(wheres))
+	for i, w := range wheres {
+		bw := *w
+		if e, ok := w.Val.(map[string]any); ok && w.Op == "expr" {
+			be := maps.Clone(e)
+			be["args"] = bindValue(e["args"], vals)
+			bw.Val = be
+		} else {
+			bw.Val = bindValue(w.Val, vals)
+		}
+		bound[i] = &bw
+	}
+	return bound
+}
+
+func bindValue(v any, vals map[string]any) any {
+	switch t := v.(type) {
+	case string:
+		if m := paramRe.FindStringSubmatch(t); m != nil {
+			return vals[m[1]]
+		}
+	case []any:
+		bound := make([]any, len(t))
+		for i, e := range t {
+			bound[i] = bindValue(e, vals)
+		}
+		return bound
+	case map[string]any:
+		bound := make(map[string]any, len(t))
+		for k, e := range t {
+			bound[k] = bindValue(e, vals)
+		}
+		return bound
+	}
+	return v
+}
@@ -15,14 +15,21 @@ import (
 type Query struct {
 	// Version     string        `json:"version,omitempty"`
 	// Entity      string        `json:"entity,omitempty"`
-	Alias       string        `json:"alias,omitempty"`
-	SelectItems []*SelectItem `json:"select"`
-	From        *From         `json:"from"`
-	Wheres      []*Where      `json:"where,omitempty"`
-	Orders      []*Order      `json:"order,omitempty"`
-	Limit       *Limit        `json:"limit,omitempty"`
-	TenantId    uint32        `json:"tenant_id,omitempty"`
-	engine      *xorm.Engine  `json:"-"`
+	Alias       string              `json:"alias,omitempty"`
+	SelectItems []*SelectItem       `json:"select"`
+	From        *From               `json:"from"`
+	Wheres      []*Where            `json:"where,omitempty"`
+	Joins       []*Join             `json:"join,omitempty"`
+	Includes    map[string]*Include `json:"include,omitempty"`
+	Orders      []*Order            `json:"order,omitempty"`
+	Limit       *Limit              `json:"limit,omitempty"`
+	Search      *Search             `json:"search,omitempty"`
+	TenantId    uint32              `json:"tenant_id,omitempty"`
+	engine      *xorm.Engine        `json:"-"`
+	joins       []*joinPlan
+	search      *searchPlan
+	// partition 作为 include 子查询时按关联键分组截取
+	partition *partitionLimit
 }
 
 type BuilderSQL interface {
@@ -55,12 +62,15 @@ func (q *Query) Parse(data []byte) error {
 	if _, ok := qSt["alias"]; ok {
 		q.Alias = string(qSt["alias"])
 	}
-	var errs [5]error
+	var errs [8]error
 	q.SelectItems, errs[0] = parseSelectItems(qSt["select"])
 	q.From, errs[1] = parseFrom(qSt["from"])
 	q.Wheres, errs[2] = parseWhere(qSt["where"])
 	q.Orders, errs[3] = parseOrder(qSt["order"])
 	q.Limit, errs[4] = parseLimit(qSt["limit"])
+	q.Joins, errs[5] = parseJoins(qSt["join"])
+	q.Includes, errs[6] = q.parseIncludes(qSt["include"])
+	q.Search, errs[7] = parseSearch(qSt["search"])
 	for _, e := range errs {
 		if e != nil {
 			return e
@@ -111,22 +121,66 @@ func (q *Query) buildCond(bld *builder.Builder) error {
 }
 
 func (q *Query) buildSelectItems(bld *builder.Builder, m *meta.EntityMeta) (*builder.Builder, error) {
-	var cols []string
+	var cols, items []string
 	for _, item := range q.SelectItems {
+		if v, ok := m.Virtuals[item.Col]; ok && item.Opt == "" {
+			cols = append(cols, v.Deps()...)
+			alias := item.Alias
+			if alias == "" {
+				alias = v.Name
+			}
+			items = append(items, fmt.Sprintf("(%s) AS %s", v.Expr, alias))
+			continue
+		}
 		cols = append(cols, item.Col)
+		items = append(items, item.String())
+	}
+	if !(len(cols) == 1 && cols[0] == "*") {
+		// 过滤、排序和关联其他实体用到的列也需要关联其属性表
+		for _, j := range q.joins {
+			cols = append(cols, j.rel.Key)
+		}
+		if q.search != nil {
+			cols = append(cols, q.search.cols...)
+		}
+		for _, c := range q.condColumns() {
+			if v, ok := m.Virtuals[c]; ok {
+				cols = append(cols, v.Deps()...)
+			} else if _, ok = m.ColumnIndex[c]; ok {
+				cols = append(cols, c)
+			}
+		}
 	}
 	e := m.Entity
-	bld.Select(cols...)
-	bld.From(e.PkAttrTable)
-
 	tables, err := m.GetAttrGroupTablesNameFromCols(cols)
 	if err != nil {
 		return nil, err
 	}
-	if len(tables) == 1 {
-		if e.PkAttrTable == tables[0] {
-			return bld, nil
+	if len(tables) > 1 || len(q.joins) > 0 {
+		// 关联属性表后主键列存在歧义，限定为主表的列；关联其他实体后所有列都限定为所在的表
+		for i, item := range q.SelectItems {
+			if item.Opt != "" || (item.Col != e.PkAttrColumn && len(q.joins) == 0) {
+				continue
+			}
+			if _, ok := m.ColumnIndex[item.Col]; !ok {
+				continue
+			}
+			alias := item.Alias
+			if alias == "" {
+				alias = item.Col
+			}
+			items[i] = fmt.Sprintf("%s AS %s", qualifyColumn(m, item.Col), alias)
 		}
+	}
+	for _, j := range q.joins {
+		items = append(items, j.selectItems()...)
+	}
+	if q.search != nil {
+		items = append(items, q.search.items...)
+	}
+	bld.Select(items...)
+	bld.From(e.PkAttrTable)
+	if len(tables) == 1 && e.PkAttrTable != tables[0] {
 		return nil, fmt.Errorf("table %s not exist", e.PkAttrTable)
 	}
 	joinCond := fmt.Sprintf("%s.%s = %%s.%s", e.PkAttrTable, e.PkAttrColumn, e.PkAttrColumn)
@@ -140,6 +194,88 @@ func (q *Query) buildSelectItems(bld *builder.Builder, m *meta.EntityMeta) (*bui
 	return bld, nil
 }
 
+// condColumns where 与 order 中引用的列
+func (q *Query) condColumns() []string {
+	var cols []string
+	for _, w := range q.Wheres {
+		if w.Op != "expr" {
+			cols = append(cols, w.Col)
+		}
+	}
+	for _, o := range q.Orders {
+		cols = append(cols, o.Col)
+	}
+	return cols
+}
+
+// expandVirtual 返回将虚拟属性替换为其表达式、主键列限定为主表列后的 where 与 order，原条件不变；
+// 关联其他实体时实体的列都限定为所在的表
+func (q *Query) expandVirtual(m *meta.EntityMeta) ([]*Where, []*Order) {
+	e := m.Entity
+	qualify := func(col string) bool {
+		_, ok := m.ColumnIndex[col]
+		return ok && (col == e.PkAttrColumn || len(q.joins) > 0)
+	}
+	wheres := make([]*Where, len(q.Wheres))
+	for i, w := range q.Wheres {
+		wheres[i] = w
+		if w.Op == "expr" || w.Op == opCond {
+			continue
+		}
+		if v, ok := m.Virtuals[w.Col]; ok {
+			cp := *w
+			cp.Col = "(" + v.Expr + ")"
+			wheres[i] = &cp
+		} else if qualify(w.Col) {
+			cp := *w
+			cp.Col = qualifyColumn(m, w.Col)
+			wheres[i] = &cp
+		}
+	}
+	orders := make([]*Order, len(q.Orders))
+	for i, o := range q.Orders {
+		orders[i] = o
+		// 选择列表中有同名输出列时按输出列排序
+		if v, ok := m.Virtuals[o.Col]; ok && !q.selects(o.Col) {
+			orders[i] = &Order{Col: "(" + v.Expr + ")", Option: o.Option}
+		} else if len(q.joins) > 0 && qualify(o.Col) {
+			orders[i] = &Order{Col: qualifyColumn(m, o.Col), Option: o.Option}
+		}
+	}
+	return wheres, orders
+}
+
+// selects 是否有以 name 为输出列名的选择项
+func (q *Query) selects(name string) bool {
+	for _, item := range q.SelectItems {
+		if item.Alias == name || (item.Alias == "" && item.Col == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers 返回结果集的列名，有别名时为别名
+func (q *Query) Headers() []string {
+	headers := make([]string, 0, len(q.SelectItems))
+	for _, item := range q.SelectItems {
+		if item.Alias != "" {
+			headers = append(headers, item.Alias)
+		} else {
+			headers = append(headers, item.Col)
+		}
+	}
+	for _, j := range q.Joins {
+		headers = append(headers, j.headers()...)
+	}
+	if q.Search != nil {
+		if m, err := q.fromMeta(); err == nil {
+			headers = append(headers, q.Search.headers(m)...)
+		}
+	}
+	return headers
+}
+
 func (q *Query) BuildSQL(bld *builder.Builder) error {
 	metas, err := q.AcquireAllMetas()
 	if err != nil {
@@ -158,11 +294,43 @@ func (q *Query) BuildSQL(bld *builder.Builder) error {
 			}
 			entityName := q.From.EntityAlias[0].Entity
 			m := metas[entityName]
-			_, err2 := q.buildSelectItems(bld, m)
-			if err2 != nil {
+			vq := *q
+			var err2 error
+			if vq.Wheres, err2 = q.resolveLinks(m); err2 != nil {
+				return err2
+			}
+			if vq.joins, err2 = q.resolveJoins(m); err2 != nil {
+				return err2
+			}
+			if q.Search != nil {
+				if vq.search, err2 = q.Search.plan(m, q.engine.DriverName()); err2 != nil {
+					return err2
+				}
+			}
+			if _, err2 = vq.buildSelectItems(bld, m); err2 != nil {
+				return err2
+			}
+			for _, j := range vq.joins {
+				cond, err3 := j.build(bld)
+				if err3 != nil {
+					return err3
+				}
+				if cond != nil && cond.IsValid() {
+					vq.Wheres = append(vq.Wheres, &Where{Col: j.name(), Op: opCond, Val: cond})
+				}
+			}
+			if vq.search != nil {
+				if cond := vq.search.build(bld); cond != nil {
+					vq.Wheres = append(vq.Wheres, &Where{Col: searchAlias, Op: opCond, Val: cond})
+				}
+				if len(vq.Orders) == 0 {
+					vq.Orders = []*Order{{Col: SearchRank, Option: "DESC"}}
+				}
+			}
+			vq.Wheres, vq.Orders = vq.expandVirtual(m)
+			if err2 = vq.buildCond(bld); err2 != nil {
 				return err2
 			}
-			q.buildCond(bld)
 		}
 	}
 	return nil
@@ -36,6 +36,42 @@ func TestQuery_Parse(t *testing.T) {
 			assert.Equal(t, "name", query.SelectItems[0].Col)
 			assert.Equal(t, len(query.Wheres), 1)
 		}},
+		{"join", `{"select":["name"],"from":"emp","join":[{"relation":"emp_dept","alias":"dept","select":["name",{"col":"code","alias":"dc"}],"where":[{"col":"code","val":"D1"}]}]}`, func(query *Query, err error) {
+			assert.Nil(t, err)
+			assert.Equal(t, "emp_dept", query.Joins[0].Relation)
+			assert.Equal(t, JoinInner, query.Joins[0].joinType())
+			assert.Equal(t, []string{"name", "dept_name", "dc"}, query.Headers())
+		}},
+		{"join bad type", `{"select":["name"],"from":"emp","join":[{"relation":"emp_dept","type":"outer"}]}`, func(query *Query, err error) {
+			assert.ErrorContains(t, err, "type must be 'left' or 'inner'")
+		}},
+		{"include", `{"select":["name"],"from":"emp","include":{"dept":{"relation":"emp_dept","select":["name"],"limit":{"num":1}},"emp_task":{}}}`, func(query *Query, err error) {
+			assert.Nil(t, err)
+			assert.Equal(t, "emp_dept", query.Includes["dept"].Relation)
+			assert.Equal(t, 1, query.Includes["dept"].Query.Limit.Num)
+			assert.Equal(t, "emp_task", query.Includes["emp_task"].Relation)
+		}},
+		{"include bad where", `{"select":["name"],"from":"emp","include":{"dept":{"where":[{"op":"eq"}]}}}`, func(query *Query, err error) {
+			assert.ErrorContains(t, err, "include 'dept': where col is required")
+		}},
+		{"join bad alias", `{"select":["name"],"from":"emp","join":[{"relation":"emp_dept","alias":"d x"}]}`, func(query *Query, err error) {
+			assert.ErrorContains(t, err, "invalid alias 'd x'")
+		}},
+		{"search", `{"select":["name"],"from":"emp","search":"go* \"x-y\" -"}`, func(query *Query, err error) {
+			assert.Nil(t, err)
+			assert.Nil(t, query.Search.Highlight)
+			assert.Equal(t, `"go"* "x-y"`, query.Search.matchExpr())
+		}},
+		{"search highlight", `{"select":["name"],"from":"emp","search":{"text":"go","highlight":{"cols":["bio"],"pre":"["}}}`, func(query *Query, err error) {
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"bio"}, query.Search.Highlight.Cols)
+			pre, post := query.Search.marks()
+			assert.Equal(t, "[", pre)
+			assert.Equal(t, "</b>", post)
+		}},
+		{"search empty", `{"select":["name"],"from":"emp","search":{"text":" * ","highlight":true}}`, func(query *Query, err error) {
+			assert.ErrorContains(t, err, "search text is required")
+		}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -225,3 +261,46 @@ func TestQuery_buildCond(t *testing.T) {
 		})
 	}
 }
+
+func TestQuery_Bind(t *testing.T) {
+	q := NewQuery(1, nil)
+	err := q.Parse([]byte(`{"select":["name"],"from":"emp","where":[{"col":"age","op":"gt","val":"${age}"},` +
+		`{"col":"idx","op":"in","val":["${id}",9]}],"join":[{"relation":"emp_dept","where":[{"col":"code","val":"${dept}"}]}],` +
+		`"include":{"tasks":{"relation":"emp_task","where":[{"col":"title","val":"${title}"}]}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"age", "dept", "id", "title"}, q.Params())
+
+	_, err = q.Bind(map[string]any{"age": 30})
+	assert.ErrorContains(t, err, "parameter 'dept' has no value")
+	bq, err := q.Bind(map[string]any{"age": 30, "id": 1, "dept": "D1", "title": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, 30, bq.Wheres[0].Val)
+	assert.Equal(t, []any{1, float64(9)}, bq.Wheres[1].Val)
+	assert.Equal(t, "D1", bq.Joins[0].Wheres[0].Val)
+	assert.Equal(t, "a", bq.Includes["tasks"].Query.Wheres[0].Val)
+	// 原查询不变
+	assert.Equal(t, "${age}", q.Wheres[0].Val)
+	assert.Equal(t, "${dept}", q.Joins[0].Wheres[0].Val)
+}
+
+func TestQuery_BindExpr(t *testing.T) {
+	q := NewQuery(1, nil)
+	assert.NoError(t, q.Parse([]byte(`{"select":["name"],"from":"emp","where":[{"col":"age","op":"expr",`+
+		`"val":{"sql":"${cond}","args":["${age}"]}}]}`)))
+	// sql 中的占位符既不算参数也不替换
+	assert.Equal(t, []string{"age"}, q.Params())
+	assert.ErrorContains(t, q.VerifyParams(), "can not contain parameters")
+	bq, err := q.Bind(map[string]any{"age": 30, "cond": "1=1"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"sql": "${cond}", "args": []any{30}}, bq.Wheres[0].Val)
+}
+
+func TestPartitionLimit_wrap(t *testing.T) {
+	p := &partitionLimit{Col: "emp_idx", Num: 2}
+	sql, args := p.wrap("SELECT title,emp_idx FROM task WHERE emp_idx IN (?,?)", []any{1, 2},
+		[]*Order{{Col: "title", Option: "DESC"}})
+	assert.Equal(t, "SELECT * FROM (SELECT t.*, ROW_NUMBER() OVER (PARTITION BY emp_idx ORDER BY title DESC) AS "+
+		"idig_include_rn FROM (SELECT title,emp_idx FROM task WHERE emp_idx IN (?,?)) t) w "+
+		"WHERE idig_include_rn <= ? ORDER BY idig_include_rn", sql)
+	assert.Equal(t, []any{1, 2, 2}, args)
+}
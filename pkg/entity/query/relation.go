@@ -0,0 +1,37 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"xorm.io/xorm"
+)
+
+// Related 从实体一侧看到的关系另一端：实体的 Key 列与另一端实体的 RelatedKey 列关联，
+// m:n 时经由 Link 关联，Link.Far 引用另一端的 RelatedKey
+type Related struct {
+	Relation   string
+	Key        string
+	Meta       *meta.EntityMeta
+	RelatedKey string
+	// Many 实体的一条记录是否可以关联另一端的多条记录
+	Many bool
+	Link *Link
+}
+
+// RelationResolver 按关系名解析实体 m 一侧的关系
+type RelationResolver func(engine *xorm.Engine, m *meta.EntityMeta, relation string) (*Related, error)
+
+var relationResolver RelationResolver
+
+// RegisterRelationResolver 注册实体关系的解析，由关系所在的包在 init 中注册
+func RegisterRelationResolver(r RelationResolver) {
+	relationResolver = r
+}
+
+func (q *Query) resolveRelated(m *meta.EntityMeta, relation string) (*Related, error) {
+	if relationResolver == nil {
+		return nil, fmt.Errorf("relation '%s': relations not available", relation)
+	}
+	return relationResolver(q.engine, m, relation)
+}
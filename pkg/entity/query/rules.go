@@ -0,0 +1,200 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// CheckRules 按实体的声明式规则检查已转换的 dt，返回所有违规单元格。
+// 规则引用的列不在 dt 中时跳过（更新时未提供的列不检查）；值为 NULL 时只有 unique 以外的规则跳过。
+// db 不为 nil 时 unique 规则还会查询数据库，更新时按主键排除行自身
+func (dt *DataTable) CheckRules(db xorm.Interface, m *meta.EntityMeta, mode int) ([]*CellError, error) {
+	var errs []*CellError
+	for _, r := range m.Rules {
+		if !r.Enabled() {
+			continue
+		}
+		j := dt.FetchColumnIndex(r.Column)
+		if j < 0 || j == dt.resultIdx {
+			continue
+		}
+		var (
+			ruleErrs []*CellError
+			err      error
+		)
+		switch r.Kind {
+		case meta.RuleRegex, meta.RuleRange, meta.RuleCompare:
+			ruleErrs, err = dt.checkRowRule(m, r, j)
+		case meta.RuleUnique:
+			ruleErrs, err = dt.checkUniqueRule(db, m, r, j, mode)
+		default:
+			err = fmt.Errorf("rule '%s': unknown kind '%s'", r.RuleName, r.Kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		errs = append(errs, ruleErrs...)
+	}
+	return errs, nil
+}
+
+func ruleError(r *meta.Rule, row int, def string) *CellError {
+	msg := r.Message
+	if msg == "" {
+		msg = def
+	}
+	return &CellError{Row: row, Col: r.Column, Message: msg}
+}
+
+func (dt *DataTable) checkRowRule(m *meta.EntityMeta, r *meta.Rule, j int) ([]*CellError, error) {
+	other := -1
+	if r.Kind == meta.RuleCompare {
+		if other = dt.FetchColumnIndex(r.Other); other < 0 {
+			return nil, nil
+		}
+	}
+	var errs []*CellError
+	for i, row := range dt.data {
+		v := row[j]
+		if v == nil {
+			continue
+		}
+		switch r.Kind {
+		case meta.RuleRegex:
+			re := r.Regexp()
+			if re == nil {
+				return nil, fmt.Errorf("rule '%s': invalid pattern", r.RuleName)
+			}
+			if !re.MatchString(toText(v)) {
+				errs = append(errs, ruleError(r, i, fmt.Sprintf("'%v' does not match %s", v, r.Pattern)))
+			}
+		case meta.RuleRange:
+			f, ok := toNumber(v)
+			if !ok {
+				errs = append(errs, ruleError(r, i, fmt.Sprintf("'%v' is not a number", v)))
+				continue
+			}
+			if r.Min != nil && f < *r.Min {
+				errs = append(errs, ruleError(r, i, fmt.Sprintf("%v is less than %v", v, *r.Min)))
+			} else if r.Max != nil && f > *r.Max {
+				errs = append(errs, ruleError(r, i, fmt.Sprintf("%v is greater than %v", v, *r.Max)))
+			}
+		case meta.RuleCompare:
+			ov := row[other]
+			if ov == nil {
+				continue
+			}
+			ok, err := compareRule(m, r, v, ov)
+			if err != nil {
+				errs = append(errs, ruleError(r, i, err.Error()))
+			} else if !ok {
+				errs = append(errs, ruleError(r, i, fmt.Sprintf("must be %s %s", r.Op, r.Other)))
+			}
+		}
+	}
+	return errs, nil
+}
+
+// compareRule 数值列按数值比较（定点数转换后为字符串），其余按 compareOrder
+func compareRule(m *meta.EntityMeta, r *meta.Rule, a, b any) (bool, error) {
+	var (
+		c   int
+		err error
+	)
+	if col := m.ColumnIndex[r.Column]; col != nil && col.SQLType.IsNumeric() {
+		fa, ok1 := toNumber(a)
+		fb, ok2 := toNumber(b)
+		if !ok1 || !ok2 {
+			return false, fmt.Errorf("can not compare %v with %v", a, b)
+		}
+		switch {
+		case fa < fb:
+			c = -1
+		case fa > fb:
+			c = 1
+		}
+	} else if c, err = compareOrder(a, b); err != nil {
+		return false, err
+	}
+	switch r.Op {
+	case "eq":
+		return c == 0, nil
+	case "ne":
+		return c != 0, nil
+	case "lt":
+		return c < 0, nil
+	case "lte":
+		return c <= 0, nil
+	case "gt":
+		return c > 0, nil
+	case "gte":
+		return c >= 0, nil
+	}
+	return false, fmt.Errorf("rule '%s': unknown op '%s'", r.RuleName, r.Op)
+}
+
+// checkUniqueRule 先检查本批数据内的重复，再逐行查询数据库
+func (dt *DataTable) checkUniqueRule(db xorm.Interface, m *meta.EntityMeta, r *meta.Rule, j int,
+	mode int) ([]*CellError, error) {
+	scopeIdx := make([]int, len(r.Scope))
+	for k, s := range r.Scope {
+		if scopeIdx[k] = dt.FetchColumnIndex(s); scopeIdx[k] < 0 && mode == ValidateUpdate {
+			// 更新时范围列未提供，无法确定范围
+			return nil, nil
+		}
+	}
+	var pkIdx []int
+	pkCols := m.PrimaryColumn()
+	for _, pk := range pkCols {
+		if idx := dt.FetchColumnIndex(pk); idx >= 0 {
+			pkIdx = append(pkIdx, idx)
+		}
+	}
+	table := m.ColumnIndex[r.Column].TableName
+	seen := map[string]int{}
+	var errs []*CellError
+	for i, row := range dt.data {
+		if row[j] == nil {
+			continue
+		}
+		cond := builder.Eq{r.Column: row[j]}
+		key := []string{toText(row[j])}
+		for k, s := range r.Scope {
+			var sv any
+			if scopeIdx[k] >= 0 {
+				sv = row[scopeIdx[k]]
+			}
+			cond[s] = sv
+			key = append(key, fmt.Sprintf("%T:%v", sv, sv))
+		}
+		k := strings.Join(key, "\x00")
+		if first, dup := seen[k]; dup {
+			errs = append(errs, ruleError(r, i, fmt.Sprintf("'%v' duplicates row %d", row[j], first+1)))
+			continue
+		}
+		seen[k] = i
+		if db == nil {
+			continue
+		}
+		var where builder.Cond = cond
+		if mode == ValidateUpdate && len(pkIdx) == len(pkCols) {
+			self := builder.Eq{}
+			for n, idx := range pkIdx {
+				self[pkCols[n]] = row[idx]
+			}
+			where = builder.And(cond, builder.Not{self})
+		}
+		exist, err := db.Table(table).Where(where).Exist()
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %w", r.RuleName, err)
+		}
+		if exist {
+			errs = append(errs, ruleError(r, i, fmt.Sprintf("'%v' already exists", row[j])))
+		}
+	}
+	return errs, nil
+}
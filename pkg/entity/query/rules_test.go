@@ -0,0 +1,72 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+func TestDataTable_CheckRules(t *testing.T) {
+	m := newValidateMeta()
+	t0 := m.AttrTables["emp"]
+	for _, name := range []string{"start_date", "end_date"} {
+		c := schemas.NewColumn(name, name, schemas.SQLType{Name: schemas.Date}, 0, 0, true)
+		c.TableName = "emp"
+		t0.AddColumn(c)
+		m.ColumnIndex[name] = c
+	}
+	min, max := 1.0, 3.0
+	m.Rules = []*meta.Rule{
+		{RuleName: "name_fmt", Kind: meta.RuleRegex, Column: "name", Pattern: `^[a-z]+$`},
+		{RuleName: "id_range", Kind: meta.RuleRange, Column: "id", Min: &min, Max: &max, Message: "id out of range"},
+		{RuleName: "period", Kind: meta.RuleCompare, Column: "end_date", Op: "gte", Other: "start_date"},
+		{RuleName: "name_in_level", Kind: meta.RuleUnique, Column: "name", Scope: []string{"level"}},
+		{RuleName: "off", Kind: meta.RuleRegex, Column: "name", Pattern: `^x$`, Status: meta.RuleStatusDisabled},
+	}
+	for _, r := range m.Rules {
+		require.NoError(t, r.Verify(m))
+	}
+
+	db, err := xorm.NewEngine("sqlite3", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("CREATE TABLE emp (id INTEGER PRIMARY KEY, name TEXT, level TEXT); INSERT INTO emp VALUES (1, 'ann', 'senior')")
+	require.NoError(t, err)
+
+	dt := NewDataTable()
+	require.NoError(t, dt.ParseValues([]byte(`{"cols":["id","name","level","start_date","end_date"],"vals":[
+		[2,"bob","junior","2024-01-01","2024-02-01"],
+		[5,"Bob","junior","2024-03-01","2024-02-01"],
+		[3,"bob","junior",null,"2024-02-01"],
+		[4,"ann","senior",null,null]
+	]}`)))
+	errs, err := dt.ValidateAll(db, m, ValidateInsert)
+	require.NoError(t, err)
+	got := map[int]map[string]string{}
+	for _, e := range errs {
+		if got[e.Row] == nil {
+			got[e.Row] = map[string]string{}
+		}
+		got[e.Row][e.Col] = e.Message
+	}
+	assert.Empty(t, got[0])
+	assert.Contains(t, got[1]["name"], "does not match")
+	assert.Equal(t, "id out of range", got[1]["id"])
+	assert.Equal(t, "must be gte start_date", got[1]["end_date"])
+	assert.Equal(t, "'bob' duplicates row 1", got[2]["name"])
+	assert.Equal(t, "id out of range", got[3]["id"])
+	assert.Equal(t, "'ann' already exists", got[3]["name"])
+
+	// 更新行自身不算重复
+	up := NewDataTable()
+	require.NoError(t, up.ParseValues([]byte(`{"vals":{"id":1,"name":"ann","level":"senior"}}`)))
+	errs, err = up.ValidateAll(db, m, ValidateUpdate)
+	require.NoError(t, err)
+	assert.Empty(t, errs)
+}
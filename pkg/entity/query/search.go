@@ -0,0 +1,236 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/goccy/go-json"
+	"xorm.io/builder"
+)
+
+const (
+	SearchRank      = "search_rank" // 检索的相关度输出列，越大越相关
+	HighlightSuffix = "_highlight"  // 高亮输出列为检索列名加此后缀
+	searchAlias     = "search"      // SQLite 检索子查询的别名
+	searchKey       = "search_key"  // SQLite 检索子查询中的主键列
+)
+
+// Search 全文检索实体声明的检索列：{"search": "text"} 或
+// {"search": {"text": "...", "highlight": true | {"cols": [...], "pre": "<b>", "post": "</b>"}}}。
+// 输出相关度列 search_rank，未指定排序时按相关度降序；高亮时每个检索列输出 <col>_highlight，
+// 缺省高亮所有检索列。SQLite 以 FTS5 影子表检索，各词都须出现，词以 * 结尾时为前缀匹配；
+// MySQL 以各表的 FULLTEXT 索引按自然语言模式检索，高亮区分大小写
+type Search struct {
+	Text      string     `json:"text"`
+	Highlight *Highlight `json:"highlight,omitempty"`
+}
+
+// Highlight 高亮检索词，pre 与 post 缺省为 <b> 与 </b>
+type Highlight struct {
+	Cols []string `json:"cols,omitempty"`
+	Pre  string   `json:"pre,omitempty"`
+	Post string   `json:"post,omitempty"`
+}
+
+func (s *Search) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &s.Text)
+	}
+	var raw struct {
+		Text      string          `json:"text"`
+		Highlight json.RawMessage `json:"highlight"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	s.Text = raw.Text
+	var on bool
+	if err := json.Unmarshal(raw.Highlight, &on); err == nil {
+		if on {
+			s.Highlight = &Highlight{}
+		}
+	} else if raw.Highlight != nil {
+		s.Highlight = &Highlight{}
+		if err = json.Unmarshal(raw.Highlight, s.Highlight); err != nil {
+			return fmt.Errorf("search highlight: %w", err)
+		}
+	}
+	return nil
+}
+
+func parseSearch(data []byte) (*Search, error) {
+	if data == nil {
+		return nil, nil
+	}
+	s := &Search{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if err := s.Verify(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Search) Verify() error {
+	if len(s.terms()) == 0 {
+		return errors.New("search text is required")
+	}
+	return nil
+}
+
+// terms 检索词，去掉引号及 FTS 与 FULLTEXT 的运算符
+func (s *Search) terms() []string {
+	var terms []string
+	for _, f := range strings.Fields(s.Text) {
+		prefix := strings.HasSuffix(f, "*")
+		f = strings.Trim(f, `"'+-~<>()*`)
+		if f == "" {
+			continue
+		}
+		if prefix {
+			f += "*"
+		}
+		terms = append(terms, f)
+	}
+	return terms
+}
+
+// highlightCols 高亮的列，未指定时为所有检索列
+func (s *Search) highlightCols(m *meta.EntityMeta) ([]string, error) {
+	if s.Highlight == nil {
+		return nil, nil
+	}
+	if len(s.Highlight.Cols) == 0 {
+		return m.SearchColumns(), nil
+	}
+	for _, c := range s.Highlight.Cols {
+		if !slices.Contains(m.SearchColumns(), c) {
+			return nil, fmt.Errorf("highlight column '%s' is not a search column of entity '%s'", c, m.Entity.EntityName)
+		}
+	}
+	return s.Highlight.Cols, nil
+}
+
+func (s *Search) headers(m *meta.EntityMeta) []string {
+	headers := []string{SearchRank}
+	cols, _ := s.highlightCols(m)
+	for _, c := range cols {
+		headers = append(headers, c+HighlightSuffix)
+	}
+	return headers
+}
+
+func (s *Search) marks() (string, string) {
+	pre, post := "<b>", "</b>"
+	if s.Highlight != nil && s.Highlight.Pre != "" {
+		pre = s.Highlight.Pre
+	}
+	if s.Highlight != nil && s.Highlight.Post != "" {
+		post = s.Highlight.Post
+	}
+	return pre, post
+}
+
+// searchPlan 按方言生成的检索：SQLite 为关联的子查询，MySQL 为条件；
+// items 为输出列，cols 为 MySQL 中条件引用的检索列，其所在的属性表需关联
+type searchPlan struct {
+	items []string
+	join  *builder.Builder
+	on    string
+	cond  builder.Cond
+	cols  []string
+}
+
+func (s *Search) plan(m *meta.EntityMeta, driver string) (*searchPlan, error) {
+	cols := m.SearchColumns()
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("entity '%s' has no search columns", m.Entity.EntityName)
+	}
+	hl, err := s.highlightCols(m)
+	if err != nil {
+		return nil, err
+	}
+	pre, post := s.marks()
+	p := &searchPlan{}
+	switch {
+	case meta.IsSQLite(driver):
+		fts := m.SearchTable()
+		items := []string{fmt.Sprintf("%s AS %s", m.Entity.PkAttrColumn, searchKey),
+			fmt.Sprintf("-bm25(%s) AS %s", fts, SearchRank)}
+		for _, c := range hl {
+			items = append(items, fmt.Sprintf("highlight(%s, %d, %s, %s) AS %s%s", fts, slices.Index(cols, c)+1,
+				quoteLiteral(driver, pre), quoteLiteral(driver, post), c, HighlightSuffix))
+		}
+		p.join = builder.Dialect(driver).Select(items...).From(fts).
+			Where(builder.Expr(fts+" MATCH ?", s.matchExpr()))
+		p.on = fmt.Sprintf("%s.%s = %s.%s", searchAlias, searchKey, m.PrimaryTable(), m.Entity.PkAttrColumn)
+		p.items = append(p.items, searchAlias+"."+SearchRank+" AS "+SearchRank)
+		for _, c := range hl {
+			p.items = append(p.items, searchAlias+"."+c+HighlightSuffix+" AS "+c+HighlightSuffix)
+		}
+	case driver == "mysql":
+		tables, groups := m.SearchTables()
+		p.cols = cols
+		var ranks []string
+		conds := builder.NewCond()
+		for _, t := range tables {
+			qualified := make([]string, len(groups[t]))
+			for i, c := range groups[t] {
+				qualified[i] = t + "." + c
+			}
+			match := fmt.Sprintf("MATCH (%s) AGAINST (%%s IN NATURAL LANGUAGE MODE)", strings.Join(qualified, ", "))
+			conds = conds.Or(builder.Expr(fmt.Sprintf(match, "?"), s.Text))
+			ranks = append(ranks, fmt.Sprintf(match, quoteLiteral(driver, s.Text)))
+		}
+		p.cond = conds
+		p.items = append(p.items, fmt.Sprintf("(%s) AS %s", strings.Join(ranks, " + "), SearchRank))
+		for _, c := range hl {
+			expr := m.FetchTableNameByColumn(c) + "." + c
+			for _, term := range s.terms() {
+				term = strings.TrimSuffix(term, "*")
+				expr = fmt.Sprintf("REPLACE(%s, %s, %s)", expr, quoteLiteral(driver, term),
+					quoteLiteral(driver, pre+term+post))
+			}
+			p.items = append(p.items, expr+" AS "+c+HighlightSuffix)
+		}
+	default:
+		return nil, fmt.Errorf("%w on %s", meta.ErrSearchUnsupported, driver)
+	}
+	return p, nil
+}
+
+// matchExpr FTS5 的检索表达式：各词以双引号引起作为短语，避免词中的符号被解析为运算符
+func (s *Search) matchExpr() string {
+	terms := s.terms()
+	for i, t := range terms {
+		prefix := strings.HasSuffix(t, "*")
+		t = `"` + strings.ReplaceAll(strings.TrimSuffix(t, "*"), `"`, `""`) + `"`
+		if prefix {
+			t += "*"
+		}
+		terms[i] = t
+	}
+	return strings.Join(terms, " ")
+}
+
+// build 关联检索子查询或增加检索条件，返回需加入 where 的条件
+func (p *searchPlan) build(bld *builder.Builder) builder.Cond {
+	if p.join != nil {
+		bld.InnerJoin(builder.As(p.join, searchAlias), p.on)
+		return nil
+	}
+	return p.cond
+}
+
+// quoteLiteral 字符串字面量，用于不能绑定参数的输出列
+func quoteLiteral(driver, s string) string {
+	s = strings.ReplaceAll(s, "'", "''")
+	if driver == "mysql" {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + s + "'"
+}
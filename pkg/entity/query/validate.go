@@ -0,0 +1,168 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+// 校验模式
+const (
+	ValidateInsert = iota // 插入：检查未提供的必填列
+	ValidateUpdate        // 更新：只检查提供的列
+)
+
+// InvalidPrefix 校验失败时 #result 的前缀
+const InvalidPrefix = "invalid: "
+
+// ValidateValue 校验已转换的值：非空、长度与枚举选项
+func ValidateValue(col *schemas.Column, v any) error {
+	if v == nil {
+		if !col.Nullable {
+			return fmt.Errorf("must not be null")
+		}
+		return nil
+	}
+	s, isText := v.(string)
+	if !isText {
+		return nil
+	}
+	if len(col.EnumOptions) > 0 {
+		if _, ok := col.EnumOptions[s]; !ok {
+			return fmt.Errorf("'%s' is not one of %s", s, optionNames(col.EnumOptions))
+		}
+	}
+	if len(col.SetOptions) > 0 {
+		for _, opt := range strings.Split(s, ",") {
+			if _, ok := col.SetOptions[opt]; !ok {
+				return fmt.Errorf("'%s' is not one of %s", opt, optionNames(col.SetOptions))
+			}
+		}
+	}
+	if col.SQLType.IsText() {
+		if l := columnLength(col); l > 0 && int64(utf8.RuneCountInString(s)) > l {
+			return fmt.Errorf("length %d exceeds %d", utf8.RuneCountInString(s), l)
+		}
+	}
+	return nil
+}
+
+func columnLength(col *schemas.Column) int64 {
+	if col.Length > 0 {
+		return col.Length
+	}
+	return col.SQLType.DefaultLength
+}
+
+func optionNames(opts map[string]int) string {
+	names := make([]string, 0, len(opts))
+	for k := range opts {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool { return opts[names[i]] < opts[names[j]] })
+	return "[" + strings.Join(names, ",") + "]"
+}
+
+// requiredOnInsert 插入时必须提供值的列：非空、无默认值、非自增
+func requiredOnInsert(col *schemas.Column) bool {
+	return !col.Nullable && col.Default == "" && !col.IsAutoIncrement
+}
+
+// Validate 按实体列类型原地转换 dt 中的值，并检查非空、长度和枚举；
+// 插入时还检查所写入表中未提供的必填列。主键列由写入逻辑单独处理。
+// 返回所有违规的单元格，按行、列顺序排列
+func (dt *DataTable) Validate(m *meta.EntityMeta, mode int) []*CellError {
+	errs := dt.Coerce(m)
+	bad := make(map[[2]int]bool, len(errs))
+	for _, e := range errs {
+		bad[[2]int{e.Row, dt.FetchColumnIndex(e.Col)}] = true
+	}
+	pks := map[string]bool{}
+	for _, pk := range m.PrimaryColumn() {
+		pks[pk] = true
+	}
+	autoIncr := m.HasAutoIncrement()
+	var missing []string
+	tables := map[string]bool{}
+	for j, name := range dt.cols {
+		col := m.ColumnIndex[name]
+		if j == dt.resultIdx || col == nil {
+			continue
+		}
+		tables[col.TableName] = true
+	}
+	if mode == ValidateInsert {
+		tables[m.PrimaryTable()] = true
+		for t := range tables {
+			schema, ok := m.AttrTables[t]
+			if !ok {
+				continue
+			}
+			for _, col := range schema.Columns() {
+				if pks[col.Name] || dt.FetchColumnIndex(col.Name) >= 0 || !requiredOnInsert(col) {
+					continue
+				}
+				missing = append(missing, col.Name)
+			}
+		}
+		sort.Strings(missing)
+	}
+	for i, row := range dt.data {
+		for j, name := range dt.cols {
+			col := m.ColumnIndex[name]
+			if j == dt.resultIdx || col == nil || bad[[2]int{i, j}] {
+				continue
+			}
+			// 自增主键插入时为空表示由数据库生成
+			if row[j] == nil && pks[name] && (autoIncr || mode == ValidateUpdate) {
+				continue
+			}
+			if err := ValidateValue(col, row[j]); err != nil {
+				errs = append(errs, &CellError{Row: i, Col: name, Message: err.Error()})
+			}
+		}
+		for _, name := range missing {
+			errs = append(errs, &CellError{Row: i, Col: name, Message: "required"})
+		}
+	}
+	sort.SliceStable(errs, func(a, b int) bool { return errs[a].Row < errs[b].Row })
+	return errs
+}
+
+// ValidateAll 依次执行 Validate 和 CheckRules，已有类型或约束错误的单元格不再报告规则错误
+func (dt *DataTable) ValidateAll(db xorm.Interface, m *meta.EntityMeta, mode int) ([]*CellError, error) {
+	errs := dt.Validate(m, mode)
+	ruleErrs, err := dt.CheckRules(db, m, mode)
+	if err != nil {
+		return nil, err
+	}
+	bad := make(map[string]bool, len(errs))
+	for _, e := range errs {
+		bad[fmt.Sprintf("%d\x00%s", e.Row, e.Col)] = true
+	}
+	for _, e := range ruleErrs {
+		if !bad[fmt.Sprintf("%d\x00%s", e.Row, e.Col)] {
+			errs = append(errs, e)
+		}
+	}
+	sort.SliceStable(errs, func(a, b int) bool { return errs[a].Row < errs[b].Row })
+	return errs, nil
+}
+
+// ReportErrors 将错误按行写入 #result，格式为 "invalid: col: msg; col: msg"，返回出错的行数
+func (dt *DataTable) ReportErrors(errs []*CellError) int {
+	msgs := map[int][]string{}
+	for _, e := range errs {
+		msgs[e.Row] = append(msgs[e.Row], e.Col+": "+e.Message)
+	}
+	dt.AddResultColumn()
+	for row, ms := range msgs {
+		_ = dt.UpdateResult(row, InvalidPrefix+strings.Join(ms, "; "))
+	}
+	return len(msgs)
+}
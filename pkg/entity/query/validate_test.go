@@ -0,0 +1,85 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm/schemas"
+)
+
+func newValidateMeta() *meta.EntityMeta {
+	col := func(name, typ string, length int64, nullable bool) *schemas.Column {
+		return schemas.NewColumn(name, name, schemas.SQLType{Name: typ}, length, 0, nullable)
+	}
+	t0 := schemas.NewEmptyTable()
+	t0.Name = "emp"
+	id := col("id", schemas.BigInt, 0, false)
+	id.IsPrimaryKey, id.IsAutoIncrement = true, true
+	t0.AddColumn(id)
+	t0.PrimaryKeys = []string{"id"}
+	t0.AddColumn(col("name", schemas.Varchar, 4, false))
+	level := col("level", schemas.Enum, 0, true)
+	level.EnumOptions = map[string]int{"junior": 0, "senior": 1}
+	t0.AddColumn(level)
+	t0.AddColumn(col("hired", schemas.Date, 0, true))
+	active := col("active", schemas.Bool, 0, false)
+	active.Default = "1"
+	t0.AddColumn(active)
+
+	m := &meta.EntityMeta{
+		Entity:     &meta.Entity{EntityName: "emp", PkAttrTable: "emp", PkAttrColumn: "id"},
+		AttrTables: map[string]*schemas.Table{"emp": t0},
+	}
+	m.ColumnIndex = map[string]*schemas.Column{}
+	for _, c := range t0.Columns() {
+		c.TableName = "emp"
+		m.ColumnIndex[c.Name] = c
+	}
+	return m
+}
+
+func TestDataTable_Validate(t *testing.T) {
+	m := newValidateMeta()
+	dt := NewDataTable()
+	require.NoError(t, dt.ParseValues([]byte(`{"cols":["name","level","hired","active"],"vals":[
+		["tom","senior","2024/3/1","yes"],
+		["jerry","boss","someday",null],
+		[null,"junior",null,true]
+	]}`)))
+	dt.AddResultColumn()
+
+	errs := dt.Validate(m, ValidateInsert)
+	got := map[int][]string{}
+	for _, e := range errs {
+		got[e.Row] = append(got[e.Row], e.Col)
+	}
+	assert.Empty(t, got[0])
+	assert.ElementsMatch(t, []string{"name", "level", "hired", "active"}, got[1])
+	assert.ElementsMatch(t, []string{"name"}, got[2])
+
+	idx := dt.FetchColumnIndex("hired")
+	assert.Equal(t, "2024-03-01", dt.Values()[0][idx])
+	assert.Equal(t, true, dt.Values()[0][dt.FetchColumnIndex("active")])
+
+	assert.Equal(t, 2, dt.ReportErrors(errs))
+	res := dt.Values()[1][dt.FetchColumnIndex(ResultColumn)].(string)
+	assert.Contains(t, res, InvalidPrefix)
+	assert.Contains(t, res, "name: length 5 exceeds 4")
+	assert.Contains(t, res, "level: 'boss' is not one of [junior,senior]")
+	assert.Nil(t, dt.Values()[0][dt.FetchColumnIndex(ResultColumn)])
+
+	// 插入时未提供的必填列，有默认值的列除外
+	ins := NewDataTable()
+	require.NoError(t, ins.ParseValues([]byte(`{"vals":{"level":"junior"}}`)))
+	errs = ins.Validate(m, ValidateInsert)
+	require.Len(t, errs, 1)
+	assert.Equal(t, &CellError{Row: 0, Col: "name", Message: "required"}, errs[0])
+
+	// 更新时不检查未提供的列
+	up := NewDataTable()
+	require.NoError(t, up.ParseValues([]byte(`{"vals":{"id":1,"level":"junior"}}`)))
+	assert.Empty(t, up.Validate(m, ValidateUpdate))
+	assert.Equal(t, int64(1), up.Values()[0][up.FetchColumnIndex("id")])
+}
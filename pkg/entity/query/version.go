@@ -0,0 +1,61 @@
+package query
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"xorm.io/xorm/schemas"
+)
+
+// ConflictPrefix 版本冲突时 #result 的前缀
+const ConflictPrefix = "conflict: "
+
+// VersionColumn 更新 dt 时检查的乐观锁版本列：实体声明的版本列；未声明时若 dt 给出了时间列 updated_at，
+// 则以其值为期望的版本，该列为空的行不检查。须在填充默认值之前取得
+func (dt *DataTable) VersionColumn(m *meta.EntityMeta) *schemas.Column {
+	if ver := m.VersionColumn(); ver != nil {
+		return ver
+	}
+	col := m.ColumnIndex[meta.UpdatedAtColumn]
+	if col == nil || !col.SQLType.IsTime() || dt.FetchColumnIndex(col.Name) < 0 {
+		return nil
+	}
+	return col
+}
+
+// CheckVersion 实体声明了版本列时，更新的每一行都必须提供读取时的版本
+func (dt *DataTable) CheckVersion(m *meta.EntityMeta) []*CellError {
+	ver := m.VersionColumn()
+	if ver == nil {
+		return nil
+	}
+	j := dt.FetchColumnIndex(ver.Name)
+	var errs []*CellError
+	for i, row := range dt.data {
+		if j < 0 || row[j] == nil {
+			errs = append(errs, &CellError{Row: i, Col: ver.Name, Message: "expected version required"})
+		}
+	}
+	return errs
+}
+
+// NextVersion 返回版本列的新值：数值列为 old + 1，时间列为 now
+func NextVersion(col *schemas.Column, old any, now time.Time) (any, error) {
+	if col.SQLType.IsTime() {
+		return CoerceValue(col, now)
+	}
+	n, ok := toNumber(old)
+	if !ok {
+		return nil, fmt.Errorf("version '%v' is not a number", old)
+	}
+	return CoerceValue(col, n+1)
+}
+
+// initialVersion 插入时版本列的初始值：数值列为 1，时间列为 now
+func initialVersion(col *schemas.Column, now time.Time) any {
+	if col.SQLType.IsTime() {
+		return now
+	}
+	return int64(1)
+}
@@ -0,0 +1,70 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm/schemas"
+)
+
+func TestNextVersion(t *testing.T) {
+	now := time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local)
+	intCol := schemas.NewColumn("version", "version", schemas.SQLType{Name: schemas.Int}, 0, 0, false)
+	timeCol := schemas.NewColumn("updated_at", "updated_at", schemas.SQLType{Name: schemas.DateTime}, 0, 0, false)
+
+	v, err := NextVersion(intCol, int64(3), now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), v)
+	v, err = NextVersion(timeCol, "2024-04-01 00:00:00", now)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-05-01 08:30:00", v)
+	_, err = NextVersion(intCol, "abc", now)
+	assert.Error(t, err)
+}
+
+func TestDataTable_CheckVersion(t *testing.T) {
+	m := newValidateMeta()
+	ver := schemas.NewColumn("version", "version", schemas.SQLType{Name: schemas.Int}, 0, 0, false)
+	ver.TableName = "emp"
+	m.AttrTables["emp"].AddColumn(ver)
+	m.ColumnIndex["version"] = ver
+
+	dt := NewDataTable()
+	require.NoError(t, dt.ParseValues([]byte(`{"cols":["id","version"],"vals":[[1,2],[2,null]]}`)))
+	assert.Empty(t, dt.CheckVersion(m), "version column not declared")
+
+	m.Entity.VersionColumn = "version"
+	errs := dt.CheckVersion(m)
+	require.Len(t, errs, 1)
+	assert.Equal(t, 1, errs[0].Row)
+
+	// 插入时初始化版本列
+	ins := NewDataTable()
+	require.NoError(t, ins.ParseValues([]byte(`{"cols":["name"],"vals":[["tom"]]}`)))
+	require.NoError(t, ins.ApplyDefaults(nil, m, ValidateInsert, nil))
+	assert.Equal(t, int64(1), ins.Values()[0][ins.FetchColumnIndex("version")])
+}
+
+func TestDataTable_VersionColumn(t *testing.T) {
+	m := newValidateMeta()
+	at := schemas.NewColumn("updated_at", "updated_at", schemas.SQLType{Name: schemas.DateTime}, 0, 0, true)
+	at.TableName = "emp"
+	m.AttrTables["emp"].AddColumn(at)
+	m.ColumnIndex["updated_at"] = at
+
+	dt := NewDataTable()
+	require.NoError(t, dt.ParseValues([]byte(`{"cols":["id","name"],"vals":[[1,"tom"]]}`)))
+	assert.Nil(t, dt.VersionColumn(m), "updated_at not given")
+	dt.AddColumn("updated_at")
+	assert.Same(t, at, dt.VersionColumn(m))
+	assert.Empty(t, dt.CheckVersion(m), "updated_at is optional")
+
+	ver := schemas.NewColumn("version", "version", schemas.SQLType{Name: schemas.Int}, 0, 0, false)
+	ver.TableName = "emp"
+	m.AttrTables["emp"].AddColumn(ver)
+	m.ColumnIndex["version"] = ver
+	m.Entity.VersionColumn = "version"
+	assert.Same(t, ver, dt.VersionColumn(m))
+}
@@ -0,0 +1,69 @@
+package query
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+func TestQuery_VirtualAttr(t *testing.T) {
+	db, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "virtual.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, meta.InitEntityTable(db))
+	_, err = db.Exec(`CREATE TABLE vq_person (id INTEGER PRIMARY KEY AUTOINCREMENT, first TEXT, last TEXT);
+		CREATE TABLE vq_person_ext (id INTEGER PRIMARY KEY, birth_year INT);
+		INSERT INTO vq_person (first, last) VALUES ('ada', 'lovelace'), ('alan', 'turing'), ('grace', 'hopper');
+		INSERT INTO vq_person_ext VALUES (1, 1990), (2, 2000), (3, 1980);`)
+	require.NoError(t, err)
+	_, err = meta.RegisterEntity(db, "vq_person", "", "vq_person", "id")
+	require.NoError(t, err)
+	_, err = meta.AddEntityAttrGroupByName(db, "vq_person", "ext", "vq_person_ext")
+	require.NoError(t, err)
+
+	require.NoError(t, meta.AddVirtualAttr(db, "vq_person", &meta.VirtualAttr{Name: "full_name", Expr: "first || ' ' || last"}))
+	require.NoError(t, meta.AddVirtualAttr(db, "vq_person", &meta.VirtualAttr{Name: "age", Expr: "2024 - birth_year", Type: "int"}))
+	assert.ErrorContains(t, meta.AddVirtualAttr(db, "vq_person", &meta.VirtualAttr{Name: "first", Expr: "last"}), "conflicts")
+	assert.ErrorContains(t, meta.AddVirtualAttr(db, "vq_person", &meta.VirtualAttr{Name: "x", Expr: "1; drop table vq_person"}), "single expression")
+	assert.ErrorContains(t, meta.AddVirtualAttr(db, "vq_person", &meta.VirtualAttr{Name: "x", Expr: "'first'"}), "references no column")
+
+	m, err := meta.AcquireMeta("vq_person", db)
+	require.NoError(t, err)
+	require.Len(t, m.Virtuals, 2)
+	assert.Equal(t, []string{"birth_year"}, m.Virtuals["age"].Deps())
+	jm := m.ToJMeta()
+	require.Len(t, jm.Virtual, 2)
+	assert.Equal(t, "age", jm.Virtual[0].Name)
+	assert.True(t, jm.Virtual[0].ReadOnly)
+
+	// age 只出现在过滤和排序中，仍需关联 vq_person_ext
+	q := NewQuery(0, db)
+	require.NoError(t, q.Parse([]byte(`{"select":["id",{"col":"full_name","alias":"name"}],
+		"from":"vq_person","where":[{"col":"age","op":"gte","val":30}],"order":[{"col":"age","opt":"desc"}]}`)))
+	bld := builder.Dialect(db.DriverName())
+	require.NoError(t, q.BuildSQL(bld))
+	sql, err := bld.ToBoundSQL()
+	require.NoError(t, err)
+	rows, err := db.QueryString(sql)
+	require.NoError(t, err, sql)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "grace hopper", rows[0]["name"])
+	assert.Equal(t, "ada lovelace", rows[1]["name"])
+	assert.Equal(t, []string{"id", "name"}, q.Headers())
+
+	dt := NewDataTable()
+	require.NoError(t, dt.ParseValues([]byte(`{"vals":{"id":1,"full_name":"x"}}`)))
+	_, err = dt.DivisionColumnsKeyVal(m)
+	assert.ErrorIs(t, err, meta.ErrReadOnlyAttr)
+
+	require.NoError(t, meta.DeleteVirtualAttr(db, "vq_person", "age"))
+	m, err = meta.AcquireMeta("vq_person", db)
+	require.NoError(t, err)
+	assert.False(t, m.IsVirtual("age"))
+}
@@ -127,6 +127,13 @@ func (w *Where) ToCond() (builder.Cond, error) {
 		cond = builder.IsNull{w.Col}
 	case "notnull":
 		cond = builder.NotNull{w.Col}
+	case OpLink, opCond:
+		// 查询时由 resolveLinks、关联解析为 builder.Cond
+		c, ok := w.Val.(builder.Cond)
+		if !ok {
+			return nil, fmt.Errorf("link condition on '%s' is not resolved", w.Col)
+		}
+		cond = c
 	case "between":
 		bv, ok := w.Val.([]any)
 		if ok && len(bv) > 1 {
@@ -0,0 +1,69 @@
+package entity
+
+import (
+	"fmt"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"xorm.io/xorm"
+)
+
+func init() {
+	query.RegisterRelationResolver(ResolveRelated)
+}
+
+// NewQuery 返回实体 name 的查询构造器；查询中的关联与 link 条件由持久化的实体关系解析，
+// 以库的方式使用时经由本包构造以确保关系解析已注册
+func NewQuery(engine *xorm.Engine, name string) *query.Builder {
+	return query.NewBuilder(engine, name)
+}
+
+// ResolveRelated 实体 m 为关系的左实体时另一端为右实体，反之为左实体；自关联时按左实体处理
+func ResolveRelated(engine *xorm.Engine, m *meta.EntityMeta, name string) (*query.Related, error) {
+	return relatedOf(engine, m, name, false)
+}
+
+// relatedOf 同 ResolveRelated，reverse 时自关联按右实体处理，即沿关系的反方向
+func relatedOf(engine *xorm.Engine, m *meta.EntityMeta, name string, reverse bool) (*query.Related, error) {
+	rels, err := EntityRelations(engine, m.Entity.EntityIdx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rels {
+		if r.RelationName != name {
+			continue
+		}
+		if reverse && r.EntityLeft != r.EntityRight {
+			return nil, fmt.Errorf("relation '%s': reverse only applies to self relations", name)
+		}
+		rel := &query.Related{Relation: name}
+		var other string
+		left := m.Entity.EntityIdx == r.EntityLeft && !reverse
+		switch {
+		case left:
+			rel.Key, rel.RelatedKey, other = r.LeftKey, r.RightKey, r.RightEntity
+			rel.Many = r.RelationType == OneToMany || r.RelationType == ManyToMany
+		case m.Entity.EntityIdx == r.EntityRight:
+			rel.Key, rel.RelatedKey, other = r.RightKey, r.LeftKey, r.LeftEntity
+			rel.Many = r.RelationType == ManyToOne || r.RelationType == ManyToMany
+		default:
+			return nil, fmt.Errorf("relation '%s' does not relate entity '%s'", name, m.Entity.EntityName)
+		}
+		if rel.Meta, err = meta.AcquireMeta(other, engine); err != nil {
+			return nil, err
+		}
+		if r.RelationType == ManyToMany {
+			link, err1 := meta.AcquireMeta(r.LinkEntity, engine)
+			if err1 != nil {
+				return nil, err1
+			}
+			rel.Link = &query.Link{Key: rel.Key, Table: link.PrimaryTable(), Meta: link,
+				Near: r.LinkLeftKey, Far: r.LinkRightKey}
+			if !left {
+				rel.Link.Near, rel.Link.Far = r.LinkRightKey, r.LinkLeftKey
+			}
+		}
+		return rel, nil
+	}
+	return nil, fmt.Errorf("%w: '%s' of entity '%s'", ErrRelationNotFound, name, m.Entity.EntityName)
+}
@@ -1,27 +1,95 @@
 package entity
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
 	"github.com/everpan/idig/pkg/core"
 	"github.com/everpan/idig/pkg/entity/meta"
-	"sync"
 	"xorm.io/xorm"
 )
 
+// RelationType 实体关系的基数，1:1、1:m 时左实体为主实体，m:1 时右实体为主实体；
+// m:n 通过链接实体关联，链接实体的 LinkLeftKey、LinkRightKey 分别引用左右实体的关联键
+type RelationType string
+
+const (
+	OneToOne   RelationType = "1:1"
+	OneToMany  RelationType = "1:m"
+	ManyToOne  RelationType = "m:1"
+	ManyToMany RelationType = "m:n"
+)
+
+// Valid 是否为已知的关系类型
+func (t RelationType) Valid() bool {
+	switch t {
+	case OneToOne, OneToMany, ManyToOne, ManyToMany:
+		return true
+	}
+	return false
+}
+
 type Relation struct {
-	RelationIdx  uint32 `xorm:"pk autoincr"`
-	RelationName string `xorm:"unique"`
-	Description  string `xorm:"relation_desc text"`
-	EntityLeft   uint32
-	EntityRight  uint32
-	LeftKey      string
-	RightKey     string
-	RelationType string // 1:1,1:m,m:1
+	RelationIdx  uint32       `json:"relation_idx" xorm:"pk autoincr"`
+	RelationName string       `json:"relation_name" xorm:"unique"`
+	Description  string       `json:"desc" xorm:"relation_desc text"`
+	EntityLeft   uint32       `json:"entity_left"`
+	EntityRight  uint32       `json:"entity_right"`
+	LeftKey      string       `json:"left_key"`
+	RightKey     string       `json:"right_key"`
+	RelationType RelationType `json:"relation_type"` // 1:1,1:m,m:1,m:n
+	// CascadePolicy 主实体删除或关联键变更时对从属实体的处理，为空时同 CascadeRestrict；
+	// m:n 时左右实体都是链接实体的主实体
+	CascadePolicy string `json:"cascade_policy,omitempty" xorm:"varchar(16)"`
+	// EntityLink m:n 的链接实体，LinkLeftKey、LinkRightKey 为其主表中引用左右实体的列，其余列为链接属性
+	EntityLink   uint32 `json:"entity_link,omitempty"`
+	LinkLeftKey  string `json:"link_left_key,omitempty"`
+	LinkRightKey string `json:"link_right_key,omitempty"`
+	// LeftEntity、RightEntity、LinkEntity 为实体名，创建时可代替 EntityLeft、EntityRight、EntityLink
+	LeftEntity  string `json:"left_entity,omitempty" xorm:"-"`
+	RightEntity string `json:"right_entity,omitempty" xorm:"-"`
+	LinkEntity  string `json:"link_entity,omitempty" xorm:"-"`
 }
 
+// 关系的级联策略。从属实体以自身的关联键引用主实体的关联键
+const (
+	CascadeRestrict   = "restrict"    // 存在从属记录时拒绝删除或变更
+	CascadeDelete     = "cascade"     // 删除从属记录；关联键变更时同步更新从属记录的关联键
+	CascadeSetNull    = "set_null"    // 从属记录的关联键置为 NULL
+	CascadeSoftDelete = "soft_delete" // 设置从属实体的软删除标记列
+)
+
+// ErrRelationNotFound 关系不存在
+var ErrRelationNotFound = errors.New("relation not found")
+
 func (r *Relation) TableName() string {
 	return "idig_entity_relation"
 }
 
+// ends 返回主实体、从属实体及各自的关联键，m:n 的两端见 links
+func (r *Relation) ends() (parent, child uint32, parentKey, childKey string, err error) {
+	switch r.RelationType {
+	case OneToOne, OneToMany:
+		return r.EntityLeft, r.EntityRight, r.LeftKey, r.RightKey, nil
+	case ManyToOne:
+		return r.EntityRight, r.EntityLeft, r.RightKey, r.LeftKey, nil
+	}
+	return 0, 0, "", "", fmt.Errorf("relation '%s': unknown relation type '%s'", r.RelationName, r.RelationType)
+}
+
+// linkEnd m:n 的一端：端点实体、端点的关联键、链接实体中引用它的列
+type linkEnd struct {
+	entity  uint32
+	key     string
+	linkKey string
+}
+
+// linkEnds 返回 m:n 左右两端
+func (r *Relation) linkEnds() []linkEnd {
+	return []linkEnd{{r.EntityLeft, r.LeftKey, r.LinkLeftKey}, {r.EntityRight, r.RightKey, r.LinkRightKey}}
+}
+
 func InitRelationTable(engine *xorm.Engine) error {
 	err := engine.Sync2(new(Relation))
 	meta.RegisterEntity(engine, "entity_relation", "实体关系", (&Relation{}).TableName(), "relation_idx")
@@ -33,32 +101,246 @@ func init() {
 }
 
 var (
-	muxRelation   sync.RWMutex
-	relationCache = make(map[uint32]map[uint32]*Relation)
+	muxRelation sync.RWMutex
+	// relationCache 以实体 idx 为键，包含该实体作为左或右实体的所有关系
+	relationCache = make(map[uint32][]*Relation)
 )
 
-func queryRelation(engine *xorm.Engine, LeftEntityIdx uint32) ([]*Relation, error) {
-	q := &Relation{
-		EntityLeft: LeftEntityIdx,
+// ListRelations 返回实体作为左或右实体的所有关系；entity 为空时返回全部关系
+func ListRelations(engine *xorm.Engine, entity string) ([]*Relation, error) {
+	if entity == "" {
+		var rels []*Relation
+		if err := engine.OrderBy("relation_idx").Find(&rels); err != nil {
+			return nil, err
+		}
+		return rels, fillEntityNames(engine, rels)
+	}
+	m, err := meta.AcquireMeta(entity, engine)
+	if err != nil {
+		return nil, err
 	}
-	var r []*Relation
-	err := engine.Find(&r, q)
-	updateRelationCache(r)
-	return r, err
+	return EntityRelations(engine, m.Entity.EntityIdx)
 }
 
-func updateRelationCache(relations []*Relation) {
-	if relations == nil {
-		return
+// EntityRelations 返回实体 idx 作为左、右或链接实体的所有关系，结果会缓存到关系变更为止
+func EntityRelations(engine *xorm.Engine, idx uint32) ([]*Relation, error) {
+	muxRelation.RLock()
+	rels, ok := relationCache[idx]
+	muxRelation.RUnlock()
+	if ok {
+		return rels, nil
 	}
+	rels, err := queryRelation(engine, idx)
+	if err != nil {
+		return nil, err
+	}
+	muxRelation.Lock()
+	relationCache[idx] = rels
+	muxRelation.Unlock()
+	return rels, nil
+}
+
+func queryRelation(engine *xorm.Engine, idx uint32) ([]*Relation, error) {
+	var rels []*Relation
+	if err := engine.Where("entity_left = ? OR entity_right = ? OR entity_link = ?", idx, idx, idx).
+		OrderBy("relation_idx").Find(&rels); err != nil {
+		return nil, err
+	}
+	return rels, fillEntityNames(engine, rels)
+}
+
+// invalidateRelationCache 关系变更后清空缓存，一个关系涉及两个实体，直接全部清空
+func invalidateRelationCache() {
 	muxRelation.Lock()
 	defer muxRelation.Unlock()
-	for _, v := range relations {
-		sub, ok := relationCache[v.EntityLeft]
-		if !ok {
-			sub = make(map[uint32]*Relation)
-			relationCache[v.EntityLeft] = sub
+	relationCache = make(map[uint32][]*Relation)
+}
+
+// fillEntityNames 按 idx 填充左右及链接实体名
+func fillEntityNames(engine *xorm.Engine, rels []*Relation) error {
+	names := map[uint32]string{0: ""}
+	for _, r := range rels {
+		for _, idx := range []uint32{r.EntityLeft, r.EntityRight, r.EntityLink} {
+			if _, ok := names[idx]; ok {
+				continue
+			}
+			e := &meta.Entity{}
+			if _, err := engine.ID(idx).Cols("entity_name").Get(e); err != nil {
+				return err
+			}
+			names[idx] = e.EntityName
 		}
-		sub[v.EntityRight] = v
+		r.LeftEntity, r.RightEntity, r.LinkEntity = names[r.EntityLeft], names[r.EntityRight], names[r.EntityLink]
+	}
+	return nil
+}
+
+// GetRelation 按名称查询关系
+func GetRelation(engine *xorm.Engine, name string) (*Relation, error) {
+	r := &Relation{}
+	has, err := engine.Where("relation_name = ?", name).Get(r)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("%w: '%s'", ErrRelationNotFound, name)
+	}
+	return r, fillEntityNames(engine, []*Relation{r})
+}
+
+// CreateRelation 校验并创建关系，左右实体可以用 idx 或名称指定
+func CreateRelation(engine *xorm.Engine, r *Relation) error {
+	if err := verifyRelation(engine, r); err != nil {
+		return err
+	}
+	r.RelationIdx = 0
+	if _, err := engine.Insert(r); err != nil {
+		return err
+	}
+	invalidateRelationCache()
+	return nil
+}
+
+// UpdateRelation 校验后以 r 替换名为 name 的关系
+func UpdateRelation(engine *xorm.Engine, name string, r *Relation) error {
+	old, err := GetRelation(engine, name)
+	if err != nil {
+		return err
+	}
+	if r.RelationName == "" {
+		r.RelationName = old.RelationName
+	}
+	if err = verifyRelation(engine, r); err != nil {
+		return err
+	}
+	r.RelationIdx = old.RelationIdx
+	if _, err = engine.ID(old.RelationIdx).AllCols().Update(r); err != nil {
+		return err
+	}
+	invalidateRelationCache()
+	return nil
+}
+
+// DeleteRelation 删除名为 name 的关系
+func DeleteRelation(engine *xorm.Engine, name string) error {
+	n, err := engine.Where("relation_name = ?", name).Delete(&Relation{})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: '%s'", ErrRelationNotFound, name)
+	}
+	invalidateRelationCache()
+	return nil
+}
+
+// verifyRelation 关系名非空，类型和级联策略合法，左右实体存在且关联键是实体的列；
+// 只有 m:n 可以且必须指定链接实体
+func verifyRelation(engine *xorm.Engine, r *Relation) error {
+	if r.RelationName == "" {
+		return fmt.Errorf("relation name required")
+	}
+	if !r.RelationType.Valid() {
+		return fmt.Errorf("relation '%s': unknown relation type '%s', expected 1:1, 1:m, m:1 or m:n",
+			r.RelationName, r.RelationType)
+	}
+	left, err := resolveEntity(engine, r.EntityLeft, r.LeftEntity)
+	if err != nil {
+		return err
+	}
+	right, err := resolveEntity(engine, r.EntityRight, r.RightEntity)
+	if err != nil {
+		return err
+	}
+	r.EntityLeft, r.LeftEntity = left.Entity.EntityIdx, left.Entity.EntityName
+	r.EntityRight, r.RightEntity = right.Entity.EntityIdx, right.Entity.EntityName
+	if _, ok := left.ColumnIndex[r.LeftKey]; !ok {
+		return fmt.Errorf("relation '%s': column '%s' not found in entity '%s'", r.RelationName, r.LeftKey, r.LeftEntity)
+	}
+	if _, ok := right.ColumnIndex[r.RightKey]; !ok {
+		return fmt.Errorf("relation '%s': column '%s' not found in entity '%s'", r.RelationName, r.RightKey, r.RightEntity)
+	}
+	if r.RelationType == ManyToMany {
+		link, err1 := verifyLink(engine, r)
+		if err1 != nil {
+			return err1
+		}
+		if err1 = verifyCascade(r, link, r.LinkLeftKey); err1 != nil {
+			return err1
+		}
+		return verifyCascade(r, link, r.LinkRightKey)
+	}
+	if r.EntityLink != 0 || r.LinkEntity != "" || r.LinkLeftKey != "" || r.LinkRightKey != "" {
+		return fmt.Errorf("relation '%s': link entity is only for m:n relations", r.RelationName)
+	}
+	if r.RelationType == ManyToOne {
+		return verifyCascade(r, left, r.LeftKey)
+	}
+	return verifyCascade(r, right, r.RightKey)
+}
+
+// verifyLink m:n 的链接实体存在，链接键是链接实体主表的列
+func verifyLink(engine *xorm.Engine, r *Relation) (*meta.EntityMeta, error) {
+	link, err := resolveEntity(engine, r.EntityLink, r.LinkEntity)
+	if err != nil {
+		return nil, fmt.Errorf("relation '%s': link %w", r.RelationName, err)
+	}
+	r.EntityLink, r.LinkEntity = link.Entity.EntityIdx, link.Entity.EntityName
+	for _, k := range []string{r.LinkLeftKey, r.LinkRightKey} {
+		if k == "" {
+			return nil, fmt.Errorf("relation '%s': link_left_key and link_right_key required", r.RelationName)
+		}
+		if link.FetchTableNameByColumn(k) != link.PrimaryTable() {
+			return nil, fmt.Errorf("relation '%s': column '%s' not found in the primary table of link entity '%s'",
+				r.RelationName, k, r.LinkEntity)
+		}
+	}
+	if r.LinkLeftKey == r.LinkRightKey {
+		return nil, fmt.Errorf("relation '%s': link_left_key and link_right_key must differ", r.RelationName)
+	}
+	return link, nil
+}
+
+// verifyCascade 级联策略合法；set_null 时从属实体的关联键不能是主键，soft_delete 时从属实体必须声明软删除标记列
+func verifyCascade(r *Relation, child *meta.EntityMeta, childKey string) error {
+	switch r.CascadePolicy {
+	case "", CascadeRestrict, CascadeDelete:
+	case CascadeSetNull:
+		if childKey == child.Entity.PkAttrColumn {
+			return fmt.Errorf("relation '%s': primary key '%s' can not be set null", r.RelationName, childKey)
+		}
+	case CascadeSoftDelete:
+		if child.DeletedColumn() == nil {
+			return fmt.Errorf("relation '%s': entity '%s' has no deleted column", r.RelationName, child.Entity.EntityName)
+		}
+	default:
+		return fmt.Errorf("relation '%s': unknown cascade policy '%s'", r.RelationName, r.CascadePolicy)
+	}
+	return nil
+}
+
+// resolveEntity 按 idx 或名称取实体元数据，两者都给出时必须一致
+func resolveEntity(engine *xorm.Engine, idx uint32, name string) (*meta.EntityMeta, error) {
+	if name == "" {
+		if idx == 0 {
+			return nil, fmt.Errorf("entity required")
+		}
+		e := &meta.Entity{}
+		has, err := engine.ID(idx).Get(e)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			return nil, fmt.Errorf("entity %d not found", idx)
+		}
+		name = e.EntityName
+	}
+	m, err := meta.AcquireMeta(name, engine)
+	if err != nil {
+		return nil, fmt.Errorf("entity '%s': %w", name, err)
+	}
+	if idx != 0 && idx != m.Entity.EntityIdx {
+		return nil, fmt.Errorf("entity %d is not '%s'", idx, name)
 	}
+	return m, nil
 }
@@ -0,0 +1,445 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// 遍历的深度与规模限制
+const (
+	DefaultTraverseDepth = 10
+	MaxTraverseDepth     = 100
+	MaxTraverseNodes     = 10000
+	// MaxTraverseEdges 递归 CTE 一次最多返回的边数，避免在检查节点数之前取回过多的行
+	MaxTraverseEdges = 5 * MaxTraverseNodes
+)
+
+// TraverseStep 遍历路径的一步，沿关系 Relation 到另一端实体；
+// Recursive 时沿自关联重复前进至多 Depth 层，Reverse 时沿自关联的反方向，如由上级部门到下级部门
+type TraverseStep struct {
+	Relation  string   `json:"relation"`
+	As        string   `json:"as,omitempty"`     // 嵌套文档中的键，缺省为关系名
+	Select    []string `json:"select,omitempty"` // 另一端实体的列，缺省为全部
+	Recursive bool     `json:"recursive,omitempty"`
+	Reverse   bool     `json:"reverse,omitempty"`
+	Depth     int      `json:"depth,omitempty"`
+}
+
+// Traversal 从实体主键为 Start（值或数组）的记录出发沿 Path 遍历；
+// 递归步之后的步作用于递归到达的所有记录，包括递归的起点
+type Traversal struct {
+	Start  any             `json:"start"`
+	Select []string        `json:"select,omitempty"`
+	Path   []*TraverseStep `json:"path"`
+	// Iterative 不使用递归 CTE，逐层查询
+	Iterative bool `json:"iterative,omitempty"`
+}
+
+// GraphNode 遍历到的记录
+type GraphNode struct {
+	Entity string         `json:"entity"`
+	ID     any            `json:"id"`
+	Data   map[string]any `json:"data"`
+}
+
+func (n *GraphNode) key() string {
+	return n.Entity + ":" + keyString(n.ID)
+}
+
+// GraphEdge 遍历经过的关系，From、To 为节点的 "<实体>:<主键>"，Depth 为递归步中的层数
+type GraphEdge struct {
+	Relation string `json:"relation"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Depth    int    `json:"depth"`
+}
+
+// Graph 遍历结果的边列表，Tree 返回以起点为根的嵌套文档
+type Graph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []*GraphEdge `json:"edges"`
+
+	roots []*GraphNode
+	steps []*traverseStep
+	nodes map[string]*GraphNode
+	// adj 每一步中节点到另一端节点的邻接
+	adj []map[string][]*GraphNode
+}
+
+type traverseStep struct {
+	*TraverseStep
+	rel *query.Related
+}
+
+func (s *traverseStep) name() string {
+	if s.As != "" {
+		return s.As
+	}
+	return s.Relation
+}
+
+func (s *traverseStep) depth() int {
+	if s.Depth == 0 {
+		return DefaultTraverseDepth
+	}
+	return s.Depth
+}
+
+// Traverse 从实体 name 的记录出发遍历实体关系
+func Traverse(engine *xorm.Engine, name string, t *Traversal) (*Graph, error) {
+	if t.Start == nil {
+		return nil, errors.New("traverse start required")
+	}
+	if len(t.Path) == 0 {
+		return nil, errors.New("traverse path required")
+	}
+	m, err := meta.AcquireMeta(name, engine)
+	if err != nil {
+		return nil, fmt.Errorf("entity '%s': %w", name, err)
+	}
+	g := &Graph{nodes: map[string]*GraphNode{}, adj: make([]map[string][]*GraphNode, len(t.Path))}
+	from := m
+	for i, ts := range t.Path {
+		if ts.Depth < 0 || ts.Depth > MaxTraverseDepth {
+			return nil, fmt.Errorf("step '%s': depth must be between 1 and %d, or 0 for the default %d",
+				ts.Relation, MaxTraverseDepth, DefaultTraverseDepth)
+		}
+		rel, err1 := relatedOf(engine, from, ts.Relation, ts.Reverse)
+		if err1 != nil {
+			return nil, fmt.Errorf("step '%s': %w", ts.Relation, err1)
+		}
+		if ts.Recursive && rel.Meta.Entity.EntityIdx != from.Entity.EntityIdx {
+			return nil, fmt.Errorf("step '%s': recursive step requires a self relation", ts.Relation)
+		}
+		g.steps = append(g.steps, &traverseStep{TraverseStep: ts, rel: rel})
+		g.adj[i] = map[string][]*GraphNode{}
+		from = rel.Meta
+	}
+
+	start, ok := t.Start.([]any)
+	if !ok {
+		start = []any{t.Start}
+	}
+	pk := m.Entity.PkAttrColumn
+	rows, err := fetchNodes(engine, m, selectColumns(m, t.Select, g.keysFrom(0)), pk, start)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		n, err1 := g.node(m, row)
+		if err1 != nil {
+			return nil, err1
+		}
+		g.roots = append(g.roots, n)
+	}
+
+	sess := engine.NewSession()
+	defer sess.Close()
+	cte := !t.Iterative && supportsRecursiveCTE(sess)
+	frontier := g.roots
+	for i, s := range g.steps {
+		// 另一端的关联键用于将到达的记录对应到起点
+		keys := append(g.keysFrom(i+1), s.rel.RelatedKey)
+		if s.Recursive {
+			keys = append(keys, s.rel.Key)
+		}
+		cols := selectColumns(s.rel.Meta, s.Select, keys)
+		switch {
+		case !s.Recursive:
+			frontier, err = g.follow(sess, i, frontier, cols, 1)
+		case cte && s.cteApplicable():
+			frontier, err = g.recurseCTE(sess, i, frontier, cols)
+		default:
+			frontier, err = g.recurse(sess, i, frontier, cols)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// keysFrom 第 i 步起始的记录需要的关联键：第 i 步的关联键，第 i 步递归时还有其后各步的关联键
+func (g *Graph) keysFrom(i int) []string {
+	var keys []string
+	for ; i < len(g.steps); i++ {
+		keys = append(keys, g.steps[i].rel.Key)
+		if !g.steps[i].Recursive {
+			break
+		}
+	}
+	return keys
+}
+
+// selectColumns 选择的列加上主键和关联键；未选择列时为全部列
+func selectColumns(m *meta.EntityMeta, sel []string, keys []string) []string {
+	if len(sel) == 0 {
+		return []string{"*"}
+	}
+	cols := slices.Clone(sel)
+	for _, c := range append([]string{m.Entity.PkAttrColumn}, keys...) {
+		if !slices.Contains(cols, c) {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+func fetchNodes(engine *xorm.Engine, m *meta.EntityMeta, cols []string, col string, vals []any) ([]map[string]any, error) {
+	return NewQuery(engine, m.Entity.EntityName).Select(cols...).Where(col, "in", vals).
+		OrderBy(m.Entity.PkAttrColumn, "").Find()
+}
+
+// node 返回 row 对应的节点，已存在时补充缺少的列
+func (g *Graph) node(m *meta.EntityMeta, row map[string]any) (*GraphNode, error) {
+	n := &GraphNode{Entity: m.Entity.EntityName, ID: row[m.Entity.PkAttrColumn], Data: row}
+	if old, ok := g.nodes[n.key()]; ok {
+		for k, v := range row {
+			if _, ok1 := old.Data[k]; !ok1 {
+				old.Data[k] = v
+			}
+		}
+		return old, nil
+	}
+	if len(g.Nodes) >= MaxTraverseNodes {
+		return nil, fmt.Errorf("traversal exceeds %d nodes", MaxTraverseNodes)
+	}
+	g.nodes[n.key()] = n
+	g.Nodes = append(g.Nodes, n)
+	return n, nil
+}
+
+func (g *Graph) edge(i int, from, to *GraphNode, depth int) {
+	for _, n := range g.adj[i][from.key()] {
+		if n == to {
+			return
+		}
+	}
+	g.adj[i][from.key()] = append(g.adj[i][from.key()], to)
+	g.Edges = append(g.Edges, &GraphEdge{Relation: g.steps[i].Relation, From: from.key(), To: to.key(), Depth: depth})
+}
+
+// follow 沿第 i 步的关系前进一层，返回到达的节点
+func (g *Graph) follow(sess *xorm.Session, i int, from []*GraphNode, cols []string, depth int) ([]*GraphNode, error) {
+	rel := g.steps[i].rel
+	// sources 以另一端关联键的值为键，值为关联到它的起点
+	sources := map[string][]*GraphNode{}
+	var vals []any
+	for _, n := range from {
+		v := n.Data[rel.Key]
+		if v == nil {
+			continue
+		}
+		k := keyString(v)
+		if _, ok := sources[k]; !ok {
+			vals = append(vals, v)
+		}
+		sources[k] = append(sources[k], n)
+	}
+	if l := rel.Link; l != nil && len(vals) > 0 {
+		// m:n 经由链接表将起点的键映射为另一端的键
+		rows, err := queryRows(sess, dialect(sess).Select(l.Near, l.Far).From(l.Table).
+			Where(builder.In(l.Near, vals...)))
+		if err != nil {
+			return nil, err
+		}
+		near := sources
+		sources, vals = map[string][]*GraphNode{}, nil
+		for _, row := range rows {
+			k := keyString(row[l.Far])
+			if _, ok := sources[k]; !ok {
+				vals = append(vals, row[l.Far])
+			}
+			sources[k] = append(sources[k], near[keyString(row[l.Near])]...)
+		}
+	}
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	rows, err := fetchNodes(sess.Engine(), rel.Meta, cols, rel.RelatedKey, vals)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*GraphNode
+	for _, row := range rows {
+		n, err1 := g.node(rel.Meta, row)
+		if err1 != nil {
+			return nil, err1
+		}
+		for _, src := range sources[keyString(row[rel.RelatedKey])] {
+			g.edge(i, src, n, depth)
+		}
+		targets = append(targets, n)
+	}
+	return targets, nil
+}
+
+// recurse 逐层沿自关联前进，已到达的节点不再展开，返回包括起点在内的所有节点
+func (g *Graph) recurse(sess *xorm.Session, i int, from []*GraphNode, cols []string) ([]*GraphNode, error) {
+	seen := map[*GraphNode]bool{}
+	for _, n := range from {
+		seen[n] = true
+	}
+	all := slices.Clone(from)
+	level := from
+	for d := 1; d <= g.steps[i].depth() && len(level) > 0; d++ {
+		targets, err := g.follow(sess, i, level, cols, d)
+		if err != nil {
+			return nil, err
+		}
+		level = nil
+		for _, n := range targets {
+			if !seen[n] {
+				seen[n] = true
+				level = append(level, n)
+				all = append(all, n)
+			}
+		}
+	}
+	return all, nil
+}
+
+// cteApplicable 递归 CTE 只用于关联键都在主表中的非 m:n 自关联
+func (s *traverseStep) cteApplicable() bool {
+	m := s.rel.Meta
+	return s.rel.Link == nil && m.FetchTableNameByColumn(s.rel.Key) == m.PrimaryTable() &&
+		m.FetchTableNameByColumn(s.rel.RelatedKey) == m.PrimaryTable()
+}
+
+// recurseCTE 以递归 CTE 一次查出自关联的边，结果与 recurse 相同
+func (g *Graph) recurseCTE(sess *xorm.Session, i int, from []*GraphNode, cols []string) ([]*GraphNode, error) {
+	s := g.steps[i]
+	if len(from) == 0 {
+		return nil, nil
+	}
+	m := s.rel.Meta
+	pk := m.Entity.PkAttrColumn
+	args := make([]any, 0, len(from)+1)
+	for _, n := range from {
+		args = append(args, n.ID)
+	}
+	args = append(args, s.depth(), MaxTraverseEdges+1)
+	sql := fmt.Sprintf(`WITH RECURSIVE traverse_edge (src, dst, depth) AS (
+SELECT s.%[2]s, c.%[2]s, 1 FROM %[1]s s JOIN %[1]s c ON c.%[4]s = s.%[3]s WHERE s.%[2]s IN (%[5]s)
+UNION ALL
+SELECT e.dst, c.%[2]s, e.depth + 1 FROM traverse_edge e JOIN %[1]s s ON s.%[2]s = e.dst JOIN %[1]s c ON c.%[4]s = s.%[3]s WHERE e.depth < ?
+) SELECT src, dst, MIN(depth) AS depth FROM traverse_edge GROUP BY src, dst ORDER BY MIN(depth), src, dst LIMIT ?`,
+		m.PrimaryTable(), pk, s.rel.Key, s.rel.RelatedKey, strings.TrimSuffix(strings.Repeat("?,", len(from)), ","))
+	edges, err := sess.QueryInterface(append([]any{sql}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(edges) > MaxTraverseEdges {
+		return nil, fmt.Errorf("traversal exceeds %d edges", MaxTraverseEdges)
+	}
+	var pks []any
+	known := map[string]bool{}
+	for _, n := range from {
+		known[keyString(n.ID)] = true
+	}
+	for _, e := range edges {
+		if k := keyString(e["dst"]); !known[k] {
+			known[k] = true
+			pks = append(pks, e["dst"])
+		}
+	}
+	all := slices.Clone(from)
+	if len(pks) > 0 {
+		rows, err1 := fetchNodes(sess.Engine(), m, cols, pk, pks)
+		if err1 != nil {
+			return nil, err1
+		}
+		for _, row := range rows {
+			n, err2 := g.node(m, row)
+			if err2 != nil {
+				return nil, err2
+			}
+			all = append(all, n)
+		}
+	}
+	prefix := m.Entity.EntityName + ":"
+	for _, e := range edges {
+		src, dst := g.nodes[prefix+keyString(e["src"])], g.nodes[prefix+keyString(e["dst"])]
+		if src == nil || dst == nil {
+			continue
+		}
+		depth, _ := strconv.Atoi(keyString(e["depth"]))
+		g.edge(i, src, dst, depth)
+	}
+	return all, nil
+}
+
+// supportsRecursiveCTE sqlite、postgres 及 MySQL 8、MariaDB 10.2 以上支持递归 CTE
+func supportsRecursiveCTE(sess *xorm.Session) bool {
+	switch sess.Engine().DriverName() {
+	case "sqlite3", "sqlite", "postgres", "pgx":
+		return true
+	case "mysql":
+		rows, err := sess.QueryString("SELECT VERSION() AS version")
+		if err != nil || len(rows) == 0 {
+			return false
+		}
+		v := rows[0]["version"]
+		var major, minor int
+		_, _ = fmt.Sscanf(v, "%d.%d", &major, &minor)
+		if strings.Contains(strings.ToLower(v), "mariadb") {
+			return major > 10 || (major == 10 && minor >= 2)
+		}
+		return major >= 8
+	}
+	return false
+}
+
+// Tree 以起点为根的嵌套文档：另一端为一时嵌入对象，为多时嵌入数组，键为步的 as 或关系名；
+// 递归步的下一层嵌入在同名键下，路径上已出现的记录不再展开
+func (g *Graph) Tree() []map[string]any {
+	docs := make([]map[string]any, 0, len(g.roots))
+	for _, n := range g.roots {
+		doc := maps.Clone(n.Data)
+		g.attach(doc, n, 0, map[string]bool{})
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func (g *Graph) attach(doc map[string]any, n *GraphNode, i int, path map[string]bool) {
+	if i >= len(g.steps) {
+		return
+	}
+	s := g.steps[i]
+	path[n.key()] = true
+	defer delete(path, n.key())
+	children := []map[string]any{}
+	for _, c := range g.adj[i][n.key()] {
+		if s.Recursive && path[c.key()] {
+			continue
+		}
+		cd := maps.Clone(c.Data)
+		if s.Recursive {
+			g.attach(cd, c, i, path)
+		} else {
+			g.attach(cd, c, i+1, path)
+		}
+		children = append(children, cd)
+	}
+	switch {
+	case s.rel.Many:
+		doc[s.name()] = children
+	case len(children) > 0:
+		doc[s.name()] = children[0]
+	default:
+		doc[s.name()] = nil
+	}
+	if s.Recursive {
+		g.attach(doc, n, i+1, path)
+	}
+}
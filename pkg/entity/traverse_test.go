@@ -0,0 +1,85 @@
+package entity
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm"
+)
+
+// newTestEngine 临时 sqlite 库，建好实体、关系和视图表，并注册 ddl 中的实体（主键为 idx）
+func newTestEngine(t *testing.T, ddl map[string]string) *xorm.Engine {
+	engine, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "entity.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = engine.Close() })
+	require.NoError(t, meta.InitEntityTable(engine))
+	require.NoError(t, InitRelationTable(engine))
+	require.NoError(t, InitViewTable(engine))
+	invalidateRelationCache()
+	for name, sql := range ddl {
+		_, err = engine.Exec(sql)
+		require.NoError(t, err)
+		_, err = meta.RegisterEntity(engine, name, "", name, "idx")
+		require.NoError(t, err)
+	}
+	return engine
+}
+
+func TestTraverse_edges(t *testing.T) {
+	engine := newTestEngine(t, map[string]string{
+		"tr_emp":  "CREATE TABLE tr_emp (idx INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, dept_code TEXT)",
+		"tr_dept": "CREATE TABLE tr_dept (idx INTEGER PRIMARY KEY AUTOINCREMENT, code TEXT, parent_code TEXT)",
+	})
+	for _, r := range []*Relation{
+		{RelationName: "tr_emp_dept", LeftEntity: "tr_emp", RightEntity: "tr_dept",
+			LeftKey: "dept_code", RightKey: "code", RelationType: ManyToOne},
+		{RelationName: "tr_dept_parent", LeftEntity: "tr_dept", RightEntity: "tr_dept",
+			LeftKey: "parent_code", RightKey: "code", RelationType: ManyToOne},
+	} {
+		require.NoError(t, CreateRelation(engine, r))
+	}
+	for _, sql := range []string{
+		"INSERT INTO tr_dept (idx, code, parent_code) VALUES (1, 'HQ', NULL), (2, 'ENG', 'HQ'), " +
+			"(3, 'WEB', 'ENG'), (4, 'X', 'Y'), (5, 'Y', 'X')",
+		"INSERT INTO tr_emp (idx, name, dept_code) VALUES (1, 'ann', 'WEB'), (2, 'bob', 'X')",
+	} {
+		_, err := engine.Exec(sql)
+		require.NoError(t, err)
+	}
+	edges := func(start int, depth int, iterative bool) []string {
+		g, err := Traverse(engine, "tr_emp", &Traversal{Start: start, Iterative: iterative, Path: []*TraverseStep{
+			{Relation: "tr_emp_dept"}, {Relation: "tr_dept_parent", Recursive: true, Depth: depth}}})
+		require.NoError(t, err)
+		var ret []string
+		for _, e := range g.Edges {
+			ret = append(ret, fmt.Sprintf("%s>%s@%d", e.From, e.To, e.Depth))
+		}
+		return ret
+	}
+	// 递归 CTE 与逐层查询的结果相同，环在已到达的记录处停止
+	tests := []struct {
+		name  string
+		start int
+		depth int
+		want  []string
+	}{
+		{"chain", 1, 0, []string{"tr_emp:1>tr_dept:3@1", "tr_dept:3>tr_dept:2@1", "tr_dept:2>tr_dept:1@2"}},
+		{"cycle", 2, 0, []string{"tr_emp:2>tr_dept:4@1", "tr_dept:4>tr_dept:5@1", "tr_dept:5>tr_dept:4@2"}},
+		{"depth", 2, 1, []string{"tr_emp:2>tr_dept:4@1", "tr_dept:4>tr_dept:5@1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, edges(tt.start, tt.depth, false))
+			assert.Equal(t, tt.want, edges(tt.start, tt.depth, true))
+		})
+	}
+
+	_, err := Traverse(engine, "tr_emp", &Traversal{Start: 1, Path: []*TraverseStep{
+		{Relation: "tr_emp_dept"}, {Relation: "tr_dept_parent", Recursive: true, Depth: MaxTraverseDepth + 1}}})
+	assert.ErrorContains(t, err, "depth must be between 1 and 100, or 0 for the default 10")
+}
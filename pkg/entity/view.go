@@ -0,0 +1,401 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/goccy/go-json"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+var (
+	ErrViewNotFound  = errors.New("view not found")
+	ErrViewForbidden = errors.New("view access denied")
+
+	errViewAuthRequired = fmt.Errorf("%w: authentication required", ErrViewForbidden)
+)
+
+// 视图参数的类型
+const (
+	ParamString = "string"
+	ParamInt    = "int"
+	ParamFloat  = "float"
+	ParamBool   = "bool"
+	ParamTime   = "time"
+)
+
+// ViewVersionParam 运行视图时指定版本的查询参数，缺省为最新版本；format 为导出格式，也不能作为参数名
+const ViewVersionParam = "_version"
+
+// ViewParam 视图的参数，查询 DSL 中 where 的值为 "${name}" 处以参数值替换；
+// list 参数可以重复或以逗号分隔多个值，用于 in 等条件
+type ViewParam struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"` // 缺省为 string
+	List     bool   `json:"list,omitempty"`
+	Required bool   `json:"required,omitempty"`
+	Default  any    `json:"default,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// View 保存的命名查询，每次保存产生新的版本，运行时缺省使用最新版本；
+// owner 为创建者，只有 owner 能保存新版本或删除，allowed 为可运行的身份，为空时所有身份可运行
+type View struct {
+	ViewIdx     uint32          `json:"view_idx" xorm:"pk autoincr"`
+	ViewName    string          `json:"view_name" xorm:"unique(view_version) not null"`
+	Version     int             `json:"version" xorm:"unique(view_version) not null"`
+	Description string          `json:"desc" xorm:"desc_str"`
+	Query       json.RawMessage `json:"query" xorm:"text 'query_dsl' not null"`
+	Params      []*ViewParam    `json:"params,omitempty" xorm:"json"`
+	Owner       string          `json:"owner,omitempty"`
+	Allowed     []string        `json:"allowed,omitempty" xorm:"json"`
+	CreatedAt   time.Time       `json:"created_at" xorm:"created"`
+}
+
+func (v *View) TableName() string {
+	return "idig_entity_view"
+}
+
+func InitViewTable(engine *xorm.Engine) error {
+	return engine.Sync2(new(View))
+}
+
+func init() {
+	core.RegisterInitTableFunction(InitViewTable)
+}
+
+// CanRun 身份 principal 是否可以运行视图
+func (v *View) CanRun(principal string) bool {
+	return len(v.Allowed) == 0 || v.Owner == principal || slices.Contains(v.Allowed, principal)
+}
+
+// CanModify 身份 principal 是否可以保存视图的新版本或删除视图，没有 owner 的视图都可以修改
+func (v *View) CanModify(principal string) bool {
+	return v.Owner == "" || v.Owner == principal
+}
+
+// ListViews 返回 principal 可运行的视图的最新版本，按名称排序
+func ListViews(engine *xorm.Engine, principal string) ([]*View, error) {
+	var all []*View
+	if err := engine.OrderBy("view_name, version DESC").Find(&all); err != nil {
+		return nil, err
+	}
+	views := make([]*View, 0, len(all))
+	for _, v := range all {
+		if len(views) > 0 && views[len(views)-1].ViewName == v.ViewName {
+			continue
+		}
+		views = append(views, v)
+	}
+	return slices.DeleteFunc(views, func(v *View) bool { return !v.CanRun(principal) }), nil
+}
+
+// ViewVersions 返回视图 name 的所有版本，按版本排序
+func ViewVersions(engine *xorm.Engine, name, principal string) ([]*View, error) {
+	var views []*View
+	if err := engine.Where("view_name = ?", name).OrderBy("version").Find(&views); err != nil {
+		return nil, err
+	}
+	if len(views) == 0 {
+		return nil, fmt.Errorf("%w: '%s'", ErrViewNotFound, name)
+	}
+	if !views[len(views)-1].CanRun(principal) {
+		return nil, fmt.Errorf("%w: '%s'", ErrViewForbidden, name)
+	}
+	return views, nil
+}
+
+// GetView 按名称和版本查询视图，version 为 0 时为最新版本
+func GetView(engine *xorm.Engine, name string, version int) (*View, error) {
+	v := &View{}
+	sess := engine.Where("view_name = ?", name)
+	if version > 0 {
+		sess = sess.And("version = ?", version)
+	}
+	has, err := sess.OrderBy("version DESC").Get(v)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		if version > 0 {
+			return nil, fmt.Errorf("%w: '%s' version %d", ErrViewNotFound, name, version)
+		}
+		return nil, fmt.Errorf("%w: '%s'", ErrViewNotFound, name)
+	}
+	return v, nil
+}
+
+// SaveView 校验并保存视图的新版本：视图不存在时 principal 成为 owner，版本为 1；
+// 否则只有 owner 可以保存，版本加 1，owner 不变。principal 为空（未认证）时拒绝
+func SaveView(engine *xorm.Engine, v *View, principal string) error {
+	if principal == "" {
+		return errViewAuthRequired
+	}
+	if err := verifyView(engine, v); err != nil {
+		return err
+	}
+	latest, err := GetView(engine, v.ViewName, 0)
+	switch {
+	case errors.Is(err, ErrViewNotFound):
+		v.Version, v.Owner = 1, principal
+	case err != nil:
+		return err
+	case !latest.CanModify(principal):
+		return fmt.Errorf("%w: '%s' is owned by '%s'", ErrViewForbidden, v.ViewName, latest.Owner)
+	default:
+		v.Version, v.Owner = latest.Version+1, latest.Owner
+	}
+	v.ViewIdx = 0
+	if _, err = engine.Insert(v); err != nil {
+		return err
+	}
+	invalidateViewCache()
+	return nil
+}
+
+// DeleteView 删除视图的所有版本，principal 为空（未认证）时拒绝
+func DeleteView(engine *xorm.Engine, name, principal string) error {
+	if principal == "" {
+		return errViewAuthRequired
+	}
+	latest, err := GetView(engine, name, 0)
+	if err != nil {
+		return err
+	}
+	if !latest.CanModify(principal) {
+		return fmt.Errorf("%w: '%s' is owned by '%s'", ErrViewForbidden, name, latest.Owner)
+	}
+	if _, err = engine.Where("view_name = ?", name).Delete(&View{}); err != nil {
+		return err
+	}
+	invalidateViewCache()
+	return nil
+}
+
+var (
+	viewNameRe  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+	paramNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+)
+
+// verifyView 查询必须能解析，引用的参数都已声明，以参数的缺省值或类型的零值绑定后能生成 SQL
+func verifyView(engine *xorm.Engine, v *View) error {
+	if !viewNameRe.MatchString(v.ViewName) {
+		return fmt.Errorf("invalid view name '%s'", v.ViewName)
+	}
+	names := map[string]bool{}
+	for _, p := range v.Params {
+		if !paramNameRe.MatchString(p.Name) || p.Name == "format" {
+			return fmt.Errorf("invalid parameter name '%s'", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate parameter '%s'", p.Name)
+		}
+		names[p.Name] = true
+		if p.Type == "" {
+			p.Type = ParamString
+		}
+		if !slices.Contains([]string{ParamString, ParamInt, ParamFloat, ParamBool, ParamTime}, p.Type) {
+			return fmt.Errorf("parameter '%s': unknown type '%s'", p.Name, p.Type)
+		}
+		if p.Default != nil {
+			if _, err := p.defaultValue(); err != nil {
+				return err
+			}
+		}
+	}
+	q := query.NewQuery(0, engine)
+	if err := q.Parse(v.Query); err != nil {
+		return fmt.Errorf("view '%s': %w", v.ViewName, err)
+	}
+	if err := q.VerifyParams(); err != nil {
+		return fmt.Errorf("view '%s': %w", v.ViewName, err)
+	}
+	for _, name := range q.Params() {
+		if !names[name] {
+			return fmt.Errorf("view '%s': parameter '%s' is not declared", v.ViewName, name)
+		}
+	}
+	vals := map[string]any{}
+	for _, p := range v.Params {
+		val, _ := p.defaultValue()
+		if val == nil {
+			val, _ = p.convert([]string{p.sample()})
+		}
+		vals[p.Name] = val
+	}
+	bq, err := q.Bind(vals)
+	if err != nil {
+		return err
+	}
+	if err = bq.BuildSQL(builder.Dialect(engine.DriverName())); err != nil {
+		return fmt.Errorf("view '%s': %w", v.ViewName, err)
+	}
+	return nil
+}
+
+// sample 类型的零值，用于校验视图
+func (p *ViewParam) sample() string {
+	switch p.Type {
+	case ParamInt, ParamFloat:
+		return "0"
+	case ParamBool:
+		return "false"
+	case ParamTime:
+		return "2006-01-02"
+	}
+	return ""
+}
+
+// defaultValue 缺省值转换为参数的类型，没有缺省值时为 nil
+func (p *ViewParam) defaultValue() (any, error) {
+	if p.Default == nil {
+		return nil, nil
+	}
+	var raws []string
+	if l, ok := p.Default.([]any); ok {
+		for _, e := range l {
+			raws = append(raws, formatDefault(e))
+		}
+	} else {
+		raws = []string{formatDefault(p.Default)}
+	}
+	return p.convert(raws)
+}
+
+func formatDefault(v any) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// convert 按类型转换请求中的参数值；list 参数的值以逗号分隔，转换为数组
+func (p *ViewParam) convert(raws []string) (any, error) {
+	if !p.List {
+		if len(raws) > 1 {
+			return nil, fmt.Errorf("parameter '%s' accepts a single value", p.Name)
+		}
+		return p.convertOne(raws[0])
+	}
+	var vals []any
+	for _, raw := range raws {
+		for _, s := range strings.Split(raw, ",") {
+			val, err := p.convertOne(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
+		}
+	}
+	return vals, nil
+}
+
+var paramTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+func (p *ViewParam) convertOne(s string) (any, error) {
+	var (
+		val any
+		err error
+	)
+	switch p.Type {
+	case ParamInt:
+		val, err = strconv.ParseInt(s, 10, 64)
+	case ParamFloat:
+		val, err = strconv.ParseFloat(s, 64)
+	case ParamBool:
+		val, err = strconv.ParseBool(s)
+	case ParamTime:
+		for _, layout := range paramTimeLayouts {
+			var t time.Time
+			if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+				return t, nil
+			}
+		}
+	default:
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parameter '%s': invalid %s value '%s'", p.Name, p.Type, s)
+	}
+	return val, nil
+}
+
+// Args 由请求的参数生成绑定的值：未给出的参数取缺省值，必需的参数缺少时报错，其余为 NULL
+func (v *View) Args(raw map[string][]string) (map[string]any, error) {
+	vals := make(map[string]any, len(v.Params))
+	for _, p := range v.Params {
+		rs, ok := raw[p.Name]
+		if !ok || len(rs) == 0 {
+			if p.Required {
+				return nil, fmt.Errorf("parameter '%s' is required", p.Name)
+			}
+			val, err := p.defaultValue()
+			if err != nil {
+				return nil, err
+			}
+			vals[p.Name] = val
+			continue
+		}
+		val, err := p.convert(rs)
+		if err != nil {
+			return nil, err
+		}
+		vals[p.Name] = val
+	}
+	return vals, nil
+}
+
+type viewKey struct {
+	engine  *xorm.Engine
+	name    string
+	version int
+}
+
+type compiledView struct {
+	view  *View
+	query *query.Query
+}
+
+var (
+	muxView sync.RWMutex
+	// viewCache 已解析的视图，以租户的引擎、名称和版本为键，版本 0 为最新版本，视图保存或删除时清空
+	viewCache = make(map[viewKey]*compiledView)
+)
+
+func invalidateViewCache() {
+	muxView.Lock()
+	defer muxView.Unlock()
+	viewCache = make(map[viewKey]*compiledView)
+}
+
+// LoadView 返回视图及解析后的查询，结果会缓存；查询只能通过 Query.Bind 取得副本后使用
+func LoadView(engine *xorm.Engine, name string, version int) (*View, *query.Query, error) {
+	key := viewKey{engine, name, version}
+	muxView.RLock()
+	cv, ok := viewCache[key]
+	muxView.RUnlock()
+	if ok {
+		return cv.view, cv.query, nil
+	}
+	v, err := GetView(engine, name, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	q := query.NewQuery(0, engine)
+	if err = q.Parse(v.Query); err != nil {
+		return nil, nil, fmt.Errorf("view '%s': %w", name, err)
+	}
+	muxView.Lock()
+	viewCache[key] = &compiledView{v, q}
+	muxView.Unlock()
+	return v, q, nil
+}
@@ -0,0 +1,74 @@
+package entity
+
+import (
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveView(t *testing.T) {
+	engine := newTestEngine(t, map[string]string{
+		"vw_emp": "CREATE TABLE vw_emp (idx INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)",
+	})
+	_, err := engine.Exec("INSERT INTO vw_emp (idx, name) VALUES (1, 'ann'), (2, 'bob'), (3, 'cat')")
+	require.NoError(t, err)
+	byName := &ViewParam{Name: "name", Default: "bob"}
+
+	tests := []struct {
+		name    string
+		view    *View
+		wantErr string
+	}{
+		{"bad_name", &View{ViewName: "1x", Query: json.RawMessage(`{"select":["idx"],"from":"vw_emp"}`)},
+			"invalid view name '1x'"},
+		{"reserved_param", &View{ViewName: "vw", Query: json.RawMessage(`{"select":["idx"],"from":"vw_emp"}`),
+			Params: []*ViewParam{{Name: "format"}}}, "invalid parameter name 'format'"},
+		{"undeclared", &View{ViewName: "vw", Query: json.RawMessage(`{"select":["idx"],"from":"vw_emp",` +
+			`"where":[{"col":"name","val":"${name}"}]}`)}, "parameter 'name' is not declared"},
+		{"expr_sql_param", &View{ViewName: "vw", Query: json.RawMessage(`{"select":["idx"],"from":"vw_emp",` +
+			`"where":[{"col":"name","op":"expr","val":{"sql":"name = ${name}","args":[]}}]}`),
+			Params: []*ViewParam{byName}}, "expr sql 'name = ${name}' can not contain parameters"},
+		{"bad_default", &View{ViewName: "vw", Query: json.RawMessage(`{"select":["idx"],"from":"vw_emp",` +
+			`"where":[{"col":"idx","val":"${id}"}]}`),
+			Params: []*ViewParam{{Name: "id", Type: ParamInt, Default: "x"}}}, "invalid int value 'x'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorContains(t, SaveView(engine, tt.view, "ann"), tt.wantErr)
+		})
+	}
+
+	// expr 条件的参数在 args 中绑定；首次保存者为 owner，只有 owner 能保存新版本
+	v := &View{ViewName: "vw", Query: json.RawMessage(`{"select":["idx"],"from":"vw_emp",` +
+		`"where":[{"col":"name","op":"expr","val":{"sql":"name = ?","args":["${name}"]}}]}`),
+		Params: []*ViewParam{byName}}
+	assert.ErrorContains(t, SaveView(engine, v, ""), "authentication required")
+	require.NoError(t, SaveView(engine, v, "ann"))
+	assert.Equal(t, 1, v.Version)
+	assert.Equal(t, "ann", v.Owner)
+	err = SaveView(engine, &View{ViewName: "vw", Query: v.Query, Params: v.Params}, "bob")
+	assert.ErrorIs(t, err, ErrViewForbidden)
+	v2 := &View{ViewName: "vw", Query: v.Query, Params: v.Params, Allowed: []string{"cat"}}
+	require.NoError(t, SaveView(engine, v2, "ann"))
+	assert.Equal(t, 2, v2.Version)
+	assert.Equal(t, "ann", v2.Owner)
+
+	lv, q, err := LoadView(engine, "vw", 0)
+	require.NoError(t, err)
+	assert.True(t, lv.CanRun("cat"))
+	assert.False(t, lv.CanRun("bob"))
+	args, err := lv.Args(map[string][]string{"name": {"cat"}})
+	require.NoError(t, err)
+	bq, err := q.Bind(args)
+	require.NoError(t, err)
+	rows, err := bq.Find()
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"idx": int64(3)}}, rows)
+
+	assert.ErrorIs(t, DeleteView(engine, "vw", ""), ErrViewForbidden)
+	require.NoError(t, DeleteView(engine, "vw", "ann"))
+	_, _, err = LoadView(engine, "vw", 0)
+	assert.ErrorIs(t, err, ErrViewNotFound)
+}
@@ -3,103 +3,400 @@ package database
 import (
 	"context"
 	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/everpan/idig/pkg/config"
+	"github.com/everpan/idig/pkg/core"
 	"github.com/everpan/idig/pkg/event"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"xorm.io/builder"
 	"xorm.io/xorm"
 )
 
+// 默认的轮询、租约与重试参数
+const (
+	DefaultBatchSize     = 100
+	DefaultPollInterval  = time.Second
+	DefaultLeaseDuration = 30 * time.Second
+	DefaultMaxAttempts   = 5
+	DefaultBaseBackoff   = time.Second
+	DefaultMaxBackoff    = 5 * time.Minute
+)
+
+// Config 数据库事件总线配置
+type Config struct {
+	WorkerID      string        // 租约持有者标识，多实例部署时需唯一
+	BatchSize     int           // 每次轮询最多认领的事件数
+	PollInterval  time.Duration // 轮询间隔
+	LeaseDuration time.Duration // 租约时长，超时后事件可被其他 worker 重新认领
+	MaxAttempts   int           // 最大尝试次数，达到后进入死信状态
+	BaseBackoff   time.Duration // 指数退避的基础间隔
+	MaxBackoff    time.Duration // 指数退避的上限
+}
+
+var defaultConfig = Config{
+	BatchSize:     DefaultBatchSize,
+	PollInterval:  DefaultPollInterval,
+	LeaseDuration: DefaultLeaseDuration,
+	MaxAttempts:   DefaultMaxAttempts,
+	BaseBackoff:   DefaultBaseBackoff,
+	MaxBackoff:    DefaultMaxBackoff,
+}
+
+func reloadDBEventConfig() error {
+	defaultConfig.BatchSize = viper.GetInt("event.database.batch-size")
+	defaultConfig.PollInterval = viper.GetDuration("event.database.poll-interval")
+	defaultConfig.LeaseDuration = viper.GetDuration("event.database.lease-duration")
+	defaultConfig.MaxAttempts = viper.GetInt("event.database.max-attempts")
+	defaultConfig.BaseBackoff = viper.GetDuration("event.database.base-backoff")
+	defaultConfig.MaxBackoff = viper.GetDuration("event.database.max-backoff")
+	return nil
+}
+
+func init() {
+	viper.SetDefault("event.database.batch-size", DefaultBatchSize)
+	viper.SetDefault("event.database.poll-interval", DefaultPollInterval)
+	viper.SetDefault("event.database.lease-duration", DefaultLeaseDuration)
+	viper.SetDefault("event.database.max-attempts", DefaultMaxAttempts)
+	viper.SetDefault("event.database.base-backoff", DefaultBaseBackoff)
+	viper.SetDefault("event.database.max-backoff", DefaultMaxBackoff)
+	config.RegisterReloadConfigFunc(reloadDBEventConfig)
+	event.RegisterBusFactory("database", func(engine *xorm.Engine) (event.EventBus, error) {
+		return NewDBEventBus(engine)
+	})
+}
+
+// DefaultConfig 返回当前生效的默认配置
+func DefaultConfig() Config {
+	return defaultConfig
+}
+
+func (c *Config) normalize() {
+	if c.WorkerID == "" {
+		host, _ := os.Hostname()
+		c.WorkerID = fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultBatchSize
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultPollInterval
+	}
+	if c.LeaseDuration <= 0 {
+		c.LeaseDuration = DefaultLeaseDuration
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultMaxAttempts
+	}
+	if c.BaseBackoff <= 0 {
+		c.BaseBackoff = DefaultBaseBackoff
+	}
+	if c.MaxBackoff < c.BaseBackoff {
+		c.MaxBackoff = c.BaseBackoff
+	}
+}
+
+// backoff 第 attempts 次失败后的等待时间: base * 2^(attempts-1)，不超过 MaxBackoff
+func (c *Config) backoff(attempts int) time.Duration {
+	d := c.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= c.MaxBackoff {
+			return c.MaxBackoff
+		}
+	}
+	return d
+}
+
+type subscription struct {
+	ctx     context.Context
+	handler func(*event.Event) error
+}
+
+type topicPoller struct {
+	subs   []*subscription
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
 type DBEventBus struct {
-	engine   *xorm.Engine
-	handlers map[string][]func(*event.Event) error
-	mu       sync.RWMutex
+	engine  *xorm.Engine
+	cfg     Config
+	pollers map[string]*topicPoller
+	mu      sync.RWMutex
+	seq     atomic.Uint64
+	closed  bool
 }
 
+var logger = core.GetLogger()
+
 // NewDBEventBus creates a new database event bus
 func NewDBEventBus(engine *xorm.Engine) (*DBEventBus, error) {
+	return NewDBEventBusWithConfig(engine, DefaultConfig())
+}
+
+// NewDBEventBusWithConfig creates a new database event bus with the given config
+func NewDBEventBusWithConfig(engine *xorm.Engine, cfg Config) (*DBEventBus, error) {
 	// 确保事件表存在
-	err := engine.Sync2(new(event.Event))
+	err := event.InitEventTable(engine)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sync database schema: %w", err)
 	}
-
+	cfg.normalize()
 	return &DBEventBus{
-		engine:   engine,
-		handlers: make(map[string][]func(*event.Event) error),
+		engine:  engine,
+		cfg:     cfg,
+		pollers: make(map[string]*topicPoller),
 	}, nil
 }
 
-func (d *DBEventBus) Publish(ctx context.Context, topic string, evt event.Event) error {
+// WorkerID 返回当前总线的租约持有者标识
+func (d *DBEventBus) WorkerID() string {
+	return d.cfg.WorkerID
+}
+
+func (d *DBEventBus) Publish(ctx context.Context, topic string, evt *event.Event) error {
 	if err := evt.Validate(); err != nil {
 		return fmt.Errorf("invalid event: %w", err)
 	}
 	evt.Topic = topic
-	_, err := d.engine.Insert(&evt)
+	_, err := d.engine.Context(ctx).Insert(evt)
 	return err
 }
 
+// Subscribe 每个 topic 只启动一个轮询协程，同一 topic 的多个 handler 共享认领到的事件
 func (d *DBEventBus) Subscribe(ctx context.Context, topic string, handler func(*event.Event) error) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if d.handlers[topic] == nil {
-		d.handlers[topic] = make([]func(*event.Event) error, 0)
-	}
-	d.handlers[topic] = append(d.handlers[topic], handler)
-
-	// Start a goroutine to poll for new events
-	go func() {
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				var evs []*event.Event
-				err := d.engine.Where("topic = ? AND processed = ?", topic, false).Find(&evs)
+	if d.closed {
+		return fmt.Errorf("event bus is closed")
+	}
+	sub := &subscription{ctx: ctx, handler: handler}
+	if p, ok := d.pollers[topic]; ok {
+		p.subs = append(p.subs, sub)
+		return nil
+	}
+	pctx, cancel := context.WithCancel(context.Background())
+	p := &topicPoller{
+		subs:   []*subscription{sub},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	d.pollers[topic] = p
+	go d.poll(pctx, topic, p)
+	return nil
+}
+
+func (d *DBEventBus) Unsubscribe(topic string) error {
+	d.mu.Lock()
+	p, ok := d.pollers[topic]
+	delete(d.pollers, topic)
+	d.mu.Unlock()
+	if ok {
+		p.cancel()
+		<-p.done
+	}
+	return nil
+}
+
+func (d *DBEventBus) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	pollers := d.pollers
+	d.pollers = make(map[string]*topicPoller)
+	d.mu.Unlock()
+	for _, p := range pollers {
+		p.cancel()
+		<-p.done
+	}
+	return d.engine.Close()
+}
+
+// activeHandlers 剔除 ctx 已结束的订阅，返回仍有效的 handler
+func (d *DBEventBus) activeHandlers(topic string, p *topicPoller) []func(*event.Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subs := p.subs[:0]
+	for _, s := range p.subs {
+		if s.ctx.Err() == nil {
+			subs = append(subs, s)
+		}
+	}
+	p.subs = subs
+	if len(subs) == 0 && d.pollers[topic] == p {
+		delete(d.pollers, topic)
+	}
+	handlers := make([]func(*event.Event) error, len(subs))
+	for i, s := range subs {
+		handlers[i] = s.handler
+	}
+	return handlers
+}
+
+func (d *DBEventBus) poll(ctx context.Context, topic string, p *topicPoller) {
+	defer close(p.done)
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				handlers := d.activeHandlers(topic, p)
+				if len(handlers) == 0 {
+					return
+				}
+				evs, err := d.claim(ctx, topic)
 				if err != nil {
-					continue
+					logger.Error("claim events failed", zap.String("topic", topic), zap.Error(err))
+					break
 				}
-
 				for _, evt := range evs {
-					d.mu.RLock()
-					handlers := d.handlers[topic]
-					d.mu.RUnlock()
-
-					// 只有所有 handler 都成功时才标记为已处理
-					allSuccess := true
-					for _, h := range handlers {
-						if err := h(evt); err != nil {
-							allSuccess = false
-							break
-						}
-					}
-
-					if allSuccess {
-						evt.Processed = true
-						_, err := d.engine.ID(evt.ID).Cols("processed").Update(evt)
-						if err != nil {
-							evt.Processed = false
-						}
+					if ctx.Err() != nil {
+						// 未处理的事件租约到期后会被重新认领
+						return
 					}
+					d.dispatch(evt, handlers)
+				}
+				// 批次未满说明已无积压，等待下一次轮询
+				if len(evs) < d.cfg.BatchSize {
+					break
 				}
 			}
 		}
+	}
+}
+
+// claim 认领一批可处理的事件：先按 id 顺序选出候选，再以带条件的 UPDATE 抢占租约，
+// 只有 UPDATE 成功的行才归当前 worker 所有，从而保证同一时刻每个事件只有一个 worker。
+func (d *DBEventBus) claim(ctx context.Context, topic string) ([]*event.Event, error) {
+	now := time.Now().UnixMilli()
+	var ids []uint64
+	err := d.engine.Context(ctx).Table(new(event.Event)).Cols("id").
+		Where("topic = ? AND processed = ? AND dead = ? AND next_attempt_at <= ? AND lease_until < ?",
+			topic, false, false, now, now).
+		OrderBy("id").Limit(d.cfg.BatchSize).Find(&ids)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	token := fmt.Sprintf("%s#%d", d.cfg.WorkerID, d.seq.Add(1))
+	bld := builder.Dialect(d.engine.DriverName()).
+		Update(builder.Eq{
+			"lease_owner": token,
+			"lease_until": now + d.cfg.LeaseDuration.Milliseconds(),
+			"attempts":    builder.Expr("attempts + 1"),
+		}).From(new(event.Event).TableName()).
+		Where(builder.In("id", ids).
+			And(builder.Eq{"processed": false, "dead": false}).
+			And(builder.Lt{"lease_until": now}))
+	sql, args, err := bld.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	ret, err := d.engine.Context(ctx).Exec(append([]any{sql}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if af, _ := ret.RowsAffected(); af == 0 {
+		return nil, nil
+	}
+
+	var evs []*event.Event
+	err = d.engine.Context(ctx).Where("lease_owner = ?", token).OrderBy("id").Find(&evs)
+	return evs, err
+}
+
+// dispatch 只有所有 handler 都成功时才标记为已处理，否则按退避策略重试或进入死信
+func (d *DBEventBus) dispatch(evt *event.Event, handlers []func(*event.Event) error) {
+	var herr error
+	for _, h := range handlers {
+		if herr = callHandler(h, evt); herr != nil {
+			break
+		}
+	}
+
+	cols := map[string]any{
+		"lease_owner": "",
+		"lease_until": 0,
+	}
+	if herr == nil {
+		cols["processed"] = true
+		cols["last_error"] = ""
+	} else {
+		cols["last_error"] = herr.Error()
+		if evt.Attempts >= d.cfg.MaxAttempts {
+			cols["dead"] = true
+			logger.Warn("event moved to dead letter", zap.Uint64("id", evt.ID),
+				zap.String("topic", evt.Topic), zap.Int("attempts", evt.Attempts), zap.Error(herr))
+		} else {
+			cols["next_attempt_at"] = time.Now().Add(d.cfg.backoff(evt.Attempts)).UnixMilli()
+		}
+	}
+	af, err := d.engine.Table(new(event.Event)).
+		Where("id = ? AND lease_owner = ?", evt.ID, evt.LeaseOwner).Update(cols)
+	if err != nil {
+		logger.Error("update event state failed", zap.Uint64("id", evt.ID), zap.Error(err))
+	} else if af == 0 {
+		// 租约已过期并被其他 worker 认领
+		logger.Warn("event lease lost", zap.Uint64("id", evt.ID), zap.String("owner", evt.LeaseOwner))
+	}
+}
+
+func callHandler(h func(*event.Event) error, evt *event.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
 	}()
+	return h(evt)
+}
 
-	return nil
+// ReplayDead 将死信事件重新投递
+func (d *DBEventBus) ReplayDead(topic string, ids ...uint64) (int64, error) {
+	return ReplayDeadEvents(d.engine, topic, ids)
 }
 
-func (d *DBEventBus) Unsubscribe(topic string) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	delete(d.handlers, topic)
-	return nil
+// ListDeadEvents 查询死信事件，topic 为空时查询所有 topic
+func ListDeadEvents(engine *xorm.Engine, topic string, limit, offset int) ([]*event.Event, error) {
+	sess := engine.Where("dead = ?", true)
+	if topic != "" {
+		sess = sess.And("topic = ?", topic)
+	}
+	if limit <= 0 {
+		limit = DefaultBatchSize
+	}
+	var evs []*event.Event
+	err := sess.OrderBy("id").Limit(limit, offset).Find(&evs)
+	return evs, err
 }
 
-func (d *DBEventBus) Close() error {
-	return d.engine.Close()
+// ReplayDeadEvents 重置死信事件的尝试次数与退避时间，使其重新被轮询；
+// ids 为空时重放 topic 下的全部死信，topic 与 ids 不能同时为空
+func ReplayDeadEvents(engine *xorm.Engine, topic string, ids []uint64) (int64, error) {
+	if topic == "" && len(ids) == 0 {
+		return 0, fmt.Errorf("topic or ids required")
+	}
+	sess := engine.Table(new(event.Event)).Where("dead = ?", true)
+	if topic != "" {
+		sess = sess.And("topic = ?", topic)
+	}
+	if len(ids) > 0 {
+		sess = sess.In("id", ids)
+	}
+	return sess.Update(map[string]any{
+		"dead":            false,
+		"attempts":        0,
+		"next_attempt_at": 0,
+		"lease_owner":     "",
+		"lease_until":     0,
+		"last_error":      "",
+	})
 }
@@ -3,258 +3,275 @@ package database
 import (
 	"context"
 	"errors"
-	"fmt"
-	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/everpan/idig/pkg/event"
 	et "github.com/everpan/idig/pkg/event/testing"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"xorm.io/xorm"
 )
 
-const (
-	schemaVersion = 1
-	testDBPath    = "test.db"
-)
-
 type DBEventBusTestSuite struct {
 	et.EventBusTestSuite
-	engine     *xorm.Engine
-	backupPath string
+	engine *xorm.Engine
 }
 
-func (suite *DBEventBusTestSuite) SetupSuite() {
-	// Create temporary directory for test files
-	tempDir := os.TempDir()
-	suite.backupPath = filepath.Join(tempDir, "backup.db")
+func testConfig() Config {
+	return Config{
+		BatchSize:     10,
+		PollInterval:  50 * time.Millisecond,
+		LeaseDuration: 5 * time.Second,
+		MaxAttempts:   3,
+		BaseBackoff:   10 * time.Millisecond,
+		MaxBackoff:    40 * time.Millisecond,
+	}
 }
 
-func (suite *DBEventBusTestSuite) TearDownSuite() {
-	// Cleanup temporary directory
-	if suite.backupPath != "" {
-		os.RemoveAll(filepath.Dir(suite.backupPath))
+func newTestEngine(t *testing.T) *xorm.Engine {
+	engine, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "event.db"))
+	if err != nil {
+		t.Fatal(err)
 	}
+	// sqlite 并发写入时避免 database is locked
+	engine.SetMaxOpenConns(1)
+	return engine
 }
 
 func (suite *DBEventBusTestSuite) SetupTest() {
-	var err error
-	suite.engine, err = xorm.NewEngine("sqlite3", "/tmp/test.db")
-	suite.Require().NoError(err)
-	suite.engine.ShowSQL(true)
-
-	// 确保表被正确创建
-	err = suite.engine.Sync2(new(event.Event))
-	suite.Require().NoError(err)
-
-	// 清理所有现有数据
-	_, err = suite.engine.Exec("DELETE FROM event")
-	suite.Require().NoError(err)
-
-	eventBus, err := NewDBEventBus(suite.engine)
+	suite.engine = newTestEngine(suite.T())
+	eventBus, err := NewDBEventBusWithConfig(suite.engine, testConfig())
 	suite.Require().NoError(err)
 	suite.EventBus = eventBus
 }
 
-func (suite *DBEventBusTestSuite) backupDatabase() error {
-	// Backup the current database
-	backup, err := os.Create(suite.backupPath)
-	if err != nil {
-		return fmt.Errorf("failed to create backup file: %w", err)
+func (suite *DBEventBusTestSuite) TearDownTest() {
+	if suite.EventBus != nil {
+		_ = suite.EventBus.Close()
 	}
-	defer backup.Close()
-
-	// Export database to backup file
-	_, err = suite.engine.Exec(fmt.Sprintf("VACUUM INTO '%s'", suite.backupPath))
-	return err
 }
 
-func (suite *DBEventBusTestSuite) restoreDatabase() error {
-	// Close current database connection
-	if err := suite.engine.Close(); err != nil {
-		return fmt.Errorf("failed to close database: %w", err)
-	}
-
-	// Create new database connection
-	var err error
-	suite.engine, err = xorm.NewEngine("sqlite3", ":memory:")
-	if err != nil {
-		return fmt.Errorf("failed to open new database: %w", err)
-	}
-
-	// Restore from backup
-	_, err = suite.engine.Exec(fmt.Sprintf(".restore '%s'", suite.backupPath))
-	return err
+func (suite *DBEventBusTestSuite) TestEventBus() {
+	suite.RunEventBusTests()
 }
 
 func (suite *DBEventBusTestSuite) TestDatabaseFeatures() {
 	ctx := context.Background()
-	topic := "test.db.specific"
 
-	// Test event persistence with topic
 	suite.Run("Event Persistence", func() {
+		topic := "test.db.persistence"
 		testEvent := et.NewTestEvent(1, "test.persistence", map[string]interface{}{
 			"message": "persistence test",
 			"nested": map[string]interface{}{
 				"key": "value",
 			},
 		})
-		testEvent.Event.Topic = topic
-		// Publish event
-		err := suite.EventBus.Publish(ctx, topic, testEvent.Event)
+		err := suite.EventBus.Publish(ctx, topic, &testEvent.Event)
 		suite.NoError(err)
+
 		storeEvent := &event.Event{ID: 1}
 		ok, err := suite.engine.Get(storeEvent)
-
 		suite.NoError(err)
-		suite.Equal(true, ok)
-
-		// Verify stored data
-		suite.Equal(testEvent.ID, storeEvent.ID)
+		suite.True(ok)
 		suite.Equal(testEvent.Type, storeEvent.Type)
 		suite.Equal(testEvent.Source, storeEvent.Source)
 		suite.Equal(topic, storeEvent.Topic)
 		suite.False(storeEvent.Processed)
-
-		// suite.Equal(testEvent.Event, *storeEvent)
+		suite.False(storeEvent.Dead)
+		suite.Equal(0, storeEvent.Attempts)
 	})
 
-	// Test subscription and event processing
-	suite.Run("Subscription and Processing", func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		processed := make(chan *event.Event, 1)
-		err := suite.EventBus.Subscribe(ctx, topic, func(e *event.Event) error {
-			processed <- e
-			return nil
-		})
-		suite.NoError(err)
-
-		// Publish events
-		for i := 0; i < 3; i++ {
-			testEvent := et.NewTestEvent(uint64(i), "test.concurrent", map[string]interface{}{})
-			testEvent.Event.Topic = topic
-			err = suite.EventBus.Publish(ctx, topic, testEvent.Event)
-			suite.NoError(err)
+	suite.Run("Ordered Processing", func() {
+		topic := "test.db.ordered"
+		for _, id := range []uint64{30, 10, 20} {
+			e := et.NewTestEvent(id, "test.ordered", map[string]interface{}{"id": id})
+			suite.NoError(suite.EventBus.Publish(ctx, topic, &e.Event))
 		}
-
-		// Wait for events to be processed
-		select {
-		case evt := <-processed:
-			suite.Equal("test.concurrent", evt.Type)
-		case <-ctx.Done():
-			suite.Fail("Timeout waiting for event processing")
-		}
-	})
-
-	// Test concurrent event publishing and processing
-	suite.Run("Concurrent Operations", func() {
-		eventCount := 3
-		processed := make(chan *event.Event, eventCount)
-		var wg sync.WaitGroup
-
-		// Subscribe to events
+		got := make(chan uint64, 3)
 		err := suite.EventBus.Subscribe(ctx, topic, func(e *event.Event) error {
-			processed <- e
+			got <- e.ID
 			return nil
 		})
 		suite.NoError(err)
-		// Publish events concurrently
-		for i := 0; i < eventCount; i++ {
-			wg.Add(1)
-			go func(index int) {
-				defer wg.Done()
-				// 使用时间戳作为 ID 基础，避免冲突
-				id := uint64(time.Now().UnixNano()) + uint64(index)
-				testEvent := et.NewTestEvent(id%100000, "test.concurrent", map[string]interface{}{
-					"index": index,
-				})
-				testEvent.Event.Topic = topic
-				err1 := suite.EventBus.Publish(ctx, topic, testEvent.Event)
-				suite.NoError(err1)
-			}(i)
-		}
-
-		// Wait for all events to be published
-		wg.Wait()
-		time.Sleep(2 * time.Second)
-		// Wait for all events to be processed
-		processedEvents := make(map[uint64]bool)
-		timeout := time.After(20 * time.Second)
-		for i := 0; i < eventCount; i++ {
+		var ids []uint64
+		for i := 0; i < 3; i++ {
 			select {
-			case e := <-processed:
-				processedEvents[e.ID] = true
-			case <-timeout:
-				suite.Fail("Timeout waiting for event processing")
-				goto checkResults
+			case id := <-got:
+				ids = append(ids, id)
+			case <-time.After(5 * time.Second):
+				suite.FailNow("timeout waiting for events")
 			}
 		}
-
-	checkResults:
-		// Verify all events were processed
-		suite.Len(processedEvents, eventCount)
-
-		// Verify database state
-		var events []*event.Event
-		err = suite.engine.Where("type = ? AND processed = ?", "test.concurrent", true).Find(&events)
-		suite.NoError(err)
-		suite.Equal(eventCount, len(events))
+		suite.Equal([]uint64{10, 20, 30}, ids)
 	})
 
-	// Test error handling
-	suite.Run("Error Handling", func() {
-		// Test invalid event
-		invalidEvent := event.Event{} // Empty event
-		err := suite.EventBus.Publish(ctx, topic, invalidEvent)
+	suite.Run("Invalid Event", func() {
+		err := suite.EventBus.Publish(ctx, "test.db.invalid", &event.Event{})
 		suite.Error(err)
-
-		// Test invalid JSON data
-		//_, err = suite.db.Exec(`
-		//	INSERT INTO events (id, type, source, topic, data, timestamp)
-		//	VALUES (?, ?, ?, ?, ?, ?)
-		//`, uint64(time.Now().UnixNano()), "test.error", "test", topic, "invalid json", time.Now())
-		//suite.Error(err)
-
-		// Test subscription error handling
-		// errorChan := make(chan error, 1)
-		err = suite.EventBus.Subscribe(ctx, topic, func(e *event.Event) error {
-			return errors.New("handler error")
-		})
-		suite.NoError(err)
-
 		testEvent := et.NewTestEvent(uint64(time.Now().UnixNano()), "test.error", nil)
-		err = suite.EventBus.Publish(ctx, topic, testEvent.Event)
+		err = suite.EventBus.Publish(ctx, "test.db.invalid", &testEvent.Event)
 		suite.ErrorContains(err, "event Data cannot be nil")
+	})
+}
 
-		// Wait a bit for error processing
-		time.Sleep(2 * time.Second)
+func (suite *DBEventBusTestSuite) TestRetryAndDeadLetter() {
+	ctx := context.Background()
+	topic := "test.db.dead"
+	var calls atomic.Int32
+	err := suite.EventBus.Subscribe(ctx, topic, func(e *event.Event) error {
+		calls.Add(1)
+		return errors.New("handler error")
+	})
+	suite.NoError(err)
+
+	testEvent := et.NewTestEvent(100, "test.dead", map[string]interface{}{"k": "v"})
+	suite.NoError(suite.EventBus.Publish(ctx, topic, &testEvent.Event))
+
+	suite.Eventually(func() bool {
+		evs, err := ListDeadEvents(suite.engine, topic, 0, 0)
+		return err == nil && len(evs) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	suite.Equal(int32(3), calls.Load())
+	evs, err := ListDeadEvents(suite.engine, topic, 0, 0)
+	suite.NoError(err)
+	suite.Equal(3, evs[0].Attempts)
+	suite.Equal("handler error", evs[0].LastError)
+	suite.False(evs[0].Processed)
+
+	// 死信不会再被轮询
+	time.Sleep(200 * time.Millisecond)
+	suite.Equal(int32(3), calls.Load())
+
+	n, err := suite.EventBus.(*DBEventBus).ReplayDead(topic, 100)
+	suite.NoError(err)
+	suite.Equal(int64(1), n)
+	suite.Eventually(func() bool {
+		return calls.Load() > 3
+	}, 5*time.Second, 20*time.Millisecond)
+}
 
-		// Verify event is not marked as processed due to error
-		storeEvent := &event.Event{ID: testEvent.ID}
-		_, err = suite.engine.Get(storeEvent)
-		suite.NoError(err)
-		suite.False(storeEvent.Processed)
+func (suite *DBEventBusTestSuite) TestRetryThenSuccess() {
+	ctx := context.Background()
+	topic := "test.db.retry"
+	var calls atomic.Int32
+	err := suite.EventBus.Subscribe(ctx, topic, func(e *event.Event) error {
+		if calls.Add(1) < 2 {
+			return errors.New("first attempt fails")
+		}
+		return nil
 	})
+	suite.NoError(err)
+
+	testEvent := et.NewTestEvent(200, "test.retry", map[string]interface{}{"k": "v"})
+	suite.NoError(suite.EventBus.Publish(ctx, topic, &testEvent.Event))
+
+	suite.Eventually(func() bool {
+		e := &event.Event{ID: 200}
+		ok, err := suite.engine.Get(e)
+		return err == nil && ok && e.Processed
+	}, 5*time.Second, 20*time.Millisecond)
+	e := &event.Event{ID: 200}
+	_, _ = suite.engine.Get(e)
+	suite.Equal(2, e.Attempts)
+	suite.Empty(e.LeaseOwner)
 }
 
-func (suite *DBEventBusTestSuite) TestEventBus() {
-	suite.RunEventBusTests()
+func TestDBEventBusSuite(t *testing.T) {
+	suite.Run(t, new(DBEventBusTestSuite))
 }
 
-func (suite *DBEventBusTestSuite) TearDownTest() {
-	if suite.EventBus != nil {
-		_ = suite.EventBus.Close()
+func TestDBEventBus_ExclusiveLease(t *testing.T) {
+	engine := newTestEngine(t)
+	cfg := testConfig()
+	cfg.WorkerID = "w1"
+	bus1, err := NewDBEventBusWithConfig(engine, cfg)
+	assert.NoError(t, err)
+	cfg.WorkerID = "w2"
+	bus2, err := NewDBEventBusWithConfig(engine, cfg)
+	assert.NoError(t, err)
+	defer bus1.Close()
+
+	ctx := context.Background()
+	topic := "test.db.lease"
+	eventCount := 50
+	for i := 1; i <= eventCount; i++ {
+		e := et.NewTestEvent(uint64(i), "test.lease", map[string]interface{}{"i": i})
+		assert.NoError(t, bus1.Publish(ctx, topic, &e.Event))
 	}
-	if suite.engine != nil {
-		_ = suite.engine.Close()
+
+	var mu sync.Mutex
+	seen := map[uint64]int{}
+	handler := func(e *event.Event) error {
+		mu.Lock()
+		seen[e.ID]++
+		mu.Unlock()
+		return nil
+	}
+	assert.NoError(t, bus1.Subscribe(ctx, topic, handler))
+	assert.NoError(t, bus2.Subscribe(ctx, topic, handler))
+
+	assert.Eventually(t, func() bool {
+		cnt, err := engine.Where("processed = ?", true).Count(new(event.Event))
+		return err == nil && cnt == int64(eventCount)
+	}, 10*time.Second, 20*time.Millisecond)
+	_ = bus2.Unsubscribe(topic)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, seen, eventCount)
+	for id, n := range seen {
+		assert.Equal(t, 1, n, "event %d handled %d times", id, n)
 	}
 }
 
-func TestDBEventBusSuite(t *testing.T) {
-	suite.Run(t, new(DBEventBusTestSuite))
+func TestConfig_backoff(t *testing.T) {
+	cfg := Config{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	assert.Equal(t, time.Second, cfg.backoff(1))
+	assert.Equal(t, 2*time.Second, cfg.backoff(2))
+	assert.Equal(t, 8*time.Second, cfg.backoff(4))
+	assert.Equal(t, 10*time.Second, cfg.backoff(5))
+}
+
+func TestReplayDeadEvents_RequiresFilter(t *testing.T) {
+	_, err := ReplayDeadEvents(nil, "", nil)
+	assert.Error(t, err)
+}
+
+// legacyEvent 租约列加入之前的事件表
+type legacyEvent struct {
+	ID        uint64    `xorm:"id pk autoincr"`
+	Type      string    `xorm:"varchar(255) notnull index"`
+	Source    string    `xorm:"varchar(255) notnull index"`
+	Topic     string    `xorm:"varchar(255) notnull index"`
+	Data      string    `xorm:"text"`
+	Timestamp time.Time `xorm:"uptime bigint notnull index"`
+	Processed bool      `xorm:"bool"`
+}
+
+func (e *legacyEvent) TableName() string {
+	return "idig_events"
+}
+
+func TestDBEventBus_MigratedRows(t *testing.T) {
+	engine := newTestEngine(t)
+	assert.NoError(t, engine.Sync2(new(legacyEvent)))
+	_, err := engine.Insert(&legacyEvent{ID: 1, Type: "test.legacy", Source: "test", Topic: "test.db.legacy",
+		Data: "{}", Timestamp: time.Now()})
+	assert.NoError(t, err)
+
+	bus, err := NewDBEventBusWithConfig(engine, testConfig())
+	assert.NoError(t, err)
+	defer bus.Close()
+	var handled atomic.Int32
+	assert.NoError(t, bus.Subscribe(context.Background(), "test.db.legacy", func(e *event.Event) error {
+		handled.Add(1)
+		return nil
+	}))
+	assert.Eventually(t, func() bool { return handled.Load() == 1 }, 5*time.Second, 20*time.Millisecond)
 }
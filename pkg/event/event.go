@@ -7,6 +7,7 @@ import (
 	"github.com/everpan/idig/pkg/config"
 	"github.com/everpan/idig/pkg/core"
 	"github.com/spf13/viper"
+	"sync"
 	"time"
 	"xorm.io/xorm"
 )
@@ -18,11 +19,19 @@ var ErrRetry = errors.New("retry event handling")
 type Event struct {
 	ID        uint64                 `json:"id" xorm:"id pk autoincr"`
 	Type      string                 `json:"type" xorm:"varchar(255) notnull index"`
+	Version   int                    `json:"version,omitempty" xorm:"int notnull default 0"` // 数据结构版本，0 表示未指定
 	Source    string                 `json:"source" xorm:"varchar(255) notnull index"`
 	Topic     string                 `json:"topic" xorm:"varchar(255) notnull index"`
 	Data      map[string]interface{} `json:"data" xorm:"text"`
 	Timestamp time.Time              `json:"timestamp" xorm:"uptime bigint notnull index"`
 	Processed bool                   `json:"processed" xorm:"bool"`
+	// 以下字段用于数据库事件总线的租约、重试与死信处理
+	Attempts      int    `json:"attempts,omitempty" xorm:"int notnull default 0"`
+	NextAttemptAt int64  `json:"-" xorm:"bigint notnull default 0 index"`        // unix 毫秒，退避后的下次可处理时间
+	LeaseOwner    string `json:"-" xorm:"varchar(128) notnull default '' index"` // 当前持有租约的 worker 标识
+	LeaseUntil    int64  `json:"-" xorm:"bigint notnull default 0"`              // unix 毫秒，租约到期时间
+	Dead          bool   `json:"dead,omitempty" xorm:"bool notnull default 0 index"`
+	LastError     string `json:"last_error,omitempty" xorm:"text"`
 }
 
 func (e *Event) TableName() string {
@@ -33,8 +42,18 @@ const defaultProvider = "database"
 
 var eventProvider = defaultProvider
 
+// InitEventTable 同步事件表；已存在的表新增的租约列可能为 NULL，补为缺省值，
+// 否则这些事件不满足 dead = false 的认领条件而永远不会被处理
 func InitEventTable(engine *xorm.Engine) error {
-	return engine.Sync2(new(Event))
+	if err := engine.Sync2(new(Event)); err != nil {
+		return err
+	}
+	tbl := new(Event).TableName()
+	if _, err := engine.Exec("UPDATE "+tbl+" SET dead = ? WHERE dead IS NULL", false); err != nil {
+		return err
+	}
+	_, err := engine.Exec("UPDATE " + tbl + " SET lease_owner = '' WHERE lease_owner IS NULL")
+	return err
 }
 
 func reloadEventConfig() error {
@@ -108,3 +127,57 @@ type EventBus interface {
 	Publisher
 	Subscriber
 }
+
+// BusFactory 创建某个 event.provider 的事件总线
+type BusFactory func(engine *xorm.Engine) (EventBus, error)
+
+var (
+	busFactories = map[string]BusFactory{}
+	busWrappers  []func(EventBus) EventBus
+)
+
+// RegisterBusFactory 注册事件总线的实现，通常在实现包的 init 中调用
+func RegisterBusFactory(provider string, factory BusFactory) {
+	busFactories[provider] = factory
+}
+
+// RegisterBusWrapper 注册对 NewEventBus 创建的总线的包装，如负载校验；按注册顺序由内向外包装
+func RegisterBusWrapper(wrapper func(EventBus) EventBus) {
+	busWrappers = append(busWrappers, wrapper)
+}
+
+// NewEventBus 按配置 event.provider 创建事件总线，并依次应用已注册的包装
+func NewEventBus(engine *xorm.Engine) (EventBus, error) {
+	factory, ok := busFactories[eventProvider]
+	if !ok {
+		return nil, fmt.Errorf("event provider '%s' is not registered", eventProvider)
+	}
+	bus, err := factory(engine)
+	if err != nil {
+		return nil, err
+	}
+	for _, wrap := range busWrappers {
+		bus = wrap(bus)
+	}
+	return bus, nil
+}
+
+// 按数据源登记的应用事件总线，服务启动时以 NewEventBus 创建并登记，DML 等通过 BusOf 发布事件
+var buses sync.Map
+
+// RegisterBus 登记数据源 engine 的应用事件总线，bus 为 nil 时取消登记
+func RegisterBus(engine *xorm.Engine, bus EventBus) {
+	if bus == nil {
+		buses.Delete(engine.DataSourceName())
+		return
+	}
+	buses.Store(engine.DataSourceName(), bus)
+}
+
+// BusOf 返回数据源 engine 的应用事件总线，未登记时为 nil
+func BusOf(engine *xorm.Engine) EventBus {
+	if v, ok := buses.Load(engine.DataSourceName()); ok {
+		return v.(EventBus)
+	}
+	return nil
+}
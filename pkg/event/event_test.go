@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"testing"
 	"time"
+
+	"xorm.io/xorm"
 )
 
 func TestEventSerialization(t *testing.T) {
@@ -227,3 +229,31 @@ func TestEventEdgeCases(t *testing.T) {
 		})
 	}
 }
+
+type nopBus struct {
+	EventBus
+	wrapped int
+}
+
+func TestNewEventBus(t *testing.T) {
+	defer func(p string, ws []func(EventBus) EventBus) {
+		eventProvider, busWrappers = p, ws
+	}(eventProvider, busWrappers)
+
+	eventProvider = "test.nop"
+	if _, err := NewEventBus(nil); err == nil {
+		t.Fatal("expected error for unregistered provider")
+	}
+	RegisterBusFactory("test.nop", func(*xorm.Engine) (EventBus, error) { return &nopBus{}, nil })
+	RegisterBusWrapper(func(b EventBus) EventBus {
+		b.(*nopBus).wrapped++
+		return b
+	})
+	bus, err := NewEventBus(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bus.(*nopBus).wrapped; n != 1 {
+		t.Errorf("bus wrapped %d times, want 1", n)
+	}
+}
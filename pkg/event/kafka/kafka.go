@@ -3,42 +3,133 @@ package kafka
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/IBM/sarama"
-	"github.com/everpan/idig/pkg/event"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/event"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"xorm.io/xorm"
 )
 
-type KafkaEventBus struct {
-	producer sarama.SyncProducer
-	consumer sarama.Consumer
-	handlers map[string][]func(*event.Event) error
-	mu       sync.RWMutex
+const (
+	DefaultGroupID          = "idig"
+	DefaultDeadLetterSuffix = ".dlq"
+	DefaultMaxRetries       = 3
+
+	OffsetNewest = "newest"
+	OffsetOldest = "oldest"
+)
+
+// 写入死信消息的 header
+const (
+	HeaderError       = "x-idig-error"
+	HeaderTopic       = "x-idig-topic"
+	HeaderPartition   = "x-idig-partition"
+	HeaderOffset      = "x-idig-offset"
+	HeaderConsumerGrp = "x-idig-group"
+)
+
+// KafkaConfig Kafka 事件总线配置
+type KafkaConfig struct {
+	Brokers         []string
+	GroupID         string // 消费组 id，同组实例分摊分区
+	InitialOffset   string // 无已提交 offset 时的起始位置: newest(默认) 或 oldest
+	DeadLetterTopic string // 处理失败的消息写入的 topic，为空时使用 <topic>.dlq
+	MaxRetries      int    // handler 返回 ErrRetry 时的最大重试次数
+	Sarama          *sarama.Config
 }
 
-// NewKafkaEventBus creates a new Kafka event bus
-func NewKafkaEventBus(brokers []string) (*KafkaEventBus, error) {
-	config := sarama.NewConfig()
+func (c *KafkaConfig) saramaConfig() (*sarama.Config, error) {
+	config := c.Sarama
+	if config == nil {
+		config = sarama.NewConfig()
+	}
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Retry.Max = 5
 	config.Producer.Return.Successes = true
+	config.Consumer.Return.Errors = true
+	switch c.InitialOffset {
+	case "", OffsetNewest:
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	case OffsetOldest:
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	default:
+		return nil, fmt.Errorf("invalid initial offset '%s', must be '%s' or '%s'",
+			c.InitialOffset, OffsetNewest, OffsetOldest)
+	}
+	return config, nil
+}
+
+type groupConsumer struct {
+	group  sarama.ConsumerGroup
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type KafkaEventBus struct {
+	producer  sarama.SyncProducer
+	newGroup  func(groupID string) (sarama.ConsumerGroup, error)
+	cfg       KafkaConfig
+	handlers  map[string][]func(*event.Event) error
+	consumers map[string]*groupConsumer
+	mu        sync.RWMutex
+}
+
+var logger = core.GetLogger()
+
+func init() {
+	viper.SetDefault("event.kafka.brokers", []string{})
+	viper.SetDefault("event.kafka.group-id", DefaultGroupID)
+	event.RegisterBusFactory("kafka", func(*xorm.Engine) (event.EventBus, error) {
+		return NewKafkaEventBusWithConfig(KafkaConfig{
+			Brokers:         viper.GetStringSlice("event.kafka.brokers"),
+			GroupID:         viper.GetString("event.kafka.group-id"),
+			DeadLetterTopic: viper.GetString("event.kafka.dead-letter-topic"),
+		})
+	})
+}
+
+// NewKafkaEventBus creates a new Kafka event bus
+func NewKafkaEventBus(brokers []string) (*KafkaEventBus, error) {
+	return NewKafkaEventBusWithConfig(KafkaConfig{Brokers: brokers})
+}
 
-	producer, err := sarama.NewSyncProducer(brokers, config)
+// NewKafkaEventBusWithConfig creates a new Kafka event bus with consumer group settings
+func NewKafkaEventBusWithConfig(cfg KafkaConfig) (*KafkaEventBus, error) {
+	config, err := cfg.saramaConfig()
 	if err != nil {
 		return nil, err
 	}
-
-	consumer, err := sarama.NewConsumer(brokers, config)
+	producer, err := sarama.NewSyncProducer(cfg.Brokers, config)
 	if err != nil {
 		return nil, err
 	}
+	return newKafkaEventBus(cfg, producer, func(groupID string) (sarama.ConsumerGroup, error) {
+		return sarama.NewConsumerGroup(cfg.Brokers, groupID, config)
+	}), nil
+}
 
+func newKafkaEventBus(cfg KafkaConfig, producer sarama.SyncProducer,
+	newGroup func(groupID string) (sarama.ConsumerGroup, error)) *KafkaEventBus {
+	if cfg.GroupID == "" {
+		cfg.GroupID = DefaultGroupID
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
 	return &KafkaEventBus{
-		producer: producer,
-		consumer: consumer,
-		handlers: make(map[string][]func(*event.Event) error),
-	}, nil
+		producer:  producer,
+		newGroup:  newGroup,
+		cfg:       cfg,
+		handlers:  make(map[string][]func(*event.Event) error),
+		consumers: make(map[string]*groupConsumer),
+	}
 }
 
 func (k *KafkaEventBus) Publish(ctx context.Context, topic string, evt *event.Event) error {
@@ -63,94 +154,196 @@ func (k *KafkaEventBus) Publish(ctx context.Context, topic string, evt *event.Ev
 	return nil
 }
 
+// DeadLetterTopic 返回 topic 对应的死信 topic
+func (k *KafkaEventBus) DeadLetterTopic(topic string) string {
+	if k.cfg.DeadLetterTopic != "" {
+		return k.cfg.DeadLetterTopic
+	}
+	return topic + DefaultDeadLetterSuffix
+}
+
+// Subscribe 以消费组方式订阅 topic 的全部分区，同一 topic 只创建一个消费组成员
 func (k *KafkaEventBus) Subscribe(ctx context.Context, topic string, handler func(*event.Event) error) error {
 	k.mu.Lock()
-	if k.handlers[topic] == nil {
-		k.handlers[topic] = make([]func(*event.Event) error, 0)
-	}
+	defer k.mu.Unlock()
 	k.handlers[topic] = append(k.handlers[topic], handler)
-	k.mu.Unlock()
+	if _, ok := k.consumers[topic]; ok {
+		return nil
+	}
 
-	partitionConsumer, err := k.consumer.ConsumePartition(topic, 0, sarama.OffsetNewest)
+	group, err := k.newGroup(k.cfg.GroupID)
 	if err != nil {
-		return fmt.Errorf("failed to create partition consumer: %w", err)
+		return fmt.Errorf("failed to create consumer group: %w", err)
 	}
+	cctx, cancel := context.WithCancel(ctx)
+	gc := &groupConsumer{group: group, cancel: cancel, done: make(chan struct{})}
+	k.consumers[topic] = gc
 
 	go func() {
-		defer partitionConsumer.Close()
-
+		for err := range group.Errors() {
+			logger.Error("kafka consumer group error", zap.String("topic", topic), zap.Error(err))
+		}
+	}()
+	go func() {
+		defer close(gc.done)
+		h := &groupHandler{bus: k, topic: topic}
 		for {
-			select {
-			case msg := <-partitionConsumer.Messages():
-				var evt event.Event
-				if err := json.Unmarshal(msg.Value, &evt); err != nil {
-					// Log error and continue
-					continue
+			// 每次 rebalance 后 Consume 返回，需要重新加入消费组
+			if err := group.Consume(cctx, []string{topic}, h); err != nil {
+				if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+					return
 				}
-
-				if err := evt.Validate(); err != nil {
-					// Log error and continue
-					continue
+				logger.Error("kafka consume failed", zap.String("topic", topic), zap.Error(err))
+				select {
+				case <-cctx.Done():
+					return
+				case <-time.After(time.Second):
 				}
-
-				k.mu.RLock()
-				handlers := k.handlers[topic]
-				k.mu.RUnlock()
-
-				for _, h := range handlers {
-					maxRetries := 3
-					retryCount := 0
-					for {
-						if err := h(&evt); err != nil {
-							if err == event.ErrRetry {
-								if retryCount < maxRetries {
-									retryCount++
-									time.Sleep(time.Duration(retryCount) * time.Second)
-									continue
-								}
-							}
-							// Log other errors and break retry loop
-							break
-						}
-						break // Success, break retry loop
-					}
-				}
-			case err := <-partitionConsumer.Errors():
-				// Log consumer errors
-				if err != nil {
-					// Consider implementing a proper error handling strategy
-					continue
-				}
-			case <-ctx.Done():
+			}
+			if cctx.Err() != nil {
 				return
 			}
 		}
 	}()
-
 	return nil
 }
 
 func (k *KafkaEventBus) Unsubscribe(topic string) error {
 	k.mu.Lock()
 	delete(k.handlers, topic)
+	gc, ok := k.consumers[topic]
+	delete(k.consumers, topic)
 	k.mu.Unlock()
+	if ok {
+		return gc.close()
+	}
 	return nil
 }
 
+func (gc *groupConsumer) close() error {
+	gc.cancel()
+	err := gc.group.Close()
+	<-gc.done
+	return err
+}
+
 func (k *KafkaEventBus) Close() error {
 	k.mu.Lock()
-	defer k.mu.Unlock()
+	consumers := k.consumers
+	k.consumers = make(map[string]*groupConsumer)
+	k.mu.Unlock()
 
 	var errs []error
+	for topic, gc := range consumers {
+		if err := gc.close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close consumer group of %s: %w", topic, err))
+		}
+	}
 	if err := k.producer.Close(); err != nil {
 		errs = append(errs, fmt.Errorf("failed to close producer: %w", err))
 	}
-	if err := k.consumer.Close(); err != nil {
-		errs = append(errs, fmt.Errorf("failed to close consumer: %w", err))
-	}
 
 	if len(errs) > 0 {
 		return fmt.Errorf("failed to close kafka event bus: %v", errs)
 	}
 	return nil
 }
+
+// handle 依次调用 topic 的 handler，返回 ErrRetry 时按次数线性退避重试
+func (k *KafkaEventBus) handle(topic string, evt *event.Event) error {
+	k.mu.RLock()
+	handlers := k.handlers[topic]
+	k.mu.RUnlock()
+
+	for _, h := range handlers {
+		retryCount := 0
+		for {
+			err := h(evt)
+			if err == nil {
+				break // Success, break retry loop
+			}
+			if errors.Is(err, event.ErrRetry) && retryCount < k.cfg.MaxRetries {
+				retryCount++
+				time.Sleep(time.Duration(retryCount) * time.Second)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// sendToDeadLetter 将无法处理的原始消息连同错误信息写入死信 topic
+func (k *KafkaEventBus) sendToDeadLetter(msg *sarama.ConsumerMessage, cause error) error {
+	dlq := &sarama.ProducerMessage{
+		Topic: k.DeadLetterTopic(msg.Topic),
+		Key:   sarama.ByteEncoder(msg.Key),
+		Value: sarama.ByteEncoder(msg.Value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(HeaderError), Value: []byte(cause.Error())},
+			{Key: []byte(HeaderTopic), Value: []byte(msg.Topic)},
+			{Key: []byte(HeaderPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+			{Key: []byte(HeaderOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+			{Key: []byte(HeaderConsumerGrp), Value: []byte(k.cfg.GroupID)},
+		},
+	}
+	_, _, err := k.producer.SendMessage(dlq)
+	return err
+}
+
+// process 处理单条消息，返回 nil 表示该消息可以提交 offset
+func (k *KafkaEventBus) process(msg *sarama.ConsumerMessage) error {
+	var evt event.Event
+	err := json.Unmarshal(msg.Value, &evt)
+	if err == nil {
+		err = evt.Validate()
+	}
+	if err == nil {
+		err = k.handle(msg.Topic, &evt)
+	}
+	if err == nil {
+		return nil
+	}
+	logger.Warn("kafka message failed, send to dead letter", zap.String("topic", msg.Topic),
+		zap.Int32("partition", msg.Partition), zap.Int64("offset", msg.Offset), zap.Error(err))
+	if dlqErr := k.sendToDeadLetter(msg, err); dlqErr != nil {
+		return fmt.Errorf("failed to send dead letter: %w", dlqErr)
+	}
+	return nil
+}
+
+// groupHandler 实现 sarama.ConsumerGroupHandler
+type groupHandler struct {
+	bus   *KafkaEventBus
+	topic string
+}
+
+func (h *groupHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	logger.Info("kafka partitions assigned", zap.String("group", h.bus.cfg.GroupID),
+		zap.String("member", sess.MemberID()), zap.Any("claims", sess.Claims()))
+	return nil
+}
+
+func (h *groupHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
+	logger.Info("kafka partitions revoked", zap.String("group", h.bus.cfg.GroupID),
+		zap.String("member", sess.MemberID()), zap.Any("claims", sess.Claims()))
+	return nil
+}
+
+func (h *groupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if err := h.bus.process(msg); err != nil {
+				// 不提交 offset，结束本次会话，rebalance 后从未提交处重新消费
+				return err
+			}
+			sess.MarkMessage(msg, "")
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+}
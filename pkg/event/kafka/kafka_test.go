@@ -2,215 +2,289 @@ package kafka
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"testing"
+	"time"
+
 	"github.com/IBM/sarama"
 	"github.com/IBM/sarama/mocks"
 	"github.com/everpan/idig/pkg/event"
 	eventesting "github.com/everpan/idig/pkg/event/testing"
-	"github.com/stretchr/testify/suite"
-	"testing"
-	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-type KafkaEventBusTestSuite struct {
-	eventesting.EventBusTestSuite
-	mockProducer *mocks.SyncProducer
-	mockConsumer *mocks.Consumer
+// fakeSession 实现 sarama.ConsumerGroupSession，记录已标记的消息
+type fakeSession struct {
+	ctx    context.Context
+	mu     sync.Mutex
+	marked []int64
 }
 
-func (suite *KafkaEventBusTestSuite) SetupTest() {
-	suite.mockProducer = mocks.NewSyncProducer(suite.T(), nil)
-	suite.mockConsumer = mocks.NewConsumer(suite.T(), nil)
+func (s *fakeSession) Claims() map[string][]int32               { return nil }
+func (s *fakeSession) MemberID() string                         { return "member" }
+func (s *fakeSession) GenerationID() int32                      { return 1 }
+func (s *fakeSession) MarkOffset(string, int32, int64, string)  {}
+func (s *fakeSession) Commit()                                  {}
+func (s *fakeSession) ResetOffset(string, int32, int64, string) {}
+func (s *fakeSession) Context() context.Context                 { return s.ctx }
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, msg.Offset)
+}
 
-	eventBus := &KafkaEventBus{
-		producer: suite.mockProducer,
-		consumer: suite.mockConsumer,
-		handlers: make(map[string][]func(event.Event) error),
-	}
-	suite.EventBus = eventBus
+type fakeClaim struct {
+	topic string
+	msgs  chan *sarama.ConsumerMessage
 }
 
-func (suite *KafkaEventBusTestSuite) TearDownTest() {
-	if suite.EventBus != nil {
-		_ = suite.EventBus.Close()
-	}
-	suite.mockProducer.Close()
-	suite.mockConsumer.Close()
+func (c *fakeClaim) Topic() string                            { return c.topic }
+func (c *fakeClaim) Partition() int32                         { return 0 }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.msgs }
+
+func newTestBus(t *testing.T, producer sarama.SyncProducer) *KafkaEventBus {
+	return newKafkaEventBus(KafkaConfig{GroupID: "test-group"}, producer,
+		func(string) (sarama.ConsumerGroup, error) {
+			return nil, errors.New("consumer group not available in unit test")
+		})
 }
 
-func TestKafkaEventBusSuite(t *testing.T) {
-	suite.Run(t, new(KafkaEventBusTestSuite))
+func encodeEvent(t *testing.T, id uint64, data map[string]interface{}) []byte {
+	te := eventesting.NewTestEvent(id, "test.kafka", data)
+	b, err := json.Marshal(&te.Event)
+	require.NoError(t, err)
+	return b
 }
 
-// TestKafkaSpecificFeatures tests Kafka-specific features
-func (suite *KafkaEventBusTestSuite) TestKafkaSpecificFeatures() {
-	ctx := context.Background()
-	topic := "test.kafka.specific"
+func consume(t *testing.T, bus *KafkaEventBus, topic string, msgs ...*sarama.ConsumerMessage) (*fakeSession, error) {
+	sess := &fakeSession{ctx: context.Background()}
+	claim := &fakeClaim{topic: topic, msgs: make(chan *sarama.ConsumerMessage, len(msgs))}
+	for _, m := range msgs {
+		claim.msgs <- m
+	}
+	close(claim.msgs)
+	h := &groupHandler{bus: bus, topic: topic}
+	return sess, h.ConsumeClaim(sess, claim)
+}
 
-	// Test message acknowledgment
-	suite.Run("Message Acknowledgment", func() {
-		testEvent := eventesting.NewTestEvent("test.ack", map[string]interface{}{
-			"message": "ack test",
-		})
-		// func(val []byte) error
-		// Setup producer expectations
-		suite.mockProducer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
-			//msg, ok := val.(*sarama.ProducerMessage)
-			//if !ok {
-			//	return false
-			//}
-			//return msg.Topic == topic
-			return nil
-		})
+func TestKafkaEventBus_Publish(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	bus := newTestBus(t, producer)
+	defer bus.Close()
 
-		err := suite.EventBus.Publish(ctx, topic, testEvent.Event)
-		suite.NoError(err)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		if msg.Topic != "test.publish" {
+			return fmt.Errorf("unexpected topic %s", msg.Topic)
+		}
+		return nil
 	})
+	te := eventesting.NewTestEvent(1, "test.publish", map[string]interface{}{"k": "v"})
+	assert.NoError(t, bus.Publish(context.Background(), "test.publish", &te.Event))
 
-	// Test consumer group behavior
-	suite.Run("Consumer Group Behavior", func() {
-		testEvent := eventesting.NewTestEvent("test.consumer", map[string]interface{}{
-			"message": "consumer test",
-		})
+	// 无效事件不会发送
+	assert.Error(t, bus.Publish(context.Background(), "test.publish", &event.Event{}))
+}
 
-		processed := make(chan bool, 1) // 使用带缓冲的通道
-		defer close(processed)
+func TestGroupHandler_ConsumeAndMark(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	bus := newTestBus(t, producer)
+	defer bus.Close()
 
-		err := suite.EventBus.Subscribe(ctx, topic, func(e event.Event) error {
-			select {
-			case processed <- true:
-			default:
-			}
-			return nil
-		})
-		suite.NoError(err)
-
-		// Create mock partition consumer
-		mockPartitionConsumer := suite.mockConsumer.ExpectConsumePartition(topic, 0, sarama.OffsetNewest)
-		defer mockPartitionConsumer.Close()
-
-		// Simulate message arrival
-		testMessage := fmt.Sprintf(`{"id":"%s","type":"%s","source":"%s","data":%s,"timestamp":"%s"}`,
-			testEvent.ID,
-			testEvent.Type,
-			testEvent.Source,
-			`{"message":"consumer test"}`,
-			testEvent.Timestamp.Format(time.RFC3339),
-		)
-
-		mockPartitionConsumer.YieldMessage(&sarama.ConsumerMessage{
-			Topic: topic,
-			Value: []byte(testMessage),
+	topic := "test.consume"
+	var got []float64
+	bus.handlers[topic] = append(bus.handlers[topic], func(e *event.Event) error {
+		got = append(got, e.Data["order"].(float64))
+		return nil
+	})
+	var msgs []*sarama.ConsumerMessage
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, &sarama.ConsumerMessage{
+			Topic: topic, Offset: int64(i),
+			Value: encodeEvent(t, uint64(i+1), map[string]interface{}{"order": i}),
 		})
+	}
+	sess, err := consume(t, bus, topic, msgs...)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0, 1, 2}, got)
+	assert.Equal(t, []int64{0, 1, 2}, sess.marked)
+}
 
-		select {
-		case <-processed:
-			// Success
-		case <-time.After(10 * time.Second): // 增加超时时间
-			suite.Fail("Timeout waiting for message processing")
-		}
-	})
+func TestGroupHandler_DeadLetter(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	bus := newTestBus(t, producer)
+	defer bus.Close()
 
-	// Test message retry
-	suite.Run("Message Retry", func() {
-		retryCount := 0
-		maxRetries := 3
-		processed := make(chan bool, 1)
-		defer close(processed)
-
-		err := suite.EventBus.Subscribe(ctx, topic, func(e event.Event) error {
-			retryCount++
-			if retryCount < maxRetries {
-				return event.ErrRetry
+	topic := "test.dead"
+	bus.handlers[topic] = append(bus.handlers[topic], func(e *event.Event) error {
+		return errors.New("handler failed")
+	})
+	checkDLQ := func(cause string) mocks.MessageChecker {
+		return func(msg *sarama.ProducerMessage) error {
+			if msg.Topic != topic+DefaultDeadLetterSuffix {
+				return fmt.Errorf("unexpected dead letter topic %s", msg.Topic)
+			}
+			for _, h := range msg.Headers {
+				if string(h.Key) == HeaderError && string(h.Value) != cause {
+					return fmt.Errorf("unexpected error header %s", h.Value)
+				}
 			}
-			processed <- true
 			return nil
-		})
-		suite.NoError(err)
+		}
+	}
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(checkDLQ("handler failed"))
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(checkDLQ("event ID cannot be zero"))
 
-		testEvent := eventesting.NewTestEvent("test.retry", map[string]interface{}{
-			"message": "retry test",
-		})
+	sess, err := consume(t, bus, topic,
+		&sarama.ConsumerMessage{Topic: topic, Offset: 7, Value: encodeEvent(t, 7, map[string]interface{}{})},
+		&sarama.ConsumerMessage{Topic: topic, Offset: 8, Value: []byte(`{"type":"invalid"}`)},
+	)
+	assert.NoError(t, err)
+	// 写入死信后 offset 照常提交
+	assert.Equal(t, []int64{7, 8}, sess.marked)
+}
 
-		// Create mock partition consumer
-		mockPartitionConsumer := suite.mockConsumer.ExpectConsumePartition(topic, 0, sarama.OffsetNewest)
-		defer mockPartitionConsumer.Close()
-
-		// Simulate message arrival with retries
-		testMessage := fmt.Sprintf(`{"id":"%s","type":"%s","source":"%s","data":%s,"timestamp":"%s"}`,
-			testEvent.ID,
-			testEvent.Type,
-			testEvent.Source,
-			`{"message":"retry test"}`,
-			testEvent.Timestamp.Format(time.RFC3339),
-		)
-
-		// Send the message multiple times to simulate retries
-		for i := 0; i < maxRetries; i++ {
-			mockPartitionConsumer.YieldMessage(&sarama.ConsumerMessage{
-				Topic: topic,
-				Value: []byte(testMessage),
-			})
-		}
+func TestGroupHandler_DeadLetterFailureStopsCommit(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	bus := newTestBus(t, producer)
+	defer bus.Close()
 
-		select {
-		case <-processed:
-			suite.Equal(maxRetries, retryCount)
-		case <-time.After(10 * time.Second):
-			suite.Fail("Timeout waiting for message retries")
+	topic := "test.dead.fail"
+	bus.handlers[topic] = append(bus.handlers[topic], func(e *event.Event) error {
+		return errors.New("handler failed")
+	})
+	producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+
+	sess, err := consume(t, bus, topic,
+		&sarama.ConsumerMessage{Topic: topic, Offset: 1, Value: encodeEvent(t, 1, map[string]interface{}{})},
+		&sarama.ConsumerMessage{Topic: topic, Offset: 2, Value: encodeEvent(t, 2, map[string]interface{}{})},
+	)
+	assert.Error(t, err)
+	assert.Empty(t, sess.marked)
+}
+
+func TestKafkaEventBus_RetryThenSucceed(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	bus := newTestBus(t, producer)
+	defer bus.Close()
+
+	topic := "test.retry"
+	calls := 0
+	bus.handlers[topic] = append(bus.handlers[topic], func(e *event.Event) error {
+		calls++
+		if calls < 2 {
+			return event.ErrRetry
 		}
+		return nil
 	})
+	sess, err := consume(t, bus, topic,
+		&sarama.ConsumerMessage{Topic: topic, Offset: 0, Value: encodeEvent(t, 1, map[string]interface{}{})})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []int64{0}, sess.marked)
+}
 
-	// Test message ordering
-	suite.Run("Message Ordering", func() {
-		messageCount := 5
-		receivedMessages := make(chan int, messageCount)
-		defer close(receivedMessages)
+func TestKafkaConfig_InitialOffset(t *testing.T) {
+	c := KafkaConfig{InitialOffset: OffsetOldest}
+	config, err := c.saramaConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.OffsetOldest, config.Consumer.Offsets.Initial)
+
+	c = KafkaConfig{}
+	config, err = c.saramaConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, sarama.OffsetNewest, config.Consumer.Offsets.Initial)
+
+	c = KafkaConfig{InitialOffset: "latest"}
+	_, err = c.saramaConfig()
+	assert.Error(t, err)
+}
 
-		err := suite.EventBus.Subscribe(ctx, topic, func(e event.Event) error {
-			if order, ok := e.Data["order"].(float64); ok {
-				receivedMessages <- int(order)
+// TestKafkaEventBus_ConsumerGroup 通过 mock broker 验证消费组会消费所有分区并提交 offset
+func TestKafkaEventBus_ConsumerGroup(t *testing.T) {
+	const (
+		topic = "test.group"
+		group = "test-group"
+	)
+	broker := sarama.NewMockBroker(t, 0)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()).
+			SetLeader(topic, 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 2).
+			SetOffset(topic, 1, sarama.OffsetOldest, 0).
+			SetOffset(topic, 1, sarama.OffsetNewest, 1),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, group, broker),
+		"HeartbeatRequest": sarama.NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGroupProtocol(sarama.RangeBalanceStrategyName),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&sarama.ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics:  map[string][]int32{topic: {0, 1}},
+			}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset(group, topic, 0, -1, "", sarama.ErrNoError).
+			SetOffset(group, topic, 1, -1, "", sarama.ErrNoError).
+			SetError(sarama.ErrNoError),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 2).
+			SetMessage(topic, 0, 0, sarama.ByteEncoder(encodeEvent(t, 1, map[string]interface{}{"p": 0}))).
+			SetMessage(topic, 0, 1, sarama.ByteEncoder(encodeEvent(t, 2, map[string]interface{}{"p": 0}))).
+			SetMessage(topic, 1, 0, sarama.ByteEncoder(encodeEvent(t, 3, map[string]interface{}{"p": 1}))),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+	})
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_0_0_0
+	config.Consumer.Offsets.AutoCommit.Interval = 50 * time.Millisecond
+	bus := newKafkaEventBus(KafkaConfig{GroupID: group}, mocks.NewSyncProducer(t, nil),
+		func(groupID string) (sarama.ConsumerGroup, error) {
+			c := KafkaConfig{InitialOffset: OffsetOldest, Sarama: config}
+			cfg, err := c.saramaConfig()
+			if err != nil {
+				return nil, err
 			}
-			return nil
+			return sarama.NewConsumerGroup([]string{broker.Addr()}, groupID, cfg)
 		})
-		suite.NoError(err)
-
-		// Setup mock partition consumer
-		mockPartitionConsumer := suite.mockConsumer.ExpectConsumePartition(topic, 0, sarama.OffsetNewest)
-		defer mockPartitionConsumer.Close()
-
-		// Send messages in order
-		for i := 0; i < messageCount; i++ {
-			testMessage := fmt.Sprintf(`{"id":"test-%d","type":"test.order","source":"test_service","data":{"order":%d},"timestamp":"%s"}`,
-				i, i, time.Now().Format(time.RFC3339))
-			mockPartitionConsumer.YieldMessage(&sarama.ConsumerMessage{
-				Topic: topic,
-				Value: []byte(testMessage),
-			})
-		}
 
-		// Collect messages with timeout
-		receivedOrder := make([]int, 0, messageCount)
-		timeout := time.After(10 * time.Second)
-
-		for i := 0; i < messageCount; i++ {
-			select {
-			case order := <-receivedMessages:
-				receivedOrder = append(receivedOrder, order)
-			case <-timeout:
-				suite.Fail("Timeout waiting for messages")
-				return
-			}
-		}
+	received := make(chan uint64, 3)
+	err := bus.Subscribe(context.Background(), topic, func(e *event.Event) error {
+		received <- e.ID
+		return nil
+	})
+	require.NoError(t, err)
 
-		// Verify message order
-		suite.Equal(messageCount, len(receivedOrder))
-		for i := 0; i < messageCount; i++ {
-			suite.Equal(i, receivedOrder[i])
+	seen := map[uint64]bool{}
+	timeout := time.After(10 * time.Second)
+	for len(seen) < 3 {
+		select {
+		case id := <-received:
+			seen[id] = true
+		case <-timeout:
+			t.Fatalf("timeout waiting for events, got %v", seen)
 		}
-	})
-}
+	}
+	assert.Equal(t, map[uint64]bool{1: true, 2: true, 3: true}, seen)
 
-func (suite *KafkaEventBusTestSuite) TestEventBus() {
-	suite.RunEventBusTests()
+	assert.Eventually(t, func() bool {
+		for _, r := range broker.History() {
+			if _, ok := r.Request.(*sarama.OffsetCommitRequest); ok {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NoError(t, bus.Close())
 }
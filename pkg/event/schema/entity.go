@@ -0,0 +1,76 @@
+package schema
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+)
+
+// FromJMeta 由实体元数据推导 object schema：每个属性按 SQL 类型映射为 JSON 类型，
+// 可空属性允许 null，枚举属性限定取值，未声明的属性不允许出现
+func FromJMeta(jm *meta.JMeta) *Schema {
+	closed := false
+	s := &Schema{
+		Type:                 Types{TypeObject},
+		Properties:           make(map[string]*Schema),
+		AdditionalProperties: &closed,
+		Description:          jm.Entity,
+	}
+	for _, attrs := range jm.Attrs {
+		for _, attr := range attrs {
+			if _, ok := s.Properties[attr.Name]; ok {
+				// 属性表中的外键与主表主键同名，保留先出现的定义
+				continue
+			}
+			s.Properties[attr.Name] = FromAttr(attr)
+		}
+	}
+	return s
+}
+
+// FromAttr 将单个属性转换为 schema
+func FromAttr(attr *meta.Attr) *Schema {
+	s := &Schema{Description: attr.Comment}
+	t := strings.ToLower(attr.Type)
+	switch {
+	case strings.Contains(t, "bool"):
+		s.Type = Types{TypeBoolean}
+	case strings.Contains(t, "int") || t == "serial" || t == "bigserial" || t == "bit":
+		s.Type = Types{TypeInteger}
+	case strings.Contains(t, "decimal") || strings.Contains(t, "numeric") || strings.Contains(t, "float") ||
+		strings.Contains(t, "double") || strings.Contains(t, "real") || strings.Contains(t, "money"):
+		s.Type = Types{TypeNumber}
+	case t == "date":
+		s.Type = Types{TypeString}
+		s.Format = "date"
+	case strings.Contains(t, "datetime") || strings.Contains(t, "timestamp"):
+		s.Type = Types{TypeString}
+		s.Format = "date-time"
+	case strings.Contains(t, "json"):
+		// json 列可以是任意结构
+	default:
+		s.Type = Types{TypeString}
+		if (strings.Contains(t, "char") || strings.Contains(t, "binary")) && attr.Length1 > 0 {
+			l := int(attr.Length1)
+			s.MaxLength = &l
+		}
+	}
+	if len(attr.EnumOptions) > 0 {
+		opts := make([]string, 0, len(attr.EnumOptions))
+		for opt := range attr.EnumOptions {
+			opts = append(opts, opt)
+		}
+		sort.Strings(opts)
+		for _, opt := range opts {
+			s.Enum = append(s.Enum, opt)
+		}
+	}
+	if attr.Nullable && len(s.Type) > 0 {
+		s.Type = append(s.Type, TypeNull)
+		if len(s.Enum) > 0 {
+			s.Enum = append(s.Enum, nil)
+		}
+	}
+	return s
+}
@@ -0,0 +1,200 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/everpan/idig/pkg/config"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/event"
+	"github.com/spf13/viper"
+)
+
+// Common errors
+var (
+	ErrUnknownEventType = errors.New("no schema registered for event type")
+	ErrUnknownVersion   = errors.New("no schema registered for event version")
+)
+
+// ValidationError 事件负载不符合 schema 时返回，包含全部违反项
+type ValidationError struct {
+	Type       string      `json:"type"`
+	Version    int         `json:"version"`
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.String()
+	}
+	return fmt.Sprintf("event '%s' v%d is invalid: %s", e.Type, e.Version, strings.Join(msgs, "; "))
+}
+
+// Registry 维护事件类型到 schema 的映射，同一类型可注册多个版本
+type Registry struct {
+	mu      sync.RWMutex
+	schemas map[string]map[int]*Schema
+	// Strict 为 true 时，未注册 schema 的事件类型会被拒绝
+	Strict bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{schemas: make(map[string]map[int]*Schema)}
+}
+
+var defaultRegistry = NewRegistry()
+
+// validateBus 为 true 时 event.NewEventBus 创建的总线按全局 registry 校验事件负载；
+// 缺省开启，未注册 schema 的事件类型只在 event.schema.strict 时被拒绝
+var validateBus = true
+
+func reloadSchemaConfig() error {
+	validateBus = viper.GetBool("event.schema.validate")
+	defaultRegistry.Strict = viper.GetBool("event.schema.strict")
+	return nil
+}
+
+func init() {
+	viper.SetDefault("event.schema.validate", validateBus)
+	viper.SetDefault("event.schema.strict", false)
+	config.RegisterReloadConfigFunc(reloadSchemaConfig)
+	event.RegisterBusWrapper(wrapBus)
+}
+
+// wrapBus 按配置 event.schema.validate 以 ValidatingBus 包装总线
+func wrapBus(bus event.EventBus) event.EventBus {
+	if !validateBus {
+		return bus
+	}
+	return NewValidatingBus(bus, defaultRegistry)
+}
+
+// Default 返回全局 registry
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Register 注册事件类型某个版本的 schema，版本号从 1 开始
+func (r *Registry) Register(eventType string, version int, s *Schema) error {
+	if eventType == "" || s == nil {
+		return fmt.Errorf("event type and schema are required")
+	}
+	if version < 1 {
+		return fmt.Errorf("schema version must be >= 1, got %d", version)
+	}
+	if err := s.Compile(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vs, ok := r.schemas[eventType]
+	if !ok {
+		vs = make(map[int]*Schema)
+		r.schemas[eventType] = vs
+	}
+	vs[version] = s
+	return nil
+}
+
+// RegisterJSON 以 JSON Schema 文本注册
+func (r *Registry) RegisterJSON(eventType string, version int, data []byte) error {
+	s, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	return r.Register(eventType, version, s)
+}
+
+// RegisterEntity 以实体元数据推导出的 schema 注册
+func (r *Registry) RegisterEntity(eventType string, version int, jm *meta.JMeta) error {
+	if jm == nil {
+		return meta.ErrNilParameter
+	}
+	return r.Register(eventType, version, FromJMeta(jm))
+}
+
+// Versions 返回事件类型已注册的版本，升序
+func (r *Registry) Versions(eventType string) []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var vs []int
+	for v := range r.schemas[eventType] {
+		vs = append(vs, v)
+	}
+	slices.Sort(vs)
+	return vs
+}
+
+// Lookup 查找 schema；version 为 0 时返回最新版本，同时返回实际使用的版本号
+func (r *Registry) Lookup(eventType string, version int) (*Schema, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	vs, ok := r.schemas[eventType]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: '%s'", ErrUnknownEventType, eventType)
+	}
+	if version == 0 {
+		for v := range vs {
+			version = max(version, v)
+		}
+	}
+	s, ok := vs[version]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: '%s' v%d", ErrUnknownVersion, eventType, version)
+	}
+	return s, version, nil
+}
+
+// Validate 按事件的类型与版本校验 Data，返回校验所用的版本：事件未指定版本时为最新版本；
+// 未注册类型仅在 Strict 模式下报错，否则返回事件自身的版本。不修改事件
+func (r *Registry) Validate(e *event.Event) (int, error) {
+	s, version, err := r.Lookup(e.Type, e.Version)
+	if err != nil {
+		if errors.Is(err, ErrUnknownEventType) && !r.Strict {
+			return e.Version, nil
+		}
+		return 0, err
+	}
+	if vs := s.Validate(e.Data); len(vs) > 0 {
+		return version, &ValidationError{Type: e.Type, Version: version, Violations: vs}
+	}
+	return version, nil
+}
+
+// ValidatingBus 在发布与消费时按 registry 校验事件负载
+type ValidatingBus struct {
+	event.EventBus
+	registry *Registry
+}
+
+func NewValidatingBus(bus event.EventBus, registry *Registry) *ValidatingBus {
+	if registry == nil {
+		registry = defaultRegistry
+	}
+	return &ValidatingBus{EventBus: bus, registry: registry}
+}
+
+// Publish 校验通过后发布，未指定版本的事件记录校验所用的版本
+func (b *ValidatingBus) Publish(ctx context.Context, topic string, evt *event.Event) error {
+	version, err := b.registry.Validate(evt)
+	if err != nil {
+		return fmt.Errorf("invalid event: %w", err)
+	}
+	evt.Version = version
+	return b.EventBus.Publish(ctx, topic, evt)
+}
+
+// Subscribe 校验失败的事件不会交给 handler，而是返回错误，由底层总线按其重试/死信策略处理
+func (b *ValidatingBus) Subscribe(ctx context.Context, topic string, handler func(*event.Event) error) error {
+	return b.EventBus.Subscribe(ctx, topic, func(evt *event.Event) error {
+		if _, err := b.registry.Validate(evt); err != nil {
+			return err
+		}
+		return handler(evt)
+	})
+}
@@ -0,0 +1,309 @@
+package schema
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/goccy/go-json"
+)
+
+// JSON Schema 类型
+const (
+	TypeObject  = "object"
+	TypeArray   = "array"
+	TypeString  = "string"
+	TypeNumber  = "number"
+	TypeInteger = "integer"
+	TypeBoolean = "boolean"
+	TypeNull    = "null"
+)
+
+// Schema 是 JSON Schema (draft-07) 的子集，覆盖事件负载校验常用的关键字:
+// type、properties、required、additionalProperties、items、enum、
+// minimum/maximum、minLength/maxLength、pattern、format(date-time/date)
+type Schema struct {
+	Type                 Types              `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Types 对应 type 关键字，既可以是单个字符串也可以是数组
+type Types []string
+
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = Types{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("schema type must be string or []string: %w", err)
+	}
+	*t = many
+	return nil
+}
+
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// Parse 从 JSON 解析并编译 schema
+func Parse(data []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid json schema: %w", err)
+	}
+	if err := s.Compile(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Compile 检查关键字并预编译 pattern
+func (s *Schema) Compile() error {
+	for _, t := range s.Type {
+		switch t {
+		case TypeObject, TypeArray, TypeString, TypeNumber, TypeInteger, TypeBoolean, TypeNull:
+		default:
+			return fmt.Errorf("unknown schema type '%s'", t)
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern '%s': %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	for name, p := range s.Properties {
+		if err := p.Compile(); err != nil {
+			return fmt.Errorf("property '%s': %w", name, err)
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.Compile(); err != nil {
+			return fmt.Errorf("items: %w", err)
+		}
+	}
+	return nil
+}
+
+// Violation 描述一处校验失败
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// Validate 校验 v，返回所有违反的规则
+func (s *Schema) Validate(v any) []Violation {
+	var vs []Violation
+	s.validate("data", v, &vs)
+	return vs
+}
+
+func (s *Schema) validate(path string, v any, vs *[]Violation) {
+	add := func(format string, args ...any) {
+		*vs = append(*vs, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	kind := jsonKind(v)
+	if len(s.Type) > 0 && !s.Type.accept(kind, v) {
+		add("expected %s, got %s", strings.Join(s.Type, " or "), kind)
+		return
+	}
+	if len(s.Enum) > 0 && !containsValue(s.Enum, v) {
+		add("value %v is not one of %v", v, s.Enum)
+	}
+	switch kind {
+	case TypeObject:
+		s.validateObject(path, v, vs)
+	case TypeArray:
+		if s.Items != nil {
+			rv := reflect.ValueOf(v)
+			for i := 0; i < rv.Len(); i++ {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), rv.Index(i).Interface(), vs)
+			}
+		}
+	case TypeString:
+		str := toString(v)
+		n := utf8.RuneCountInString(str)
+		if s.MinLength != nil && n < *s.MinLength {
+			add("length %d is less than %d", n, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			add("length %d exceeds %d", n, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			add("'%s' does not match pattern '%s'", str, s.Pattern)
+		}
+		if err := checkFormat(s.Format, v, str); err != nil {
+			add("%v", err)
+		}
+	case TypeNumber, TypeInteger:
+		f, _ := toFloat(v)
+		if s.Minimum != nil && f < *s.Minimum {
+			add("%v is less than minimum %v", f, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			add("%v is greater than maximum %v", f, *s.Maximum)
+		}
+	}
+}
+
+func (s *Schema) validateObject(path string, v any, vs *[]Violation) {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	for _, r := range s.Required {
+		if _, ok := obj[r]; !ok {
+			*vs = append(*vs, Violation{Path: path + "." + r, Message: "is required"})
+		}
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if p, ok := s.Properties[k]; ok {
+			p.validate(path+"."+k, obj[k], vs)
+		} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+			*vs = append(*vs, Violation{Path: path + "." + k, Message: "is not allowed"})
+		}
+	}
+}
+
+func (t Types) accept(kind string, v any) bool {
+	for _, want := range t {
+		if want == kind {
+			return true
+		}
+		if want == TypeNumber && kind == TypeInteger {
+			return true
+		}
+		if want == TypeInteger && kind == TypeNumber {
+			if f, ok := toFloat(v); ok && f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonKind 返回 Go 值对应的 JSON 类型；整数返回 integer
+func jsonKind(v any) string {
+	if v == nil {
+		return TypeNull
+	}
+	if _, ok := v.(time.Time); ok {
+		return TypeString
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		return TypeObject
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return TypeString
+		}
+		return TypeArray
+	case reflect.String:
+		return TypeString
+	case reflect.Bool:
+		return TypeBoolean
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return TypeInteger
+	case reflect.Float32, reflect.Float64:
+		return TypeNumber
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return TypeNull
+		}
+		return jsonKind(rv.Elem().Interface())
+	}
+	return rv.Kind().String()
+}
+
+func toFloat(v any) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func toString(v any) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case time.Time:
+		return s.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func containsValue(enum []any, v any) bool {
+	f, isNum := toFloat(v)
+	return slices.ContainsFunc(enum, func(e any) bool {
+		if isNum {
+			if ef, ok := toFloat(e); ok {
+				return ef == f
+			}
+		}
+		return reflect.DeepEqual(e, v)
+	})
+}
+
+func checkFormat(format string, v any, s string) error {
+	if _, ok := v.(time.Time); ok {
+		return nil
+	}
+	switch format {
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			if _, err = time.Parse(time.DateTime, s); err != nil {
+				return fmt.Errorf("'%s' is not a valid date-time", s)
+			}
+		}
+	case "date":
+		if _, err := time.Parse(time.DateOnly, s); err != nil {
+			return fmt.Errorf("'%s' is not a valid date", s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/event"
+	_ "github.com/everpan/idig/pkg/event/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm"
+)
+
+const employeeSchema = `{
+	"type": "object",
+	"required": ["id", "name"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"name": {"type": "string", "minLength": 1, "maxLength": 8},
+		"mobile": {"type": ["string", "null"], "pattern": "^1[0-9]{10}$"},
+		"gender": {"enum": ["male", "female"]},
+		"salary": {"type": "number", "maximum": 100000},
+		"tags": {"type": "array", "items": {"type": "string"}},
+		"joined": {"type": "string", "format": "date"}
+	}
+}`
+
+func TestSchema_Validate(t *testing.T) {
+	s, err := Parse([]byte(employeeSchema))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		data  map[string]any
+		paths []string
+	}{
+		{"valid", map[string]any{"id": float64(1), "name": "tom", "mobile": nil, "gender": "male",
+			"salary": 12.5, "tags": []any{"a"}, "joined": "2024-01-02"}, nil},
+		{"go int types", map[string]any{"id": 3, "name": "tom", "salary": int64(100)}, nil},
+		{"missing required", map[string]any{"id": float64(1)}, []string{"data.name"}},
+		{"wrong types", map[string]any{"id": "1", "name": 2}, []string{"data.id", "data.name"}},
+		{"fraction for integer", map[string]any{"id": 1.5, "name": "tom"}, []string{"data.id"}},
+		{"constraints", map[string]any{"id": float64(0), "name": "too long name", "mobile": "123",
+			"gender": "x", "salary": float64(200000), "tags": []any{"a", 1}, "joined": "2024/01/02"},
+			[]string{"data.gender", "data.id", "data.joined", "data.mobile", "data.name", "data.salary", "data.tags[1]"}},
+		{"additional property", map[string]any{"id": float64(1), "name": "tom", "other": 1}, []string{"data.other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			for _, v := range s.Validate(tt.data) {
+				paths = append(paths, v.Path)
+			}
+			assert.Equal(t, tt.paths, paths)
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	_, err := Parse([]byte(`{"type": "strin"}`))
+	assert.ErrorContains(t, err, "unknown schema type")
+	_, err = Parse([]byte(`{"type": "string", "pattern": "("}`))
+	assert.ErrorContains(t, err, "invalid pattern")
+}
+
+func TestRegistry_Versions(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.RegisterJSON("employee.created", 1,
+		[]byte(`{"type":"object","required":["name"]}`)))
+	require.NoError(t, r.RegisterJSON("employee.created", 2,
+		[]byte(`{"type":"object","required":["name","mobile"]}`)))
+	assert.Error(t, r.RegisterJSON("employee.created", 0, []byte(`{}`)))
+	assert.Equal(t, []int{1, 2}, r.Versions("employee.created"))
+
+	// 未指定版本按最新版本校验
+	e := event.NewEvent(1, "employee.created", "test", map[string]any{"name": "tom"})
+	v, err := r.Validate(e)
+	var ve *ValidationError
+	require.ErrorAs(t, err, &ve)
+	assert.Equal(t, 2, ve.Version)
+	assert.Equal(t, 2, v)
+	assert.Contains(t, err.Error(), "data.mobile: is required")
+
+	// 旧版本事件按旧 schema 校验
+	e.Version = 1
+	v, err = r.Validate(e)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+
+	e.Version = 3
+	_, err = r.Validate(e)
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+
+	// 返回校验所用的版本，不修改事件
+	e = event.NewEvent(2, "employee.created", "test", map[string]any{"name": "tom", "mobile": "1"})
+	v, err = r.Validate(e)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v)
+	assert.Equal(t, 0, e.Version)
+
+	unknown := event.NewEvent(3, "unknown", "test", map[string]any{})
+	_, err = r.Validate(unknown)
+	assert.NoError(t, err)
+	r.Strict = true
+	_, err = r.Validate(unknown)
+	assert.ErrorIs(t, err, ErrUnknownEventType)
+}
+
+func TestFromJMeta(t *testing.T) {
+	jm := &meta.JMeta{
+		Entity: "employee",
+		Attrs: map[string][]*meta.Attr{
+			"employee": {
+				{Name: "id", Type: "integer"},
+				{Name: "name", Type: "varchar", Length1: 4},
+				{Name: "salary", Type: "decimal", Nullable: true},
+				{Name: "birthday", Type: "date"},
+				{Name: "created", Type: "datetime"},
+				{Name: "gender", Type: "enum", EnumOptions: map[string]int{"male": 0, "female": 1}},
+			},
+		},
+	}
+	r := NewRegistry()
+	require.NoError(t, r.RegisterEntity("employee.updated", 1, jm))
+
+	e := event.NewEvent(1, "employee.updated", "test", map[string]any{
+		"id": float64(1), "name": "tom", "salary": nil, "birthday": "2000-01-01",
+		"created": time.Now(), "gender": "male",
+	})
+	_, err := r.Validate(e)
+	assert.NoError(t, err)
+
+	e.Data = map[string]any{"id": "x", "name": "tommy", "gender": "other", "age": 1}
+	_, err = r.Validate(e)
+	require.Error(t, err)
+	for _, p := range []string{"data.id", "data.name", "data.gender", "data.age"} {
+		assert.Contains(t, err.Error(), p)
+	}
+}
+
+type recordBus struct {
+	published []*event.Event
+	handler   func(*event.Event) error
+}
+
+func (b *recordBus) Publish(_ context.Context, _ string, e *event.Event) error {
+	b.published = append(b.published, e)
+	return nil
+}
+func (b *recordBus) Subscribe(_ context.Context, _ string, h func(*event.Event) error) error {
+	b.handler = h
+	return nil
+}
+func (b *recordBus) Unsubscribe(string) error { return nil }
+func (b *recordBus) Close() error             { return nil }
+
+func TestValidatingBus(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.RegisterJSON("t", 1, []byte(`{"type":"object","required":["k"]}`)))
+	inner := &recordBus{}
+	bus := NewValidatingBus(inner, r)
+	ctx := context.Background()
+
+	assert.Error(t, bus.Publish(ctx, "topic", event.NewEvent(1, "t", "s", map[string]any{})))
+	assert.NoError(t, bus.Publish(ctx, "topic", event.NewEvent(2, "t", "s", map[string]any{"k": 1})))
+	assert.Len(t, inner.published, 1)
+	assert.Equal(t, 1, inner.published[0].Version)
+
+	called := 0
+	require.NoError(t, bus.Subscribe(ctx, "topic", func(*event.Event) error {
+		called++
+		return nil
+	}))
+	var ve *ValidationError
+	assert.True(t, errors.As(inner.handler(event.NewEvent(3, "t", "s", map[string]any{})), &ve))
+	assert.NoError(t, inner.handler(event.NewEvent(4, "t", "s", map[string]any{"k": 1})))
+	assert.Equal(t, 1, called)
+}
+
+func TestWrapBus(t *testing.T) {
+	inner := &recordBus{}
+	defer func() { validateBus = true }()
+	bus, ok := wrapBus(inner).(*ValidatingBus)
+	require.True(t, ok)
+	assert.Same(t, defaultRegistry, bus.registry)
+	validateBus = false
+	assert.Same(t, inner, wrapBus(inner))
+}
+
+// 应用以 event.NewEventBus 创建的总线缺省按全局 registry 校验，发布不符合 schema 的事件被拒绝
+func TestNewEventBus_validates(t *testing.T) {
+	require.NoError(t, Default().RegisterJSON("schema.test.created", 1, []byte(`{"type":"object","required":["k"]}`)))
+	engine, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "event.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = engine.Close() })
+	bus, err := event.NewEventBus(engine)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = bus.Close() })
+
+	ctx := context.Background()
+	err = bus.Publish(ctx, "schema.test", event.NewEvent(1, "schema.test.created", "s", map[string]any{}))
+	var ve *ValidationError
+	assert.True(t, errors.As(err, &ve), err)
+	assert.NoError(t, bus.Publish(ctx, "schema.test", event.NewEvent(2, "schema.test.created", "s", map[string]any{"k": 1})))
+	n, err := engine.Table(new(event.Event)).Where("type = ?", "schema.test.created").Count()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
@@ -63,7 +63,7 @@ func (suite *EventBusTestSuite) TestBasicPublishSubscribe() {
 	})
 	suite.NoError(err)
 
-	err = suite.EventBus.Publish(ctx, topic, testEvent.Event)
+	err = suite.EventBus.Publish(ctx, topic, &testEvent.Event)
 	suite.NoError(err)
 
 	select {
@@ -99,7 +99,7 @@ func (suite *EventBusTestSuite) TestMultipleSubscribers() {
 	})
 	suite.NoError(err)
 
-	err = suite.EventBus.Publish(ctx, topic, testEvent.Event)
+	err = suite.EventBus.Publish(ctx, topic, &testEvent.Event)
 	suite.NoError(err)
 
 	for i, ch := range []chan *event.Event{received1, received2} {
@@ -133,7 +133,7 @@ func (suite *EventBusTestSuite) TestUnsubscribe() {
 	err = suite.EventBus.Unsubscribe(topic)
 	suite.NoError(err)
 
-	err = suite.EventBus.Publish(ctx, topic, testEvent.Event)
+	err = suite.EventBus.Publish(ctx, topic, &testEvent.Event)
 	suite.NoError(err)
 
 	select {
@@ -168,7 +168,7 @@ func (suite *EventBusTestSuite) TestConcurrentPublishing() {
 			testEvent := NewTestEvent(uint64(time.Now().UnixNano()), "test.concurrent", map[string]interface{}{
 				"counter": i,
 			})
-			err := suite.EventBus.Publish(ctx, topic, testEvent.Event)
+			err := suite.EventBus.Publish(ctx, topic, &testEvent.Event)
 			suite.NoError(err)
 		}(i)
 	}
@@ -196,7 +196,7 @@ func (suite *EventBusTestSuite) TestErrorHandling() {
 		"message": "error test",
 	})
 
-	err = suite.EventBus.Publish(ctx, topic, testEvent.Event)
+	err = suite.EventBus.Publish(ctx, topic, &testEvent.Event)
 	suite.NoError(err) // Publishing should succeed even if handler returns error
 }
 
@@ -220,7 +220,7 @@ func (suite *EventBusTestSuite) TestLargeEventData() {
 	})
 	suite.NoError(err)
 
-	err = suite.EventBus.Publish(ctx, topic, testEvent.Event)
+	err = suite.EventBus.Publish(ctx, topic, &testEvent.Event)
 	suite.NoError(err)
 
 	select {
@@ -253,7 +253,7 @@ func (suite *EventBusTestSuite) TestMultipleTopics() {
 		testEvent := NewTestEvent(uint64(time.Now().UnixNano()), topic, map[string]interface{}{
 			"topic": topic,
 		})
-		err := suite.EventBus.Publish(ctx, topic, testEvent.Event)
+		err := suite.EventBus.Publish(ctx, topic, &testEvent.Event)
 		suite.NoError(err)
 	}
 
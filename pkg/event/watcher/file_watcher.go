@@ -2,63 +2,419 @@ package watcher
 
 import (
 	"context"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/everpan/idig/pkg/event" // Adjust the import path accordingly
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/event"
 	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
 )
 
+var logger = core.GetLogger()
+
+// 事件类型，同时作为默认 topic
+const (
+	TypeCreate = "file.create"
+	TypeWrite  = "file.write"
+	TypeRemove = "file.remove"
+	TypeRename = "file.rename"
+	TypeChmod  = "file.chmod"
+)
+
+const (
+	DefaultDebounce        = 100 * time.Millisecond
+	DefaultMaxChecksumSize = 64 << 20 // 超过该大小的文件不计算校验和
+	AllOps                 = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod
+)
+
+var ErrClosed = errors.New("file watcher is closed")
+
+// Options 文件监听配置
+type Options struct {
+	Recursive bool     // 监听目录时是否包含子目录，新建的子目录会自动加入
+	Include   []string // glob，匹配相对监听根目录的路径或文件名，为空时全部包含；支持 '**'
+	Exclude   []string // glob，优先于 Include，匹配的目录不会被递归监听
+	// Ops 关注的操作，为 0 时关注全部操作
+	Ops fsnotify.Op
+	// Debounce 同一路径在该时间内的多次操作合并为一个事件，小于 0 时不合并
+	Debounce time.Duration
+	// Topics 按事件类型（如 file.write）覆盖发布的 topic，未配置的类型使用 Topic，再次之使用事件类型本身
+	Topics map[string]string
+	Topic  string
+	// Checksum 是否为普通文件计算 sha256
+	Checksum        bool
+	MaxChecksumSize int64
+}
+
+// DefaultOptions 返回默认配置：关注全部操作，100ms 防抖
+func DefaultOptions() *Options {
+	return &Options{
+		Ops:             AllOps,
+		Debounce:        DefaultDebounce,
+		MaxChecksumSize: DefaultMaxChecksumSize,
+	}
+}
+
+// pending 防抖窗口内某路径累积的操作
+type pending struct {
+	root     string
+	ops      fsnotify.Op
+	deadline time.Time
+}
+
 // FileWatcher monitors file changes and triggers events
 type FileWatcher struct {
 	watcher *fsnotify.Watcher
 	bus     event.EventBus
+	opts    *Options
+	seq     atomic.Uint64
+
+	mu      sync.Mutex
+	roots   []string // 监听的根路径，用于计算相对路径
+	pending map[string]*pending
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewFileWatcher creates a new FileWatcher
+// NewFileWatcher creates a new FileWatcher with DefaultOptions
 func NewFileWatcher(bus event.EventBus) (*FileWatcher, error) {
+	return NewFileWatcherWithOptions(bus, DefaultOptions())
+}
+
+// NewFileWatcherWithOptions creates a new FileWatcher and starts its single event loop
+func NewFileWatcherWithOptions(bus event.EventBus, opts *Options) (*FileWatcher, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	o := *opts
+	opts = &o
+	if opts.Ops == 0 {
+		opts.Ops = AllOps
+	}
+	if opts.MaxChecksumSize <= 0 {
+		opts.MaxChecksumSize = DefaultMaxChecksumSize
+	}
+	for _, p := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := filepath.Match(strings.ReplaceAll(p, "**", "*"), ""); err != nil {
+			return nil, err
+		}
+	}
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
-	return &FileWatcher{watcher: watcher, bus: bus}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	fw := &FileWatcher{
+		watcher: watcher,
+		bus:     bus,
+		opts:    opts,
+		pending: make(map[string]*pending),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	fw.seq.Store(uint64(time.Now().UnixNano()))
+	go fw.handleEvents()
+	return fw, nil
 }
 
-// Watch starts watching the specified file
-func (fw *FileWatcher) Watch(filePath string) error {
-	if err := fw.watcher.Add(filePath); err != nil {
+// Watch starts watching the specified file or directory; it may be called multiple times
+func (fw *FileWatcher) Watch(path string) error {
+	if fw.ctx.Err() != nil {
+		return ErrClosed
+	}
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
 		return err
 	}
-	go fw.handleEvents()
+	root := path
+	if !info.IsDir() {
+		root = filepath.Dir(path)
+	}
+	if err = fw.watcher.Add(path); err != nil {
+		return err
+	}
+	fw.mu.Lock()
+	fw.roots = append(fw.roots, root)
+	fw.mu.Unlock()
+	if info.IsDir() && fw.opts.Recursive {
+		return fw.addSubDirs(root, path)
+	}
 	return nil
 }
 
-// handleEvents listens for file system events and triggers corresponding events
+// addSubDirs 递归监听 dir 下未被排除的子目录
+func (fw *FileWatcher) addSubDirs(root, dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == dir {
+			return nil
+		}
+		if fw.excluded(fw.relPath(root, p)) {
+			return filepath.SkipDir
+		}
+		return fw.watcher.Add(p)
+	})
+}
+
+// handleEvents 唯一的事件循环：收集 fsnotify 事件，防抖后发布
 func (fw *FileWatcher) handleEvents() {
+	defer close(fw.done)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
 	for {
 		select {
+		case <-fw.ctx.Done():
+			timer.Stop()
+			fw.flush(true)
+			return
 		case ev, ok := <-fw.watcher.Events:
 			if !ok {
+				fw.flush(true)
 				return
 			}
-			if ev.Op.Has(fsnotify.Write) {
-				// Trigger an event when the file is written to
-				fw.bus.Publish(context.Background(), "file.write", &event.Event{
-					Type:      "file.write",
-					Source:    ev.Name,
-					Timestamp: time.Now(),
-				})
+			fw.collect(ev)
+			if fw.opts.Debounce < 0 {
+				fw.flush(true)
+			} else {
+				timer.Reset(fw.opts.Debounce)
+			}
+		case <-timer.C:
+			if next := fw.flush(false); next > 0 {
+				timer.Reset(next)
 			}
 		case err, ok := <-fw.watcher.Errors:
 			if !ok {
+				fw.flush(true)
 				return
 			}
-			fmt.Println("Error watching file:", err)
+			logger.Error("watching file error", zap.Error(err))
+		}
+	}
+}
+
+// collect 将 fsnotify 事件加入待发布队列
+func (fw *FileWatcher) collect(ev fsnotify.Event) {
+	root := fw.rootOf(ev.Name)
+	if fw.opts.Recursive && ev.Op.Has(fsnotify.Create) {
+		if info, err := os.Stat(ev.Name); err == nil && info.IsDir() && !fw.excluded(fw.relPath(root, ev.Name)) {
+			if err = fw.watcher.Add(ev.Name); err != nil {
+				logger.Error("watch new directory failed", zap.String("path", ev.Name), zap.Error(err))
+			} else if err = fw.addSubDirs(root, ev.Name); err != nil {
+				logger.Error("watch new directory failed", zap.String("path", ev.Name), zap.Error(err))
+			}
+		}
+	}
+	op := ev.Op & fw.opts.Ops
+	if op == 0 || !fw.matched(fw.relPath(root, ev.Name)) {
+		return
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	p, ok := fw.pending[ev.Name]
+	if !ok {
+		p = &pending{root: root}
+		fw.pending[ev.Name] = p
+	}
+	p.ops |= op
+	p.deadline = time.Now().Add(fw.opts.Debounce)
+}
+
+// flush 发布到期的事件，all 为 true 时发布全部；返回下一个到期的等待时间
+func (fw *FileWatcher) flush(all bool) time.Duration {
+	now := time.Now()
+	var next time.Duration
+	fw.mu.Lock()
+	ready := make(map[string]*pending)
+	for path, p := range fw.pending {
+		if all || !p.deadline.After(now) {
+			ready[path] = p
+			delete(fw.pending, path)
+		} else if wait := p.deadline.Sub(now); next == 0 || wait < next {
+			next = wait
+		}
+	}
+	fw.mu.Unlock()
+	for path, p := range ready {
+		fw.publish(path, p)
+	}
+	return next
+}
+
+// primaryType 合并后的操作按 remove > rename > create > write > chmod 确定事件类型
+func primaryType(op fsnotify.Op) string {
+	switch {
+	case op.Has(fsnotify.Remove):
+		return TypeRemove
+	case op.Has(fsnotify.Rename):
+		return TypeRename
+	case op.Has(fsnotify.Create):
+		return TypeCreate
+	case op.Has(fsnotify.Write):
+		return TypeWrite
+	}
+	return TypeChmod
+}
+
+func opNames(op fsnotify.Op) []string {
+	var names []string
+	for _, o := range []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove, fsnotify.Rename, fsnotify.Chmod} {
+		if op.Has(o) {
+			names = append(names, strings.ToLower(o.String()))
+		}
+	}
+	return names
+}
+
+// topicOf 返回事件类型对应的 topic
+func (o *Options) topicOf(typ string) string {
+	if t, ok := o.Topics[typ]; ok && t != "" {
+		return t
+	}
+	if o.Topic != "" {
+		return o.Topic
+	}
+	return typ
+}
+
+func (fw *FileWatcher) publish(path string, p *pending) {
+	ops := p.ops
+	info, err := os.Stat(path)
+	if err == nil && ops.Has(fsnotify.Create) {
+		// 删除或改名后又在原路径创建（如编辑器的原子保存），以最终存在的文件为准
+		ops &^= fsnotify.Remove | fsnotify.Rename
+	}
+	typ := primaryType(ops)
+	data := map[string]interface{}{
+		"path": path,
+		"rel":  fw.relPath(p.root, path),
+		"name": filepath.Base(path),
+		"ops":  opNames(p.ops),
+	}
+	if err == nil && typ != TypeRemove && typ != TypeRename {
+		data["size"] = info.Size()
+		data["mtime"] = info.ModTime()
+		data["is_dir"] = info.IsDir()
+		if fw.opts.Checksum && info.Mode().IsRegular() && info.Size() <= fw.opts.MaxChecksumSize {
+			if sum, err1 := checksum(path); err1 == nil {
+				data["checksum"] = sum
+			}
+		}
+	}
+	evt := event.NewEvent(fw.seq.Add(1), typ, path, data)
+	if err := fw.bus.Publish(context.Background(), fw.opts.topicOf(typ), evt); err != nil {
+		logger.Error("publish file event failed", zap.String("path", path), zap.String("type", typ), zap.Error(err))
+	}
+}
+
+func checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// rootOf 返回包含 path 的最长监听根路径
+func (fw *FileWatcher) rootOf(path string) string {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	root := filepath.Dir(path)
+	best := -1
+	for _, r := range fw.roots {
+		if (path == r || strings.HasPrefix(path, r+string(filepath.Separator))) && len(r) > best {
+			root, best = r, len(r)
+		}
+	}
+	return root
+}
+
+func (fw *FileWatcher) relPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return filepath.ToSlash(filepath.Base(path))
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (fw *FileWatcher) excluded(rel string) bool {
+	return matchAny(fw.opts.Exclude, rel)
+}
+
+func (fw *FileWatcher) matched(rel string) bool {
+	if fw.excluded(rel) {
+		return false
+	}
+	return len(fw.opts.Include) == 0 || matchAny(fw.opts.Include, rel)
+}
+
+// matchAny 不含 '/' 的模式匹配文件名，否则匹配相对路径
+func matchAny(patterns []string, rel string) bool {
+	base := rel[strings.LastIndex(rel, "/")+1:]
+	for _, p := range patterns {
+		if !strings.Contains(p, "/") {
+			if ok, _ := filepath.Match(p, base); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlob(strings.Split(p, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob 逐段匹配，'**' 匹配零个或多个目录
+func matchGlob(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchGlob(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], parts[0]); !ok {
+			return false
 		}
+		pattern, parts = pattern[1:], parts[1:]
 	}
+	return len(parts) == 0
 }
 
-// Close stops watching and closes the watcher
+// Close stops the event loop, publishes pending events and closes the watcher
 func (fw *FileWatcher) Close() error {
-	return fw.watcher.Close()
+	var err error
+	fw.closeOnce.Do(func() {
+		fw.cancel()
+		<-fw.done
+		err = fw.watcher.Close()
+	})
+	return err
 }
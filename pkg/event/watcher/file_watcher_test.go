@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,18 +13,25 @@ import (
 
 // MockEventBus is a mock implementation of the EventBus interface
 type MockEventBus struct {
+	mu                 sync.Mutex
 	publishedEvents    []event.Event
+	topics             []string
 	subscribedHandlers map[string][]func(*event.Event) error
 }
 
 // Publish implements the Publish method of EventBus
 func (m *MockEventBus) Publish(ctx context.Context, topic string, event *event.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.publishedEvents = append(m.publishedEvents, *event)
+	m.topics = append(m.topics, topic)
 	return nil
 }
 
 // Subscribe implements the Subscribe method of EventBus
 func (m *MockEventBus) Subscribe(ctx context.Context, topic string, handler func(*event.Event) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.subscribedHandlers == nil {
 		m.subscribedHandlers = make(map[string][]func(*event.Event) error)
 	}
@@ -44,7 +52,34 @@ func (m *MockEventBus) Close() error {
 
 // GetPublishedEvents returns the published events
 func (m *MockEventBus) GetPublishedEvents() []event.Event {
-	return m.publishedEvents
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]event.Event(nil), m.publishedEvents...)
+}
+
+// waitEvents waits until at least n events are published
+func (m *MockEventBus) waitEvents(t *testing.T, n int) []event.Event {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if evs := m.GetPublishedEvents(); len(evs) >= n {
+			return evs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	evs := m.GetPublishedEvents()
+	t.Fatalf("Expected at least %d published events, got %d", n, len(evs))
+	return evs
+}
+
+// findEvent returns the first event of the given type for path
+func findEvent(evs []event.Event, typ, path string) *event.Event {
+	for i := range evs {
+		if evs[i].Type == typ && evs[i].Data["path"] == path {
+			return &evs[i]
+		}
+	}
+	return nil
 }
 
 // TestNewFileWatcher tests the NewFileWatcher function
@@ -57,41 +92,63 @@ func TestNewFileWatcher(t *testing.T) {
 	if fw == nil {
 		t.Fatal("Expected FileWatcher, got nil")
 	}
+	_ = fw.Close()
 }
 
 // TestWatch tests the Watch method
 func TestWatch(t *testing.T) {
 	bus := &MockEventBus{}
 	fw, _ := NewFileWatcher(bus)
-	testFile := filepath.Join(os.TempDir(), "testfile.txt")
+	defer fw.Close()
+	testFile := filepath.Join(t.TempDir(), "testfile.txt")
 	os.WriteFile(testFile, []byte("test content"), 0644)
-	defer os.Remove(testFile)
 
+	if err := fw.Watch(testFile); err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	// Watch may be called again without starting another event loop
 	if err := fw.Watch(testFile); err != nil {
 		t.Fatal("Expected no error, got", err)
 	}
 
 	// Simulate a write to the file
 	os.WriteFile(testFile, []byte("new content"), 0644)
-	time.Sleep(100 * time.Millisecond) // Wait for event to be processed
+	evs := bus.waitEvents(t, 1)
+	time.Sleep(2 * DefaultDebounce)
+	if n := len(bus.GetPublishedEvents()); n != 1 {
+		t.Errorf("Expected 1 published event, got %d", n)
+	}
+	if err := evs[0].Validate(); err != nil {
+		t.Error("Expected valid event, got", err)
+	}
 }
 
 // TestHandleEvents tests the handleEvents method
 func TestHandleEvents(t *testing.T) {
 	bus := &MockEventBus{}
-	fw, _ := NewFileWatcher(bus)
+	fw, _ := NewFileWatcherWithOptions(bus, &Options{Checksum: true})
 	defer fw.Close()
-	testFile := filepath.Join(os.TempDir(), "testfile.txt")
+	testFile := filepath.Join(t.TempDir(), "testfile.txt")
 	os.WriteFile(testFile, []byte("test content"), 0644)
 	fw.Watch(testFile)
 
 	// Simulate a write event
 	os.WriteFile(testFile, []byte("new content"), 0644)
-	time.Sleep(100 * time.Millisecond) // Wait for event to be processed
+	evs := bus.waitEvents(t, 1)
 
-	// Verify that the event was published
-	if len(bus.GetPublishedEvents()) != 1 {
-		t.Errorf("Expected 1 published event, got %d", len(bus.GetPublishedEvents()))
+	ev := findEvent(evs, TypeWrite, testFile)
+	if ev == nil {
+		t.Fatalf("Expected %s event, got %v", TypeWrite, evs)
+	}
+	if ev.ID == 0 || ev.Data["size"] != int64(len("new content")) {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+	if _, ok := ev.Data["mtime"].(time.Time); !ok {
+		t.Error("Expected mtime in event data")
+	}
+	// sha256("new content")
+	if ev.Data["checksum"] != "fe32608c9ef5b6cf7e3f946480253ff76f24f4ec0678f3d0f07f9844cbff9601" {
+		t.Error("Unexpected checksum", ev.Data["checksum"])
 	}
 }
 
@@ -99,22 +156,23 @@ func TestHandleEvents(t *testing.T) {
 func TestFileCreation(t *testing.T) {
 	bus := &MockEventBus{}
 	fw, _ := NewFileWatcher(bus)
-	testFile := filepath.Join(os.TempDir(), "testfile_create.txt")
-	defer os.Remove(testFile)
-
-	// Create the file before watching
-	os.WriteFile(testFile, []byte("initial content"), 0644)
+	defer fw.Close()
+	dir := t.TempDir()
+	testFile := filepath.Join(dir, "testfile_create.txt")
 
-	if err := fw.Watch(testFile); err != nil {
+	if err := fw.Watch(dir); err != nil {
 		t.Fatal("Expected no error, got", err)
 	}
 
 	// Simulate file creation
 	os.WriteFile(testFile, []byte("test content"), 0644)
-	time.Sleep(100 * time.Millisecond) // Wait for event to be processed
-
-	if len(bus.publishedEvents) == 0 {
-		t.Fatal("Expected at least one published event")
+	evs := bus.waitEvents(t, 1)
+	ev := findEvent(evs, TypeCreate, testFile)
+	if ev == nil {
+		t.Fatalf("Expected %s event, got %v", TypeCreate, evs)
+	}
+	if ev.Data["rel"] != "testfile_create.txt" {
+		t.Error("Unexpected rel path", ev.Data["rel"])
 	}
 }
 
@@ -122,9 +180,9 @@ func TestFileCreation(t *testing.T) {
 func TestFileDeletion(t *testing.T) {
 	bus := &MockEventBus{}
 	fw, _ := NewFileWatcher(bus)
-	testFile := filepath.Join(os.TempDir(), "testfile_delete.txt")
+	defer fw.Close()
+	testFile := filepath.Join(t.TempDir(), "testfile_delete.txt")
 	os.WriteFile(testFile, []byte("test content"), 0644)
-	defer os.Remove(testFile)
 
 	if err := fw.Watch(testFile); err != nil {
 		t.Fatal("Expected no error, got", err)
@@ -132,19 +190,18 @@ func TestFileDeletion(t *testing.T) {
 
 	// Simulate file deletion
 	os.Remove(testFile)
-	time.Sleep(100 * time.Millisecond) // Wait for event to be processed
-
-	if len(bus.publishedEvents) == 0 {
-		t.Fatal("Expected at least one published event")
+	evs := bus.waitEvents(t, 1)
+	if findEvent(evs, TypeRemove, testFile) == nil {
+		t.Fatalf("Expected %s event, got %v", TypeRemove, evs)
 	}
 }
 
-// TestConcurrentWrites tests the FileWatcher handling of concurrent writes.
+// TestConcurrentWrites tests that concurrent writes to one file are debounced into one event.
 func TestConcurrentWrites(t *testing.T) {
 	bus := &MockEventBus{}
 	fw, _ := NewFileWatcher(bus)
-	testFile := filepath.Join(os.TempDir(), "testfile_concurrent.txt")
-	defer os.Remove(testFile)
+	defer fw.Close()
+	testFile := filepath.Join(t.TempDir(), "testfile_concurrent.txt")
 
 	// Create the file before watching
 	os.WriteFile(testFile, []byte("initial content"), 0644)
@@ -154,12 +211,20 @@ func TestConcurrentWrites(t *testing.T) {
 	}
 
 	// Simulate concurrent writes
-	go os.WriteFile(testFile, []byte("first write"), 0644)
-	go os.WriteFile(testFile, []byte("second write"), 0644)
-	time.Sleep(100 * time.Millisecond) // Wait for events to be processed
+	var wg sync.WaitGroup
+	for _, s := range []string{"first write", "second write"} {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			os.WriteFile(testFile, []byte(s), 0644)
+		}(s)
+	}
+	wg.Wait()
+	bus.waitEvents(t, 1)
+	time.Sleep(2 * DefaultDebounce)
 
-	if len(bus.publishedEvents) < 2 {
-		t.Fatal("Expected at least two published events")
+	if n := len(bus.GetPublishedEvents()); n != 1 {
+		t.Fatalf("Expected one debounced event, got %d", n)
 	}
 }
 
@@ -167,6 +232,7 @@ func TestConcurrentWrites(t *testing.T) {
 func TestWatchNonExistentFile(t *testing.T) {
 	bus := &MockEventBus{}
 	fw, _ := NewFileWatcher(bus)
+	defer fw.Close()
 
 	// Attempt to watch a non-existent file
 	err := fw.Watch("non_existent_file.txt")
@@ -178,37 +244,116 @@ func TestWatchNonExistentFile(t *testing.T) {
 // TestClose tests the Close method of FileWatcher.
 func TestClose(t *testing.T) {
 	bus := &MockEventBus{}
-	fw, _ := NewFileWatcher(bus)
-	testFile := filepath.Join(os.TempDir(), "testfile_close.txt")
-	defer os.Remove(testFile)
+	fw, _ := NewFileWatcherWithOptions(bus, &Options{Debounce: time.Hour})
+	testFile := filepath.Join(t.TempDir(), "testfile_close.txt")
+	os.WriteFile(testFile, []byte("test content"), 0644)
 
 	if err := fw.Watch(testFile); err != nil {
 		t.Fatal("Expected no error, got", err)
 	}
+	os.WriteFile(testFile, []byte("pending content"), 0644)
+	time.Sleep(50 * time.Millisecond)
 
-	// Close the watcher
+	// Close the watcher, pending events are published
 	if err := fw.Close(); err != nil {
 		t.Fatal("Expected no error on close, got", err)
 	}
+	if len(bus.GetPublishedEvents()) != 1 {
+		t.Fatal("Expected pending event to be published on close")
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal("Expected no error on second close, got", err)
+	}
+	if err := fw.Watch(testFile); err != ErrClosed {
+		t.Fatal("Expected ErrClosed, got", err)
+	}
 }
 
 // TestMultipleEvents tests the FileWatcher handling of multiple events.
 func TestMultipleEvents(t *testing.T) {
 	bus := &MockEventBus{}
-	fw, _ := NewFileWatcher(bus)
-	testFile := filepath.Join(os.TempDir(), "testfile_multiple_events.txt")
-	defer os.Remove(testFile)
+	fw, _ := NewFileWatcherWithOptions(bus, &Options{
+		Debounce: 20 * time.Millisecond,
+		Topics:   map[string]string{TypeRemove: "file.gone"},
+		Topic:    "files",
+	})
+	defer fw.Close()
+	testFile := filepath.Join(t.TempDir(), "testfile_multiple_events.txt")
+	os.WriteFile(testFile, []byte("initial content"), 0644)
 
 	if err := fw.Watch(testFile); err != nil {
 		t.Fatal("Expected no error, got", err)
 	}
 
-	// Simulate multiple write events
+	// Simulate write and remove events outside of the debounce window
 	os.WriteFile(testFile, []byte("first write"), 0644)
-	os.WriteFile(testFile, []byte("second write"), 0644)
-	time.Sleep(100 * time.Millisecond) // Wait for events to be processed
+	bus.waitEvents(t, 1)
+	os.Remove(testFile)
+	evs := bus.waitEvents(t, 2)
 
-	if len(bus.publishedEvents) < 2 {
-		t.Fatal("Expected at least two published events")
+	if evs[0].Type != TypeWrite || evs[1].Type != TypeRemove {
+		t.Fatalf("Unexpected events %v", evs)
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if bus.topics[0] != "files" || bus.topics[1] != "file.gone" {
+		t.Fatalf("Unexpected topics %v", bus.topics)
+	}
+}
+
+// TestRecursivePatterns tests recursive directory watching with include/exclude patterns.
+func TestRecursivePatterns(t *testing.T) {
+	bus := &MockEventBus{}
+	fw, _ := NewFileWatcherWithOptions(bus, &Options{
+		Recursive: true,
+		Include:   []string{"*.csv", "data/**/*.json"},
+		Exclude:   []string{"tmp"},
+		Ops:       AllOps,
+	})
+	defer fw.Close()
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "data", "a"), 0755)
+	os.MkdirAll(filepath.Join(dir, "tmp"), 0755)
+
+	if err := fw.Watch(dir); err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	// new sub directory is watched automatically
+	os.MkdirAll(filepath.Join(dir, "data", "b"), 0755)
+	time.Sleep(50 * time.Millisecond)
+
+	os.WriteFile(filepath.Join(dir, "tmp", "x.csv"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "data", "a", "x.txt"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "data", "a", "x.json"), []byte("{}"), 0644)
+	os.WriteFile(filepath.Join(dir, "data", "b", "y.csv"), []byte("y"), 0644)
+	time.Sleep(3 * DefaultDebounce)
+
+	got := map[string]bool{}
+	for _, ev := range bus.GetPublishedEvents() {
+		got[ev.Data["rel"].(string)] = true
+	}
+	want := map[string]bool{"data/a/x.json": true, "data/b/y.csv": true}
+	if len(got) != len(want) || !got["data/a/x.json"] || !got["data/b/y.csv"] {
+		t.Fatalf("Expected events for %v, got %v", want, got)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		rel      string
+		want     bool
+	}{
+		{[]string{"*.csv"}, "a/b/c.csv", true},
+		{[]string{"a/*.csv"}, "a/b/c.csv", false},
+		{[]string{"a/**/*.csv"}, "a/b/c.csv", true},
+		{[]string{"a/**/*.csv"}, "a/c.csv", true},
+		{[]string{"**/b/*"}, "a/b/c.csv", true},
+		{[]string{"*.json"}, "a/b/c.csv", false},
+	}
+	for _, tt := range tests {
+		if got := matchAny(tt.patterns, tt.rel); got != tt.want {
+			t.Errorf("matchAny(%v, %s) = %v, want %v", tt.patterns, tt.rel, got, tt.want)
+		}
 	}
 }
@@ -0,0 +1,255 @@
+// Package exporter 将查询游标逐行流式写出为 CSV、NDJSON 或 XLSX，不在内存中保留结果集
+package exporter
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/everpan/idig/pkg/xlsx"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"xorm.io/xorm/schemas"
+)
+
+// 导出格式
+const (
+	FormatJSON   = "json" // 非流式，由调用方按原有方式响应
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+	FormatXLSX   = "xlsx"
+)
+
+const (
+	MIMECSV    = "text/csv"
+	MIMENDJSON = "application/x-ndjson"
+	MIMEXLSX   = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// flushRows 每写出多少行刷新一次缓冲
+const flushRows = 1000
+
+var contentTypes = map[string]string{
+	FormatCSV:    MIMECSV + "; charset=utf-8",
+	FormatNDJSON: MIMENDJSON,
+	FormatXLSX:   MIMEXLSX,
+}
+
+// Negotiate 优先使用 format 参数，否则按 Accept 头协商；未指定或接受任意类型时为 json
+func Negotiate(fb *fiber.Ctx) (string, error) {
+	if f := strings.ToLower(fb.Query("format")); f != "" {
+		switch f {
+		case FormatJSON, FormatCSV, FormatNDJSON, FormatXLSX:
+			return f, nil
+		case "jsonl":
+			return FormatNDJSON, nil
+		}
+		return "", fmt.Errorf("unsupported export format '%s'", f)
+	}
+	switch fb.Accepts(fiber.MIMEApplicationJSON, MIMECSV, MIMENDJSON, "application/jsonl", MIMEXLSX) {
+	case MIMECSV:
+		return FormatCSV, nil
+	case MIMENDJSON, "application/jsonl":
+		return FormatNDJSON, nil
+	case MIMEXLSX:
+		return FormatXLSX, nil
+	}
+	return FormatJSON, nil
+}
+
+// ContentType 返回格式对应的 Content-Type
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// rowValues 扫描游标并按列类型规范化值：[]byte 转为字符串，数值列的文本转为数字
+type rowValues struct {
+	rows    *sql.Rows
+	numeric []bool
+	vals    []any
+	ptrs    []any
+}
+
+func newRowValues(rows *sql.Rows) (*rowValues, error) {
+	cts, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	rv := &rowValues{rows: rows, numeric: make([]bool, len(cts)), vals: make([]any, len(cts)), ptrs: make([]any, len(cts))}
+	for i, ct := range cts {
+		st := schemas.SQLType{Name: strings.ToUpper(ct.DatabaseTypeName())}
+		rv.numeric[i] = st.IsNumeric()
+		rv.ptrs[i] = &rv.vals[i]
+	}
+	return rv, nil
+}
+
+func (rv *rowValues) scan() ([]any, error) {
+	if err := rv.rows.Scan(rv.ptrs...); err != nil {
+		return nil, err
+	}
+	for i, v := range rv.vals {
+		b, ok := v.([]byte)
+		if !ok {
+			continue
+		}
+		s := string(b)
+		rv.vals[i] = s
+		if !rv.numeric[i] {
+			continue
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			rv.vals[i] = n
+		} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+			rv.vals[i] = f
+		}
+	}
+	return rv.vals, nil
+}
+
+// Write 将 rows 按 format 写出到 w，headers 为列名（为空时取游标的列名），返回写出的数据行数；
+// 不关闭 rows
+func Write(w io.Writer, format string, headers []string, rows *sql.Rows) (int64, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if len(headers) != len(cols) {
+		headers = cols
+	}
+	rv, err := newRowValues(rows)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(w)
+	var n int64
+	switch format {
+	case FormatCSV:
+		n, err = writeCSV(bw, headers, rv)
+	case FormatNDJSON:
+		n, err = writeNDJSON(bw, headers, rv)
+	case FormatXLSX:
+		n, err = writeXLSX(bw, headers, rv)
+	default:
+		return 0, fmt.Errorf("unsupported export format '%s'", format)
+	}
+	if err != nil {
+		return n, err
+	}
+	if err = rows.Err(); err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+func textOf(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case time.Time:
+		return t.Format(time.DateTime)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func writeCSV(bw *bufio.Writer, headers []string, rv *rowValues) (int64, error) {
+	cw := csv.NewWriter(bw)
+	if err := cw.Write(headers); err != nil {
+		return 0, err
+	}
+	rec := make([]string, len(headers))
+	var n int64
+	for rv.rows.Next() {
+		vals, err := rv.scan()
+		if err != nil {
+			return n, err
+		}
+		for i, v := range vals {
+			rec[i] = textOf(v)
+		}
+		if err = cw.Write(rec); err != nil {
+			return n, err
+		}
+		if n++; n%flushRows == 0 {
+			if err = flush(cw, bw); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush(cw, bw)
+}
+
+func flush(cw *csv.Writer, bw *bufio.Writer) error {
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeNDJSON(bw *bufio.Writer, headers []string, rv *rowValues) (int64, error) {
+	enc := json.NewEncoder(bw)
+	rec := make(map[string]any, len(headers))
+	var n int64
+	for rv.rows.Next() {
+		vals, err := rv.scan()
+		if err != nil {
+			return n, err
+		}
+		for i, h := range headers {
+			if t, ok := vals[i].(time.Time); ok {
+				rec[h] = t.Format(time.DateTime)
+			} else {
+				rec[h] = vals[i]
+			}
+		}
+		if err = enc.Encode(rec); err != nil {
+			return n, err
+		}
+		if n++; n%flushRows == 0 {
+			if err = bw.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func writeXLSX(bw *bufio.Writer, headers []string, rv *rowValues) (int64, error) {
+	xw, err := xlsx.NewWriter(bw, "")
+	if err != nil {
+		return 0, err
+	}
+	row := make([]any, len(headers))
+	for i, h := range headers {
+		row[i] = h
+	}
+	if err = xw.WriteRow(row); err != nil {
+		return 0, err
+	}
+	var n int64
+	for rv.rows.Next() {
+		vals, err1 := rv.scan()
+		if err1 != nil {
+			return n, err1
+		}
+		if err1 = xw.WriteRow(vals); err1 != nil {
+			return n, err1
+		}
+		if n++; n%flushRows == 0 {
+			if err1 = bw.Flush(); err1 != nil {
+				return n, err1
+			}
+		}
+	}
+	return n, xw.Close()
+}
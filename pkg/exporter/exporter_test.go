@@ -0,0 +1,94 @@
+package exporter
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/everpan/idig/pkg/xlsx"
+	"github.com/gofiber/fiber/v2"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRows(t *testing.T) func() *sql.Rows {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	_, err = db.Exec(`CREATE TABLE att (id INTEGER, name TEXT, hours DECIMAL(5,2));
+		INSERT INTO att VALUES (1, 'tom', 7.5), (2, 'a,"b"', NULL)`)
+	require.NoError(t, err)
+	return func() *sql.Rows {
+		rows, err := db.Query("SELECT id, name AS who, hours FROM att ORDER BY id")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = rows.Close() })
+		return rows
+	}
+}
+
+func TestWrite(t *testing.T) {
+	query := newTestRows(t)
+
+	var buf bytes.Buffer
+	n, err := Write(&buf, FormatCSV, []string{"ID", "Who", "Hours"}, query())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, "ID,Who,Hours\n1,tom,7.5\n2,\"a,\"\"b\"\"\",\n", buf.String())
+
+	buf.Reset()
+	// 表头数量不一致时使用游标列名
+	_, err = Write(&buf, FormatNDJSON, nil, query())
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"id":1,"who":"tom","hours":7.5}`, lines[0])
+	assert.JSONEq(t, `{"id":2,"who":"a,\"b\"","hours":null}`, lines[1])
+
+	buf.Reset()
+	_, err = Write(&buf, FormatXLSX, []string{"ID", "Who", "Hours"}, query())
+	require.NoError(t, err)
+	sh, err := xlsx.ReadBytes(buf.Bytes(), "")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"ID", "Who", "Hours"}, {"1", "tom", "7.5"}, {"2", `a,"b"`}}, sh.Rows)
+
+	_, err = Write(&buf, "pdf", nil, query())
+	assert.Error(t, err)
+}
+
+func TestNegotiate(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		f, err := Negotiate(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return c.SendString(f)
+	})
+	tests := []struct {
+		url, accept, want string
+	}{
+		{"/", "", FormatJSON},
+		{"/", "*/*", FormatJSON},
+		{"/", "text/csv", FormatCSV},
+		{"/", "application/x-ndjson", FormatNDJSON},
+		{"/", MIMEXLSX, FormatXLSX},
+		{"/?format=xlsx", "text/csv", FormatXLSX},
+		{"/?format=jsonl", "", FormatNDJSON},
+		{"/?format=pdf", "", "unsupported export format 'pdf'"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(fiber.MethodGet, tt.url, nil)
+		if tt.accept != "" {
+			req.Header.Set(fiber.HeaderAccept, tt.accept)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		var body bytes.Buffer
+		_, _ = body.ReadFrom(resp.Body)
+		assert.Equal(t, tt.want, body.String(), tt.url+" "+tt.accept)
+	}
+}
@@ -3,14 +3,18 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"github.com/everpan/idig/pkg/core"
 	"github.com/everpan/idig/pkg/entity/meta"
 	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/importer"
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
+	"time"
 	"xorm.io/builder"
 	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
 )
 
 var dmlRoutes = []*core.IDigRoute{
@@ -24,10 +28,18 @@ var dmlRoutes = []*core.IDigRoute{
 		Handler: dmlUpdate,
 		Method:  fiber.MethodPut,
 	},
+	{
+		Path:    "/entity/dm/:entity?", // 数据操作
+		Handler: dmlDelete,
+		Method:  fiber.MethodDelete,
+	},
 }
 
 func init() {
 	core.RegisterRouter(dmlRoutes)
+	// 批量导入复用 DML 的写入路径
+	importer.RegisterLoader(importer.ModeInsert, InsertEntityRows)
+	importer.RegisterLoader(importer.ModeUpsert, UpsertEntityRows)
 }
 
 // parseToColumnValue 解析请求体中的列值
@@ -59,9 +71,30 @@ func prepareEntityOperation(ctx *core.Context) (*query.ColumnValue, error) {
 	return cv, nil
 }
 
+// writeContext 当前请求写入时用于生成系统列的上下文，未认证时以 core.AnonymousPrincipal 写入身份列；
+// 写入成功的行收集到 evs，事务提交后以 evs.publish 发布
+func writeContext(ctx *core.Context) (*query.WriteContext, *entityEvents) {
+	evs := &entityEvents{}
+	principal := ctx.Principal()
+	if principal == "" {
+		principal = core.AnonymousPrincipal
+	}
+	wc := &query.WriteContext{Principal: principal, TenantIdx: core.DefaultTenant.TenantIdx, Now: time.Now(),
+		Written: evs.add}
+	if t := ctx.Tenant(); t != nil {
+		wc.TenantIdx = t.TenantIdx
+	}
+	return wc, evs
+}
+
 // handleTransaction 处理事务的通用逻辑
 func handleTransaction(ctx *core.Context, operation func(*xorm.Session) error) error {
-	sess := ctx.Engine().NewSession()
+	return withTransaction(ctx.Engine(), operation)
+}
+
+// withTransaction 在 engine 的新事务中执行 operation，出错时回滚
+func withTransaction(engine *xorm.Engine, operation func(*xorm.Session) error) error {
+	sess := engine.NewSession()
 	defer func(sess *xorm.Session) {
 		_ = sess.Close()
 	}(sess)
@@ -78,102 +111,392 @@ func handleTransaction(ctx *core.Context, operation func(*xorm.Session) error) e
 	return sess.Commit()
 }
 
-// dmlUpdate 更新实体数据
+// dmlUpdate 更新实体数据：vals 中有主键时按主键逐行更新，否则按 where 条件更新
 func dmlUpdate(ctx *core.Context) error {
 	cv, err := prepareEntityOperation(ctx)
 	if err != nil {
 		return ctx.SendBadRequestError(err)
 	}
 	dt := cv.DataTable()
-	pkColumns := cv.Meta.PrimaryColumn()
-	pkId, err := dt.FetchColumnsIndex(pkColumns, nil)
-	if err != nil {
-		return ctx.SendBadRequestError(err)
+	if _, err = dt.FetchColumnsIndex(cv.Meta.PrimaryColumn(), nil); err != nil {
+		if wheres := cv.Wheres(); len(wheres) > 0 {
+			return dmlUpdateWhere(ctx, cv.Meta, dt, wheres)
+		}
+		return ctx.SendBadRequestError(fmt.Errorf("primary key values or where condition required: %w", err))
 	}
-	if len(pkId) == 0 {
-		return ctx.SendJSON(-2, "there is no pk in values, not implement", nil)
+	if len(cv.Wheres()) > 0 {
+		return ctx.SendBadRequestError(errors.New("where condition can not be combined with primary key values"))
 	}
-	tabColsKV, err := dt.DivisionColumnsKeyVal(cv.Meta)
-	if err != nil {
-		return ctx.SendBadRequestError(err)
+	wc, evs := writeContext(ctx)
+	if !isAtomic(ctx) {
+		return dmlPartially(ctx, cv.Meta, dt, UpdateEntityRows, wc, evs)
 	}
 	if err = handleTransaction(ctx, func(sess *xorm.Session) error {
-		return updateEntities(sess, tabColsKV, dt)
+		return UpdateEntityRows(sess, cv.Meta, dt, wc)
 	}); err != nil {
+		if errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrInvalidRows) {
+			return sendInvalidRows(ctx, err, dt)
+		}
 		return ctx.SendBadRequestError(err)
 	}
+	evs.publish(ctx.Engine())
+	if cv.Meta.VersionColumn() != nil || dt.FetchColumnIndex(meta.UpdatedAtColumn) >= 0 {
+		// 返回新的版本，便于客户端继续更新
+		jd := &query.JDataTable{}
+		jd.From(dt)
+		return ctx.SendJSON(0, "update finished", jd)
+	}
 	return ctx.SendJSON(0, "update finished", nil)
 }
 
-// updateEntities 更新多个实体
-func updateEntities(sess *xorm.Session, tabColsKV map[string]*query.ColumnKeyVal, dt *query.DataTable) error {
+// UpdateEntityRows 在事务中按主键更新 dt 中的所有行，dt 必须包含主键列；
+// 写入前填充更新时的默认值和系统列，按列类型转换并校验，有违规时不执行 SQL。
+// 实体声明了版本列时按版本更新，版本不符的行在 #result 中记录冲突并返回 ErrVersionConflict；
+// 被其他实体引用的关联键变更时按关系的级联策略处理从属记录
+func UpdateEntityRows(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, wc *query.WriteContext) error {
+	ver := dt.VersionColumn(m)
+	if err := dt.ApplyDefaults(sess, m, query.ValidateUpdate, wc); err != nil {
+		return err
+	}
+	tabColsKV, err := dt.DivisionColumnsKeyVal(m)
+	if err != nil {
+		return err
+	}
+	if err = validateEntityRows(sess, m, dt, query.ValidateUpdate); err != nil {
+		return err
+	}
+	if err = cascadeKeyUpdate(sess, m, dt, wc); err != nil {
+		return err
+	}
+	if err = updateEntities(sess, m, ver, tabColsKV, dt, wc); err != nil {
+		return err
+	}
+	wc.RowsWritten(m, query.OpUpdated, dt)
+	return nil
+}
+
+// updateEntities 更新多个实体；有版本列 ver 时先更新版本列所在的表，有冲突时整批回滚，不再更新其他属性表，
+// 未冲突的行在 #result 中记录为已回滚，版本不回填
+func updateEntities(sess *xorm.Session, m *meta.EntityMeta, ver *schemas.Column,
+	tabColsKV map[string]*query.ColumnKeyVal, dt *query.DataTable, wc *query.WriteContext) error {
+	if ver != nil {
+		now := time.Now()
+		if wc != nil && !wc.Now.IsZero() {
+			now = wc.Now
+		}
+		ok, next, err := updateVersionedTable(sess, ver, tabColsKV[ver.TableName], dt, now)
+		if err != nil {
+			return fmt.Errorf("update entity error: %w", err)
+		}
+		if conflicts := len(dt.Values()) - len(ok); conflicts > 0 {
+			for _, i := range ok {
+				_ = dt.UpdateResult(i, fmt.Sprintf("%s: %d row(s) in the batch conflicted", RolledBack, conflicts))
+			}
+			return fmt.Errorf("%w: %d row(s) were modified by others", ErrVersionConflict, conflicts)
+		}
+		verIdx := dt.FetchColumnIndex(ver.Name)
+		for k, i := range ok {
+			dt.Values()[i][verIdx] = next[k]
+		}
+		delete(tabColsKV, ver.TableName)
+	}
 	for t, ckv := range tabColsKV {
-		if err := UpdateEntity(sess, t, ckv, dt); err != nil {
+		if len(ckv.VCols) == 0 {
+			// 只有主键列，没有需要更新的值
+			continue
+		}
+		if err := updateAttrGroup(sess, m, t, ckv, dt); err != nil {
 			return fmt.Errorf("update entity error: %w", err)
 		}
 	}
-	return nil
+	return syncSearchIndex(sess, m, dt)
+}
+
+// ErrVersionConflict 按版本更新时影响行数为 0，各行的冲突原因记录在 #result 中
+var ErrVersionConflict = errors.New("version conflict")
+
+// RolledBack 整批因其他行的版本冲突回滚时，未冲突行的 #result 前缀
+const RolledBack = "rolled back"
+
+// updateVersionedTable 逐行以 WHERE pk = ? AND ver = ? 更新版本列所在的表，同时把版本列设为新值；
+// 返回更新成功的行号及其新的版本，由调用者在整批成功后回填到 dt，影响行数为 0 的行在 #result 中记录冲突。
+// 期望的版本为空的行（只可能是未声明版本列时的 updated_at）只按主键更新
+func updateVersionedTable(sess *xorm.Session, ver *schemas.Column, ckv *query.ColumnKeyVal,
+	dt *query.DataTable, now time.Time) ([]int, []any, error) {
+	verIdx := dt.FetchColumnIndex(ver.Name)
+	if ckv == nil || verIdx < 0 {
+		return nil, nil, fmt.Errorf("expected version '%s' required", ver.Name)
+	}
+	var (
+		setCols []string
+		err     error
+	)
+	for _, c := range ckv.VCols {
+		if c != ver.Name {
+			setCols = append(setCols, c)
+		}
+	}
+	var setIdx []int
+	if len(setCols) > 0 {
+		if setIdx, err = dt.FetchColumnsIndex(setCols, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	pkIdx, err := dt.FetchColumnsIndex(ckv.KCols, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		ok   []int
+		next []any
+	)
+	for i, row := range dt.Values() {
+		nv, err1 := query.NextVersion(ver, row[verIdx], now)
+		if err1 != nil {
+			return nil, nil, err1
+		}
+		sets := make([]builder.Cond, 0, len(setCols)+1)
+		for k, c := range setCols {
+			sets = append(sets, builder.Eq{c: row[setIdx[k]]})
+		}
+		sets = append(sets, builder.Eq{ver.Name: nv})
+		pkCond := builder.Eq{}
+		for k, c := range ckv.KCols {
+			pkCond[c] = row[pkIdx[k]]
+		}
+		cond := builder.Cond(pkCond)
+		if row[verIdx] != nil {
+			cond = builder.And(pkCond, builder.Eq{ver.Name: row[verIdx]})
+		}
+		sqlStr, args, err1 := builder.Dialect(sess.Engine().DriverName()).Update(sets...).From(ver.TableName).
+			Where(cond).ToSQL()
+		if err1 != nil {
+			return nil, nil, err1
+		}
+		result, err1 := sess.Exec(append([]any{sqlStr}, args...)...)
+		if err1 != nil {
+			return nil, nil, err1
+		}
+		if af, _ := result.RowsAffected(); af == 0 {
+			msg, err2 := describeConflict(sess, ver, pkCond, row[verIdx])
+			if err2 != nil {
+				return nil, nil, err2
+			}
+			_ = dt.UpdateResult(i, query.ConflictPrefix+msg)
+			continue
+		}
+		_ = dt.UpdateAffectedResult(i, 1)
+		ok = append(ok, i)
+		next = append(next, nv)
+	}
+	return ok, next, nil
+}
+
+// describeConflict 区分行不存在与版本不符
+func describeConflict(sess *xorm.Session, ver *schemas.Column, pkCond builder.Eq, expected any) (string, error) {
+	var current string
+	has, err := sess.Table(ver.TableName).Where(pkCond).Cols(ver.Name).Get(&current)
+	if err != nil {
+		return "", err
+	}
+	if !has {
+		return "row not found", nil
+	}
+	return fmt.Sprintf("%s is %s, expected %v", ver.Name, current, expected), nil
 }
 
-// dmlInsert 插入实体数据
+// dmlInsert 插入实体数据，?nested=true 时写入嵌套文档
 func dmlInsert(ctx *core.Context) error {
+	if isNested(ctx) {
+		return dmlNested(ctx)
+	}
 	cv, err := prepareEntityOperation(ctx)
 	if err != nil {
 		return ctx.SendJSON(-1, fmt.Sprintf("Error parsing column values: %v", err), nil)
 	}
 
 	dt := cv.DataTable()
-	tableColsKV, err := dt.DivisionColumnsKeyVal(cv.Meta)
+	wc, evs := writeContext(ctx)
+	if !isAtomic(ctx) {
+		return dmlPartially(ctx, cv.Meta, dt, InsertEntityRows, wc, evs)
+	}
+	if err = handleTransaction(ctx, func(sess *xorm.Session) error {
+		return InsertEntityRows(sess, cv.Meta, dt, wc)
+	}); err != nil {
+		if errors.Is(err, ErrInvalidRows) {
+			return sendInvalidRows(ctx, err, dt)
+		}
+		return ctx.SendJSON(-1, fmt.Sprintf("inserting entity error: %v", err), nil)
+	}
+	evs.publish(ctx.Engine())
+	msg := fmt.Sprintf("insert %d row(s) for entity %s", len(dt.Values()), cv.EntityName)
+	// Insertion successful, return primary key and unique key values
+	var rdt any
+	if cv.Meta.HasAutoIncrement() {
+		tableColsKV, _ := dt.DivisionColumnsKeyVal(cv.Meta)
+		pkColsKV := tableColsKV[cv.Meta.PrimaryTable()]
+		ukCols := cv.Meta.FilterOutPrimaryTableUniqueCols(pkColsKV.VCols)
+		ukIdx, _ := dt.FetchColumnsIndex(ukCols, nil)
+		ret, _ := dt.FetchRows(ukIdx)
+		rdt = &query.JDataTable{
+			Cols: pkColsKV.KCols,
+			Data: ret,
+		}
+	}
+	return ctx.SendJSON(0, msg, rdt)
+}
+
+// InsertEntityRows 在事务中插入 dt 中的所有行，自增主键会回填到 dt 的主键列；
+// 写入前填充默认值和系统列，按列类型转换并校验，有违规时不执行 SQL
+func InsertEntityRows(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, wc *query.WriteContext) error {
+	if err := dt.ApplyDefaults(sess, m, query.ValidateInsert, wc); err != nil {
+		return err
+	}
+	tableColsKV, err := dt.DivisionColumnsKeyVal(m)
+	if err != nil {
+		return fmt.Errorf("cannot divide entity into attribute groups: %w", err)
+	}
+	if err = validateEntityRows(sess, m, dt, query.ValidateInsert); err != nil {
+		return err
+	}
+	if ckv, ok := tableColsKV[m.PrimaryTable()]; !ok || m.HasAutoIncrement() && len(ckv.VCols) == 0 {
+		// 自增主键由数据库产生，主表没有其他列的值时无法插入
+		return fmt.Errorf("no values provided for the primary table")
+	}
+	pkValueIsNull, _, err := dt.FirstRowColumnsIsNull(m.PrimaryColumn())
 	if err != nil {
-		return ctx.SendJSON(-1, fmt.Sprintf("Cannot divide entity into attribute groups: %v", err), nil)
+		return err
 	}
+	if !m.HasAutoIncrement() && pkValueIsNull {
+		return fmt.Errorf("primary key cannot be null for non-auto increment table")
+	}
+	if err = insertTables(sess, m, tableColsKV, dt); err != nil {
+		return err
+	}
+	wc.RowsWritten(m, query.OpInserted, dt)
+	return nil
+}
 
-	pkTable := cv.Meta.PrimaryTable()
-	pkColsKV, ok := tableColsKV[pkTable]
-	if !ok {
-		return ctx.SendJSON(-1, "No values provided for the primary table", nil)
+// UpsertEntityRows 在事务中按主键写入 dt：主键已存在的行更新，其余行插入
+func UpsertEntityRows(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, wc *query.WriteContext) error {
+	pkCols := m.PrimaryColumn()
+	pkIdx, err := dt.FetchColumnsIndex(pkCols, nil)
+	if err != nil || len(pkIdx) != len(pkCols) {
+		// 没有主键列，只能插入
+		return InsertEntityRows(sess, m, dt, wc)
+	}
+	var inserts, updates []int
+	for i := range dt.Values() {
+		pks, _ := dt.FetchRow(i, pkIdx, nil)
+		exist, err1 := primaryKeyExists(sess, m.PrimaryTable(), pkCols, pks)
+		if err1 != nil {
+			return err1
+		}
+		if exist {
+			updates = append(updates, i)
+		} else {
+			inserts = append(inserts, i)
+		}
 	}
+	if len(updates) > 0 {
+		sub, _ := dt.SubTable(updates)
+		if err = UpdateEntityRows(sess, m, sub, wc); err != nil {
+			return err
+		}
+		copyBack(dt, sub, updates)
+	}
+	if len(inserts) > 0 {
+		sub, _ := dt.SubTable(inserts)
+		if err = InsertEntityRows(sess, m, sub, wc); err != nil {
+			return err
+		}
+		copyBack(dt, sub, inserts)
+	}
+	return nil
+}
 
-	pkValueIsNull, _, err := dt.FirstRowColumnsIsNull(pkColsKV.KCols)
-	if err != nil {
-		return ctx.SendJSON(-1, fmt.Sprintf("No values for the primary table: %v", err), nil)
+// copyBack 子表填充默认值时添加的列可能使行数据与原表分离，将子表中原表也有的列
+// （包括回填的自增主键和 #result）写回原表
+func copyBack(dt, sub *query.DataTable, rows []int) {
+	for i, col := range dt.Columns() {
+		j := sub.FetchColumnIndex(col)
+		if j < 0 {
+			continue
+		}
+		for k, row := range sub.Values() {
+			dt.Values()[rows[k]][i] = row[j]
+		}
 	}
+}
+
+// ErrInvalidRows 写入前校验失败，各行的违规记录在 #result 中
+var ErrInvalidRows = errors.New("invalid rows")
 
-	hasAutoIncrement := cv.Meta.HasAutoIncrement()
-	if !hasAutoIncrement && pkValueIsNull {
-		return ctx.SendJSON(-1, "Primary key cannot be null for non-auto increment table", nil)
+// validateEntityRows 转换并按列定义和实体规则校验 dt，违规写入 #result
+func validateEntityRows(db xorm.Interface, m *meta.EntityMeta, dt *query.DataTable, mode int) error {
+	errs, err := dt.ValidateAll(db, m, mode)
+	if err != nil {
+		return err
 	}
+	if mode == query.ValidateUpdate {
+		errs = append(errs, dt.CheckVersion(m)...)
+	}
+	if n := dt.ReportErrors(errs); n > 0 {
+		return fmt.Errorf("%w: %d of %d row(s) failed validation", ErrInvalidRows, n, len(dt.Values()))
+	}
+	return nil
+}
 
-	if err = handleTransaction(ctx, func(sess *xorm.Session) error {
-		// 插入主表，便于产生 auto increment key
-		if err1 := insertEntity(sess, pkTable, pkColsKV, dt, hasAutoIncrement); err1 != nil {
-			return fmt.Errorf("error inserting entity into the primary table: %w", err1)
+// sendInvalidRows 返回带 #result 的完整数据表
+func sendInvalidRows(ctx *core.Context, err error, dt *query.DataTable) error {
+	jd := &query.JDataTable{}
+	jd.From(dt)
+	return ctx.SendJSON(-1, err.Error(), jd)
+}
+
+// primaryKeyExists 主键值中有 nil 时视为不存在
+func primaryKeyExists(sess *xorm.Session, table string, pkCols []string, pks []any) (bool, error) {
+	cond := builder.NewCond()
+	for i, col := range pkCols {
+		if pks[i] == nil {
+			return false, nil
 		}
+		cond = cond.And(builder.Eq{col: pks[i]})
+	}
+	return sess.Table(table).Where(cond).Exist()
+}
 
-		delete(tableColsKV, pkTable)
-		for t, ckv := range tableColsKV {
-			if err1 := insertEntity(sess, t, ckv, dt, false); err1 != nil {
-				return fmt.Errorf("error inserting entity into attribute table: %w", err1)
-			}
+// insertTables 先插入主表，便于产生 auto increment key，再插入各属性表
+func insertTables(sess *xorm.Session, m *meta.EntityMeta, tableColsKV map[string]*query.ColumnKeyVal,
+	dt *query.DataTable) error {
+	pkTable := m.PrimaryTable()
+	if err := insertEntity(sess, pkTable, tableColsKV[pkTable], dt, m.HasAutoIncrement()); err != nil {
+		return fmt.Errorf("error inserting entity into the primary table: %w", err)
+	}
+	for t, ckv := range tableColsKV {
+		if t == pkTable {
+			continue
 		}
-		rowCnt := len(dt.Values())
-		msg := fmt.Sprintf("insert %d row(s) for entity %s", rowCnt, cv.EntityName)
-		// Insertion successful, return primary key and unique key values
-		var rdt any
-		if hasAutoIncrement {
-			ukCols := cv.Meta.FilterOutPrimaryTableUniqueCols(pkColsKV.VCols)
-			ukIdx, _ := dt.FetchColumnsIndex(ukCols, nil)
-			ret, _ := dt.FetchRows(ukIdx)
-			rdt = &query.JDataTable{
-				Cols: pkColsKV.KCols,
-				Data: ret,
-			}
+		if err := insertEntity(sess, t, ckv, dt, false); err != nil {
+			return fmt.Errorf("error inserting entity into attribute table: %w", err)
 		}
-		return ctx.SendJSON(0, msg, rdt)
-	}); err != nil {
-		return ctx.SendJSON(-1, fmt.Sprintf("inserting entity error: %v", err), nil)
 	}
-	return nil
+	return syncSearchIndex(sess, m, dt)
+}
+
+// syncSearchIndex 按 dt 中的主键同步实体的全文检索索引
+func syncSearchIndex(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable) error {
+	idx := dt.FetchColumnIndex(m.Entity.PkAttrColumn)
+	if idx < 0 || len(m.SearchColumns()) == 0 {
+		return nil
+	}
+	pks := make([]any, 0, len(dt.Values()))
+	for _, row := range dt.Values() {
+		if row[idx] != nil {
+			pks = append(pks, row[idx])
+		}
+	}
+	return meta.SyncSearchIndex(sess, m, pks)
 }
 
 // insertEntities 插入实体
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+// ErrorPrefix 非原子写入时单行写入失败的 #result 前缀
+const ErrorPrefix = "error: "
+
+// rowWriter InsertEntityRows 或 UpdateEntityRows
+type rowWriter func(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, wc *query.WriteContext) error
+
+// isAtomic 默认整批在一个事务中写入，任一行失败全部回滚；?atomic=false 时逐行写入，失败的行不影响其他行
+func isAtomic(ctx *core.Context) bool {
+	return ctx.Fiber().QueryBool("atomic", true)
+}
+
+// dmlPartially 非原子写入：在同一事务中逐行以保存点写入，校验失败或写入失败的行不影响其他行，
+// 每行的结果或错误记录在 #result 中，返回完整的数据表，客户端可只重试失败的行
+func dmlPartially(ctx *core.Context, m *meta.EntityMeta, dt *query.DataTable, write rowWriter,
+	wc *query.WriteContext, evs *entityEvents) error {
+	var failed int
+	if err := handleTransaction(ctx, func(sess *xorm.Session) error {
+		var err1 error
+		failed, err1 = writeRowsPartially(sess, m, dt, write, wc)
+		return err1
+	}); err != nil {
+		return sendInvalidRows(ctx, err, dt)
+	}
+	evs.publish(ctx.Engine())
+	jd := &query.JDataTable{}
+	jd.From(dt)
+	total := len(dt.Values())
+	if failed > 0 {
+		return ctx.SendJSON(-1, fmt.Sprintf("%d of %d row(s) failed", failed, total), jd)
+	}
+	return ctx.SendJSON(0, fmt.Sprintf("%d row(s) written for entity %s", total, m.Entity.EntityName), jd)
+}
+
+// writeRowsPartially 逐行在保存点中调用 write（由其填充默认值并校验），失败时回滚到保存点、
+// 恢复该行的数据（如回填的自增主键），并在 #result 中记录原因；返回失败的行数。只有保存点本身出错时才返回 error
+func writeRowsPartially(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable,
+	write rowWriter, wc *query.WriteContext) (int, error) {
+	// 主键列先加入原表，以便写回回填的自增主键
+	dt.AddColumns(m.PrimaryColumn())
+	dt.AddResultColumn()
+	resultIdx := dt.FetchColumnIndex(query.ResultColumn)
+	var failed int
+	for i, row := range dt.Values() {
+		orig := slices.Clone(row)
+		sub, _ := dt.SubTable([]int{i})
+		err := withSavepoint(sess, "idig_row", func() error {
+			return write(sess, m, sub, wc)
+		})
+		copyBack(dt, sub, []int{i})
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errSavepoint) {
+			return failed, err
+		}
+		failed++
+		result := row[resultIdx]
+		copy(row, orig)
+		// 校验失败和版本冲突已在 #result 中记录了各列的原因
+		if s, ok := result.(string); ok && (strings.HasPrefix(s, query.InvalidPrefix) ||
+			strings.HasPrefix(s, query.ConflictPrefix)) {
+			row[resultIdx] = s
+		} else {
+			row[resultIdx] = ErrorPrefix + err.Error()
+		}
+	}
+	return failed, nil
+}
+
+var errSavepoint = errors.New("savepoint")
+
+// withSavepoint 在 sess 已开启的事务中以保存点执行 fn，fn 出错时回滚到保存点，事务可继续使用。
+// SQLite、MySQL、PostgreSQL 使用 SAVEPOINT，SQL Server 使用 SAVE TRANSACTION
+func withSavepoint(sess *xorm.Session, name string, fn func() error) error {
+	save, rollback, release := "SAVEPOINT "+name, "ROLLBACK TO SAVEPOINT "+name, "RELEASE SAVEPOINT "+name
+	if sess.Engine().Dialect().URI().DBType == schemas.MSSQL {
+		save, rollback, release = "SAVE TRANSACTION "+name, "ROLLBACK TRANSACTION "+name, ""
+	}
+	if _, err := sess.Exec(save); err != nil {
+		return fmt.Errorf("%w: %v", errSavepoint, err)
+	}
+	if err := fn(); err != nil {
+		if _, err1 := sess.Exec(rollback); err1 != nil {
+			return fmt.Errorf("%w: %v", errSavepoint, err1)
+		}
+		if release != "" {
+			_, _ = sess.Exec(release)
+		}
+		return err
+	}
+	if release != "" {
+		if _, err := sess.Exec(release); err != nil {
+			return fmt.Errorf("%w: %v", errSavepoint, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/stretchr/testify/assert"
+)
+
+type EmpPart struct {
+	Idx    uint32 `xorm:"pk autoincr"`
+	Mobile string `xorm:"unique varchar(32)"`
+	Age    int    `xorm:"int"`
+}
+
+func TestDM_NonAtomic(t *testing.T) {
+	engine := setupDMEntity(t, "emp_part", new(EmpPart))
+	_, err := engine.Insert(&EmpPart{Mobile: "m0", Age: 20})
+	assert.NoError(t, err)
+
+	app := core.CreateApp()
+	batch := `{"cols":["mobile","age"],"vals":[["m1",21],["m0",22],["m3","abc"],["m4",24]]}`
+	// 默认整批回滚
+	body := sendRequest(t, app, http.MethodPost, "dm/emp_part", batch)
+	assert.Contains(t, body, `"code":-1`)
+	n, _ := engine.Count(new(EmpPart))
+	assert.Equal(t, int64(1), n)
+
+	body = sendRequest(t, app, http.MethodPost, "dm/emp_part?atomic=false", batch)
+	assert.Contains(t, body, "2 of 4 row(s) failed")
+	assert.Contains(t, body, "UNIQUE constraint failed")
+	assert.Contains(t, body, "invalid: age: 'abc' is not an integer")
+	var mobiles []string
+	assert.NoError(t, engine.Table("emp_part").Cols("mobile").Asc("idx").Find(&mobiles))
+	assert.Equal(t, []string{"m0", "m1", "m4"}, mobiles)
+	// 失败的行不回填自增主键
+	assert.Contains(t, body, `["m0",22,"error: `)
+	assert.Contains(t, body, `constraint failed: emp_part.mobile",null]`)
+
+	body = sendRequest(t, app, http.MethodPut, "dm/emp_part?atomic=false", `{"cols":["idx","age"],"vals":[[1,30],[2,"x"]]}`)
+	assert.Contains(t, body, "1 of 2 row(s) failed")
+	e := &EmpPart{}
+	_, err = engine.ID(1).Get(e)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, e.Age)
+}
@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// DeleteResult 删除实体的结果，Cascade 为按关系级联策略对从属记录的影响
+type DeleteResult struct {
+	Matched int                 `json:"matched"`
+	Deleted int64               `json:"deleted"`
+	DryRun  bool                `json:"dry_run,omitempty"`
+	Cascade *entity.CascadePlan `json:"cascade,omitempty"`
+}
+
+// dmlDelete 按主键或 where 条件删除实体，各属性表的行一并删除；从属实体按关系的级联策略处理，
+// 有 restrict 的从属记录时整体拒绝。?dry_run=true 时只返回匹配的行数和级联影响
+func dmlDelete(ctx *core.Context) error {
+	cv, err := prepareEntityOperation(ctx)
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	m, dt, wheres := cv.Meta, cv.DataTable(), cv.Wheres()
+	if dt.FetchColumnIndex(m.Entity.PkAttrColumn) < 0 && len(wheres) == 0 {
+		return ctx.SendBadRequestError(fmt.Errorf("primary key values or where condition required"))
+	}
+	limit := maxAffectedRows(ctx)
+	ret := &DeleteResult{DryRun: ctx.Fiber().QueryBool("dry_run")}
+	evs := &entityEvents{}
+	err = handleTransaction(ctx, func(sess *xorm.Session) error {
+		pks, err1 := deleteKeys(sess, m, dt, wheres, limit)
+		if err1 != nil {
+			return err1
+		}
+		ret.Matched = len(pks)
+		if ret.Cascade, err1 = entity.PlanDelete(sess, m, pks); err1 != nil || ret.DryRun {
+			return err1
+		}
+		if err1 = ret.Cascade.Check(); err1 != nil {
+			return err1
+		}
+		if err1 = ret.Cascade.Apply(sess, time.Now()); err1 != nil {
+			return err1
+		}
+		ret.Deleted, err1 = entity.DeleteEntities(sess, m, pks)
+		evs.addDeleted(m, pks)
+		return err1
+	})
+	if errors.Is(err, entity.ErrRestricted) {
+		return ctx.SendJSON(-1, err.Error(), ret)
+	}
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if ret.DryRun {
+		msg := fmt.Sprintf("dry run, %d row(s) matched", ret.Matched)
+		if err = ret.Cascade.Check(); err != nil {
+			msg += ", " + err.Error()
+		}
+		return ctx.SendJSON(0, msg, ret)
+	}
+	evs.publish(ctx.Engine())
+	return ctx.SendJSON(0, fmt.Sprintf("delete %d row(s) for entity %s", ret.Deleted, m.Entity.EntityName), ret)
+}
+
+// deleteKeys 请求中有主键列时取各行的主键，否则按 wheres 匹配主键
+func deleteKeys(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, wheres []*query.Where,
+	limit int) ([]any, error) {
+	idx := dt.FetchColumnIndex(m.Entity.PkAttrColumn)
+	if idx < 0 {
+		return matchPrimaryKeys(sess, m, wheres, limit)
+	}
+	pks := make([]any, 0, len(dt.Values()))
+	for _, row := range dt.Values() {
+		if row[idx] != nil {
+			pks = append(pks, row[idx])
+		}
+	}
+	return pks, nil
+}
+
+// cascadeKeyUpdate 按主键更新 dt 前，对被其他实体引用的关联键的变更执行级联
+func cascadeKeyUpdate(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, wc *query.WriteContext) error {
+	idx := dt.FetchColumnIndex(m.Entity.PkAttrColumn)
+	if idx < 0 {
+		return nil
+	}
+	pks, rows := make([]any, 0, len(dt.Values())), make([]int, 0, len(dt.Values()))
+	for i, row := range dt.Values() {
+		if row[idx] != nil {
+			pks, rows = append(pks, row[idx]), append(rows, i)
+		}
+	}
+	plan, err := keyUpdatePlan(sess, m, dt, pks, rows)
+	if err != nil {
+		return err
+	}
+	return applyCascade(sess, plan, wc)
+}
+
+// applyCascade 检查 restrict 后执行级联
+func applyCascade(sess *xorm.Session, plan *entity.CascadePlan, wc *query.WriteContext) error {
+	if err := plan.Check(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if wc != nil && !wc.Now.IsZero() {
+		now = wc.Now
+	}
+	return plan.Apply(sess, now)
+}
+
+// keyUpdatePlan 计算实体 pks[i] 的关联键变为 dt 第 rows[i] 行的值时的级联影响；
+// dt 中没有被引用的关联键时不查询旧值
+func keyUpdatePlan(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, pks []any,
+	rows []int) (*entity.CascadePlan, error) {
+	keyCols, err := entity.KeyColumns(sess, m)
+	if err != nil {
+		return nil, err
+	}
+	var cols []string
+	for _, c := range keyCols {
+		if dt.FetchColumnIndex(c) >= 0 {
+			cols = append(cols, c)
+		}
+	}
+	if len(cols) == 0 || len(pks) == 0 {
+		return &entity.CascadePlan{}, nil
+	}
+	old, err := fetchKeyValues(sess, m, cols, pks)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*entity.KeyChange
+	for i, pk := range pks {
+		o, ok := old[fmt.Sprint(pk)]
+		if !ok {
+			continue
+		}
+		row := dt.Values()[rows[i]]
+		for _, c := range cols {
+			changes = append(changes, &entity.KeyChange{Column: c, Old: o[c], New: row[dt.FetchColumnIndex(c)]})
+		}
+	}
+	return entity.PlanKeyUpdate(sess, m, changes)
+}
+
+// fetchKeyValues 查询实体 pks 的 cols 列的当前值，按主键的字符串形式索引
+func fetchKeyValues(sess *xorm.Session, m *meta.EntityMeta, cols []string, pks []any) (map[string]map[string]any, error) {
+	pkTable, pk := m.PrimaryTable(), m.Entity.PkAttrColumn
+	sel, joins := []string{pkTable + "." + pk}, map[string]bool{}
+	for _, c := range cols {
+		t := m.FetchTableNameByColumn(c)
+		sel = append(sel, t+"."+c)
+		if t != pkTable {
+			joins[t] = true
+		}
+	}
+	names := make([]string, 0, len(joins))
+	for t := range joins {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	ret := map[string]map[string]any{}
+	for start := 0; start < len(pks); start += updateInChunk {
+		chunk := pks[start:min(start+updateInChunk, len(pks))]
+		bld := builder.Dialect(sess.Engine().DriverName()).Select(sel...).From(pkTable)
+		for _, t := range names {
+			bld.LeftJoin(t, fmt.Sprintf("%s.%s = %s.%s", t, pk, pkTable, pk))
+		}
+		sqlStr, args, err := bld.Where(builder.In(pkTable+"."+pk, chunk...)).ToSQL()
+		if err != nil {
+			return nil, err
+		}
+		rows, err := sess.QueryInterface(append([]any{sqlStr}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			ret[fmt.Sprint(r[pk])] = r
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+type CasDept struct {
+	Idx  uint32 `xorm:"pk autoincr"`
+	Code string `xorm:"varchar(16) unique"`
+}
+
+type CasEmp struct {
+	Idx       uint32     `xorm:"pk autoincr"`
+	DeptCode  string     `xorm:"varchar(16)"`
+	DeletedAt *time.Time `xorm:"datetime null"`
+}
+
+type CasTask struct {
+	Idx    uint32 `xorm:"pk autoincr"`
+	EmpIdx *int64 `xorm:"null"`
+}
+
+func TestDM_DeleteCascade(t *testing.T) {
+	engine := setupDMEntity(t, "cas_dept", new(CasDept))
+	setupDMEntity(t, "cas_emp", new(CasEmp))
+	setupDMEntity(t, "cas_task", new(CasTask))
+	idx := map[string]uint32{}
+	for _, name := range []string{"cas_dept", "cas_emp", "cas_task"} {
+		m, err := meta.AcquireMeta(name, engine)
+		assert.NoError(t, err)
+		idx[name] = m.Entity.EntityIdx
+	}
+	_, _ = engine.Exec("DELETE FROM idig_entity_relation WHERE relation_name IN ('emp_dept', 'emp_task')")
+	empDept := &entity.Relation{RelationName: "emp_dept", EntityLeft: idx["cas_emp"], EntityRight: idx["cas_dept"],
+		LeftKey: "dept_code", RightKey: "code", RelationType: "m:1", CascadePolicy: entity.CascadeDelete}
+	empTask := &entity.Relation{RelationName: "emp_task", EntityLeft: idx["cas_emp"], EntityRight: idx["cas_task"],
+		LeftKey: "idx", RightKey: "emp_idx", RelationType: "1:m"}
+	_, err := engine.Insert(empDept, empTask)
+	assert.NoError(t, err)
+	one := int64(1)
+	_, err = engine.Insert(&CasDept{Idx: 1, Code: "D1"}, &CasDept{Idx: 2, Code: "D2"},
+		&CasEmp{Idx: 1, DeptCode: "D1"}, &CasEmp{Idx: 2, DeptCode: "D1"}, &CasEmp{Idx: 3, DeptCode: "D2"},
+		&CasTask{Idx: 1, EmpIdx: &one})
+	assert.NoError(t, err)
+
+	app := core.CreateApp()
+	count := func(bean any) int64 {
+		n, err := engine.Count(bean)
+		assert.NoError(t, err)
+		return n
+	}
+
+	// emp 1 有 task，emp_task 默认 restrict：试运行报告影响，实际删除被拒绝
+	ret := sendRequest(t, app, http.MethodDelete, "dm/cas_dept?dry_run=true", `{"vals":{"idx":1}}`)
+	assert.Contains(t, ret, `"code":0`)
+	assert.Contains(t, ret, "restricted by relation: 1 cas_task record(s) by relation 'emp_task'")
+	assert.Contains(t, ret, `{"relation":"emp_dept","entity":"cas_emp","policy":"cascade","column":"dept_code","keys":[1,2]}`)
+	ret = sendRequest(t, app, http.MethodDelete, "dm/cas_dept", `{"vals":{"idx":1}}`)
+	assert.Contains(t, ret, `"code":-1`)
+	assert.Equal(t, int64(2), count(new(CasDept)))
+	assert.Equal(t, int64(3), count(new(CasEmp)))
+
+	// emp_task 改为 set_null 后删除部门 D1：员工级联删除，任务的员工置空
+	_, err = engine.ID(empTask.RelationIdx).Cols("cascade_policy").Update(&entity.Relation{CascadePolicy: entity.CascadeSetNull})
+	assert.NoError(t, err)
+	ret = sendRequest(t, app, http.MethodDelete, "dm/cas_dept", `{"where":[{"col":"code","val":"D1"}]}`)
+	assert.Contains(t, ret, `"matched":1,"deleted":1`)
+	assert.Equal(t, int64(1), count(new(CasDept)))
+	assert.Equal(t, int64(1), count(new(CasEmp)))
+	task := &CasTask{}
+	_, err = engine.ID(1).Get(task)
+	assert.NoError(t, err)
+	assert.Nil(t, task.EmpIdx)
+
+	// 变更被引用的部门编码：cascade 同步更新员工的 dept_code
+	ret = sendRequest(t, app, http.MethodPut, "dm/cas_dept", `{"vals":{"idx":2,"code":"D9"}}`)
+	assert.Contains(t, ret, `"code":0`)
+	emp := &CasEmp{}
+	_, err = engine.ID(3).Get(emp)
+	assert.NoError(t, err)
+	assert.Equal(t, "D9", emp.DeptCode)
+
+	// soft_delete 要求从属实体声明软删除标记列
+	_, err = engine.ID(empDept.RelationIdx).Cols("cascade_policy").Update(&entity.Relation{CascadePolicy: entity.CascadeSoftDelete})
+	assert.NoError(t, err)
+	ret = sendRequest(t, app, http.MethodDelete, "dm/cas_dept", `{"vals":{"idx":2}}`)
+	assert.Contains(t, ret, "entity 'cas_emp' has no deleted column")
+	assert.NoError(t, meta.SetDeletedColumn(engine, "cas_emp", "deleted_at"))
+	ret = sendRequest(t, app, http.MethodDelete, "dm/cas_dept", `{"vals":{"idx":2}}`)
+	assert.Contains(t, ret, `"deleted":1`)
+	emp = &CasEmp{}
+	_, err = engine.ID(3).Get(emp)
+	assert.NoError(t, err)
+	assert.NotNil(t, emp.DeletedAt)
+	assert.Equal(t, int64(0), count(new(CasDept)))
+
+	ret = sendRequest(t, app, http.MethodDelete, "dm/cas_dept", `{"vals":{"code":"x"}}`)
+	assert.Contains(t, ret, "primary key values or where condition required")
+}
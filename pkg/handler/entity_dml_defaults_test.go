@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+type EmpSeq struct {
+	Idx    uint32 `xorm:"pk autoincr"`
+	Mobile string `xorm:"unique varchar(32)"`
+	Code   int    `xorm:"int"`
+}
+
+func TestDM_SequenceDefault(t *testing.T) {
+	engine := setupDMEntity(t, "emp_seq", new(EmpSeq))
+	assert.NoError(t, meta.SetColumnDefault(engine, "emp_seq",
+		&meta.ColumnDefault{Column: "code", Generator: meta.GenSequence, OnInsert: true}))
+
+	app := core.CreateApp()
+	// 回滚的写入不消耗序列，每行只取一次序列值
+	body := sendRequest(t, app, http.MethodPost, "dm/emp_seq", `{"cols":["mobile"],"vals":[["m1"],["m1"]]}`)
+	assert.Contains(t, body, `"code":-1`)
+	body = sendRequest(t, app, http.MethodPost, "dm/emp_seq", `{"cols":["mobile"],"vals":[["m1"],["m2"]]}`)
+	assert.Contains(t, body, "insert 2 row(s)")
+	var codes []int
+	assert.NoError(t, engine.Table("emp_seq").Cols("code").Asc("idx").Find(&codes))
+	assert.Equal(t, []int{1, 2}, codes)
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"go.uber.org/zap"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// 属性组是实体的可选扩展，实体创建时不一定有属性组的行。更新属性组的列时，
+// 主表中存在而属性组中缺少的行按 PkAttrColumn 在同一事务中补插，避免 UPDATE 影响 0 行而丢失数据
+
+// updateAttrGroup 更新属性表 table：已有的行执行 UPDATE，缺少的行以主键和更新的值插入
+func updateAttrGroup(sess *xorm.Session, m *meta.EntityMeta, table string, ckv *query.ColumnKeyVal,
+	dt *query.DataTable) error {
+	if m.IsPrimaryTable(table) {
+		return UpdateEntity(sess, table, ckv, dt)
+	}
+	missing, err := missingGroupRows(sess, m, table, dt)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return UpdateEntity(sess, table, ckv, dt)
+	}
+	var (
+		existing []int
+		lack     = map[int]bool{}
+	)
+	for _, i := range missing {
+		lack[i] = true
+	}
+	for i := range dt.Values() {
+		if !lack[i] {
+			existing = append(existing, i)
+		}
+	}
+	if len(existing) > 0 {
+		sub, _ := dt.SubTable(existing)
+		if err = UpdateEntity(sess, table, ckv, sub); err != nil {
+			return err
+		}
+	}
+	logger.Info("insert missing attribute group rows", zap.String("entity", m.Entity.EntityName),
+		zap.String("table", table), zap.Int("rows", len(missing)))
+	sub, _ := dt.SubTable(missing)
+	return insertEntity(sess, table, groupKeyVal(m, ckv), sub, false)
+}
+
+// groupKeyVal 属性表以 PkAttrColumn 关联主表，插入时的列为 PkAttrColumn 和更新的值列
+func groupKeyVal(m *meta.EntityMeta, ckv *query.ColumnKeyVal) *query.ColumnKeyVal {
+	pk := m.Entity.PkAttrColumn
+	ret := &query.ColumnKeyVal{KCols: []string{pk}}
+	for _, c := range ckv.VCols {
+		if c != pk {
+			ret.VCols = append(ret.VCols, c)
+		}
+	}
+	ret.MergeSortAllColumns()
+	return ret
+}
+
+// missingGroupRows 返回 dt 中实体在主表存在、但属性表 table 中没有对应行的行号
+func missingGroupRows(sess *xorm.Session, m *meta.EntityMeta, table string, dt *query.DataTable) ([]int, error) {
+	pkIdx := dt.FetchColumnIndex(m.Entity.PkAttrColumn)
+	if pkIdx < 0 {
+		return nil, fmt.Errorf("primary key '%s' required", m.Entity.PkAttrColumn)
+	}
+	pks := make([]any, 0, len(dt.Values()))
+	for _, row := range dt.Values() {
+		if row[pkIdx] != nil {
+			pks = append(pks, row[pkIdx])
+		}
+	}
+	lack, err := missingGroupKeys(sess, m, table, pks)
+	if err != nil || len(lack) == 0 {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(lack))
+	for _, pk := range lack {
+		keys[fmt.Sprint(pk)] = true
+	}
+	var rows []int
+	for i, row := range dt.Values() {
+		// 请求中的主键可能是 float64 等类型，按字符串比较
+		if row[pkIdx] != nil && keys[fmt.Sprint(row[pkIdx])] {
+			rows = append(rows, i)
+		}
+	}
+	return rows, nil
+}
+
+// missingGroupKeys 在 pks 中找出主表存在、属性表 table 中缺少的主键
+func missingGroupKeys(db xorm.Interface, m *meta.EntityMeta, table string, pks []any) ([]any, error) {
+	pkTable, pk := m.PrimaryTable(), m.Entity.PkAttrColumn
+	var ret []any
+	for start := 0; start < len(pks); start += updateInChunk {
+		chunk := pks[start:min(start+updateInChunk, len(pks))]
+		sqlStr, args, err := builder.Dialect(dialectOf(db)).Select(pkTable+"."+pk).From(pkTable).
+			LeftJoin(table, fmt.Sprintf("%s.%s = %s.%s", table, pk, pkTable, pk)).
+			Where(builder.In(pkTable+"."+pk, chunk...).And(builder.IsNull{table + "." + pk})).ToSQL()
+		if err != nil {
+			return nil, err
+		}
+		rows, err := db.QueryInterface(append([]any{sqlStr}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			ret = append(ret, r[pk])
+		}
+	}
+	return ret, nil
+}
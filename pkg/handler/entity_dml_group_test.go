@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/stretchr/testify/assert"
+)
+
+type EmpGrp0 struct {
+	Idx  uint32 `xorm:"pk autoincr"`
+	Name string `xorm:"varchar(64)"`
+}
+
+type EmpGrp1 struct {
+	Idx  uint32 `xorm:"unique"`
+	Dept string `xorm:"varchar(64)"`
+	Room string `xorm:"varchar(64)"`
+}
+
+func TestDM_UpdateMissingGroup(t *testing.T) {
+	engine := setupDMEntity(t, "emp_grp", new(EmpGrp0), new(EmpGrp1))
+	_, err := engine.Insert(&EmpGrp0{Idx: 1, Name: "a"}, &EmpGrp0{Idx: 2, Name: "b"}, &EmpGrp0{Idx: 3, Name: "c"},
+		&EmpGrp0{Idx: 4, Name: "d"})
+	assert.NoError(t, err)
+	_, err = engine.Insert(&EmpGrp1{Idx: 1, Dept: "d1", Room: "r1"})
+	assert.NoError(t, err)
+
+	app := core.CreateApp()
+	dept := func(idx uint32) *EmpGrp1 {
+		e := &EmpGrp1{}
+		has, err := engine.Where("idx = ?", idx).Get(e)
+		assert.NoError(t, err)
+		if !has {
+			return nil
+		}
+		return e
+	}
+
+	// 按主键：已有属性组的行更新，缺少的行补插，主表中不存在的实体不插入
+	ret := sendRequest(t, app, http.MethodPut, "dm/emp_grp", `{"cols":["idx","dept"],"vals":[[1,"d2"],[2,"d3"],[9,"d9"]]}`)
+	assert.Contains(t, ret, `"code":0`)
+	assert.Equal(t, &EmpGrp1{Idx: 1, Dept: "d2", Room: "r1"}, dept(1))
+	assert.Equal(t, &EmpGrp1{Idx: 2, Dept: "d3"}, dept(2))
+	assert.Nil(t, dept(9))
+
+	// 按条件：条件引用主表，缺少的属性组行同样补插
+	ret = sendRequest(t, app, http.MethodPut, "dm/emp_grp", `{"where":[{"col":"name","op":"in","val":["c","d"]}],"vals":{"room":"r5"}}`)
+	assert.Contains(t, ret, `"affected":{"emp_grp1":2}`)
+	assert.Equal(t, &EmpGrp1{Idx: 3, Room: "r5"}, dept(3))
+	assert.Equal(t, &EmpGrp1{Idx: 4, Room: "r5"}, dept(4))
+}
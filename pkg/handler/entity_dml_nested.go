@@ -0,0 +1,303 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/goccy/go-json"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// isNested 请求体为嵌套文档：POST /entity/dm/:entity?nested=true
+func isNested(ctx *core.Context) bool {
+	return ctx.Fiber().QueryBool("nested", false)
+}
+
+// dmlNested 在一个事务中写入聚合：vals 为一个或多个文档，文档中以实体关系名为键的字段为关联实体的文档，
+// 另一端为多时为数组，否则为对象。被引用的一端（m:1）先写入，其关联键回填到本实体；
+// 从属的一端（1:m）在本实体之后写入，外键取本实体的关联键，自增主键由 insertEntity 回填；
+// m:n 写入另一端后插入缺少的链接。有主键且已存在的记录更新，只给出主键时仅引用不写入。
+// 返回各文档的键树：主键及各关联字段的键树；未给出的关联记录不删除
+func dmlNested(ctx *core.Context) error {
+	var body struct {
+		Vals json.RawMessage `json:"vals"`
+	}
+	if err := json.Unmarshal(ctx.Fiber().Body(), &body); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	docs, many, err := parseDocuments(body.Vals)
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	m, err := meta.AcquireMeta(ctx.Fiber().Params("entity"), ctx.Engine())
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	wc, evs := writeContext(ctx)
+	trees := make([]map[string]any, 0, len(docs))
+	if err = handleTransaction(ctx, func(sess *xorm.Session) error {
+		for i, doc := range docs {
+			path := m.Entity.EntityName
+			if many {
+				path = fmt.Sprintf("%s[%d]", path, i)
+			}
+			_, tree, err1 := writeDocument(sess, m, doc, wc, path)
+			if err1 != nil {
+				return err1
+			}
+			trees = append(trees, tree)
+		}
+		return nil
+	}); err != nil {
+		if errors.Is(err, entity.ErrRelationNotFound) {
+			return sendRelationError(ctx, err)
+		}
+		return ctx.SendJSON(-1, fmt.Sprintf("writing document error: %v", err), nil)
+	}
+	evs.publish(ctx.Engine())
+	msg := fmt.Sprintf("write %d document(s) for entity %s", len(docs), m.Entity.EntityName)
+	if many {
+		return ctx.SendJSON(0, msg, trees)
+	}
+	return ctx.SendJSON(0, msg, trees[0])
+}
+
+// parseDocuments vals 为对象或对象数组，many 表示为数组
+func parseDocuments(data json.RawMessage) ([]map[string]any, bool, error) {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, false, fmt.Errorf("parse vals error: %w", err)
+	}
+	if doc, ok := v.(map[string]any); ok {
+		return []map[string]any{doc}, false, nil
+	}
+	if _, ok := v.([]any); !ok {
+		return nil, false, fmt.Errorf("parse vals error: need object or array, not %T", v)
+	}
+	docs, err := asDocuments(v, "vals")
+	return docs, true, err
+}
+
+// asDocuments 关联字段的值转换为文档数组
+func asDocuments(v any, path string) ([]map[string]any, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: need array, not %T", path, v)
+	}
+	docs := make([]map[string]any, 0, len(arr))
+	for i, a := range arr {
+		doc, ok := a.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s[%d]: need object, not %T", path, i, a)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// nestedField 文档中的关联字段
+type nestedField struct {
+	name string
+	rel  *query.Related
+	val  any
+}
+
+// owns 实体 m 是否为关系 rel 中从属一端的属主：另一端为多，或 1:1 时 m 以主键关联另一端的非主键
+func owns(m *meta.EntityMeta, rel *query.Related) bool {
+	if rel.Many {
+		return true
+	}
+	return slices.Contains(m.PrimaryColumn(), rel.Key) && !slices.Contains(rel.Meta.PrimaryColumn(), rel.RelatedKey)
+}
+
+// writeDocument 写入实体 m 的文档 doc，返回写入后的列值及键树；path 用于错误信息中定位文档
+func writeDocument(sess *xorm.Session, m *meta.EntityMeta, doc map[string]any, wc *query.WriteContext,
+	path string) (map[string]any, map[string]any, error) {
+	rels, err := entity.EntityRelations(sess.Engine(), m.Entity.EntityIdx)
+	if err != nil {
+		return nil, nil, err
+	}
+	row := map[string]any{}
+	var before, after []*nestedField
+	for _, name := range slices.Sorted(maps.Keys(doc)) {
+		v := doc[name]
+		_, isMap := v.(map[string]any)
+		_, isArr := v.([]any)
+		isRel := slices.ContainsFunc(rels, func(r *entity.Relation) bool { return r.RelationName == name })
+		if !isRel || !(isMap || isArr) {
+			row[name] = v
+			continue
+		}
+		rel, err1 := entity.ResolveRelated(sess.Engine(), m, name)
+		if err1 != nil {
+			return nil, nil, fmt.Errorf("%s.%s: %w", path, name, err1)
+		}
+		f := &nestedField{name: name, rel: rel, val: v}
+		if rel.Link != nil || owns(m, rel) {
+			after = append(after, f)
+		} else {
+			before = append(before, f)
+		}
+	}
+
+	tree := map[string]any{}
+	// 被引用的一端先写入，关联键回填到本实体
+	for _, f := range before {
+		sub, ok := f.val.(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s.%s: need object, not %T", path, f.name, f.val)
+		}
+		ref, refTree, err1 := writeDocument(sess, f.rel.Meta, sub, wc, path+"."+f.name)
+		if err1 != nil {
+			return nil, nil, err1
+		}
+		if row[f.rel.Key], err1 = columnValue(sess, f.rel.Meta, ref, f.rel.RelatedKey); err1 != nil {
+			return nil, nil, fmt.Errorf("%s.%s: %w", path, f.name, err1)
+		}
+		tree[f.name] = refTree
+	}
+
+	if err = writeRow(sess, m, row, wc); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, col := range m.PrimaryColumn() {
+		tree[col] = row[col]
+	}
+
+	// 从属的一端及 m:n 的另一端在本实体之后写入
+	for _, f := range after {
+		fpath := path + "." + f.name
+		key, err1 := columnValue(sess, m, row, f.rel.Key)
+		if err1 != nil {
+			return nil, nil, fmt.Errorf("%s: %w", fpath, err1)
+		}
+		var subs []map[string]any
+		if f.rel.Many {
+			if subs, err1 = asDocuments(f.val, fpath); err1 != nil {
+				return nil, nil, err1
+			}
+		} else if sub, ok := f.val.(map[string]any); ok {
+			subs = []map[string]any{sub}
+		} else {
+			return nil, nil, fmt.Errorf("%s: need object, not %T", fpath, f.val)
+		}
+		trees := make([]map[string]any, 0, len(subs))
+		for i, sub := range subs {
+			spath := fpath
+			if f.rel.Many {
+				spath = fmt.Sprintf("%s[%d]", fpath, i)
+			}
+			if f.rel.Link == nil {
+				sub[f.rel.RelatedKey] = key
+			}
+			other, subTree, err2 := writeDocument(sess, f.rel.Meta, sub, wc, spath)
+			if err2 != nil {
+				return nil, nil, err2
+			}
+			if f.rel.Link != nil {
+				if err2 = writeLink(sess, f.rel, key, other, wc); err2 != nil {
+					return nil, nil, fmt.Errorf("%s: %w", spath, err2)
+				}
+			}
+			trees = append(trees, subTree)
+		}
+		if f.rel.Many {
+			tree[f.name] = trees
+		} else {
+			tree[f.name] = trees[0]
+		}
+	}
+	return row, tree, nil
+}
+
+// writeRow 按主键写入一行：主键已存在时更新，只给出主键时仅引用，否则插入；
+// 写入后的列值（包括回填的自增主键）写回 row。单行不经 UpsertEntityRows 的子表，以便取得回填的列
+func writeRow(sess *xorm.Session, m *meta.EntityMeta, row map[string]any, wc *query.WriteContext) error {
+	pkCols := m.PrimaryColumn()
+	pks := make([]any, len(pkCols))
+	for i, c := range pkCols {
+		pks[i] = row[c]
+	}
+	exist, err := primaryKeyExists(sess, m.PrimaryTable(), pkCols, pks)
+	if err != nil || exist && len(row) == len(pkCols) {
+		return err
+	}
+	dt := query.NewDataTable()
+	cols := slices.Sorted(maps.Keys(row))
+	for _, c := range pkCols {
+		if _, ok := row[c]; !ok {
+			cols = append(cols, c) // 便于回填自增主键
+		}
+	}
+	dt.AddColumns(cols)
+	vals := make([]any, len(cols))
+	for i, c := range cols {
+		vals[i] = row[c]
+	}
+	if err = dt.AddRow(vals); err != nil {
+		return err
+	}
+	write := InsertEntityRows
+	if exist {
+		write = UpdateEntityRows
+	}
+	if err = write(sess, m, dt, wc); err != nil {
+		if idx := dt.FetchColumnIndex(query.ResultColumn); errors.Is(err, ErrInvalidRows) && idx >= 0 {
+			return fmt.Errorf("%w: %v", err, dt.Values()[0][idx])
+		}
+		return err
+	}
+	for i, c := range dt.Columns() {
+		if c != query.ResultColumn {
+			row[c] = dt.Values()[0][i]
+		}
+	}
+	return nil
+}
+
+// columnValue 取已写入记录的列 col，row 中没有时按主键从库中读取
+func columnValue(sess *xorm.Session, m *meta.EntityMeta, row map[string]any, col string) (any, error) {
+	if v := row[col]; v != nil {
+		return v, nil
+	}
+	table := m.FetchTableNameByColumn(col)
+	if table == "" {
+		return nil, fmt.Errorf("column '%s' not found in entity '%s'", col, m.Entity.EntityName)
+	}
+	cond := builder.Eq{}
+	for _, c := range m.PrimaryColumn() {
+		cond[c] = row[c]
+	}
+	rows, err := sess.Table(table).Select(col).Where(cond).QueryInterface()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || rows[0][col] == nil {
+		return nil, fmt.Errorf("key '%s' of entity '%s' is null", col, m.Entity.EntityName)
+	}
+	return rows[0][col], nil
+}
+
+// writeLink 链接 m:n 的两端，链接已存在时不重复插入
+func writeLink(sess *xorm.Session, rel *query.Related, key any, other map[string]any, wc *query.WriteContext) error {
+	far, err := columnValue(sess, rel.Meta, other, rel.RelatedKey)
+	if err != nil {
+		return err
+	}
+	l := rel.Link
+	exist, err := sess.Table(l.Table).Where(builder.Eq{l.Near: key, l.Far: far}).Exist()
+	if err != nil || exist {
+		return err
+	}
+	dt := query.NewDataTable()
+	dt.AddColumns([]string{l.Near, l.Far})
+	_ = dt.AddRow([]any{key, far})
+	return InsertEntityRows(sess, l.Meta, dt, wc)
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNestedDocument(t *testing.T) {
+	_ = core.ReloadTenantConfig()
+	app := core.CreateApp()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	assert.NoError(t, err)
+	setupJoinEntities(t, engine)
+	count := func(table, where string) int64 {
+		n, err := engine.Table(table).Where(where).Count()
+		assert.NoError(t, err)
+		return n
+	}
+
+	// 新部门先写入，部门编码回填到员工；任务在员工之后写入，外键为员工的自增主键；返回键树
+	ret := sendRequest(t, app, http.MethodPost, "dm/jn_emp?nested=true",
+		`{"vals":{"name":"dan","jn_emp_dept":{"code":"D3","name":"Dev","active":1},`+
+			`"jn_emp_task":[{"title":"x"},{"title":"y"}]}}`)
+	assert.Contains(t, ret, `"data":{"idx":4,"jn_emp_dept":{"idx":3},"jn_emp_task":[{"idx":4},{"idx":5}]}`)
+	assert.Equal(t, int64(1), count("jn_emp", "idx = 4 AND dept_code = 'D3'"))
+	assert.Equal(t, int64(1), count("jn_dept_ext", "idx = 3 AND active = 1"))
+	assert.Equal(t, int64(2), count("jn_task", "emp_idx = 4"))
+
+	// 只给出主键的部门仅引用，按主键读取其编码；已存在的任务更新并改为属于新员工
+	ret = sendRequest(t, app, http.MethodPost, "dm/jn_emp?nested=true",
+		`{"vals":[{"name":"eve","jn_emp_dept":{"idx":1},"jn_emp_task":[{"idx":3,"title":"c2"}]}]}`)
+	assert.Contains(t, ret, `"data":[{"idx":5,"jn_emp_dept":{"idx":1},"jn_emp_task":[{"idx":3}]}]`)
+	assert.Equal(t, int64(1), count("jn_emp", "idx = 5 AND dept_code = 'D1'"))
+	assert.Equal(t, int64(1), count("jn_task", "idx = 3 AND emp_idx = 5 AND title = 'c2'"))
+	assert.Equal(t, int64(1), count("jn_dept", "idx = 1 AND name = 'Sales'"))
+
+	// 任一文档出错时整个聚合回滚
+	ret = sendRequest(t, app, http.MethodPost, "dm/jn_emp?nested=true",
+		`{"vals":{"name":"fay","jn_emp_task":[{"title":"z"},{"nope":1}]}}`)
+	assert.Contains(t, ret, "jn_emp.jn_emp_task[1]")
+	assert.Equal(t, int64(0), count("jn_emp", "name = 'fay'"))
+	assert.Equal(t, int64(0), count("jn_task", "title = 'z'"))
+	ret = sendRequest(t, app, http.MethodPost, "dm/jn_emp?nested=true",
+		`{"vals":{"name":"fay","jn_emp_task":{"title":"z"}}}`)
+	assert.Contains(t, ret, "need array")
+}
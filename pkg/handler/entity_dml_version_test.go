@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+type EmpVer0 struct {
+	Idx     uint32 `xorm:"pk autoincr"`
+	Name    string `xorm:"varchar(64)"`
+	Version int    `xorm:"int not null default 0"`
+}
+
+type EmpVer1 struct {
+	Idx  uint32 `xorm:"unique"`
+	Dept string `xorm:"varchar(64)"`
+}
+
+func TestDM_UpdateVersion(t *testing.T) {
+	engine := setupDMEntity(t, "emp_ver", new(EmpVer0), new(EmpVer1))
+	assert.NoError(t, meta.SetVersionColumn(engine, "emp_ver", "version"))
+	assert.ErrorContains(t, meta.SetVersionColumn(engine, "emp_ver", "idx"), "primary key")
+
+	_, err := engine.Insert(&EmpVer0{Idx: 1, Name: "a1", Version: 1}, &EmpVer0{Idx: 2, Name: "b1", Version: 1})
+	assert.NoError(t, err)
+	_, err = engine.Insert(&EmpVer1{Idx: 1, Dept: "d1"}, &EmpVer1{Idx: 2, Dept: "d1"})
+	assert.NoError(t, err)
+
+	app := core.CreateApp()
+	check := func(idx uint32, name, dept string, version int) {
+		e0, e1 := &EmpVer0{}, &EmpVer1{}
+		_, err := engine.ID(idx).Get(e0)
+		assert.NoError(t, err)
+		_, err = engine.Where("idx = ?", idx).Get(e1)
+		assert.NoError(t, err)
+		assert.Equal(t, []any{name, dept, version}, []any{e0.Name, e1.Dept, e0.Version}, "idx %d", idx)
+	}
+
+	body := sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"vals":{"idx":1,"name":"a2","dept":"d2","version":1}}`)
+	assert.Contains(t, body, `"code":0`)
+	check(1, "a2", "d2", 2)
+
+	// 使用过期的版本，两个属性组都不更新
+	body = sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"vals":{"idx":1,"name":"a3","dept":"d3","version":1}}`)
+	assert.Contains(t, body, "conflict: version is 2, expected 1")
+	check(1, "a2", "d2", 2)
+
+	// 只更新属性组时也检查并递增版本
+	body = sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"vals":{"idx":1,"dept":"d4","version":2}}`)
+	assert.Contains(t, body, `"code":0`)
+	check(1, "a2", "d4", 3)
+
+	body = sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"vals":{"idx":1,"name":"a5"}}`)
+	assert.Contains(t, body, "version: expected version required")
+
+	// 批量中有冲突时整个事务回滚，未冲突的行标记为已回滚，版本不变
+	body = sendRequest(t, app, http.MethodPut, "dm/emp_ver",
+		`{"cols":["idx","name","version"],"vals":[[2,"b2",1],[1,"a6",1],[9,"x",1]]}`)
+	assert.Contains(t, body, "conflict: version is 3, expected 1")
+	assert.Contains(t, body, "conflict: row not found")
+	assert.Contains(t, body, `[2,"b2",1,"rolled back: 2 row(s) in the batch conflicted"]`)
+	check(2, "b1", "d1", 1)
+}
+
+type EmpStamp struct {
+	Idx       uint32    `xorm:"pk autoincr"`
+	Name      string    `xorm:"varchar(64)"`
+	UpdatedAt time.Time `xorm:"datetime"`
+}
+
+func TestDM_UpdatedAtVersion(t *testing.T) {
+	engine := setupDMEntity(t, "emp_stamp", new(EmpStamp))
+	_, err := engine.Exec("INSERT INTO emp_stamp (idx, name, updated_at) VALUES (1, 'a1', '2024-01-01 00:00:00')")
+	assert.NoError(t, err)
+
+	app := core.CreateApp()
+	name := func() string {
+		var n string
+		_, err := engine.Table("emp_stamp").Where("idx = 1").Cols("name").Get(&n)
+		assert.NoError(t, err)
+		return n
+	}
+
+	// 未声明版本列时，给出 updated_at 则以其为期望的版本
+	body := sendRequest(t, app, http.MethodPut, "dm/emp_stamp",
+		`{"vals":{"idx":1,"name":"a2","updated_at":"2024-01-01 00:00:00"}}`)
+	assert.Contains(t, body, `"code":0`)
+	assert.Equal(t, "a2", name())
+	body = sendRequest(t, app, http.MethodPut, "dm/emp_stamp",
+		`{"vals":{"idx":1,"name":"a3","updated_at":"2024-01-01 00:00:00"}}`)
+	assert.Contains(t, body, "conflict: updated_at is")
+	assert.Equal(t, "a2", name())
+
+	// 未给出 updated_at 时不检查
+	body = sendRequest(t, app, http.MethodPut, "dm/emp_stamp", `{"vals":{"idx":1,"name":"a4"}}`)
+	assert.Contains(t, body, `"code":0`)
+	assert.Equal(t, "a4", name())
+}
@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/spf13/viper"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+// DefaultMaxAffectedRows 按条件更新时默认允许影响的最大行数
+const DefaultMaxAffectedRows = 1000
+
+// updateInChunk 按主键 IN 更新时每条语句的主键数
+const updateInChunk = 500
+
+func init() {
+	viper.SetDefault("entity.dml.max-affected-rows", DefaultMaxAffectedRows)
+}
+
+// ErrTooManyRows 按条件匹配的行数超过上限
+var ErrTooManyRows = errors.New("too many rows matched")
+
+// UpdateWhereResult 按条件更新的结果，Affected 为各表的影响行数
+type UpdateWhereResult struct {
+	Matched  int                 `json:"matched"`
+	Affected map[string]int64    `json:"affected,omitempty"`
+	DryRun   bool                `json:"dry_run,omitempty"`
+	Cascade  *entity.CascadePlan `json:"cascade,omitempty"`
+}
+
+// maxAffectedRows 上限取配置 entity.dml.max-affected-rows，?max_rows= 只能调低
+func maxAffectedRows(ctx *core.Context) int {
+	limit := viper.GetInt("entity.dml.max-affected-rows")
+	if limit <= 0 {
+		limit = DefaultMaxAffectedRows
+	}
+	if n := ctx.Fiber().QueryInt("max_rows"); n > 0 && n < limit {
+		limit = n
+	}
+	return limit
+}
+
+// dmlUpdateWhere 按 where 条件更新实体，vals 只能有一行；?dry_run=true 时只返回匹配的行数和关联键变更的级联影响
+func dmlUpdateWhere(ctx *core.Context, m *meta.EntityMeta, dt *query.DataTable, wheres []*query.Where) error {
+	if len(dt.Values()) != 1 {
+		return ctx.SendBadRequestError(fmt.Errorf("update by condition requires exactly one row of values, got %d",
+			len(dt.Values())))
+	}
+	limit := maxAffectedRows(ctx)
+	if ctx.Fiber().QueryBool("dry_run") {
+		return dryRunUpdateWhere(ctx, m, dt, wheres, limit)
+	}
+	wc, evs := writeContext(ctx)
+	var ret *UpdateWhereResult
+	if err := handleTransaction(ctx, func(sess *xorm.Session) error {
+		var err1 error
+		ret, err1 = UpdateEntityWhere(sess, m, dt, wheres, limit, wc)
+		return err1
+	}); err != nil {
+		if errors.Is(err, ErrInvalidRows) {
+			return sendInvalidRows(ctx, err, dt)
+		}
+		return ctx.SendBadRequestError(err)
+	}
+	evs.publish(ctx.Engine())
+	return ctx.SendJSON(0, fmt.Sprintf("update %d row(s) for entity %s", ret.Matched, m.Entity.EntityName), ret)
+}
+
+// dryRunUpdateWhere 只查询，不写入
+func dryRunUpdateWhere(ctx *core.Context, m *meta.EntityMeta, dt *query.DataTable, wheres []*query.Where,
+	limit int) error {
+	sess := ctx.Engine().NewSession()
+	defer func() { _ = sess.Close() }()
+	pks, err := matchPrimaryKeys(sess, m, wheres, limit)
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	ret := &UpdateWhereResult{Matched: len(pks), DryRun: true}
+	if ret.Cascade, err = keyUpdatePlan(sess, m, dt, pks, make([]int, len(pks))); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	msg := fmt.Sprintf("dry run, %d row(s) matched", len(pks))
+	if err = ret.Cascade.Check(); err != nil {
+		msg += ", " + err.Error()
+	}
+	return ctx.SendJSON(0, msg, ret)
+}
+
+// UpdateEntityWhere 在事务中把 dt 第一行的值写入满足 wheres 的所有实体。
+// 先取出匹配的主键（超过 limit 时返回 ErrTooManyRows），各属性表再按主键子集更新，
+// 避免先更新的表改变后续表的条件结果；属性组中缺少的行以主键和值补插；有版本列时同时递增版本；
+// 被引用的关联键变更时先按关系的级联策略处理从属记录
+func UpdateEntityWhere(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, wheres []*query.Where,
+	limit int, wc *query.WriteContext) (*UpdateWhereResult, error) {
+	pk := m.Entity.PkAttrColumn
+	if dt.FetchColumnIndex(pk) >= 0 {
+		return nil, fmt.Errorf("primary key '%s' can not be updated by condition", pk)
+	}
+	if err := dt.ApplyDefaults(sess, m, query.ValidateUpdate, wc); err != nil {
+		return nil, err
+	}
+	tabColsKV, err := dt.DivisionColumnsKeyVal(m)
+	if err != nil {
+		return nil, err
+	}
+	pks, err := matchPrimaryKeys(sess, m, wheres, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateUpdateWhere(sess, m, dt, pks); err != nil {
+		return nil, err
+	}
+	ret := &UpdateWhereResult{Matched: len(pks), Affected: map[string]int64{}}
+	if len(pks) == 0 {
+		return ret, nil
+	}
+	// 所有匹配的实体都取 dt 第一行的值
+	if ret.Cascade, err = keyUpdatePlan(sess, m, dt, pks, make([]int, len(pks))); err != nil {
+		return nil, err
+	}
+	if err = applyCascade(sess, ret.Cascade, wc); err != nil {
+		return nil, err
+	}
+	if len(ret.Cascade.Effects) == 0 {
+		ret.Cascade = nil
+	}
+	sets, inserts := map[string][]builder.Cond{}, map[string]builder.Eq{}
+	for t, ckv := range tabColsKV {
+		if len(ckv.VCols) == 0 {
+			continue
+		}
+		vals, err1 := dt.FetchRowDataByColumns(0, ckv.VCols)
+		if err1 != nil {
+			return nil, err1
+		}
+		sets[t] = buildValueConditions(ckv.VCols, vals)
+		if !m.IsPrimaryTable(t) {
+			inserts[t] = builder.Eq{}
+			for i, c := range ckv.VCols {
+				inserts[t][c] = vals[i]
+			}
+		}
+	}
+	if ver := m.VersionColumn(); ver != nil {
+		// 版本列所在表的行必须已存在，不补插
+		delete(inserts, ver.TableName)
+		next := any(builder.Expr(ver.Name + " + 1"))
+		if ver.SQLType.IsTime() {
+			now := time.Now()
+			if wc != nil && !wc.Now.IsZero() {
+				now = wc.Now
+			}
+			next, _ = query.NextVersion(ver, nil, now)
+		}
+		sets[ver.TableName] = append(sets[ver.TableName], builder.Eq{ver.Name: next})
+	}
+	tables := make([]string, 0, len(sets))
+	for t := range sets {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	for _, t := range tables {
+		for start := 0; start < len(pks); start += updateInChunk {
+			chunk := pks[start:min(start+updateInChunk, len(pks))]
+			sqlStr, args, err1 := builder.Dialect(sess.Engine().DriverName()).Update(sets[t]...).From(t).
+				Where(builder.In(pk, chunk...)).ToSQL()
+			if err1 != nil {
+				return nil, err1
+			}
+			result, err1 := sess.Exec(append([]any{sqlStr}, args...)...)
+			if err1 != nil {
+				return nil, fmt.Errorf("update entity error: %w", err1)
+			}
+			af, _ := result.RowsAffected()
+			ret.Affected[t] += af
+		}
+		if vals, ok := inserts[t]; ok {
+			af, err1 := insertMissingGroupRows(sess, m, t, pks, vals)
+			if err1 != nil {
+				return nil, fmt.Errorf("update entity error: %w", err1)
+			}
+			ret.Affected[t] += af
+		}
+	}
+	if err = meta.SyncSearchIndex(sess, m, pks); err != nil {
+		return nil, err
+	}
+	_ = dt.UpdateAllWithResult(int64(ret.Matched))
+	for _, v := range pks {
+		row := map[string]any{pk: v}
+		for i, c := range dt.Columns() {
+			if c != query.ResultColumn {
+				row[c] = dt.Values()[0][i]
+			}
+		}
+		wc.RowWritten(m, query.OpUpdated, row)
+	}
+	return ret, nil
+}
+
+// validateUpdateWhere 校验按条件更新的值，unique 规则查询数据库。
+// 匹配多行时同一个值写入唯一列必然重复，直接拒绝；只匹配一行时带上其主键校验，排除行自身
+func validateUpdateWhere(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, pks []any) error {
+	if len(pks) > 1 {
+		for _, r := range m.Rules {
+			if !r.Enabled() || r.Kind != meta.RuleUnique {
+				continue
+			}
+			if j := dt.FetchColumnIndex(r.Column); j >= 0 && dt.Values()[0][j] != nil {
+				return fmt.Errorf("column '%s' is unique (rule '%s'), can not set one value on %d matched rows",
+					r.Column, r.RuleName, len(pks))
+			}
+		}
+	}
+	chk := dt
+	if len(pks) == 1 {
+		chk = dt.WithColumn(m.Entity.PkAttrColumn, pks[0])
+	}
+	// 按条件更新时没有期望的版本，只校验值
+	errs, err := chk.ValidateAll(sess, m, query.ValidateUpdate)
+	if err != nil {
+		return err
+	}
+	if n := dt.ReportErrors(errs); n > 0 {
+		return fmt.Errorf("%w: %d of %d row(s) failed validation", ErrInvalidRows, n, len(dt.Values()))
+	}
+	return nil
+}
+
+// matchPrimaryKeys 查询满足 wheres 的实体主键，条件中引用的属性表通过主键左连接到主表；
+// 最多取 limit+1 行，超过 limit 时返回 ErrTooManyRows
+func matchPrimaryKeys(db xorm.Interface, m *meta.EntityMeta, wheres []*query.Where, limit int) ([]any, error) {
+	pkTable, pk := m.PrimaryTable(), m.Entity.PkAttrColumn
+	joins := map[string]bool{}
+	qualified := make([]*query.Where, len(wheres))
+	for i, w := range wheres {
+		qualified[i] = w
+		if w.Op == "expr" {
+			continue
+		}
+		col, ok := m.ColumnIndex[w.Col]
+		if !ok {
+			if m.IsVirtual(w.Col) {
+				return nil, fmt.Errorf("where column '%s' is virtual, use an expr condition", w.Col)
+			}
+			return nil, fmt.Errorf("where column '%s' not found", w.Col)
+		}
+		if col.TableName != pkTable {
+			joins[col.TableName] = true
+		}
+		if w.Col == pk {
+			cp := *w
+			cp.Col = pkTable + "." + pk
+			qualified[i] = &cp
+		}
+	}
+	bld := builder.Dialect(dialectOf(db)).Select(pkTable + "." + pk).From(pkTable)
+	names := make([]string, 0, len(joins))
+	for t := range joins {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	for _, t := range names {
+		bld.LeftJoin(t, fmt.Sprintf("%s.%s = %s.%s", t, pk, pkTable, pk))
+	}
+	if err := query.BuildWheresSQL(bld, qualified); err != nil {
+		return nil, err
+	}
+	bld.OrderBy(pkTable + "." + pk).Limit(limit + 1)
+	sqlStr, args, err := bld.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryInterface(append([]any{sqlStr}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > limit {
+		return nil, fmt.Errorf("%w: more than %d row(s), narrow the condition or raise entity.dml.max-affected-rows",
+			ErrTooManyRows, limit)
+	}
+	pks := make([]any, len(rows))
+	for i, r := range rows {
+		pks[i] = r[pk]
+	}
+	return pks, nil
+}
+
+// dialectOf 返回 db 的驱动名，用于 builder
+func dialectOf(db xorm.Interface) string {
+	switch t := db.(type) {
+	case *xorm.Session:
+		return t.Engine().DriverName()
+	case *xorm.Engine:
+		return t.DriverName()
+	}
+	return builder.SQLITE
+}
+
+// insertMissingGroupRows 为 pks 中主表存在、属性表 table 中缺少的实体插入一行，值为 vals
+func insertMissingGroupRows(sess *xorm.Session, m *meta.EntityMeta, table string, pks []any,
+	vals builder.Eq) (int64, error) {
+	lack, err := missingGroupKeys(sess, m, table, pks)
+	if err != nil {
+		return 0, err
+	}
+	var affected int64
+	for _, k := range lack {
+		row := builder.Eq{m.Entity.PkAttrColumn: k}
+		for c, v := range vals {
+			row[c] = v
+		}
+		sqlStr, args, err1 := builder.Dialect(sess.Engine().DriverName()).Insert(row).Into(table).ToSQL()
+		if err1 != nil {
+			return affected, err1
+		}
+		result, err1 := sess.Exec(append([]any{sqlStr}, args...)...)
+		if err1 != nil {
+			return affected, err1
+		}
+		af, _ := result.RowsAffected()
+		affected += af
+	}
+	return affected, nil
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDM_UpdateWhere(t *testing.T) {
+	engine := setupDMEntity(t, "emp_ver", new(EmpVer0), new(EmpVer1))
+	assert.NoError(t, meta.SetVersionColumn(engine, "emp_ver", "version"))
+	for i := uint32(1); i <= 3; i++ {
+		dept := "d1"
+		if i == 3 {
+			dept = "d2"
+		}
+		_, err := engine.Insert(&EmpVer0{Idx: i, Name: "n", Version: 1}, &EmpVer1{Idx: i, Dept: dept})
+		assert.NoError(t, err)
+	}
+
+	app := core.CreateApp()
+	body := `{"where":[{"col":"dept","val":"d1"}],"vals":{"name":"m","dept":"d9"}}`
+
+	ret := sendRequest(t, app, http.MethodPut, "dm/emp_ver?dry_run=true", body)
+	assert.Contains(t, ret, `"matched":2`)
+	assert.Contains(t, ret, `"dry_run":true`)
+	ret = sendRequest(t, app, http.MethodPut, "dm/emp_ver?max_rows=1", body)
+	assert.Contains(t, ret, "too many rows matched")
+
+	ret = sendRequest(t, app, http.MethodPut, "dm/emp_ver", body)
+	assert.Contains(t, ret, `"code":0`)
+	assert.Contains(t, ret, `"affected":{"emp_ver0":2,"emp_ver1":2}`)
+	var rows []struct {
+		Name    string
+		Dept    string
+		Version int
+	}
+	assert.NoError(t, engine.SQL("SELECT name, dept, version FROM emp_ver0 JOIN emp_ver1 ON emp_ver0.idx = emp_ver1.idx "+
+		"ORDER BY emp_ver0.idx").Find(&rows))
+	assert.Len(t, rows, 3)
+	assert.Equal(t, []any{"m", "d9", 2}, []any{rows[1].Name, rows[1].Dept, rows[1].Version})
+	assert.Equal(t, []any{"n", "d2", 1}, []any{rows[2].Name, rows[2].Dept, rows[2].Version})
+
+	ret = sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"vals":{"name":"x"}}`)
+	assert.Contains(t, ret, "primary key values or where condition required")
+	ret = sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"where":[{"col":"dept","val":"d2"}],"vals":{"idx":3,"name":"x"}}`)
+	assert.Contains(t, ret, "where condition can not be combined with primary key values")
+
+	// unique 规则：匹配多行时拒绝写入唯一列；只匹配一行时查询数据库并排除行自身
+	assert.NoError(t, meta.AddRule(engine, "emp_ver", &meta.Rule{RuleName: "name_unique", Kind: meta.RuleUnique,
+		Column: "name"}))
+	ret = sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"where":[{"col":"dept","val":"d9"}],"vals":{"name":"z"}}`)
+	assert.Contains(t, ret, "column 'name' is unique (rule 'name_unique'), can not set one value on 2 matched rows")
+	ret = sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"where":[{"col":"dept","val":"d2"}],"vals":{"name":"m"}}`)
+	assert.Contains(t, ret, "invalid: name: 'm' already exists")
+	ret = sendRequest(t, app, http.MethodPut, "dm/emp_ver", `{"where":[{"col":"dept","val":"d2"}],"vals":{"name":"n"}}`)
+	assert.Contains(t, ret, `"code":0`)
+}
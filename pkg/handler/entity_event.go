@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/event"
+	"go.uber.org/zap"
+	"xorm.io/xorm"
+)
+
+// EntityEventType 实体写入后发布的事件类型 <实体名>.<操作>，操作为 query.OpInserted 等；
+// 事件发布到与类型同名的 topic，工作流规则未指定 topic 时即订阅该类型
+func EntityEventType(entity, op string) string {
+	return entity + "." + op
+}
+
+// EntityEventSource 实体事件的来源
+const EntityEventSource = "entity.dml"
+
+// eventSeq 实体事件的 ID，以启动时间为起点递增，同一批写入的多行不重复
+var eventSeq atomic.Uint64
+
+func init() {
+	eventSeq.Store(uint64(time.Now().UnixNano()))
+}
+
+// entityEvents 收集一次请求中写入成功的行，事务提交后发布为实体事件，Data 为行的列值
+type entityEvents struct {
+	events []*event.Event
+}
+
+func (es *entityEvents) add(m *meta.EntityMeta, op string, row map[string]any) {
+	es.events = append(es.events, event.NewEvent(eventSeq.Add(1),
+		EntityEventType(m.Entity.EntityName, op), EntityEventSource, row))
+}
+
+// addDeleted 删除的实体，Data 只有主键
+func (es *entityEvents) addDeleted(m *meta.EntityMeta, pks []any) {
+	for _, pk := range pks {
+		es.add(m, query.OpDeleted, map[string]any{m.Entity.PkAttrColumn: pk})
+	}
+}
+
+// publish 发布到数据源 engine 的应用总线，未登记总线时不发布；写入已提交，发布失败只记录日志
+func (es *entityEvents) publish(engine *xorm.Engine) {
+	bus := event.BusOf(engine)
+	if bus == nil {
+		return
+	}
+	for _, evt := range es.events {
+		if err := bus.Publish(context.Background(), evt.Type, evt); err != nil {
+			logger.Error("publish entity event failed", zap.String("type", evt.Type), zap.Uint64("id", evt.ID),
+				zap.Error(err))
+		}
+	}
+	es.events = nil
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/importer"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+var importRoutes = []*core.IDigRoute{
+	{
+		// multipart 上传：file 为 csv/tsv/xlsx 文件，可选字段
+		// mode(insert|upsert) format sheet aliases(JSON 对象 表头->列名) ignore_unknown chunk_size
+		Path:    "/entity/import/:entity",
+		Handler: importEntity,
+		Method:  fiber.MethodPost,
+	},
+}
+
+func init() {
+	core.RegisterRouter(importRoutes)
+}
+
+func importEntity(ctx *core.Context) error {
+	fb := ctx.Fiber()
+	m, err := meta.AcquireMeta(fb.Params("entity"), ctx.Engine())
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	fh, err := fb.FormFile("file")
+	if err != nil {
+		return ctx.SendBadRequestError(fmt.Errorf("form file 'file' required: %w", err))
+	}
+	wc, evs := writeContext(ctx)
+	opts := &importer.Options{Mode: fb.FormValue("mode", importer.ModeInsert), Writer: wc}
+	if opts.Mode != importer.ModeInsert && opts.Mode != importer.ModeUpsert {
+		return ctx.SendBadRequestError(fmt.Errorf("unsupported mode '%s'", opts.Mode))
+	}
+	if v := fb.FormValue("chunk_size"); v != "" {
+		if opts.ChunkSize, err = strconv.Atoi(v); err != nil {
+			return ctx.SendBadRequestError(fmt.Errorf("invalid chunk_size '%s'", v))
+		}
+	}
+	if v := fb.FormValue("aliases"); v != "" {
+		if err = json.Unmarshal([]byte(v), &opts.Aliases); err != nil {
+			return ctx.SendBadRequestError(fmt.Errorf("invalid aliases: %w", err))
+		}
+	}
+	if v := fb.FormValue("ignore_unknown"); v != "" {
+		if opts.IgnoreUnknown, err = strconv.ParseBool(v); err != nil {
+			return ctx.SendBadRequestError(fmt.Errorf("invalid ignore_unknown '%s'", v))
+		}
+	}
+	format := fb.FormValue("format", importer.FormatOf(fh.Filename))
+	f, err := fh.Open()
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	defer f.Close()
+	var src *query.DataTable
+	if format == importer.FormatXLSX {
+		src, err = importer.ParseXLSX(f, fb.FormValue("sheet"))
+	} else {
+		src, err = importer.Parse(format, f)
+	}
+	if err != nil {
+		return ctx.SendBadRequestError(fmt.Errorf("parse file error: %w", err))
+	}
+	ret, _, err := importer.Import(ctx.Engine(), m, src, opts)
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	evs.publish(ctx.Engine())
+	msg := fmt.Sprintf("total %d, succeeded %d, invalid %d, failed %d",
+		ret.Total, ret.Succeeded, ret.Invalid, ret.Failed)
+	if ret.Invalid > 0 || ret.Failed > 0 {
+		return ctx.SendJSON(-1, msg, ret)
+	}
+	return ctx.SendJSON(0, msg, ret)
+}
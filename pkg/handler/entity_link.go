@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/gofiber/fiber/v2"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
+
+var linkRoutes = []*core.IDigRoute{
+	{
+		Path:    "/entity/link/:relation", // m:n 链接列表 ?left=&right=
+		Handler: listLinks,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/link/:relation", // 链接，已存在的链接更新链接属性
+		Handler: linkRecords,
+		Method:  fiber.MethodPost,
+	},
+	{
+		Path:    "/entity/link/:relation", // 取消链接
+		Handler: unlinkRecords,
+		Method:  fiber.MethodDelete,
+	},
+}
+
+func init() {
+	core.RegisterRouter(linkRoutes)
+}
+
+// parseLinkRequest 取 m:n 关系、链接实体和请求体中的链接行，行的列为链接实体的列
+func parseLinkRequest(ctx *core.Context) (*entity.Relation, *meta.EntityMeta, *query.DataTable, error) {
+	r, link, err := entity.LinkRelation(ctx.Engine(), ctx.Fiber().Params("relation"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cv := &query.ColumnValue{}
+	if err = cv.ParseValues(ctx.Fiber().Body()); err != nil {
+		return nil, nil, nil, err
+	}
+	return r, link, cv.DataTable(), nil
+}
+
+// listLinks 按左端或右端关联键的值列出链接实体主表的行
+func listLinks(ctx *core.Context) error {
+	r, link, err := entity.LinkRelation(ctx.Engine(), ctx.Fiber().Params("relation"))
+	if err != nil {
+		return sendRelationError(ctx, err)
+	}
+	fb := ctx.Fiber()
+	cond := builder.NewCond()
+	if v := fb.Query("left"); v != "" {
+		cond = cond.And(builder.Eq{r.LinkLeftKey: v})
+	}
+	if v := fb.Query("right"); v != "" {
+		cond = cond.And(builder.Eq{r.LinkRightKey: v})
+	}
+	rows, err := ctx.Engine().Table(link.PrimaryTable()).Where(cond).OrderBy(link.Entity.PkAttrColumn).QueryInterface()
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	jd := &query.JDataTable{}
+	jd.FromArrayMap(rows)
+	return ctx.SendSuccess(jd)
+}
+
+// linkRecords 两端的记录必须存在；两端相同的链接已存在时更新其链接属性，否则插入
+func linkRecords(ctx *core.Context) error {
+	r, link, dt, err := parseLinkRequest(ctx)
+	if err != nil {
+		return sendRelationError(ctx, err)
+	}
+	wc, evs := writeContext(ctx)
+	if err = handleTransaction(ctx, func(sess *xorm.Session) error {
+		errs, err1 := entity.CheckLinkEnds(sess, r, dt)
+		if err1 != nil {
+			return err1
+		}
+		if n := dt.ReportErrors(errs); n > 0 {
+			return fmt.Errorf("%w: %d of %d row(s) failed validation", ErrInvalidRows, n, len(dt.Values()))
+		}
+		pkIdx := dt.AddColumn(link.Entity.PkAttrColumn)
+		for i := range dt.Values() {
+			pks, err2 := entity.FindLinks(sess, r, link, dt, i)
+			if err2 != nil {
+				return err2
+			}
+			if len(pks) > 0 {
+				_ = dt.UpdateData(i, pkIdx, pks[0])
+			}
+		}
+		return UpsertEntityRows(sess, link, dt, wc)
+	}); err != nil {
+		if errors.Is(err, ErrInvalidRows) {
+			return sendInvalidRows(ctx, err, dt)
+		}
+		return ctx.SendBadRequestError(err)
+	}
+	evs.publish(ctx.Engine())
+	jd := &query.JDataTable{}
+	jd.From(dt)
+	return ctx.SendJSON(0, fmt.Sprintf("%d link(s) saved for relation %s", len(dt.Values()), r.RelationName), jd)
+}
+
+// unlinkRecords 删除与各行两端相同的链接，行中只有一端时删除该端的所有链接；链接实体的从属记录按级联策略处理
+func unlinkRecords(ctx *core.Context) error {
+	r, link, dt, err := parseLinkRequest(ctx)
+	if err != nil {
+		return sendRelationError(ctx, err)
+	}
+	if dt.FetchColumnIndex(r.LinkLeftKey) < 0 && dt.FetchColumnIndex(r.LinkRightKey) < 0 {
+		return ctx.SendBadRequestError(fmt.Errorf("'%s' or '%s' required", r.LinkLeftKey, r.LinkRightKey))
+	}
+	ret := &DeleteResult{}
+	evs := &entityEvents{}
+	err = handleTransaction(ctx, func(sess *xorm.Session) error {
+		var pks []any
+		for i := range dt.Values() {
+			found, err1 := entity.FindLinks(sess, r, link, dt, i)
+			if err1 != nil {
+				return err1
+			}
+			pks = append(pks, found...)
+		}
+		ret.Matched = len(pks)
+		if len(pks) == 0 {
+			return nil
+		}
+		plan, err1 := entity.PlanDelete(sess, link, pks)
+		if err1 != nil {
+			return err1
+		}
+		if len(plan.Effects) > 0 {
+			ret.Cascade = plan
+		}
+		if err1 = plan.Check(); err1 != nil {
+			return err1
+		}
+		if err1 = plan.Apply(sess, time.Now()); err1 != nil {
+			return err1
+		}
+		ret.Deleted, err1 = entity.DeleteEntities(sess, link, pks)
+		evs.addDeleted(link, pks)
+		return err1
+	})
+	if errors.Is(err, entity.ErrRestricted) {
+		return ctx.SendJSON(-1, err.Error(), ret)
+	}
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendJSON(0, fmt.Sprintf("%d link(s) removed for relation %s", ret.Deleted, r.RelationName), ret)
+}
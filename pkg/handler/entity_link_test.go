@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkRelation(t *testing.T) {
+	_ = core.ReloadTenantConfig()
+	app := core.CreateApp()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	assert.NoError(t, err)
+	_, _ = engine.Exec("DELETE FROM idig_entity_relation WHERE relation_name LIKE 'lnk_%'")
+	ddl := map[string]string{
+		"lnk_emp":    "CREATE TABLE lnk_emp (idx INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)",
+		"lnk_proj":   "CREATE TABLE lnk_proj (idx INTEGER PRIMARY KEY AUTOINCREMENT, code TEXT)",
+		"lnk_member": "CREATE TABLE lnk_member (idx INTEGER PRIMARY KEY AUTOINCREMENT, emp_idx INTEGER, proj_code TEXT, role TEXT)",
+	}
+	for _, name := range []string{"lnk_emp", "lnk_proj", "lnk_member"} {
+		_, _ = engine.Exec("DROP TABLE IF EXISTS " + name)
+		_, _ = engine.Exec("DELETE FROM idig_entity WHERE entity_name = ?", name)
+		meta.InvalidateMeta(name)
+		_, err = engine.Exec(ddl[name])
+		assert.NoError(t, err)
+		_, err = meta.RegisterEntity(engine, name, "", name, "idx")
+		assert.NoError(t, err)
+	}
+	_, err = engine.Exec("INSERT INTO lnk_emp (idx, name) VALUES (1, 'ann'), (2, 'bob'), (3, 'cat')")
+	assert.NoError(t, err)
+	_, err = engine.Exec("INSERT INTO lnk_proj (idx, code) VALUES (1, 'P1'), (2, 'P2')")
+	assert.NoError(t, err)
+	count := func(where string) int64 {
+		n, err := engine.Table("lnk_member").Where(where).Count()
+		assert.NoError(t, err)
+		return n
+	}
+
+	ret := sendRequest(t, app, http.MethodPost, "relation",
+		`{"relation_name":"lnk_x","left_entity":"lnk_emp","right_entity":"lnk_proj",`+
+			`"left_key":"idx","right_key":"code","relation_type":"m:n","link_entity":"lnk_member",`+
+			`"link_left_key":"emp_idx","link_right_key":"emp_idx"}`)
+	assert.Contains(t, ret, "must differ")
+	ret = sendRequest(t, app, http.MethodPost, "relation",
+		`{"relation_name":"lnk_x","left_entity":"lnk_emp","right_entity":"lnk_proj",`+
+			`"left_key":"idx","right_key":"code","relation_type":"m:1","link_entity":"lnk_member"}`)
+	assert.Contains(t, ret, "m:n")
+	ret = sendRequest(t, app, http.MethodPost, "relation",
+		`{"relation_name":"lnk_emp_proj","left_entity":"lnk_emp","right_entity":"lnk_proj",`+
+			`"left_key":"idx","right_key":"code","relation_type":"m:n","link_entity":"lnk_member",`+
+			`"link_left_key":"emp_idx","link_right_key":"proj_code","cascade_policy":"cascade"}`)
+	assert.Contains(t, ret, `"code":0`)
+
+	ret = sendRequest(t, app, http.MethodPost, "link/lnk_emp_proj", `{"cols":["emp_idx","proj_code","role"],`+
+		`"vals":[[1,"P1","dev"],[2,"P1","dev"],[1,"P2","dev"]]}`)
+	assert.Contains(t, ret, "3 link(s) saved")
+	// 已存在的链接更新其属性，不重复插入
+	ret = sendRequest(t, app, http.MethodPost, "link/lnk_emp_proj",
+		`{"vals":{"emp_idx":1,"proj_code":"P1","role":"lead"}}`)
+	assert.Contains(t, ret, `"code":0`)
+	assert.Equal(t, int64(3), count("1 = 1"))
+	assert.Equal(t, int64(1), count("role = 'lead'"))
+	// 两端的记录必须存在
+	ret = sendRequest(t, app, http.MethodPost, "link/lnk_emp_proj",
+		`{"cols":["emp_idx","proj_code"],"vals":[[9,"P1"],[3,null]]}`)
+	assert.Contains(t, ret, "lnk_emp '9' not found")
+	assert.Contains(t, ret, "required")
+	assert.Equal(t, int64(3), count("1 = 1"))
+
+	ret = sendRequest(t, app, http.MethodGet, "link/lnk_emp_proj?left=1", "")
+	assert.Contains(t, ret, `"P1"`)
+	assert.Contains(t, ret, `"P2"`)
+	ret = sendRequest(t, app, http.MethodGet, "link/lnk_emp_proj?right=P2", "")
+	assert.NotContains(t, ret, `"P1"`)
+
+	// 查询以 link 条件按另一端及链接属性过滤
+	query := func(from, val string) string {
+		col := map[string]string{"lnk_emp": "name", "lnk_proj": "code"}[from]
+		return sendRequest(t, app, http.MethodPost, "dq", `{"select":["`+col+`"],"from":"`+from+
+			`","where":[{"col":"lnk_emp_proj","op":"link","val":`+val+`}]}`)
+	}
+	ret = query("lnk_emp", `"P1"`)
+	assert.Contains(t, ret, "ann")
+	assert.Contains(t, ret, "bob")
+	assert.NotContains(t, ret, "cat")
+	ret = query("lnk_emp", `{"keys":["P1"],"where":[{"col":"role","val":"dev"}]}`)
+	assert.Contains(t, ret, "bob")
+	assert.NotContains(t, ret, "ann")
+	ret = query("lnk_emp", `null`)
+	assert.NotContains(t, ret, "cat")
+	ret = query("lnk_proj", `[2]`)
+	assert.Contains(t, ret, "P1")
+	assert.NotContains(t, ret, "P2")
+	ret = query("lnk_emp", `{"where":[{"col":"name","val":"ann"}]}`)
+	assert.Contains(t, ret, "link attribute 'name' not found")
+
+	ret = sendRequest(t, app, http.MethodPost, "dq",
+		`{"select":["name"],"from":"lnk_emp","where":[{"col":"idx","op":"in","val":[1,3]}],`+
+			`"include":{"projects":{"relation":"lnk_emp_proj","select":["code"],"order":[{"col":"code"}]}}}`)
+	assert.Contains(t, ret, `[{"name":"ann","projects":[{"code":"P1"},{"code":"P2"}]},{"name":"cat","projects":[]}]`)
+	// 沿 m:n 遍历经由链接表
+	ret = sendRequest(t, app, http.MethodPost, "traverse/lnk_emp",
+		`{"start":1,"path":[{"relation":"lnk_emp_proj","as":"projects","select":["code"]}]}`)
+	assert.Contains(t, ret, `"projects":[{"code":"P1","idx":1},{"code":"P2","idx":2}]`)
+	// 嵌套文档写入 m:n 的另一端并链接，已存在的链接不重复插入
+	ret = sendRequest(t, app, http.MethodPost, "dm/lnk_emp?nested=true",
+		`{"vals":{"name":"dan","lnk_emp_proj":[{"idx":1},{"code":"P3"}]}}`)
+	assert.Contains(t, ret, `"data":{"idx":4,"lnk_emp_proj":[{"idx":1},{"idx":3}]}`)
+	assert.Equal(t, int64(2), count("emp_idx = 4"))
+	ret = sendRequest(t, app, http.MethodPost, "dm/lnk_emp?nested=true",
+		`{"vals":{"idx":4,"lnk_emp_proj":[{"idx":3}]}}`)
+	assert.Contains(t, ret, `"code":0`)
+	assert.Equal(t, int64(2), count("emp_idx = 4"))
+	_, _ = engine.Exec("DELETE FROM lnk_member WHERE emp_idx = 4")
+	ret = sendRequest(t, app, http.MethodDelete, "link/lnk_emp_proj", `{"vals":{"emp_idx":1,"proj_code":"P2"}}`)
+	assert.Contains(t, ret, `"deleted":1`)
+	assert.Equal(t, int64(2), count("1 = 1"))
+	ret = sendRequest(t, app, http.MethodDelete, "link/lnk_emp_proj", `{"vals":{"role":"dev"}}`)
+	assert.Contains(t, ret, "'emp_idx' or 'proj_code' required")
+
+	// 删除一端的记录时链接按级联策略删除
+	ret = sendRequest(t, app, http.MethodDelete, "dm/lnk_emp", `{"vals":{"idx":2}}`)
+	assert.Contains(t, ret, `"deleted":1`)
+	assert.Equal(t, int64(1), count("1 = 1"))
+	assert.Equal(t, int64(0), count("emp_idx = 2"))
+}
@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"github.com/everpan/idig/pkg/core"
 
+	"github.com/everpan/idig/pkg/entity"
 	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -14,6 +17,81 @@ var routes = []*core.IDigRoute{
 		Handler: getMeta,
 		Method:  fiber.MethodGet,
 	},
+	{
+		Path:    "/entity/meta/:entity/rule", // 实体校验规则
+		Handler: listMetaRules,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/meta/:entity/rule",
+		Handler: addMetaRule,
+		Method:  fiber.MethodPost,
+	},
+	{
+		Path:    "/entity/meta/:entity/rule/:name",
+		Handler: getMetaRule,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/meta/:entity/rule/:name",
+		Handler: updateMetaRule,
+		Method:  fiber.MethodPut,
+	},
+	{
+		Path:    "/entity/meta/:entity/rule/:name",
+		Handler: deleteMetaRule,
+		Method:  fiber.MethodDelete,
+	},
+	{
+		Path:    "/entity/meta/:entity/virtual", // 虚拟属性
+		Handler: listVirtualAttrs,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/meta/:entity/virtual",
+		Handler: addVirtualAttr,
+		Method:  fiber.MethodPost,
+	},
+	{
+		Path:    "/entity/meta/:entity/virtual/:name",
+		Handler: updateVirtualAttr,
+		Method:  fiber.MethodPut,
+	},
+	{
+		Path:    "/entity/meta/:entity/virtual/:name",
+		Handler: deleteVirtualAttr,
+		Method:  fiber.MethodDelete,
+	},
+	{
+		Path:    "/entity/meta/:entity/default", // 列默认值与系统列
+		Handler: listColumnDefaults,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/meta/:entity/default/:column",
+		Handler: setColumnDefault,
+		Method:  fiber.MethodPut,
+	},
+	{
+		Path:    "/entity/meta/:entity/default/:column",
+		Handler: deleteColumnDefault,
+		Method:  fiber.MethodDelete,
+	},
+	{
+		Path:    "/entity/meta/:entity/version", // 乐观锁版本列
+		Handler: setVersionColumn,
+		Method:  fiber.MethodPut,
+	},
+	{
+		Path:    "/entity/meta/:entity/deleted", // 软删除标记列
+		Handler: setDeletedColumn,
+		Method:  fiber.MethodPut,
+	},
+	{
+		Path:    "/entity/meta/:entity/search", // 全文检索列，设置时重建索引
+		Handler: setSearchColumns,
+		Method:  fiber.MethodPut,
+	},
 }
 
 func init() {
@@ -32,5 +110,186 @@ func getMeta(c *core.Context) error {
 	if m == nil {
 		return c.SendBadRequestError(fmt.Errorf("not found meta of entity:%v", eName))
 	}
-	return c.SendSuccess(m.ToJMeta())
+	rels, err := entity.EntityRelations(c.Engine(), m.Entity.EntityIdx)
+	if err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(&entityMetaView{JMeta: m.ToJMeta(), Relations: rels})
+}
+
+// entityMetaView 实体元数据及实体作为左或右实体的关系
+type entityMetaView struct {
+	*meta.JMeta
+	Relations []*entity.Relation `json:"relations,omitempty"`
+}
+
+func listMetaRules(c *core.Context) error {
+	rules, err := meta.ListRules(c.Engine(), c.Fiber().Params("entity"))
+	if err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(rules)
+}
+
+func getMetaRule(c *core.Context) error {
+	fb := c.Fiber()
+	r, err := meta.GetRule(c.Engine(), fb.Params("entity"), fb.Params("name"))
+	if err != nil {
+		return sendRuleError(c, err)
+	}
+	return c.SendSuccess(r)
+}
+
+func addMetaRule(c *core.Context) error {
+	r := &meta.Rule{}
+	if err := json.Unmarshal(c.Fiber().Body(), r); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	if err := meta.AddRule(c.Engine(), c.Fiber().Params("entity"), r); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(r)
+}
+
+func updateMetaRule(c *core.Context) error {
+	fb := c.Fiber()
+	r := &meta.Rule{}
+	if err := json.Unmarshal(fb.Body(), r); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	if err := meta.UpdateRule(c.Engine(), fb.Params("entity"), fb.Params("name"), r); err != nil {
+		return sendRuleError(c, err)
+	}
+	return c.SendSuccess(r)
+}
+
+func deleteMetaRule(c *core.Context) error {
+	fb := c.Fiber()
+	if err := meta.DeleteRule(c.Engine(), fb.Params("entity"), fb.Params("name")); err != nil {
+		return sendRuleError(c, err)
+	}
+	return c.SendSuccess(nil)
+}
+
+func listVirtualAttrs(c *core.Context) error {
+	attrs, err := meta.ListVirtualAttrs(c.Engine(), c.Fiber().Params("entity"))
+	if err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(attrs)
+}
+
+func addVirtualAttr(c *core.Context) error {
+	v := &meta.VirtualAttr{}
+	if err := json.Unmarshal(c.Fiber().Body(), v); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	if err := meta.AddVirtualAttr(c.Engine(), c.Fiber().Params("entity"), v); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(v)
+}
+
+func updateVirtualAttr(c *core.Context) error {
+	fb := c.Fiber()
+	v := &meta.VirtualAttr{}
+	if err := json.Unmarshal(fb.Body(), v); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	if err := meta.UpdateVirtualAttr(c.Engine(), fb.Params("entity"), fb.Params("name"), v); err != nil {
+		return sendRuleError(c, err)
+	}
+	return c.SendSuccess(v)
+}
+
+func deleteVirtualAttr(c *core.Context) error {
+	fb := c.Fiber()
+	if err := meta.DeleteVirtualAttr(c.Engine(), fb.Params("entity"), fb.Params("name")); err != nil {
+		return sendRuleError(c, err)
+	}
+	return c.SendSuccess(nil)
+}
+
+func listColumnDefaults(c *core.Context) error {
+	defs, err := meta.ListColumnDefaults(c.Engine(), c.Fiber().Params("entity"))
+	if err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(defs)
+}
+
+func setColumnDefault(c *core.Context) error {
+	fb := c.Fiber()
+	d := &meta.ColumnDefault{}
+	if err := json.Unmarshal(fb.Body(), d); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	d.Column = fb.Params("column")
+	if err := meta.SetColumnDefault(c.Engine(), fb.Params("entity"), d); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(d)
+}
+
+func deleteColumnDefault(c *core.Context) error {
+	fb := c.Fiber()
+	if err := meta.DeleteColumnDefault(c.Engine(), fb.Params("entity"), fb.Params("column")); err != nil {
+		return sendRuleError(c, err)
+	}
+	return c.SendSuccess(nil)
+}
+
+// setVersionColumn 请求体为 {"column": "version"}，column 为空时取消版本检查
+func setVersionColumn(c *core.Context) error {
+	fb := c.Fiber()
+	body := struct {
+		Column string `json:"column"`
+	}{}
+	if err := json.Unmarshal(fb.Body(), &body); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	if err := meta.SetVersionColumn(c.Engine(), fb.Params("entity"), body.Column); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(body)
+}
+
+// setDeletedColumn 请求体为 {"column": "deleted_at"}，column 为空时取消，关系级联软删除时使用
+func setDeletedColumn(c *core.Context) error {
+	fb := c.Fiber()
+	body := struct {
+		Column string `json:"column"`
+	}{}
+	if err := json.Unmarshal(fb.Body(), &body); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	if err := meta.SetDeletedColumn(c.Engine(), fb.Params("entity"), body.Column); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(body)
+}
+
+// setSearchColumns 请求体为 {"columns": ["title", "body"]}，列可在不同的属性表中，columns 为空时取消检索
+func setSearchColumns(c *core.Context) error {
+	fb := c.Fiber()
+	body := struct {
+		Columns []string `json:"columns"`
+	}{}
+	if err := json.Unmarshal(fb.Body(), &body); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	if err := meta.SetSearchColumns(c.Engine(), fb.Params("entity"), body.Columns); err != nil {
+		return c.SendBadRequestError(err)
+	}
+	return c.SendSuccess(body)
+}
+
+// sendRuleError 规则、虚拟属性或列默认值不存在时返回 404
+func sendRuleError(c *core.Context, err error) error {
+	if errors.Is(err, meta.ErrRuleNotFound) || errors.Is(err, meta.ErrVirtualAttrNotFound) ||
+		errors.Is(err, meta.ErrColumnDefaultNotFound) {
+		c.Fiber().Status(fiber.StatusNotFound)
+		return c.SendJSON(-1, err.Error(), nil)
+	}
+	return c.SendBadRequestError(err)
 }
@@ -20,6 +20,8 @@ func Test_getMeta(t *testing.T) {
 		Status:       1,
 	}
 	engine, _ := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	_, _ = engine.Exec("DELETE FROM idig_entity WHERE entity_name = ?", noAttEntity.EntityName)
+	meta.InvalidateMeta(noAttEntity.EntityName)
 	_, _ = engine.Insert(noAttEntity)
 	tests := []struct {
 		name     string
@@ -28,8 +30,8 @@ func Test_getMeta(t *testing.T) {
 		wantStr  string
 	}{
 		{"fetch_not_exist", "not-exist", 400,
-			`{"code":-99,"msg":"entity 'not-exist' not found"}`},
-		{"not-attr-entity", "not-attr-entity", 400, "entry 'not-attr-entity' not found"},
+			`{"code":-99,"msg":"entity not found"}`},
+		{"not-attr-entity", "not-attr-entity", 400, "table not found: not-attr-entity"},
 		{"tenant", "tenant", 200, `"primary_keys":["tenant_idx"]`},
 		{"entity_relation", "entity_relation", 200, `"primary_keys":["relation_idx"]`},
 	}
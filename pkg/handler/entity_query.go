@@ -1,10 +1,12 @@
 package handler
 
 import (
+	"bufio"
 	"encoding/base64"
 	"fmt"
 	"github.com/everpan/idig/pkg/core"
 	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/exporter"
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 	"xorm.io/builder"
@@ -73,6 +75,14 @@ func queryData(ctx *core.Context, data []byte) error {
 	if err := q.Parse(data); err != nil {
 		return ctx.SendBadRequestError(err)
 	}
+	return runQuery(ctx, q)
+}
+
+// runQuery 执行解析后的查询，按协商的格式返回或导出
+func runQuery(ctx *core.Context, q *query.Query) error {
+	if len(q.Includes) > 0 {
+		return queryIncludes(ctx, q)
+	}
 
 	bld := builder.Dialect(ctx.Engine().DriverName())
 	if err := q.BuildSQL(bld); err != nil {
@@ -84,7 +94,19 @@ func queryData(ctx *core.Context, data []byte) error {
 		return ctx.SendJSON(-1, "构建 SQL 错误", err2.Error())
 	}
 
-	logger.Info("dq", zap.String("sql", sql))
+	// 绑定参数可能含敏感数据，只在 Debug 级别记录带占位符的 SQL
+	if ce := logger.Check(zap.DebugLevel, "dq"); ce != nil {
+		psql, args, _ := bld.ToSQL()
+		ce.Write(zap.String("sql", psql), zap.Int("args", len(args)))
+	}
+
+	format, err := exporter.Negotiate(ctx.Fiber())
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if format != exporter.FormatJSON {
+		return streamExport(ctx, q, sql, format)
+	}
 
 	ret, err := ctx.Engine().QueryInterface(sql)
 	if err != nil {
@@ -94,6 +116,22 @@ func queryData(ctx *core.Context, data []byte) error {
 	return sendResponse(ctx, ret)
 }
 
+// queryIncludes 含 include 的查询返回嵌套文档，不能导出为表格格式
+func queryIncludes(ctx *core.Context, q *query.Query) error {
+	format, err := exporter.Negotiate(ctx.Fiber())
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if format != exporter.FormatJSON || ctx.Fiber().Get("X-DATA-FORMAT") == "data-table" {
+		return ctx.SendBadRequestError(fmt.Errorf("query with include returns nested documents, only json is supported"))
+	}
+	ret, err := q.Find()
+	if err != nil {
+		return ctx.SendJSON(-1, "查询错误", err.Error())
+	}
+	return ctx.SendSuccess(ret)
+}
+
 // sendResponse 根据请求的格式发送响应
 func sendResponse(ctx *core.Context, ret []map[string]any) error {
 	if ctx.Fiber().Get("X-DATA-FORMAT") == "data-table" {
@@ -103,3 +141,31 @@ func sendResponse(ctx *core.Context, ret []map[string]any) error {
 	}
 	return ctx.SendSuccess(ret)
 }
+
+// streamExport 在响应体写出时从游标逐行读取并写出，结果集不在内存中保留；
+// 查询在返回前执行，以便查询错误仍以 JSON 响应
+func streamExport(ctx *core.Context, q *query.Query, sql, format string) error {
+	rows, err := ctx.Engine().DB().QueryContext(ctx.Fiber().UserContext(), sql)
+	if err != nil {
+		return ctx.SendJSON(-1, "查询错误", err.Error())
+	}
+	name := "export"
+	if len(q.From.EntityAlias) > 0 && q.From.EntityAlias[0].Entity != "" {
+		name = q.From.EntityAlias[0].Entity
+	}
+	headers := q.Headers()
+	fb := ctx.Fiber()
+	fb.Attachment(name + "." + format)
+	fb.Set(fiber.HeaderContentType, exporter.ContentType(format))
+	fb.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer rows.Close()
+		n, err1 := exporter.Write(w, format, headers, rows.Rows)
+		if err1 != nil {
+			// 响应头已发出，只能记录错误并截断响应
+			logger.Error("dq export", zap.String("format", format), zap.Int64("rows", n), zap.Error(err1))
+			return
+		}
+		logger.Info("dq export", zap.String("format", format), zap.Int64("rows", n))
+	})
+	return nil
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/stretchr/testify/assert"
+	"xorm.io/xorm"
+)
+
+// setupJoinEntities 员工 m:1 部门（部门有属性表 jn_dept_ext）、员工 1:m 任务
+func setupJoinEntities(t *testing.T, engine *xorm.Engine) {
+	var err error
+	_, _ = engine.Exec("DELETE FROM idig_entity_relation WHERE relation_name LIKE 'jn_%'")
+	ddl := map[string]string{
+		"jn_dept":     "CREATE TABLE jn_dept (idx INTEGER PRIMARY KEY AUTOINCREMENT, code TEXT, name TEXT)",
+		"jn_dept_ext": "CREATE TABLE jn_dept_ext (idx INTEGER PRIMARY KEY, active INTEGER)",
+		"jn_emp":      "CREATE TABLE jn_emp (idx INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, dept_code TEXT)",
+		"jn_task":     "CREATE TABLE jn_task (idx INTEGER PRIMARY KEY AUTOINCREMENT, emp_idx INTEGER, title TEXT)",
+	}
+	for _, name := range []string{"jn_dept", "jn_dept_ext", "jn_emp", "jn_task"} {
+		_, _ = engine.Exec("DROP TABLE IF EXISTS " + name)
+		_, err = engine.Exec(ddl[name])
+		assert.NoError(t, err)
+	}
+	_, _ = engine.Exec("DELETE FROM idig_entity_attr_group WHERE attr_table = 'jn_dept_ext'")
+	for _, name := range []string{"jn_dept", "jn_emp", "jn_task"} {
+		_, _ = engine.Exec("DELETE FROM idig_entity WHERE entity_name = ?", name)
+		meta.InvalidateMeta(name)
+		_, err = meta.RegisterEntity(engine, name, "", name, "idx")
+		assert.NoError(t, err)
+	}
+	_, err = meta.AddEntityAttrGroupByName(engine, "jn_dept", "ext", "jn_dept_ext")
+	assert.NoError(t, err)
+	for _, r := range []*entity.Relation{
+		{RelationName: "jn_emp_dept", LeftEntity: "jn_emp", RightEntity: "jn_dept",
+			LeftKey: "dept_code", RightKey: "code", RelationType: entity.ManyToOne},
+		{RelationName: "jn_emp_task", LeftEntity: "jn_emp", RightEntity: "jn_task",
+			LeftKey: "idx", RightKey: "emp_idx", RelationType: entity.OneToMany},
+	} {
+		assert.NoError(t, entity.CreateRelation(engine, r))
+	}
+	for _, sql := range []string{
+		"INSERT INTO jn_dept (idx, code, name) VALUES (1, 'D1', 'Sales'), (2, 'D2', 'Ops')",
+		"INSERT INTO jn_dept_ext (idx, active) VALUES (1, 1), (2, 0)",
+		"INSERT INTO jn_emp (idx, name, dept_code) VALUES (1, 'ann', 'D1'), (2, 'bob', 'D2'), (3, 'cat', NULL)",
+		"INSERT INTO jn_task (emp_idx, title) VALUES (1, 'a'), (1, 'b'), (2, 'c')",
+	} {
+		_, err = engine.Exec(sql)
+		assert.NoError(t, err)
+	}
+}
+
+func TestQueryJoin(t *testing.T) {
+	_ = core.ReloadTenantConfig()
+	app := core.CreateApp()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	assert.NoError(t, err)
+	setupJoinEntities(t, engine)
+	column := func(rows []map[string]any, col string) []string {
+		var vals []string
+		for _, row := range rows {
+			if row[col] == nil {
+				vals = append(vals, "")
+			} else {
+				vals = append(vals, fmt.Sprintf("%s", row[col]))
+			}
+		}
+		return vals
+	}
+	emp := func() *query.Builder {
+		return entity.NewQuery(engine, "jn_emp").Select("name").OrderBy("idx", "")
+	}
+
+	tests := []struct {
+		name string
+		b    *query.Builder
+		col  string
+		want []string
+	}{
+		// m:1 缺省 left join，没有部门的员工保留
+		{"left", emp().Join(query.JoinOf("jn_emp_dept").As("dept").Select("name")),
+			"dept_name", []string{"Sales", "Ops", ""}},
+		// 另一端有条件时为 inner join，条件列可以在属性表中
+		{"inner on attr table", emp().Join(query.JoinOf("jn_emp_dept").Where("active", "eq", 1)),
+			"name", []string{"ann"}},
+		// 显式 left join 的条件只限制关联的记录
+		{"left with cond", emp().Join(query.JoinOf("jn_emp_dept").Left().Where("name", "eq", "Ops").Select("code")),
+			"jn_emp_dept_code", []string{"", "D2", ""}},
+		// 1:m 只用于过滤时以子查询表达，员工不重复
+		{"semi", emp().Join(query.JoinOf("jn_emp_task").Where("title", "in", []any{"a", "b"})),
+			"name", []string{"ann"}},
+		{"to many", emp().Join(query.JoinOf("jn_emp_task").As("task").Select("title")).OrderBy("task_title", ""),
+			"task_title", []string{"a", "b", "c", ""}},
+		// 从右实体一侧关联
+		{"reverse", entity.NewQuery(engine, "jn_dept").Select("code").
+			Join(query.JoinOf("jn_emp_dept").Where("name", "eq", "bob")), "code", []string{"D2"}},
+	}
+	for _, tt := range tests {
+		rows, err := tt.b.Find()
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, column(rows, tt.col), tt.name)
+	}
+
+	_, err = emp().Join(query.JoinOf("jn_emp_dept").Select("nope")).Find()
+	assert.ErrorContains(t, err, "column 'nope' not found in entity 'jn_dept'")
+	_, err = emp().Join(query.JoinOf("jn_emp_dept").Left().Where("active", "eq", 1)).Find()
+	assert.ErrorContains(t, err, "must be in table 'jn_dept'")
+	_, err = emp().Join(query.JoinOf("jn_nope")).Find()
+	assert.ErrorContains(t, err, "relation not found")
+
+	ret := sendRequest(t, app, http.MethodPost, "dq", `{"select":["name"],"from":"jn_emp",`+
+		`"join":[{"relation":"jn_emp_dept","alias":"dept","select":[{"col":"name","alias":"dept"}]}],`+
+		`"where":[{"col":"name","val":"bob"}]}`)
+	assert.Contains(t, ret, `"dept":"Ops"`)
+}
+
+func TestQueryInclude(t *testing.T) {
+	_ = core.ReloadTenantConfig()
+	app := core.CreateApp()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	assert.NoError(t, err)
+	setupJoinEntities(t, engine)
+
+	// m:1 嵌入对象，1:m 嵌入数组；limit 作用于每个员工的任务；关联键只用于嵌入，不输出
+	ret := sendRequest(t, app, http.MethodPost, "dq",
+		`{"select":["name"],"from":"jn_emp","order":[{"col":"idx"}],"include":{`+
+			`"dept":{"relation":"jn_emp_dept","select":["name"]},`+
+			`"tasks":{"relation":"jn_emp_task","select":["title"],"order":[{"col":"title","opt":"desc"}],"limit":{"num":1}}}}`)
+	assert.Contains(t, ret, `"data":[{"dept":{"name":"Sales"},"name":"ann","tasks":[{"title":"b"}]},`+
+		`{"dept":{"name":"Ops"},"name":"bob","tasks":[{"title":"c"}]},{"dept":null,"name":"cat","tasks":[]}]`)
+
+	// 按关联键分组截取，offset 同样作用于每个员工的任务
+	ret = sendRequest(t, app, http.MethodPost, "dq",
+		`{"select":["name"],"from":"jn_emp","order":[{"col":"idx"}],"include":{`+
+			`"tasks":{"relation":"jn_emp_task","select":["title"],"order":[{"col":"title","opt":"desc"}],"limit":{"offset":1,"num":1}}}}`)
+	assert.Contains(t, ret, `"data":[{"name":"ann","tasks":[{"title":"a"}]},{"name":"bob","tasks":[]},{"name":"cat","tasks":[]}]`)
+
+	// 从部门一侧嵌入员工，员工再嵌入任务；子查询支持 where
+	ret = sendRequest(t, app, http.MethodPost, "dq",
+		`{"select":["code"],"from":"jn_dept","where":[{"col":"code","val":"D1"}],"include":{`+
+			`"jn_emp_dept":{"select":["name"],"include":{"tasks":{"relation":"jn_emp_task","select":["title"],`+
+			`"where":[{"col":"title","op":"ne","val":"a"}]}}}}}`)
+	assert.Contains(t, ret, `"data":[{"code":"D1","jn_emp_dept":[{"name":"ann","tasks":[{"title":"b"}]}]}]`)
+
+	rows, err := entity.NewQuery(engine, "jn_emp").Select("name").Where("idx", "eq", 2).
+		Include("dept", query.IncludeOf("jn_emp_dept").Select("code")).Find()
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"name": "bob", "dept": map[string]any{"code": "D2"}}}, rows)
+
+	ret = sendRequest(t, app, http.MethodPost, "dq",
+		`{"select":["name"],"from":"jn_emp","include":{"x":{"relation":"jn_nope"}}}`)
+	assert.Contains(t, ret, "include 'x'")
+	ret = sendRequest(t, app, http.MethodPost, "dq",
+		`{"select":["name"],"from":"jn_emp","include":{"dept":{"relation":"jn_emp_dept"}}}`, "Accept", "text/csv")
+	assert.Contains(t, ret, "only json is supported")
+}
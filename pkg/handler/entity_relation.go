@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+var relationRoutes = []*core.IDigRoute{
+	{
+		Path:    "/entity/relation", // 关系列表 ?entity=
+		Handler: listRelations,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/relation",
+		Handler: createRelation,
+		Method:  fiber.MethodPost,
+	},
+	{
+		Path:    "/entity/relation/:name",
+		Handler: getRelation,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/relation/:name",
+		Handler: updateRelation,
+		Method:  fiber.MethodPut,
+	},
+	{
+		Path:    "/entity/relation/:name",
+		Handler: deleteRelation,
+		Method:  fiber.MethodDelete,
+	},
+}
+
+func init() {
+	core.RegisterRouter(relationRoutes)
+}
+
+func listRelations(ctx *core.Context) error {
+	rels, err := entity.ListRelations(ctx.Engine(), ctx.Fiber().Query("entity"))
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendSuccess(rels)
+}
+
+func getRelation(ctx *core.Context) error {
+	r, err := entity.GetRelation(ctx.Engine(), ctx.Fiber().Params("name"))
+	if err != nil {
+		return sendRelationError(ctx, err)
+	}
+	return ctx.SendSuccess(r)
+}
+
+// createRelation 左右实体可以用 entity_left/entity_right 或 left_entity/right_entity 指定
+func createRelation(ctx *core.Context) error {
+	r := &entity.Relation{}
+	if err := json.Unmarshal(ctx.Fiber().Body(), r); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if err := entity.CreateRelation(ctx.Engine(), r); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendSuccess(r)
+}
+
+// updateRelation 以请求体替换关系，relation_name 为空时保留原名
+func updateRelation(ctx *core.Context) error {
+	r := &entity.Relation{}
+	if err := json.Unmarshal(ctx.Fiber().Body(), r); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if err := entity.UpdateRelation(ctx.Engine(), ctx.Fiber().Params("name"), r); err != nil {
+		return sendRelationError(ctx, err)
+	}
+	return ctx.SendSuccess(r)
+}
+
+func deleteRelation(ctx *core.Context) error {
+	if err := entity.DeleteRelation(ctx.Engine(), ctx.Fiber().Params("name")); err != nil {
+		return sendRelationError(ctx, err)
+	}
+	return ctx.SendJSON(0, "relation deleted", nil)
+}
+
+// sendRelationError 关系不存在时返回 404
+func sendRelationError(ctx *core.Context, err error) error {
+	if errors.Is(err, entity.ErrRelationNotFound) {
+		ctx.Fiber().Status(fiber.StatusNotFound)
+		return ctx.SendJSON(-1, err.Error(), nil)
+	}
+	return ctx.SendBadRequestError(err)
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelationAPI(t *testing.T) {
+	app := core.CreateApp()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	assert.NoError(t, err)
+	_, _ = engine.Exec("DELETE FROM idig_entity_relation WHERE relation_name LIKE 'rel_%'")
+	for _, name := range []string{"rel_dept", "rel_emp"} {
+		_, _ = engine.Exec("DROP TABLE IF EXISTS " + name)
+		_, _ = engine.Exec("DELETE FROM idig_entity WHERE entity_name = ?", name)
+		meta.InvalidateMeta(name)
+	}
+	_, err = engine.Exec("CREATE TABLE rel_dept (idx INTEGER PRIMARY KEY AUTOINCREMENT, code TEXT)")
+	assert.NoError(t, err)
+	_, err = engine.Exec("CREATE TABLE rel_emp (idx INTEGER PRIMARY KEY AUTOINCREMENT, dept_code TEXT)")
+	assert.NoError(t, err)
+	for _, name := range []string{"rel_dept", "rel_emp"} {
+		_, err = meta.RegisterEntity(engine, name, "", name, "idx")
+		assert.NoError(t, err)
+	}
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"bad type", `{"relation_name":"rel_x","left_entity":"rel_emp","right_entity":"rel_dept",` +
+			`"left_key":"dept_code","right_key":"code","relation_type":"n:n"}`, "unknown relation type 'n:n'"},
+		{"bad key", `{"relation_name":"rel_x","left_entity":"rel_emp","right_entity":"rel_dept",` +
+			`"left_key":"dept","right_key":"code","relation_type":"m:1"}`, "column 'dept' not found in entity 'rel_emp'"},
+		{"bad entity", `{"relation_name":"rel_x","left_entity":"rel_nope","right_entity":"rel_dept",` +
+			`"left_key":"dept_code","right_key":"code","relation_type":"m:1"}`, "rel_nope"},
+		{"bad policy", `{"relation_name":"rel_x","left_entity":"rel_emp","right_entity":"rel_dept",` +
+			`"left_key":"dept_code","right_key":"code","relation_type":"m:1","cascade_policy":"drop"}`, "unknown cascade policy"},
+		{"set null pk", `{"relation_name":"rel_x","left_entity":"rel_dept","right_entity":"rel_emp",` +
+			`"left_key":"idx","right_key":"idx","relation_type":"1:1","cascade_policy":"set_null"}`, "can not be set null"},
+		{"create", `{"relation_name":"rel_emp_dept","left_entity":"rel_emp","right_entity":"rel_dept",` +
+			`"left_key":"dept_code","right_key":"code","relation_type":"m:1"}`, `"code":0`},
+	}
+	for _, tt := range tests {
+		ret := sendRequest(t, app, http.MethodPost, "relation", tt.body)
+		assert.Contains(t, ret, tt.want, tt.name)
+	}
+
+	// 两个方向的实体元数据都包含该关系
+	for _, name := range []string{"rel_dept", "rel_emp"} {
+		ret := sendRequest(t, app, http.MethodGet, "meta/"+name, "")
+		assert.Contains(t, ret, `"relation_name":"rel_emp_dept"`, name)
+		assert.Contains(t, ret, `"left_entity":"rel_emp","right_entity":"rel_dept"`, name)
+	}
+
+	ret := sendRequest(t, app, http.MethodPut, "relation/rel_emp_dept",
+		`{"left_entity":"rel_emp","right_entity":"rel_dept",`+
+			`"left_key":"dept_code","right_key":"code","relation_type":"m:1","cascade_policy":"cascade"}`)
+	assert.Contains(t, ret, `"cascade_policy":"cascade"`)
+	ret = sendRequest(t, app, http.MethodGet, "relation?entity=rel_dept", "")
+	assert.Contains(t, ret, `"cascade_policy":"cascade"`)
+
+	code, _ := doRequest(t, app, http.MethodDelete, "relation/rel_emp_dept", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(t, app, http.MethodGet, "relation/rel_emp_dept", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	ret = sendRequest(t, app, http.MethodGet, "meta/rel_dept", "")
+	assert.NotContains(t, ret, "rel_emp_dept")
+}
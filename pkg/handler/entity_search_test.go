@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearch(t *testing.T) {
+	_ = core.ReloadTenantConfig()
+	app := core.CreateApp()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	assert.NoError(t, err)
+	_, _ = engine.Exec("DROP TABLE IF EXISTS idig_fts_sr_doc")
+	for name, ddl := range map[string]string{
+		"sr_doc":     "CREATE TABLE sr_doc (idx INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT, hits INTEGER)",
+		"sr_doc_ext": "CREATE TABLE sr_doc_ext (idx INTEGER PRIMARY KEY, body TEXT)",
+	} {
+		_, _ = engine.Exec("DROP TABLE IF EXISTS " + name)
+		_, err = engine.Exec(ddl)
+		assert.NoError(t, err)
+	}
+	_, _ = engine.Exec("DELETE FROM idig_entity_attr_group WHERE attr_table = 'sr_doc_ext'")
+	_, _ = engine.Exec("DELETE FROM idig_entity WHERE entity_name = 'sr_doc'")
+	meta.InvalidateMeta("sr_doc")
+	_, err = meta.RegisterEntity(engine, "sr_doc", "", "sr_doc", "idx")
+	assert.NoError(t, err)
+	_, err = meta.AddEntityAttrGroupByName(engine, "sr_doc", "ext", "sr_doc_ext")
+	assert.NoError(t, err)
+	_, err = engine.Exec("INSERT INTO sr_doc (idx, title) VALUES (1, 'Go tips'), (2, 'Rust notes')")
+	assert.NoError(t, err)
+	_, err = engine.Exec("INSERT INTO sr_doc_ext (idx, body) VALUES (1, 'channels and goroutines'), (2, 'ownership')")
+	assert.NoError(t, err)
+
+	ret := sendRequest(t, app, http.MethodPut, "meta/sr_doc/search", `{"columns":["hits"]}`)
+	assert.Contains(t, ret, "must be text")
+	ret = sendRequest(t, app, http.MethodPut, "meta/sr_doc/search", `{"columns":["title","body"]}`)
+	if strings.Contains(ret, "fts5") {
+		t.Skip("sqlite is built without fts5, run with -tags sqlite_fts5")
+	}
+	assert.Contains(t, ret, `"code":0`)
+	search := func(body string) string {
+		return sendRequest(t, app, http.MethodPost, "dq", `{"select":["idx"],"from":"sr_doc",`+body+`}`)
+	}
+	// 建立索引时写入已有的记录，检索列可在属性表中
+	ret = search(`"search":"goroutines"`)
+	assert.Contains(t, ret, `"idx":1`)
+	assert.NotContains(t, ret, `"idx":2`)
+
+	// 写入主表或属性表后索引按主键同步
+	ret = sendRequest(t, app, http.MethodPost, "dm/sr_doc", `{"vals":{"title":"Go generics","body":"type parameters"}}`)
+	assert.Contains(t, ret, `"code":0`)
+	ret = sendRequest(t, app, http.MethodPut, "dm/sr_doc", `{"vals":{"idx":2,"body":"ownership and goroutines"}}`)
+	assert.Contains(t, ret, `"code":0`)
+	ret = search(`"search":"goroutines"`)
+	assert.Contains(t, ret, `"idx":2`)
+	ret = search(`"search":"go"`)
+	assert.Contains(t, ret, `"idx":3`)
+
+	// 标题与正文都匹配的记录相关度更高，缺省按相关度降序；高亮检索词
+	ret = sendRequest(t, app, http.MethodPut, "dm/sr_doc", `{"vals":{"idx":1,"title":"goroutines in Go"}}`)
+	assert.Contains(t, ret, `"code":0`)
+	rows, err := entity.NewQuery(engine, "sr_doc").Select("idx").Search("goroutines").Highlight("[", "]", "title").Find()
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, int64(1), rows[0]["idx"])
+	assert.Equal(t, "[goroutines] in Go", rows[0]["title_highlight"])
+	rank := func(row map[string]any) float64 {
+		f, err := strconv.ParseFloat(fmt.Sprint(row[query.SearchRank]), 64)
+		assert.NoError(t, err)
+		return f
+	}
+	assert.Greater(t, rank(rows[0]), rank(rows[1]))
+	ret = search(`"search":{"text":"type","highlight":true}`)
+	assert.Contains(t, ret, `"body_highlight":"\u003cb\u003etype\u003c/b\u003e parameters"`)
+	ret = search(`"search":{"text":"type","highlight":{"cols":["hits"]}}`)
+	assert.Contains(t, ret, "not a search column")
+
+	// 删除的记录不再命中；取消检索后不能检索
+	ret = sendRequest(t, app, http.MethodDelete, "dm/sr_doc", `{"vals":{"idx":2}}`)
+	assert.Contains(t, ret, `"deleted":1`)
+	ret = search(`"search":"ownership"`)
+	assert.Contains(t, ret, `"code":0`)
+	assert.NotContains(t, ret, `"idx"`)
+	ret = sendRequest(t, app, http.MethodPut, "meta/sr_doc/search", `{"columns":[]}`)
+	assert.Contains(t, ret, `"code":0`)
+	ret = search(`"search":"go"`)
+	assert.Contains(t, ret, "has no search columns")
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -12,9 +13,58 @@ import (
 	"github.com/everpan/idig/pkg/entity/meta"
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
-	"github.com/valyala/fasthttp"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm"
 )
 
+// doRequest 向 app 发送 /api/v1/entity/ 下 path 的请求，返回状态码和响应体；header 为成对的名称和值
+func doRequest(t *testing.T, app *fiber.App, method, path, body string, header ...string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/v1/entity/"+path, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := app.Test(req, -1)
+	assert.NoError(t, err)
+	ret, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(ret)
+}
+
+// sendRequest 同 doRequest，只返回响应体
+func sendRequest(t *testing.T, app *fiber.App, method, path, body string, header ...string) string {
+	t.Helper()
+	_, ret := doRequest(t, app, method, path, body, header...)
+	return ret
+}
+
+// setupDMEntity 在默认租户库中重建 beans 的表，以第一个表为主表、idx 为主键重新注册实体 name，
+// 其余表依次加入属性组 g1、g2…；实体原有的属性组、规则、列默认值与序列一并清除
+func setupDMEntity(t *testing.T, name string, beans ...any) *xorm.Engine {
+	t.Helper()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	require.NoError(t, err)
+	_ = engine.DropTables(beans...)
+	require.NoError(t, engine.Sync2(beans...))
+	byEntity := "WHERE entity_idx IN (SELECT entity_idx FROM idig_entity WHERE entity_name = ?)"
+	_, _ = engine.Exec("DELETE FROM idig_entity_rule "+byEntity, name)
+	_, _ = engine.Exec("DELETE FROM idig_entity_column_default "+byEntity, name)
+	_, _ = engine.Exec("DELETE FROM idig_entity_sequence WHERE seq_name LIKE ?", name+".%")
+	_, _ = engine.Exec("DELETE FROM idig_entity WHERE entity_name = ?", name)
+	tables := make([]string, len(beans))
+	for i, bean := range beans {
+		tables[i] = engine.TableName(bean)
+		_, _ = engine.Exec("DELETE FROM idig_entity_attr_group WHERE attr_table = ?", tables[i])
+	}
+	meta.InvalidateMeta(name)
+	_, err = meta.RegisterEntity(engine, name, "", tables[0], "idx")
+	require.NoError(t, err)
+	for i, table := range tables[1:] {
+		_, err = meta.AddEntityAttrGroupByName(engine, name, fmt.Sprintf("g%d", i+1), table)
+		require.NoError(t, err)
+	}
+	return engine
+}
+
 type Student0 struct {
 	Idx    uint32 `xorm:"pk autoincr"`
 	Name   string `xorm:"varchar(255)"`
@@ -24,7 +74,7 @@ type Student0 struct {
 
 type Student1 struct {
 	Idx     uint32 `xorm:"unique"`
-	Gender  string `xorm:"int"`
+	Gender  string `xorm:"varchar(16)"`
 	ClassId int    `xorm:"int"`
 }
 
@@ -33,7 +83,9 @@ func TestDM_INSERT(t *testing.T) {
 	engine, err := core.GetEngine(tenant.Driver, tenant.DataSource)
 	assert.NoError(t, err)
 	engine.DropTables(new(Student0), new(Student1))
-	engine.Truncate(new(meta.Entity), new(meta.AttrGroup))
+	engine.Exec("DELETE FROM idig_entity WHERE entity_name = 'student'")
+	engine.Exec("DELETE FROM idig_entity_attr_group WHERE attr_table IN ('student0', 'student1')")
+	meta.InvalidateMeta("student")
 	err = engine.Sync2(new(Student0), new(Student1))
 	assert.NoError(t, err)
 
@@ -59,7 +111,7 @@ func TestDM_INSERT(t *testing.T) {
 		{"Insert with unique key", `{"vals":{"mobile":"uk1","name":"nam1","card":"c1","gender":"male"}}`, "student", checkUniqueKeyConstraint},
 		{"Insert multiple values", `{"vals":[{"mobile":"uk21","name":"nam1","card":"c1","gender":"male"},{"mobile":"uk22","name":"nam1","card":"c1","gender":"male"}]}`, "student", checkInsertMultipleSuccess},
 		{"Insert array values", `{"cols":["mobile","name","card","gender","class_id"],"vals":[["uk321","nam1","c1","male",234],["uk322","nam1","c1","male",245]]}`, "student", checkInsertArraySuccess},
-		{"Primary key table empty", `{"cols":["gender","class_id"],"vals":[["uk321","nam1"],["male",245]]}`, "student", checkEmptyCols},
+		{"Primary key table empty", `{"cols":["gender","class_id"],"vals":[["female",123],["male",245]]}`, "student", checkEmptyCols},
 	}
 
 	for _, tt := range tests {
@@ -80,27 +132,27 @@ func TestDM_INSERT(t *testing.T) {
 }
 
 func checkInsertSuccess(t *testing.T, body string, err error) {
-	assert.Contains(t, body, "insert 1 rows")
+	assert.Contains(t, body, "insert 1 row(s)")
 }
 
 func checkColumnNotFound(t *testing.T, body string, err error) {
-	assert.Contains(t, body, `"data":"column 'not-exit' not found"`)
+	assert.Contains(t, body, `column 'not-exit' not found`)
 }
 
 func checkUniqueKeyConstraint(t *testing.T, body string, err error) {
-	assert.True(t, strings.Contains(body, "insert 1 rows") || strings.Contains(body, "UNIQUE constraint failed"))
+	assert.True(t, strings.Contains(body, "insert 1 row(s)") || strings.Contains(body, "UNIQUE constraint failed"))
 }
 
 func checkInsertMultipleSuccess(t *testing.T, body string, err error) {
-	assert.True(t, strings.Contains(body, "insert 2 rows") || strings.Contains(body, "UNIQUE constraint failed"))
+	assert.True(t, strings.Contains(body, "insert 2 row(s)") || strings.Contains(body, "UNIQUE constraint failed"))
 }
 
 func checkInsertArraySuccess(t *testing.T, body string, err error) {
-	assert.True(t, strings.Contains(body, "insert 2 rows") || strings.Contains(body, "UNIQUE constraint failed"))
+	assert.True(t, strings.Contains(body, "insert 2 row(s)") || strings.Contains(body, "UNIQUE constraint failed"))
 }
 
 func checkEmptyCols(t *testing.T, body string, err error) {
-	assert.Contains(t, body, `cols is empty`)
+	assert.Contains(t, body, `no values provided for the primary table`)
 }
 
 func TestDM_Update(t *testing.T) {
@@ -266,23 +318,16 @@ func TestDM_Update(t *testing.T) {
 		},
 	}
 
+	app := core.CreateApp()
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ctx := core.AcquireContext()
-			defer core.ReleaseContext(ctx)
-			app := fiber.New()
-			fctx := app.AcquireCtx(&fasthttp.RequestCtx{})
-			defer app.ReleaseCtx(fctx)
-
-			// 设置 tenant 信息
-			fctx.Request().Header.Set(core.TenantHeader, tenant.TenantUid)
-			err := ctx.FromFiber(fctx) // FromFiber 会自动设置 engine
-			if err != nil {
-				t.Fatalf("setup context failed: %v", err)
-			}
-
-			body := []byte(tt.body)
-			//err = updateData(ctx, body)
+			req := httptest.NewRequest(http.MethodPut, "/api/v1/entity/dm/student", strings.NewReader(tt.body))
+			req.Header.Set(core.TenantHeader, tenant.TenantUid)
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			t.Log(tt.name, string(body))
+			assert.Contains(t, string(body), `"code":0`)
 			if tt.check != nil {
 				tt.check(t, string(body), err)
 			}
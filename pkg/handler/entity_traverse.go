@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+var traverseRoutes = []*core.IDigRoute{
+	{
+		Path:    "/entity/traverse/:entity", // 沿实体关系遍历，?format=tree|edges
+		Handler: traverseEntity,
+		Method:  fiber.MethodPost,
+	},
+}
+
+func init() {
+	core.RegisterRouter(traverseRoutes)
+}
+
+// traverseEntity 请求体为 entity.Traversal；format 缺省为 tree，返回以起点为根的嵌套文档，edges 返回节点与边的列表
+func traverseEntity(ctx *core.Context) error {
+	t := &entity.Traversal{}
+	if err := json.Unmarshal(ctx.Fiber().Body(), t); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	format := ctx.Fiber().Query("format", "tree")
+	if format != "tree" && format != "edges" {
+		return ctx.SendBadRequestError(fmt.Errorf("unknown format '%s', expected tree or edges", format))
+	}
+	g, err := entity.Traverse(ctx.Engine(), ctx.Fiber().Params("entity"), t)
+	if err != nil {
+		return sendRelationError(ctx, err)
+	}
+	if format == "edges" {
+		return ctx.SendSuccess(g)
+	}
+	return ctx.SendSuccess(g.Tree())
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraverse(t *testing.T) {
+	_ = core.ReloadTenantConfig()
+	app := core.CreateApp()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	assert.NoError(t, err)
+	_, _ = engine.Exec("DELETE FROM idig_entity_relation WHERE relation_name LIKE 'tr_%'")
+	ddl := map[string]string{
+		"tr_emp":  "CREATE TABLE tr_emp (idx INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, dept_code TEXT)",
+		"tr_dept": "CREATE TABLE tr_dept (idx INTEGER PRIMARY KEY AUTOINCREMENT, code TEXT, name TEXT, parent_code TEXT, cc_code TEXT)",
+		"tr_cc":   "CREATE TABLE tr_cc (idx INTEGER PRIMARY KEY AUTOINCREMENT, code TEXT, name TEXT)",
+	}
+	for _, name := range []string{"tr_emp", "tr_dept", "tr_cc"} {
+		_, _ = engine.Exec("DROP TABLE IF EXISTS " + name)
+		_, _ = engine.Exec("DELETE FROM idig_entity WHERE entity_name = ?", name)
+		meta.InvalidateMeta(name)
+		_, err = engine.Exec(ddl[name])
+		assert.NoError(t, err)
+		_, err = meta.RegisterEntity(engine, name, "", name, "idx")
+		assert.NoError(t, err)
+	}
+	for _, r := range []*entity.Relation{
+		{RelationName: "tr_emp_dept", LeftEntity: "tr_emp", RightEntity: "tr_dept",
+			LeftKey: "dept_code", RightKey: "code", RelationType: entity.ManyToOne},
+		{RelationName: "tr_dept_parent", LeftEntity: "tr_dept", RightEntity: "tr_dept",
+			LeftKey: "parent_code", RightKey: "code", RelationType: entity.ManyToOne},
+		{RelationName: "tr_dept_cc", LeftEntity: "tr_dept", RightEntity: "tr_cc",
+			LeftKey: "cc_code", RightKey: "code", RelationType: entity.ManyToOne},
+	} {
+		assert.NoError(t, entity.CreateRelation(engine, r))
+	}
+	for _, sql := range []string{
+		"INSERT INTO tr_cc (idx, code, name) VALUES (1, 'C1', 'Corp'), (2, 'C2', 'Tech')",
+		"INSERT INTO tr_dept (idx, code, name, parent_code, cc_code) VALUES (1, 'HQ', 'HQ', NULL, 'C1'), " +
+			"(2, 'ENG', 'ENG', 'HQ', 'C2'), (3, 'WEB', 'WEB', 'ENG', NULL), (4, 'X', 'X', 'Y', NULL), (5, 'Y', 'Y', 'X', NULL)",
+		"INSERT INTO tr_emp (idx, name, dept_code) VALUES (1, 'ann', 'WEB'), (2, 'bob', 'X')",
+	} {
+		_, err = engine.Exec(sql)
+		assert.NoError(t, err)
+	}
+	send := func(path, body string) map[string]any {
+		ret := map[string]any{}
+		data := sendRequest(t, app, http.MethodPost, "traverse/"+path, body)
+		assert.NoError(t, json.Unmarshal([]byte(data), &ret), data)
+		return ret
+	}
+	chain := `[{"relation":"tr_emp_dept","as":"dept","select":["name"]},` +
+		`{"relation":"tr_dept_parent","as":"parent","recursive":true,"select":["name"]},` +
+		`{"relation":"tr_dept_cc","as":"cc","select":["name"]}]`
+
+	// 员工 → 部门 → 上级部门（递归）→ 成本中心
+	ret := send("tr_emp", `{"start":1,"select":["name"],"path":`+chain+`}`)
+	docs, _ := ret["data"].([]any)
+	assert.Len(t, docs, 1, ret)
+	doc := docs[0].(map[string]any)
+	dept := doc["dept"].(map[string]any)
+	assert.Equal(t, "WEB", dept["name"])
+	assert.Nil(t, dept["cc"])
+	eng := dept["parent"].(map[string]any)
+	assert.Equal(t, "ENG", eng["name"])
+	assert.Equal(t, "Tech", eng["cc"].(map[string]any)["name"])
+	hq := eng["parent"].(map[string]any)
+	assert.Equal(t, "Corp", hq["cc"].(map[string]any)["name"])
+	assert.Nil(t, hq["parent"])
+
+	ret = send("tr_emp", `{"start":[2],"path":`+chain+`}`)
+	x := ret["data"].([]any)[0].(map[string]any)["dept"].(map[string]any)
+	assert.Equal(t, "Y", x["parent"].(map[string]any)["name"])
+	assert.Nil(t, x["parent"].(map[string]any)["parent"])
+
+	// 反方向的自关联为一对多，嵌入数组
+	ret = send("tr_dept?format=tree", `{"start":1,"select":["name"],"path":[{"relation":"tr_dept_parent","as":"children","recursive":true,"reverse":true,"select":["name"]}]}`)
+	hq = ret["data"].([]any)[0].(map[string]any)
+	children := hq["children"].([]any)
+	assert.Len(t, children, 1)
+	assert.Equal(t, "WEB", children[0].(map[string]any)["children"].([]any)[0].(map[string]any)["name"])
+
+	ret = send("tr_emp?format=edges", `{"start":1,"path":[{"relation":"tr_emp_dept"}]}`)
+	assert.Len(t, ret["data"].(map[string]any)["nodes"], 2)
+	assert.Len(t, ret["data"].(map[string]any)["edges"], 1)
+
+	for body, want := range map[string]string{
+		`{"start":1,"path":[{"relation":"tr_emp_dept","recursive":true}]}`: "recursive step requires a self relation",
+		`{"start":1,"path":[{"relation":"tr_emp_dept","reverse":true}]}`:   "reverse only applies to self relations",
+		`{"start":1,"path":[{"relation":"tr_nope"}]}`:                      "relation not found",
+		`{"start":1,"path":[]}`: "traverse path required",
+		`{"start":1,"path":[{"relation":"tr_emp_dept","depth":1000}]}`: "depth must be between 1 and 100, or 0 for the default 10",
+	} {
+		ret = send("tr_emp", body)
+		assert.Contains(t, ret["msg"], want, body)
+	}
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+var viewRoutes = []*core.IDigRoute{
+	{
+		Path:    "/entity/view/:name", // 运行视图 ?param=...&_version=，输出格式同 dq
+		Handler: runView,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/views", // 可运行的视图列表，每个视图为最新版本
+		Handler: listViews,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/views", // 保存视图的新版本
+		Handler: saveView,
+		Method:  fiber.MethodPost,
+	},
+	{
+		Path:    "/entity/views/:name", // 视图的所有版本
+		Handler: viewVersions,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/entity/views/:name",
+		Handler: deleteView,
+		Method:  fiber.MethodDelete,
+	},
+}
+
+func init() {
+	core.RegisterRouter(viewRoutes)
+}
+
+// runView 以请求的参数绑定视图的查询后执行，同一参数可以重复给出多个值；
+// 无论运行哪个版本，都按最新版本的 owner 和 allowed 检查权限
+func runView(ctx *core.Context) error {
+	fb := ctx.Fiber()
+	name := fb.Params("name")
+	v, q, err := entity.LoadView(ctx.Engine(), name, 0)
+	if err != nil {
+		return sendViewError(ctx, err)
+	}
+	if !v.CanRun(ctx.Principal()) {
+		return sendViewError(ctx, entity.ErrViewForbidden)
+	}
+	if version := fb.QueryInt(entity.ViewVersionParam, 0); version > 0 && version != v.Version {
+		if v, q, err = entity.LoadView(ctx.Engine(), name, version); err != nil {
+			return sendViewError(ctx, err)
+		}
+	}
+	raw := map[string][]string{}
+	fb.Context().QueryArgs().VisitAll(func(k, val []byte) {
+		raw[string(k)] = append(raw[string(k)], string(val))
+	})
+	args, err := v.Args(raw)
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	bq, err := q.Bind(args)
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return runQuery(ctx, bq)
+}
+
+func listViews(ctx *core.Context) error {
+	views, err := entity.ListViews(ctx.Engine(), ctx.Principal())
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendSuccess(views)
+}
+
+func viewVersions(ctx *core.Context) error {
+	views, err := entity.ViewVersions(ctx.Engine(), ctx.Fiber().Params("name"), ctx.Principal())
+	if err != nil {
+		return sendViewError(ctx, err)
+	}
+	return ctx.SendSuccess(views)
+}
+
+// saveView 请求体为 entity.View，返回保存的版本
+func saveView(ctx *core.Context) error {
+	v := &entity.View{}
+	if err := json.Unmarshal(ctx.Fiber().Body(), v); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if err := entity.SaveView(ctx.Engine(), v, ctx.Principal()); err != nil {
+		return sendViewError(ctx, err)
+	}
+	return ctx.SendSuccess(v)
+}
+
+func deleteView(ctx *core.Context) error {
+	if err := entity.DeleteView(ctx.Engine(), ctx.Fiber().Params("name"), ctx.Principal()); err != nil {
+		return sendViewError(ctx, err)
+	}
+	return ctx.SendSuccess(nil)
+}
+
+// sendViewError 视图不存在时返回 404，无权限时返回 403
+func sendViewError(ctx *core.Context, err error) error {
+	switch {
+	case errors.Is(err, entity.ErrViewNotFound):
+		ctx.Fiber().Status(fiber.StatusNotFound)
+	case errors.Is(err, entity.ErrViewForbidden):
+		ctx.Fiber().Status(fiber.StatusForbidden)
+	default:
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendJSON(-1, err.Error(), nil)
+}
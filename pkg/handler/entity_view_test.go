@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestView(t *testing.T) {
+	_ = core.ReloadTenantConfig()
+	viper.Set("auth.tokens", []map[string]any{
+		{"token": "tk-ann", "principal": "ann"},
+		{"token": "tk-bob", "principal": "bob"},
+		{"token": "tk-cat", "principal": "cat"},
+	})
+	assert.NoError(t, core.ReloadAuthConfig())
+	t.Cleanup(func() {
+		viper.Set("auth.tokens", nil)
+		_ = core.ReloadAuthConfig()
+	})
+	app := core.CreateApp()
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	assert.NoError(t, err)
+	setupJoinEntities(t, engine)
+	_, _ = engine.Exec("DELETE FROM idig_entity_view WHERE view_name LIKE 'jn_%'")
+
+	// 未认证时不能保存视图
+	code, ret := doRequest(t, app, http.MethodPost, "views",
+		`{"view_name":"jn_emps","query":{"select":["name"],"from":"jn_emp"}}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Contains(t, ret, "authentication required")
+	ret = sendRequest(t, app, http.MethodPost, "views",
+		`{"view_name":"jn_emps","query":{"select":["name"],"from":"jn_emp",`+
+			`"where":[{"col":"idx","op":"in","val":"${ids}"}]}}`, "Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, "parameter 'ids' is not declared")
+	ret = sendRequest(t, app, http.MethodPost, "views",
+		`{"view_name":"jn_emps","query":{"select":["name"],"from":"jn_emp",`+
+			`"where":[{"col":"idx","op":"in","val":"${ids}"}]},"params":[{"name":"ids","type":"int","list":true,"required":true}]}`,
+		"Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, `"version":1`)
+	assert.Contains(t, ret, `"owner":"ann"`)
+
+	// 参数按类型转换后绑定，可重复或以逗号分隔
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps?ids=1&ids=3", "")
+	assert.Contains(t, ret, `[{"name":"ann"},{"name":"cat"}]`)
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps?ids=2,3&format=csv", "")
+	assert.Equal(t, "name\nbob\ncat\n", ret)
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps?ids=x", "")
+	assert.Contains(t, ret, "invalid int value 'x'")
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps", "")
+	assert.Contains(t, ret, "parameter 'ids' is required")
+	// 值不拼接进 SQL
+	ret = sendRequest(t, app, http.MethodPost, "views",
+		`{"view_name":"jn_by_name","query":{"select":["idx"],"from":"jn_emp",`+
+			`"where":[{"col":"name","val":"${name}"}]},"params":[{"name":"name","default":"bob"}]}`,
+		"Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, `"code":0`)
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_by_name", "")
+	assert.Contains(t, ret, `[{"idx":2}]`)
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_by_name?name=x'%20OR%20'1'='1", "")
+	assert.Contains(t, ret, `"code":0`)
+	assert.NotContains(t, ret, `"idx"`)
+	// expr 条件的参数只能在 args 中绑定，sql 中不能有占位符
+	ret = sendRequest(t, app, http.MethodPost, "views",
+		`{"view_name":"jn_expr","query":{"select":["idx"],"from":"jn_emp",`+
+			`"where":[{"col":"name","op":"expr","val":{"sql":"${cond}","args":[]}}]},"params":[{"name":"cond"}]}`,
+		"Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, "expr sql '${cond}' can not contain parameters")
+	ret = sendRequest(t, app, http.MethodPost, "views",
+		`{"view_name":"jn_expr","query":{"select":["idx"],"from":"jn_emp",`+
+			`"where":[{"col":"name","op":"expr","val":{"sql":"name = ?","args":["${name}"]}}]},"params":[{"name":"name","default":"cat"}]}`,
+		"Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, `"code":0`)
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_expr", "")
+	assert.Contains(t, ret, `[{"idx":3}]`)
+
+	// 只有 owner 能保存新版本，新版本限定可运行的身份，旧版本仍可按版本运行
+	ret = sendRequest(t, app, http.MethodPost, "views",
+		`{"view_name":"jn_emps","query":{"select":["idx"],"from":"jn_emp"}}`, "Authorization", "Bearer tk-bob")
+	assert.Contains(t, ret, "owned by 'ann'")
+	ret = sendRequest(t, app, http.MethodPost, "views",
+		`{"view_name":"jn_emps","query":{"select":["idx","name"],"from":"jn_emp",`+
+			`"where":[{"col":"idx","op":"in","val":"${ids}"}]},"params":[{"name":"ids","type":"int","list":true,"default":[2]}],`+
+			`"allowed":["cat"]}`, "Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, `"version":2`)
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps", "", "Authorization", "Bearer tk-cat")
+	assert.Contains(t, ret, `[{"idx":2,"name":"bob"}]`)
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps?ids=1", "", "Authorization", "Bearer tk-bob")
+	assert.Contains(t, ret, "view access denied")
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps?ids=1&_version=1", "", "Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, `[{"name":"ann"}]`)
+	// 旧版本没有限定身份，但按最新版本检查权限
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps?ids=1&_version=1", "", "Authorization", "Bearer tk-bob")
+	assert.Contains(t, ret, "view access denied")
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps?ids=1&_version=1", "", "Authorization", "Bearer tk-cat")
+	assert.Contains(t, ret, `[{"name":"ann"}]`)
+
+	ret = sendRequest(t, app, http.MethodGet, "views", "", "Authorization", "Bearer tk-bob")
+	assert.Contains(t, ret, "jn_by_name")
+	assert.NotContains(t, ret, "jn_emps")
+	ret = sendRequest(t, app, http.MethodGet, "views/jn_emps", "", "Authorization", "Bearer tk-cat")
+	assert.Contains(t, ret, `"version":1`)
+	assert.Contains(t, ret, `"version":2`)
+	code, ret = doRequest(t, app, http.MethodDelete, "views/jn_emps", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Contains(t, ret, "authentication required")
+	ret = sendRequest(t, app, http.MethodDelete, "views/jn_emps", "", "Authorization", "Bearer tk-bob")
+	assert.Contains(t, ret, "owned by 'ann'")
+	ret = sendRequest(t, app, http.MethodDelete, "views/jn_emps", "", "Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, `"code":0`)
+	ret = sendRequest(t, app, http.MethodGet, "view/jn_emps?ids=1", "", "Authorization", "Bearer tk-ann")
+	assert.Contains(t, ret, "view not found")
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/event/database"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+var eventAdminRoutes = []*core.IDigRoute{
+	{
+		Path:    "/event/dead", // 死信事件列表
+		Handler: listDeadEvents,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/event/dead/replay", // 重放死信事件
+		Handler: replayDeadEvents,
+		Method:  fiber.MethodPost,
+	},
+}
+
+func init() {
+	core.RegisterRouter(eventAdminRoutes)
+}
+
+// listDeadEvents GET /event/dead?topic=&limit=&offset=
+func listDeadEvents(ctx *core.Context) error {
+	fb := ctx.Fiber()
+	evs, err := database.ListDeadEvents(ctx.Engine(), fb.Query("topic"),
+		fb.QueryInt("limit", database.DefaultBatchSize), fb.QueryInt("offset", 0))
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendSuccess(evs)
+}
+
+type replayRequest struct {
+	Topic string   `json:"topic"`
+	IDs   []uint64 `json:"ids"`
+}
+
+// replayDeadEvents POST /event/dead/replay {"topic":"", "ids":[]}
+func replayDeadEvents(ctx *core.Context) error {
+	req := &replayRequest{}
+	if err := json.Unmarshal(ctx.Fiber().Body(), req); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	n, err := database.ReplayDeadEvents(ctx.Engine(), req.Topic, req.IDs)
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendJSON(0, fmt.Sprintf("replay %d dead event(s)", n), n)
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/workflow"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"xorm.io/xorm"
+)
+
+var workflowRoutes = []*core.IDigRoute{
+	{
+		Path:    "/workflow/rule", // 规则列表 ?event_type=
+		Handler: listWorkflowRules,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/workflow/rule",
+		Handler: createWorkflowRule,
+		Method:  fiber.MethodPost,
+	},
+	{
+		Path:    "/workflow/rule/:name",
+		Handler: getWorkflowRule,
+		Method:  fiber.MethodGet,
+	},
+	{
+		Path:    "/workflow/rule/:name",
+		Handler: updateWorkflowRule,
+		Method:  fiber.MethodPut,
+	},
+	{
+		Path:    "/workflow/rule/:name",
+		Handler: deleteWorkflowRule,
+		Method:  fiber.MethodDelete,
+	},
+	{
+		Path:    "/workflow/execution", // 执行历史 ?rule=&event_id=&status=&limit=&offset=
+		Handler: listWorkflowExecutions,
+		Method:  fiber.MethodGet,
+	},
+}
+
+func init() {
+	core.RegisterRouter(workflowRoutes)
+	workflow.RegisterActionExecutor(workflow.ActionInsert, insertEntityAction)
+	workflow.RegisterActionExecutor(workflow.ActionUpdate, updateEntityAction)
+}
+
+func listWorkflowRules(ctx *core.Context) error {
+	rules, err := workflow.ListRules(ctx.Engine(), ctx.Fiber().Query("event_type"))
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendSuccess(rules)
+}
+
+func getWorkflowRule(ctx *core.Context) error {
+	r, err := workflow.GetRule(ctx.Engine(), ctx.Fiber().Params("name"))
+	if err != nil {
+		return sendWorkflowError(ctx, err)
+	}
+	return ctx.SendSuccess(r)
+}
+
+func createWorkflowRule(ctx *core.Context) error {
+	r := &workflow.Rule{}
+	if err := json.Unmarshal(ctx.Fiber().Body(), r); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if err := workflow.CreateRule(ctx.Engine(), r); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if err := workflow.Notify(ctx.Engine()); err != nil {
+		return ctx.SendJSON(-1, fmt.Sprintf("rule saved, but subscribe failed: %v", err), r)
+	}
+	return ctx.SendSuccess(r)
+}
+
+func updateWorkflowRule(ctx *core.Context) error {
+	r := &workflow.Rule{}
+	if err := json.Unmarshal(ctx.Fiber().Body(), r); err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	if err := workflow.UpdateRule(ctx.Engine(), ctx.Fiber().Params("name"), r); err != nil {
+		return sendWorkflowError(ctx, err)
+	}
+	if err := workflow.Notify(ctx.Engine()); err != nil {
+		return ctx.SendJSON(-1, fmt.Sprintf("rule saved, but subscribe failed: %v", err), r)
+	}
+	return ctx.SendSuccess(r)
+}
+
+func deleteWorkflowRule(ctx *core.Context) error {
+	if err := workflow.DeleteRule(ctx.Engine(), ctx.Fiber().Params("name")); err != nil {
+		return sendWorkflowError(ctx, err)
+	}
+	return ctx.SendJSON(0, "rule deleted", nil)
+}
+
+func listWorkflowExecutions(ctx *core.Context) error {
+	fb := ctx.Fiber()
+	execs, err := workflow.ListExecutions(ctx.Engine(), &workflow.ExecutionFilter{
+		RuleName: fb.Query("rule"),
+		EventId:  uint64(fb.QueryInt("event_id", 0)),
+		Status:   fb.Query("status"),
+		Limit:    fb.QueryInt("limit", 100),
+		Offset:   fb.QueryInt("offset", 0),
+	})
+	if err != nil {
+		return ctx.SendBadRequestError(err)
+	}
+	return ctx.SendSuccess(execs)
+}
+
+func sendWorkflowError(ctx *core.Context, err error) error {
+	if errors.Is(err, workflow.ErrRuleNotFound) {
+		ctx.Fiber().Status(fiber.StatusNotFound)
+		return ctx.SendJSON(-1, err.Error(), nil)
+	}
+	return ctx.SendBadRequestError(err)
+}
+
+// actionDataTable 将动作的值转换为单行 DataTable
+func actionDataTable(a *workflow.Action, values map[string]any, db *xorm.Engine) (*meta.EntityMeta, *query.DataTable, error) {
+	m, err := meta.AcquireMeta(a.Entity, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	dt := query.NewDataTable()
+	if err = dt.ParseKeyVals(map[string]any{query.KeyVals: values}); err != nil {
+		return nil, nil, err
+	}
+	dt.AddResultColumn()
+	return m, dt, nil
+}
+
+// actionWriteContext 工作流动作以 workflow:<规则名> 的身份写入系统列
+func actionWriteContext(ac *workflow.ActionContext) *query.WriteContext {
+	wc := &query.WriteContext{TenantIdx: core.DefaultTenant.TenantIdx}
+	if ac.Rule != nil {
+		wc.Principal = "workflow:" + ac.Rule.RuleName
+	}
+	return wc
+}
+
+// firstRow 返回 DataTable 第一行，用于记录动作结果
+func firstRow(dt *query.DataTable) map[string]any {
+	ret := map[string]any{}
+	if len(dt.Values()) == 0 {
+		return ret
+	}
+	for i, col := range dt.Columns() {
+		ret[col] = dt.Values()[0][i]
+	}
+	return ret
+}
+
+// insertEntityAction 工作流 insert 动作，自增主键回填到结果中
+func insertEntityAction(ac *workflow.ActionContext, a *workflow.Action, values map[string]any) (any, error) {
+	m, dt, err := actionDataTable(a, values, ac.DB)
+	if err != nil {
+		return nil, err
+	}
+	if err = withTransaction(ac.DB, func(sess *xorm.Session) error {
+		return InsertEntityRows(sess, m, dt, actionWriteContext(ac))
+	}); err != nil {
+		return nil, err
+	}
+	return firstRow(dt), nil
+}
+
+// updateEntityAction 工作流 update 动作，values 中必须包含主键
+func updateEntityAction(ac *workflow.ActionContext, a *workflow.Action, values map[string]any) (any, error) {
+	m, dt, err := actionDataTable(a, values, ac.DB)
+	if err != nil {
+		return nil, err
+	}
+	pkId, err := dt.FetchColumnsIndex(m.PrimaryColumn(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkId) == 0 {
+		return nil, fmt.Errorf("update action on '%s' requires primary key values", a.Entity)
+	}
+	if err = withTransaction(ac.DB, func(sess *xorm.Session) error {
+		return UpdateEntityRows(sess, m, dt, actionWriteContext(ac))
+	}); err != nil {
+		return nil, err
+	}
+	return firstRow(dt), nil
+}
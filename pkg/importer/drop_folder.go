@@ -0,0 +1,389 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/everpan/idig/pkg/config"
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/event"
+	"github.com/everpan/idig/pkg/event/watcher"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"xorm.io/xorm"
+)
+
+var logger = core.GetLogger()
+
+const (
+	DefaultChunkSize   = 500
+	DefaultSettle      = time.Second // 文件最后一次变更后等待的时间，避免读取写了一半的文件
+	DefaultFileTopic   = "import.file"
+	DefaultResultTopic = "import.result"
+	DefaultPrincipal   = "importer" // 投递目录导入写入系统列（如 created_by）的身份
+
+	// 结果事件类型
+	TypeImportDone   = "import.done"
+	TypeImportFailed = "import.failed"
+
+	ResultSuffix = ".result.csv"
+)
+
+// Mapping 文件到实体的映射，Pattern 为文件名 glob
+type Mapping struct {
+	Pattern string `mapstructure:"pattern" json:"pattern"`
+	Entity  string `mapstructure:"entity" json:"entity"`
+	Mode    string `mapstructure:"mode" json:"mode"` // insert 或 upsert，为空时使用 DropFolderConfig.Mode
+	// Aliases 表头别名 -> 实体列名
+	Aliases       map[string]string `mapstructure:"aliases" json:"aliases,omitempty"`
+	IgnoreUnknown bool              `mapstructure:"ignore-unknown" json:"ignore_unknown,omitempty"`
+}
+
+// DropFolderConfig 投递目录导入配置；未匹配 Mappings 的文件按文件名约定
+// <entity>[__<任意后缀>].<csv|tsv|json|xlsx> 确定实体
+type DropFolderConfig struct {
+	Dir         string        `mapstructure:"dir"`
+	DoneDir     string        `mapstructure:"done-dir"`   // 默认 Dir/done
+	FailedDir   string        `mapstructure:"failed-dir"` // 默认 Dir/failed
+	Mode        string        `mapstructure:"mode"`
+	ChunkSize   int           `mapstructure:"chunk-size"`
+	Settle      time.Duration `mapstructure:"settle"`
+	FileTopic   string        `mapstructure:"file-topic"`   // 文件事件的 topic
+	ResultTopic string        `mapstructure:"result-topic"` // 导入结果事件的 topic
+	Principal   string        `mapstructure:"principal"`    // 写入系统列的身份
+	Mappings    []*Mapping    `mapstructure:"mappings"`
+}
+
+func init() {
+	viper.SetDefault("import.drop.mode", ModeInsert)
+	viper.SetDefault("import.drop.chunk-size", DefaultChunkSize)
+	viper.SetDefault("import.drop.settle", DefaultSettle)
+	viper.SetDefault("import.drop.file-topic", DefaultFileTopic)
+	viper.SetDefault("import.drop.result-topic", DefaultResultTopic)
+	viper.SetDefault("import.drop.principal", DefaultPrincipal)
+	config.RegisterReloadConfigFunc(func() error {
+		cfg := &DropFolderConfig{}
+		if err := viper.UnmarshalKey("import.drop", cfg); err != nil {
+			return err
+		}
+		muConfig.Lock()
+		defer muConfig.Unlock()
+		dropConfig = cfg
+		return nil
+	})
+}
+
+var (
+	muConfig   sync.Mutex
+	dropConfig *DropFolderConfig
+)
+
+// ConfiguredDropFolder 返回配置文件中 import.drop 的配置，未配置目录时返回 nil
+func ConfiguredDropFolder() *DropFolderConfig {
+	muConfig.Lock()
+	defer muConfig.Unlock()
+	if dropConfig == nil || dropConfig.Dir == "" {
+		return nil
+	}
+	cfg := *dropConfig
+	return &cfg
+}
+
+func (c *DropFolderConfig) withDefaults() error {
+	if c.Dir == "" {
+		return errors.New("drop folder dir is required")
+	}
+	if c.DoneDir == "" {
+		c.DoneDir = filepath.Join(c.Dir, "done")
+	}
+	if c.FailedDir == "" {
+		c.FailedDir = filepath.Join(c.Dir, "failed")
+	}
+	if c.Mode == "" {
+		c.Mode = ModeInsert
+	}
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = DefaultChunkSize
+	}
+	if c.Principal == "" {
+		c.Principal = DefaultPrincipal
+	}
+	if c.Settle <= 0 {
+		c.Settle = DefaultSettle
+	}
+	if c.FileTopic == "" {
+		c.FileTopic = DefaultFileTopic
+	}
+	if c.ResultTopic == "" {
+		c.ResultTopic = DefaultResultTopic
+	}
+	for _, m := range c.Mappings {
+		if _, err := filepath.Match(m.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid mapping pattern '%s': %w", m.Pattern, err)
+		}
+		if m.Entity == "" {
+			return fmt.Errorf("mapping '%s' requires entity", m.Pattern)
+		}
+	}
+	return nil
+}
+
+// resolve 根据配置或文件名约定确定实体和导入选项
+func (c *DropFolderConfig) resolve(name string) (string, *Options) {
+	opts := &Options{Mode: c.Mode, ChunkSize: c.ChunkSize,
+		Writer: &query.WriteContext{Principal: c.Principal, TenantIdx: core.DefaultTenant.TenantIdx}}
+	for _, m := range c.Mappings {
+		if ok, _ := filepath.Match(m.Pattern, name); ok {
+			if m.Mode != "" {
+				opts.Mode = m.Mode
+			}
+			opts.Aliases = m.Aliases
+			opts.IgnoreUnknown = m.IgnoreUnknown
+			return m.Entity, opts
+		}
+	}
+	entity := strings.TrimSuffix(name, filepath.Ext(name))
+	if i := strings.Index(entity, "__"); i >= 0 {
+		entity = entity[:i]
+	}
+	return entity, opts
+}
+
+// Report 单个文件的导入结果
+type Report struct {
+	File       string  `json:"file"`
+	Entity     string  `json:"entity"`
+	Mode       string  `json:"mode"`
+	MovedTo    string  `json:"moved_to"`
+	ResultFile string  `json:"result_file,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	Result     *Result `json:"result,omitempty"`
+}
+
+// DropFolder 监听投递目录，将新文件导入对应实体，完成后移动到 done 或 failed 目录
+type DropFolder struct {
+	cfg     *DropFolderConfig
+	db      *xorm.Engine
+	bus     event.EventBus
+	watcher *watcher.FileWatcher
+
+	mu         sync.Mutex
+	processing map[string]struct{}
+}
+
+func NewDropFolder(db *xorm.Engine, bus event.EventBus, cfg *DropFolderConfig) (*DropFolder, error) {
+	c := *cfg
+	if err := c.withDefaults(); err != nil {
+		return nil, err
+	}
+	return &DropFolder{
+		cfg:        &c,
+		db:         db,
+		bus:        bus,
+		processing: make(map[string]struct{}),
+	}, nil
+}
+
+// Start 创建目录、订阅文件事件并开始监听，已存在的文件会立即导入
+func (d *DropFolder) Start(ctx context.Context) error {
+	for _, dir := range []string{d.cfg.Dir, d.cfg.DoneDir, d.cfg.FailedDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	if err := d.bus.Subscribe(ctx, d.cfg.FileTopic, d.handleFileEvent); err != nil {
+		return err
+	}
+	fw, err := watcher.NewFileWatcherWithOptions(d.bus, &watcher.Options{
+		Include:  []string{"*.csv", "*.tsv", "*.json", "*.xlsx"},
+		Exclude:  []string{".*", "*" + ResultSuffix},
+		Ops:      fsnotify.Create | fsnotify.Write,
+		Debounce: d.cfg.Settle,
+		Topic:    d.cfg.FileTopic,
+	})
+	if err != nil {
+		return err
+	}
+	if err = fw.Watch(d.cfg.Dir); err != nil {
+		_ = fw.Close()
+		return err
+	}
+	d.watcher = fw
+	entries, err := os.ReadDir(d.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && FormatOf(e.Name()) != "" {
+			d.Process(filepath.Join(d.cfg.Dir, e.Name()))
+		}
+	}
+	return nil
+}
+
+// Close 停止监听并取消订阅
+func (d *DropFolder) Close() error {
+	var err error
+	if d.watcher != nil {
+		err = d.watcher.Close()
+	}
+	return errors.Join(err, d.bus.Unsubscribe(d.cfg.FileTopic))
+}
+
+func (d *DropFolder) handleFileEvent(evt *event.Event) error {
+	path, _ := evt.Data["path"].(string)
+	if path == "" || filepath.Dir(path) != filepath.Clean(d.cfg.Dir) {
+		return nil
+	}
+	if isDir, _ := evt.Data["is_dir"].(bool); isDir {
+		return nil
+	}
+	d.Process(path)
+	return nil
+}
+
+// Process 导入单个文件；文件已被处理或正在处理时返回 nil
+func (d *DropFolder) Process(path string) *Report {
+	d.mu.Lock()
+	if _, ok := d.processing[path]; ok {
+		d.mu.Unlock()
+		return nil
+	}
+	d.processing[path] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.processing, path)
+		d.mu.Unlock()
+	}()
+	if _, err := os.Stat(path); err != nil {
+		// 同一文件的后续事件到达时，文件已被移走
+		return nil
+	}
+
+	name := filepath.Base(path)
+	rp := &Report{File: name}
+	entity, opts := d.cfg.resolve(name)
+	rp.Entity, rp.Mode = entity, opts.Mode
+	dt, loadErr := d.importFile(path, rp, opts)
+
+	dest := d.cfg.DoneDir
+	if loadErr != nil {
+		rp.Error = loadErr.Error()
+		dest = d.cfg.FailedDir
+	} else if rp.Result.Failed > 0 || rp.Result.Invalid > 0 {
+		dest = d.cfg.FailedDir
+	}
+	target := moveTarget(dest, name, time.Now())
+	rp.MovedTo = target
+	if err := os.Rename(path, rp.MovedTo); err != nil {
+		logger.Error("move imported file failed", zap.String("file", path), zap.Error(err))
+		rp.MovedTo = ""
+	}
+	if dt != nil {
+		rp.ResultFile = target + ResultSuffix
+		if err := writeResultFile(rp.ResultFile, dt); err != nil {
+			logger.Error("write import result failed", zap.String("file", rp.ResultFile), zap.Error(err))
+			rp.ResultFile = ""
+		}
+	}
+	d.publishReport(rp)
+	return rp
+}
+
+// moveTarget 文件移入 dir 后的路径；已有同名文件（或其结果文件）时在扩展名前加时间戳，
+// 仍重名时再加序号，避免覆盖之前导入的文件
+func moveTarget(dir, name string, now time.Time) string {
+	free := func(p string) bool {
+		_, err1 := os.Stat(p)
+		_, err2 := os.Stat(p + ResultSuffix)
+		return os.IsNotExist(err1) && os.IsNotExist(err2)
+	}
+	target := filepath.Join(dir, name)
+	if free(target) {
+		return target
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext) + "." + now.Format("20060102150405")
+	target = filepath.Join(dir, base+ext)
+	for i := 1; !free(target); i++ {
+		target = filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+	}
+	return target
+}
+
+// importFile 解析并导入；解析失败时返回的 DataTable 为 nil
+func (d *DropFolder) importFile(path string, rp *Report, opts *Options) (*query.DataTable, error) {
+	m, err := meta.AcquireMeta(rp.Entity, d.db)
+	if err != nil {
+		return nil, fmt.Errorf("entity '%s': %w", rp.Entity, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := Parse(FormatOf(path), f)
+	_ = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("parse file error: %w", err)
+	}
+	ret, dt, err := Import(d.db, m, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	rp.Result = ret
+	return dt, nil
+}
+
+func writeResultFile(path string, dt *query.DataTable) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = WriteCSV(f, dt); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (d *DropFolder) publishReport(rp *Report) {
+	typ := TypeImportDone
+	if rp.MovedTo == "" || filepath.Dir(rp.MovedTo) == filepath.Clean(d.cfg.FailedDir) {
+		typ = TypeImportFailed
+	}
+	data := map[string]interface{}{
+		"file":        rp.File,
+		"entity":      rp.Entity,
+		"mode":        rp.Mode,
+		"moved_to":    rp.MovedTo,
+		"result_file": rp.ResultFile,
+	}
+	if rp.Error != "" {
+		data["error"] = rp.Error
+	}
+	if rp.Result != nil {
+		data["total"] = rp.Result.Total
+		data["succeeded"] = rp.Result.Succeeded
+		data["invalid"] = rp.Result.Invalid
+		data["failed"] = rp.Result.Failed
+		if len(rp.Result.Errors) > 0 {
+			data["errors"] = rp.Result.Errors
+		}
+	}
+	evt := event.NewEvent(uint64(time.Now().UnixNano()), typ, "import:"+d.cfg.Dir, data)
+	if err := d.bus.Publish(context.Background(), d.cfg.ResultTopic, evt); err != nil {
+		logger.Error("publish import result failed", zap.String("file", rp.File), zap.Error(err))
+	}
+	logger.Info("file imported", zap.String("file", rp.File), zap.String("type", typ),
+		zap.String("entity", rp.Entity), zap.String("error", rp.Error))
+}
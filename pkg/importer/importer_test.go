@@ -0,0 +1,244 @@
+package importer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/event"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm"
+)
+
+// memBus 同步分发事件的内存总线
+type memBus struct {
+	mu       sync.Mutex
+	handlers map[string][]func(*event.Event) error
+	sent     map[string][]*event.Event
+}
+
+func newMemBus() *memBus {
+	return &memBus{handlers: map[string][]func(*event.Event) error{}, sent: map[string][]*event.Event{}}
+}
+
+func (b *memBus) Publish(_ context.Context, topic string, evt *event.Event) error {
+	b.mu.Lock()
+	b.sent[topic] = append(b.sent[topic], evt)
+	hs := b.handlers[topic]
+	b.mu.Unlock()
+	for _, h := range hs {
+		_ = h(evt)
+	}
+	return nil
+}
+
+func (b *memBus) Subscribe(_ context.Context, topic string, handler func(*event.Event) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], handler)
+	return nil
+}
+
+func (b *memBus) Unsubscribe(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, topic)
+	return nil
+}
+
+func (b *memBus) Close() error { return nil }
+
+func (b *memBus) events(topic string) []*event.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*event.Event(nil), b.sent[topic]...)
+}
+
+// rowLoader 逐行插入主表，行结果记录为 1
+func rowLoader(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, _ *query.WriteContext) error {
+	for i, row := range dt.Values() {
+		rec := map[string]any{}
+		for j, col := range dt.Columns() {
+			if col != query.ResultColumn {
+				rec[col] = row[j]
+			}
+		}
+		if _, err := sess.Table(m.PrimaryTable()).Insert(rec); err != nil {
+			return err
+		}
+		_ = dt.UpdateResult(i, 1)
+	}
+	return nil
+}
+
+func newTestDB(t *testing.T, entity string) *xorm.Engine {
+	db, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "import.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	require.NoError(t, meta.InitEntityTable(db))
+	_, err = db.Exec("CREATE TABLE " + entity + " (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, amount INT)")
+	require.NoError(t, err)
+	_, err = meta.RegisterEntity(db, entity, "", entity, "id")
+	require.NoError(t, err)
+	RegisterLoader("test.rows", rowLoader)
+	return db
+}
+
+func TestParse(t *testing.T) {
+	dt, err := ParseCSV(strings.NewReader("\ufeffname, amount\ntom,1\njerry,\n"), ',')
+	require.NoError(t, err)
+	assert.Equal(t, []string{"name", "amount"}, dt.Columns())
+	assert.Equal(t, [][]any{{"tom", "1"}, {"jerry", nil}}, dt.Values())
+
+	_, err = ParseCSV(strings.NewReader("name,name\n"), ',')
+	assert.ErrorContains(t, err, "duplicate column")
+
+	dt, err = Parse(FormatTSV, strings.NewReader("name\tamount\ntom\t1\n"))
+	require.NoError(t, err)
+	assert.Equal(t, [][]any{{"tom", "1"}}, dt.Values())
+
+	dt, err = ParseJSON(strings.NewReader(`[{"name":"tom","amount":1}]`))
+	require.NoError(t, err)
+	assert.Len(t, dt.Values(), 1)
+	dt, err = ParseJSON(strings.NewReader(`{"cols":["name"],"vals":[["tom"],["jerry"]]}`))
+	require.NoError(t, err)
+	assert.Len(t, dt.Values(), 2)
+}
+
+func TestResolve(t *testing.T) {
+	cfg := &DropFolderConfig{Dir: "x", Mappings: []*Mapping{{Pattern: "PAY_*.csv", Entity: "payroll", Mode: ModeUpsert}}}
+	require.NoError(t, cfg.withDefaults())
+	e, o := cfg.resolve("PAY_20240101.csv")
+	assert.Equal(t, "payroll", e)
+	assert.Equal(t, ModeUpsert, o.Mode)
+	e, o = cfg.resolve("employee__20240101.json")
+	assert.Equal(t, "employee", e)
+	assert.Equal(t, ModeInsert, o.Mode)
+	assert.Equal(t, DefaultChunkSize, o.ChunkSize)
+	e, _ = cfg.resolve("employee.csv")
+	assert.Equal(t, "employee", e)
+}
+
+func TestProcessChunks(t *testing.T) {
+	db := newTestDB(t, "import_chunk")
+	dir := t.TempDir()
+	bus := newMemBus()
+	d, err := NewDropFolder(db, bus, &DropFolderConfig{Dir: dir, Mode: "test.rows", ChunkSize: 2})
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(d.cfg.FailedDir, 0o755))
+
+	// 第三行 name 为空，校验失败不写入；第四行主键重复，所在块回滚
+	file := filepath.Join(dir, "import_chunk__night.csv")
+	require.NoError(t, os.WriteFile(file, []byte("id,name,amount\n1,tom,1\n2,jerry,2\n,,3\n2,dup,4\n"), 0o644))
+	rp := d.Process(file)
+	require.NotNil(t, rp)
+	assert.Equal(t, "import_chunk", rp.Entity)
+	assert.Equal(t, 4, rp.Result.Total)
+	assert.Equal(t, 2, rp.Result.Succeeded)
+	assert.Equal(t, 1, rp.Result.Invalid)
+	assert.Equal(t, 1, rp.Result.Failed)
+	assert.Equal(t, RowInvalid, rp.Result.Rows[2].Status)
+	assert.Equal(t, RowFailed, rp.Result.Rows[3].Status)
+	assert.Equal(t, filepath.Join(d.cfg.FailedDir, "import_chunk__night.csv"), rp.MovedTo)
+	assert.NoFileExists(t, file)
+
+	report, err := os.ReadFile(rp.ResultFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(report)), "\n")
+	require.Len(t, lines, 5)
+	assert.Equal(t, "id,name,amount,#result", lines[0])
+	assert.Equal(t, "1,tom,1,1", lines[1])
+	assert.Equal(t, ",,3,invalid: name: must not be null", lines[3])
+	assert.Contains(t, lines[4], "error:")
+
+	n, err := db.Table("import_chunk").Count()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	evs := bus.events(DefaultResultTopic)
+	require.Len(t, evs, 1)
+	assert.Equal(t, TypeImportFailed, evs[0].Type)
+	assert.NoError(t, evs[0].Validate())
+}
+
+func TestMoveTarget(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, filepath.Join(dir, "emp.csv"), moveTarget(dir, "emp.csv", now))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "emp.csv"), nil, 0o644))
+	stamped := filepath.Join(dir, "emp.20240102030405.csv")
+	assert.Equal(t, stamped, moveTarget(dir, "emp.csv", now))
+
+	// 同一秒内再次重名时加序号；只有结果文件重名也不覆盖
+	require.NoError(t, os.WriteFile(stamped+ResultSuffix, nil, 0o644))
+	assert.Equal(t, filepath.Join(dir, "emp.20240102030405-1.csv"), moveTarget(dir, "emp.csv", now))
+}
+
+func TestDropFolderWatch(t *testing.T) {
+	db := newTestDB(t, "import_watch")
+	dir := t.TempDir()
+	bus := newMemBus()
+	// 启动前已存在的文件
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing.json"), []byte(`[{"name":"a","amount":1}]`), 0o644))
+	d, err := NewDropFolder(db, bus, &DropFolderConfig{
+		Dir:      dir,
+		Mode:     "test.rows",
+		Settle:   50 * time.Millisecond,
+		Mappings: []*Mapping{{Pattern: "*.json", Entity: "import_watch"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, d.Start(context.Background()))
+	defer d.Close()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "import_watch.csv"), []byte("name,amount\nb,2\nc,3\n"), 0o644))
+	require.Eventually(t, func() bool {
+		return len(bus.events(DefaultResultTopic)) == 2
+	}, 3*time.Second, 20*time.Millisecond)
+
+	for _, ev := range bus.events(DefaultResultTopic) {
+		assert.Equal(t, TypeImportDone, ev.Type, ev.Data)
+	}
+	assert.FileExists(t, filepath.Join(dir, "done", "import_watch.csv"))
+	assert.FileExists(t, filepath.Join(dir, "done", "import_watch.csv"+ResultSuffix))
+	assert.FileExists(t, filepath.Join(dir, "done", "existing.json"))
+	n, err := db.Table("import_watch").Count()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+}
+
+func TestImportInvalidRows(t *testing.T) {
+	db := newTestDB(t, "import_coerce")
+	m, err := meta.AcquireMeta("import_coerce", db)
+	require.NoError(t, err)
+	src, err := ParseCSV(strings.NewReader("Full Name,AMOUNT,note\ntom,1,a\njerry,x2,b\nbob,3.0,c\n"), ',')
+	require.NoError(t, err)
+
+	_, _, err = Import(db, m, src, &Options{Mode: "test.rows", Aliases: map[string]string{"full name": "name"}})
+	assert.ErrorContains(t, err, "unknown column")
+
+	ret, dt, err := Import(db, m, src, &Options{Mode: "test.rows", Aliases: map[string]string{"full name": "name"}, IgnoreUnknown: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"Full Name": "name", "AMOUNT": "amount"}, ret.Columns)
+	assert.Equal(t, []string{"note"}, ret.Ignored)
+	assert.Equal(t, 3, ret.Total)
+	assert.Equal(t, 2, ret.Succeeded)
+	assert.Equal(t, 1, ret.Invalid)
+	assert.Equal(t, RowInvalid, ret.Rows[1].Status)
+	require.Len(t, ret.Rows[1].Errors, 1)
+	assert.Equal(t, 2, ret.Rows[1].Errors[0].Row)
+	assert.Equal(t, "amount", ret.Rows[1].Errors[0].Col)
+	assert.Equal(t, int64(3), dt.Values()[2][1])
+	assert.Contains(t, dt.Values()[1][2], "invalid: amount:")
+
+	_, err = Parse(FormatOf("a.xlsx"), strings.NewReader("not a zip"))
+	assert.ErrorContains(t, err, "invalid xlsx")
+}
@@ -0,0 +1,254 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"xorm.io/xorm"
+)
+
+// 写入模式
+const (
+	ModeInsert = "insert"
+	ModeUpsert = "upsert"
+)
+
+// Loader 在事务中将 dt 写入实体，并在 #result 列记录每行结果；wc 用于填充系统列
+type Loader func(sess *xorm.Session, m *meta.EntityMeta, dt *query.DataTable, wc *query.WriteContext) error
+
+var (
+	muLoader sync.RWMutex
+	loaders  = map[string]Loader{}
+)
+
+// RegisterLoader 注册写入模式；insert/upsert 由 handler 包使用 DML 的写入路径注册
+func RegisterLoader(mode string, fn Loader) {
+	muLoader.Lock()
+	defer muLoader.Unlock()
+	loaders[mode] = fn
+}
+
+func getLoader(mode string) (Loader, error) {
+	muLoader.RLock()
+	defer muLoader.RUnlock()
+	fn, ok := loaders[mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown import mode '%s'", mode)
+	}
+	return fn, nil
+}
+
+// 行状态
+const (
+	RowOK      = "ok"
+	RowInvalid = "invalid" // 类型转换或校验失败，未写入
+	RowFailed  = "failed"  // 所在块写入失败，已回滚
+)
+
+// Options 导入选项
+type Options struct {
+	Mode          string              // insert 或 upsert
+	ChunkSize     int                 // 每个事务写入的行数
+	Aliases       map[string]string   // 表头别名 -> 实体列名
+	IgnoreUnknown bool                // 忽略无法映射到实体列的表头，否则报错
+	Writer        *query.WriteContext // 填充系统列（如 created_by）使用的身份和租户
+}
+
+// RowReport 单行导入结果，Row 为数据行号（从 1 开始，不含表头）
+type RowReport struct {
+	Row    int                `json:"row"`
+	Status string             `json:"status"`
+	Result any                `json:"result,omitempty"` // 写入成功时为 #result 的值，如自增主键或影响行数
+	Errors []*query.CellError `json:"errors,omitempty"`
+}
+
+// Result 导入结果
+type Result struct {
+	Total     int               `json:"total"`
+	Succeeded int               `json:"succeeded"`
+	Invalid   int               `json:"invalid"`
+	Failed    int               `json:"failed"`
+	Errors    []string          `json:"errors,omitempty"`  // 各失败块的错误
+	Columns   map[string]string `json:"columns"`           // 表头 -> 实体列名
+	Ignored   []string          `json:"ignored,omitempty"` // 被忽略的表头
+	Rows      []*RowReport      `json:"rows"`
+}
+
+// Import 将表头映射为实体列，按列类型转换并校验后，把合法的行按 ChunkSize 分块、每块一个事务写入；
+// 校验失败的行与失败块中的行在 #result 中记录原因，返回的 DataTable 为映射后的数据
+func Import(engine *xorm.Engine, m *meta.EntityMeta, src *query.DataTable, opts *Options) (*Result, *query.DataTable, error) {
+	fn, err := getLoader(opts.Mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	dt, ret, err := MapHeaders(src, m, opts.Aliases, opts.IgnoreUnknown)
+	if err != nil {
+		return nil, nil, err
+	}
+	dt.AddResultColumn()
+	total := len(dt.Values())
+	ret.Total = total
+	ret.Rows = make([]*RowReport, total)
+	for i := range ret.Rows {
+		ret.Rows[i] = &RowReport{Row: i + 1, Status: RowOK}
+	}
+	vmode := query.ValidateUpdate
+	if opts.Mode == ModeInsert {
+		vmode = query.ValidateInsert
+		// 先填充默认值再校验，避免由默认值提供的必填列被判为缺失；upsert 在写入时按行区分
+		if err = dt.ApplyDefaults(engine, m, vmode, opts.Writer); err != nil {
+			return nil, nil, err
+		}
+	}
+	errs, err := dt.ValidateAll(engine, m, vmode)
+	if err != nil {
+		return nil, nil, err
+	}
+	ret.Invalid = dt.ReportErrors(errs)
+	for _, ce := range errs {
+		r := ret.Rows[ce.Row]
+		r.Status = RowInvalid
+		r.Errors = append(r.Errors, &query.CellError{Row: ce.Row + 1, Col: ce.Col, Message: ce.Message})
+	}
+	var valid []int
+	for i, r := range ret.Rows {
+		if r.Status != RowInvalid {
+			valid = append(valid, i)
+		}
+	}
+	resultIdx := dt.FetchColumnIndex(query.ResultColumn)
+	for start := 0; start < len(valid); start += chunkSize {
+		rows := valid[start:min(start+chunkSize, len(valid))]
+		chunk, _ := dt.SubTable(rows)
+		if err = loadChunk(engine, m, chunk, fn, opts.Writer); err != nil {
+			ret.Errors = append(ret.Errors, fmt.Sprintf("rows %d-%d: %v", rows[0]+1, rows[len(rows)-1]+1, err))
+			_ = chunk.UpdateAllWithResult("error: " + err.Error())
+			for _, i := range rows {
+				ret.Rows[i].Status = RowFailed
+			}
+			ret.Failed += len(rows)
+			continue
+		}
+		for _, i := range rows {
+			ret.Rows[i].Result = dt.Values()[i][resultIdx]
+		}
+		ret.Succeeded += len(rows)
+	}
+	return ret, dt, nil
+}
+
+// normalizeHeader 忽略大小写、首尾空白，空格与 '-' 视为 '_'
+func normalizeHeader(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(s)
+}
+
+// MapHeaders 依次按别名、列名、规范化后的列名将表头映射为实体列，返回只含映射列的新表
+func MapHeaders(src *query.DataTable, m *meta.EntityMeta, aliases map[string]string,
+	ignoreUnknown bool) (*query.DataTable, *Result, error) {
+	normCols := make(map[string]string, len(m.ColumnIndex))
+	for col := range m.ColumnIndex {
+		normCols[normalizeHeader(col)] = col
+	}
+	normAliases := make(map[string]string, len(aliases))
+	for k, v := range aliases {
+		normAliases[normalizeHeader(k)] = v
+	}
+	ret := &Result{Columns: map[string]string{}}
+	var (
+		srcIdx  []int
+		cols    []string
+		unknown []string
+		target  = map[string]string{}
+	)
+	for j, h := range src.Columns() {
+		if h == query.ResultColumn {
+			continue
+		}
+		col, ok := aliases[h]
+		if !ok {
+			col, ok = normAliases[normalizeHeader(h)]
+		}
+		if ok {
+			if _, exist := m.ColumnIndex[col]; !exist {
+				return nil, nil, fmt.Errorf("alias '%s' refers to unknown column '%s'", h, col)
+			}
+		} else if _, exist := m.ColumnIndex[h]; exist {
+			col = h
+		} else if col, ok = normCols[normalizeHeader(h)]; !ok {
+			unknown = append(unknown, h)
+			continue
+		}
+		if prev, dup := target[col]; dup {
+			return nil, nil, fmt.Errorf("headers '%s' and '%s' both map to column '%s'", prev, h, col)
+		}
+		target[col] = h
+		ret.Columns[h] = col
+		srcIdx = append(srcIdx, j)
+		cols = append(cols, col)
+	}
+	if len(unknown) > 0 {
+		if !ignoreUnknown {
+			return nil, nil, fmt.Errorf("unknown column(s) for entity '%s': %s",
+				m.Entity.EntityName, strings.Join(unknown, ", "))
+		}
+		ret.Ignored = unknown
+	}
+	if len(cols) == 0 {
+		return nil, nil, errors.New("no column can be mapped to the entity")
+	}
+	dt := query.NewDataTable()
+	dt.AddColumns(cols)
+	for i := range src.Values() {
+		row, _ := src.FetchRow(i, srcIdx, nil)
+		if err := dt.AddRow(row); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dt, ret, nil
+}
+
+// loadChunk 在一个事务中写入一块；块内写入的行在提交后才转交 wc.Written，回滚的块不产生写入记录
+func loadChunk(engine *xorm.Engine, m *meta.EntityMeta, chunk *query.DataTable, fn Loader,
+	wc *query.WriteContext) error {
+	sess := engine.NewSession()
+	defer func() {
+		_ = sess.Close()
+	}()
+	if err := sess.Begin(); err != nil {
+		return err
+	}
+	type written struct {
+		m   *meta.EntityMeta
+		op  string
+		row map[string]any
+	}
+	var rows []written
+	cwc := wc
+	if wc != nil && wc.Written != nil {
+		c := *wc
+		c.Written = func(m *meta.EntityMeta, op string, row map[string]any) {
+			rows = append(rows, written{m, op, row})
+		}
+		cwc = &c
+	}
+	if err := fn(sess, m, chunk, cwc); err != nil {
+		_ = sess.Rollback()
+		return err
+	}
+	if err := sess.Commit(); err != nil {
+		return err
+	}
+	for _, w := range rows {
+		wc.Written(w.m, w.op, w.row)
+	}
+	return nil
+}
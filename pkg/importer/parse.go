@@ -0,0 +1,190 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/xlsx"
+	"github.com/goccy/go-json"
+)
+
+// 支持的文件格式
+const (
+	FormatCSV  = "csv"
+	FormatTSV  = "tsv"
+	FormatJSON = "json"
+	FormatXLSX = "xlsx"
+)
+
+// FormatOf 按扩展名识别文件格式，不支持时返回空串
+func FormatOf(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return FormatCSV
+	case ".tsv":
+		return FormatTSV
+	case ".json":
+		return FormatJSON
+	case ".xlsx":
+		return FormatXLSX
+	}
+	return ""
+}
+
+// Parse 按格式将文件内容解析为 DataTable
+func Parse(format string, r io.Reader) (*query.DataTable, error) {
+	switch format {
+	case FormatCSV:
+		return ParseCSV(r, ',')
+	case FormatTSV:
+		return ParseCSV(r, '\t')
+	case FormatJSON:
+		return ParseJSON(r)
+	case FormatXLSX:
+		return ParseXLSX(r, "")
+	}
+	return nil, fmt.Errorf("unsupported import format '%s'", format)
+}
+
+// ParseCSV 第一行为列名，空字符串视为 NULL
+func ParseCSV(r io.Reader, comma rune) (*query.DataTable, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("empty file, header row required")
+		}
+		return nil, err
+	}
+	dt, err := newTableWithHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		rec, err1 := cr.Read()
+		if errors.Is(err1, io.EOF) {
+			break
+		}
+		if err1 != nil {
+			return nil, err1
+		}
+		if err1 = addTextRow(dt, rec); err1 != nil {
+			return nil, err1
+		}
+	}
+	return dt, nil
+}
+
+// ParseXLSX 读取工作表 sheet（为空时为第一个），第一行为列名，空单元格视为 NULL，空行忽略
+func ParseXLSX(r io.Reader, sheet string) (*query.DataTable, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := xlsx.ReadBytes(data, sheet)
+	if err != nil {
+		return nil, err
+	}
+	if len(sh.Rows) == 0 {
+		return nil, errors.New("empty sheet, header row required")
+	}
+	dt, err := newTableWithHeader(sh.Rows[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range sh.Rows[1:] {
+		if strings.Join(rec, "") == "" {
+			continue
+		}
+		if len(rec) > len(dt.Columns()) {
+			return nil, fmt.Errorf("row has %d cells, more than %d headers", len(rec), len(dt.Columns()))
+		}
+		rec = append(rec, make([]string, len(dt.Columns())-len(rec))...)
+		if err = addTextRow(dt, rec); err != nil {
+			return nil, err
+		}
+	}
+	return dt, nil
+}
+
+func addTextRow(dt *query.DataTable, rec []string) error {
+	row := make([]any, len(rec))
+	for i, v := range rec {
+		if v != "" {
+			row[i] = v
+		}
+	}
+	return dt.AddRow(row)
+}
+
+func newTableWithHeader(header []string) (*query.DataTable, error) {
+	dt := query.NewDataTable()
+	for i, col := range header {
+		col = strings.TrimSpace(col)
+		if i == 0 {
+			col = strings.TrimPrefix(col, "\ufeff") // UTF-8 BOM
+		}
+		if col == "" {
+			return nil, fmt.Errorf("column %d has an empty header", i+1)
+		}
+		if dt.FetchColumnIndex(col) >= 0 {
+			return nil, fmt.Errorf("duplicate column '%s'", col)
+		}
+		dt.AddColumn(col)
+	}
+	return dt, nil
+}
+
+// ParseJSON 支持对象数组 [{...}] 或与 /entity/dm 相同的 {"cols":[], "vals":[]} 格式
+func ParseJSON(r io.Reader) (*query.DataTable, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	dt := query.NewDataTable()
+	if len(data) > 0 && data[0] == '[' {
+		var vals []any
+		if err = json.Unmarshal(data, &vals); err != nil {
+			return nil, fmt.Errorf("json unmarshal error: %v", err)
+		}
+		err = dt.ParseKeyVals(map[string]any{query.KeyVals: vals})
+	} else {
+		err = dt.ParseValues(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dt, nil
+}
+
+// WriteCSV 将 DataTable（包括 #result 列）写为 CSV
+func WriteCSV(w io.Writer, dt *query.DataTable) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(dt.Columns()); err != nil {
+		return err
+	}
+	rec := make([]string, len(dt.Columns()))
+	for _, row := range dt.Values() {
+		for i, v := range row {
+			if v == nil {
+				rec[i] = ""
+			} else {
+				rec[i] = fmt.Sprintf("%v", v)
+			}
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
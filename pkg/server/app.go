@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/event"
+	"github.com/everpan/idig/pkg/importer"
+	"github.com/everpan/idig/pkg/workflow"
+)
+
+// AppInit 以默认租户的数据库创建应用的事件总线（按配置包装 schema 校验）并登记，
+// 随后启动订阅该总线的工作流引擎，配置了 import.drop.dir 时启动投递目录导入；
+// 返回的 stop 在服务退出时按相反顺序释放
+func AppInit(ctx context.Context) (stop func(), err error) {
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	if err != nil {
+		return nil, err
+	}
+	bus, err := event.NewEventBus(engine)
+	if err != nil {
+		return nil, err
+	}
+	event.RegisterBus(engine, bus)
+	closers := []func(){func() {
+		event.RegisterBus(engine, nil)
+		_ = bus.Close()
+	}}
+	stop = func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	wf := workflow.NewEngine(engine, bus)
+	closers = append(closers, func() { _ = wf.Stop() })
+	if err = wf.Start(ctx); err != nil {
+		stop()
+		return nil, err
+	}
+	if cfg := importer.ConfiguredDropFolder(); cfg != nil {
+		df, err := importer.NewDropFolder(engine, bus, cfg)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		closers = append(closers, func() { _ = df.Close() })
+		if err = df.Start(ctx); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+	return stop, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/everpan/idig/pkg/config"
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/event"
+	"github.com/everpan/idig/pkg/event/schema"
+	_ "github.com/everpan/idig/pkg/handler"
+	"github.com/everpan/idig/pkg/workflow"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm"
+)
+
+// setupApp 以临时 sqlite 库作为默认租户执行 AppInit
+func setupApp(t *testing.T) *xorm.Engine {
+	viper.Set("tenant.default.driver", "sqlite3")
+	viper.Set("tenant.default.data-source", filepath.Join(t.TempDir(), "app.db"))
+	require.NoError(t, core.ReloadTenantConfig())
+	stop, err := AppInit(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(stop)
+	engine, err := core.GetEngine(core.DefaultTenant.Driver, core.DefaultTenant.DataSource)
+	require.NoError(t, err)
+	return engine
+}
+
+func TestAppInit_validatesEvents(t *testing.T) {
+	engine := setupApp(t)
+	require.NoError(t, schema.Default().RegisterJSON("app.test.created", 1, []byte(`{"type":"object","required":["k"]}`)))
+	bus := event.BusOf(engine)
+	require.NotNil(t, bus)
+
+	ctx := context.Background()
+	err := bus.Publish(ctx, "app.test", event.NewEvent(1, "app.test.created", "test", map[string]any{}))
+	assert.ErrorContains(t, err, "data.k: is required")
+	assert.NoError(t, bus.Publish(ctx, "app.test", event.NewEvent(2, "app.test.created", "test", map[string]any{"k": 1})))
+}
+
+type AppStu struct {
+	Idx  uint32 `xorm:"pk autoincr"`
+	Name string `xorm:"varchar(64)"`
+}
+
+// 经 DML 写入的实体发布 <实体名>.inserted 事件，由启动时运行的工作流引擎执行规则
+func TestAppInit_workflowOnInsert(t *testing.T) {
+	engine := setupApp(t)
+	require.NoError(t, engine.Sync2(new(AppStu)))
+	_, err := meta.RegisterEntity(engine, "app_stu", "", "app_stu", "idx")
+	require.NoError(t, err)
+	require.NoError(t, workflow.CreateRule(engine, &workflow.Rule{
+		RuleName:  "stu_inserted",
+		EventType: "app_stu.inserted",
+		Actions: []*workflow.Action{{Type: workflow.ActionPublish, EventType: "app_stu.greeted",
+			Values: map[string]any{"name": "${data.name}"}}},
+	}))
+	require.NoError(t, workflow.Notify(engine))
+
+	app := core.CreateApp()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/entity/dm/app_stu",
+		strings.NewReader(`{"cols":["name"],"vals":[["s1"]]}`))
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	require.Contains(t, string(body), `"code":0`)
+
+	var execs []*workflow.Execution
+	require.Eventually(t, func() bool {
+		execs, err = workflow.ListExecutions(engine, &workflow.ExecutionFilter{RuleName: "stu_inserted"})
+		return err == nil && len(execs) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, workflow.ExecStatusSuccess, execs[0].Status)
+	assert.Equal(t, "app_stu.inserted", execs[0].EventType)
+}
+
+// 配置了 import.drop.dir 时启动投递目录，投递的文件导入到实体
+func TestAppInit_dropFolder(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(t.TempDir(), "idig.yaml")
+	require.NoError(t, os.WriteFile(cfgFile, []byte("import:\n  drop:\n    dir: "+dir+"\n    settle: 50ms\n"), 0o644))
+	viper.SetConfigFile(cfgFile)
+	require.NoError(t, config.ReloadConfig())
+	t.Cleanup(func() {
+		viper.Set("import.drop.dir", "")
+		_ = config.ReloadConfig()
+	})
+	engine := setupApp(t)
+	require.NoError(t, engine.Sync2(new(AppStu)))
+	_, err := meta.RegisterEntity(engine, "app_stu", "", "app_stu", "idx")
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app_stu.csv"), []byte("name\ns1\ns2\n"), 0o644))
+	require.Eventually(t, func() bool {
+		n, err := engine.Table("app_stu").Count()
+		return err == nil && n == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "done", "app_stu.csv"))
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+type AppAudit struct {
+	Idx       uint32 `xorm:"pk autoincr"`
+	Name      string `xorm:"varchar(64)"`
+	CreatedBy string `xorm:"varchar(64)"`
+}
+
+// 经认证中间件写入的身份填充 created_by，未认证时为 core.AnonymousPrincipal，令牌无效时拒绝
+func TestAppInit_auditPrincipal(t *testing.T) {
+	engine := setupApp(t)
+	viper.Set("auth.tokens", []map[string]any{{"token": "Tk-Alice", "principal": "alice"}})
+	require.NoError(t, core.ReloadAuthConfig())
+	t.Cleanup(func() {
+		viper.Set("auth.tokens", nil)
+		_ = core.ReloadAuthConfig()
+	})
+	require.NoError(t, engine.Sync2(new(AppAudit)))
+	_, err := meta.RegisterEntity(engine, "app_audit", "", "app_audit", "idx")
+	require.NoError(t, err)
+	require.NoError(t, meta.SetColumnDefault(engine, "app_audit",
+		&meta.ColumnDefault{Column: "created_by", Generator: meta.GenPrincipal, OnInsert: true, Override: true}))
+
+	app := core.CreateApp()
+	insert := func(name, auth string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/entity/dm/app_audit",
+			strings.NewReader(`{"cols":["name"],"vals":[["`+name+`"]]}`))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := app.Test(req, -1)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	code, body := insert("a", "Bearer Tk-Alice")
+	require.Equal(t, http.StatusOK, code, body)
+	code, body = insert("b", "")
+	require.Equal(t, http.StatusOK, code, body)
+	code, body = insert("c", "Bearer tk-alice")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Contains(t, body, "invalid authorization token")
+
+	var rows []*AppAudit
+	require.NoError(t, engine.Asc("idx").Find(&rows))
+	require.Len(t, rows, 2)
+	assert.Equal(t, "alice", rows[0].CreatedBy)
+	assert.Equal(t, core.AnonymousPrincipal, rows[1].CreatedBy)
+}
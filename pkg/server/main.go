@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/everpan/idig/pkg/config"
 	"github.com/everpan/idig/pkg/core"
 	_ "github.com/everpan/idig/pkg/event"
+	_ "github.com/everpan/idig/pkg/event/database"
+	_ "github.com/everpan/idig/pkg/event/kafka"
+	_ "github.com/everpan/idig/pkg/event/schema"
 	_ "github.com/everpan/idig/pkg/handler"
 	"github.com/spf13/viper"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var hostPort = ":9090"
@@ -24,7 +31,17 @@ func main() {
 	_ = viper.SafeWriteConfigAs("./idig.yaml")
 	_ = config.ReloadConfig()
 	// 启动之初，将以 tenant.default 的 db信息作为整个系统的信息，进行初始化
-	// AppInit()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	stop, err := AppInit(ctx)
+	if err != nil {
+		panic(fmt.Errorf("app init failed: %w", err))
+	}
+	defer stop()
 	app := core.CreateApp()
+	go func() {
+		<-ctx.Done()
+		_ = app.Shutdown()
+	}()
 	_ = app.Listen(hostPort)
 }
@@ -0,0 +1,250 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/everpan/idig/pkg/config"
+	"github.com/everpan/idig/pkg/event"
+	"github.com/goccy/go-json"
+	"github.com/spf13/viper"
+	"xorm.io/xorm"
+)
+
+// 内置动作类型
+const (
+	ActionInsert  = "insert"  // 通过 DML 插入实体
+	ActionUpdate  = "update"  // 通过 DML 按主键更新实体
+	ActionPublish = "publish" // 发布新的事件
+	ActionWebhook = "webhook" // 调用本地 webhook
+)
+
+// Action 规则动作；Values 中形如 ${data.name}、${event.id} 的字符串会被替换为事件中的值
+type Action struct {
+	Type      string            `json:"type"`
+	Entity    string            `json:"entity,omitempty"`
+	Values    map[string]any    `json:"values,omitempty"`
+	Topic     string            `json:"topic,omitempty"`
+	EventType string            `json:"event_type,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Method    string            `json:"method,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// ActionContext 动作执行上下文
+type ActionContext struct {
+	Ctx   context.Context
+	DB    *xorm.Engine
+	Bus   event.EventBus
+	Rule  *Rule
+	Event *event.Event
+}
+
+// ActionExecutor 执行动作，values 为替换模板后的值，返回值记录到执行历史
+type ActionExecutor func(ac *ActionContext, a *Action, values map[string]any) (any, error)
+
+var (
+	muExecutor sync.RWMutex
+	executors  = map[string]ActionExecutor{}
+)
+
+// RegisterActionExecutor 注册动作类型；DML 动作由 handler 包注册，避免循环依赖
+func RegisterActionExecutor(typ string, fn ActionExecutor) {
+	muExecutor.Lock()
+	defer muExecutor.Unlock()
+	executors[typ] = fn
+}
+
+func getActionExecutor(typ string) (ActionExecutor, bool) {
+	muExecutor.RLock()
+	defer muExecutor.RUnlock()
+	fn, ok := executors[typ]
+	return fn, ok
+}
+
+var webhookAllowHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+func init() {
+	RegisterActionExecutor(ActionPublish, publishAction)
+	RegisterActionExecutor(ActionWebhook, webhookAction)
+	viper.SetDefault("workflow.webhook.allow-hosts", webhookAllowHosts)
+	config.RegisterReloadConfigFunc(func() error {
+		webhookAllowHosts = viper.GetStringSlice("workflow.webhook.allow-hosts")
+		return nil
+	})
+}
+
+// Verify 校验动作定义
+func (a *Action) Verify() error {
+	if _, ok := getActionExecutor(a.Type); !ok {
+		return fmt.Errorf("unknown action type '%s'", a.Type)
+	}
+	switch a.Type {
+	case ActionInsert, ActionUpdate:
+		if a.Entity == "" {
+			return fmt.Errorf("action %s requires entity", a.Type)
+		}
+		if len(a.Values) == 0 {
+			return fmt.Errorf("action %s requires values", a.Type)
+		}
+	case ActionPublish:
+		if a.EventType == "" {
+			return errors.New("action publish requires event_type")
+		}
+	case ActionWebhook:
+		return checkLocalURL(a.URL)
+	}
+	return nil
+}
+
+// checkLocalURL webhook 只允许调用本机或配置中允许的主机
+func checkLocalURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook url scheme must be http or https")
+	}
+	host := u.Hostname()
+	if slices.Contains(webhookAllowHosts, host) {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("webhook host '%s' is not allowed", host)
+}
+
+var templateRe = regexp.MustCompile(`\$\{([^}]+)}`)
+
+// resolveValues 替换 values 中的 ${...} 模板；整个字符串仅为一个模板时保留原始类型
+func resolveValues(values map[string]any, evt *event.Event) map[string]any {
+	if values == nil {
+		return nil
+	}
+	ret := make(map[string]any, len(values))
+	for k, v := range values {
+		ret[k] = resolveValue(v, evt)
+	}
+	return ret
+}
+
+func resolveValue(v any, evt *event.Event) any {
+	switch t := v.(type) {
+	case string:
+		if m := templateRe.FindStringSubmatch(t); m != nil && m[0] == t {
+			return lookupTemplate(strings.TrimSpace(m[1]), evt)
+		}
+		return templateRe.ReplaceAllStringFunc(t, func(s string) string {
+			val := lookupTemplate(strings.TrimSpace(s[2:len(s)-1]), evt)
+			if val == nil {
+				return ""
+			}
+			return fmt.Sprintf("%v", val)
+		})
+	case map[string]any:
+		return resolveValues(t, evt)
+	case []any:
+		ret := make([]any, len(t))
+		for i, e := range t {
+			ret[i] = resolveValue(e, evt)
+		}
+		return ret
+	}
+	return v
+}
+
+func lookupTemplate(path string, evt *event.Event) any {
+	switch path {
+	case "event.id":
+		return evt.ID
+	case "event.type":
+		return evt.Type
+	case "event.source":
+		return evt.Source
+	case "event.topic":
+		return evt.Topic
+	case "event.timestamp":
+		return evt.Timestamp
+	}
+	if !strings.HasPrefix(path, "data.") {
+		return nil
+	}
+	var cur any = evt.Data
+	for _, p := range strings.Split(strings.TrimPrefix(path, "data."), ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil
+		}
+		cur = m[p]
+	}
+	return cur
+}
+
+func publishAction(ac *ActionContext, a *Action, values map[string]any) (any, error) {
+	if ac.Bus == nil {
+		return nil, errors.New("no event bus for publish action")
+	}
+	if values == nil {
+		values = map[string]any{}
+	}
+	topic := a.Topic
+	if topic == "" {
+		topic = a.EventType
+	}
+	evt := event.NewEvent(uint64(time.Now().UnixNano()), a.EventType, "workflow:"+ac.Rule.RuleName, values)
+	if err := ac.Bus.Publish(ac.Ctx, topic, evt); err != nil {
+		return nil, err
+	}
+	return map[string]any{"event_id": evt.ID, "topic": topic}, nil
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func webhookAction(ac *ActionContext, a *Action, values map[string]any) (any, error) {
+	if err := checkLocalURL(a.URL); err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]any{
+		"rule":   ac.Rule.RuleName,
+		"event":  ac.Event,
+		"values": values,
+	})
+	if err != nil {
+		return nil, err
+	}
+	method := a.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ac.Ctx, method, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range a.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("webhook returned %d: %s", resp.StatusCode, respBody)
+	}
+	return map[string]any{"status": resp.StatusCode, "body": string(respBody)}, nil
+}
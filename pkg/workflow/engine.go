@@ -0,0 +1,170 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/event"
+	"go.uber.org/zap"
+	"xorm.io/xorm"
+)
+
+var logger = core.GetLogger()
+
+// Engine 订阅规则涉及的 topic，收到事件后求值条件并执行动作
+type Engine struct {
+	db     *xorm.Engine
+	bus    event.EventBus
+	ctx    context.Context
+	mu     sync.Mutex
+	topics map[string]struct{}
+}
+
+// 按数据源记录运行中的引擎，规则变更后通过 Notify 订阅新 topic
+var engines sync.Map
+
+func NewEngine(db *xorm.Engine, bus event.EventBus) *Engine {
+	return &Engine{
+		db:     db,
+		bus:    bus,
+		topics: make(map[string]struct{}),
+	}
+}
+
+// Start 订阅所有启用规则的 topic
+func (e *Engine) Start(ctx context.Context) error {
+	if err := InitWorkflowTable(e.db); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.ctx = ctx
+	e.mu.Unlock()
+	engines.Store(meta.DataSourceHash(e.db.DataSourceName()), e)
+	return e.Sync()
+}
+
+// Stop 取消所有订阅
+func (e *Engine) Stop() error {
+	engines.Delete(meta.DataSourceHash(e.db.DataSourceName()))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for topic := range e.topics {
+		if err := e.bus.Unsubscribe(topic); err != nil {
+			return err
+		}
+		delete(e.topics, topic)
+	}
+	return nil
+}
+
+// Sync 为新增规则的 topic 建立订阅；已订阅的 topic 每次事件到达时都会重新读取规则，无需重复订阅
+func (e *Engine) Sync() error {
+	rules, err := ListRules(e.db, "")
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range rules {
+		if r.Status != RuleStatusEnabled {
+			continue
+		}
+		topic := r.SubscribeTopic()
+		if _, ok := e.topics[topic]; ok {
+			continue
+		}
+		if err = e.bus.Subscribe(e.ctx, topic, e.handler(topic)); err != nil {
+			return fmt.Errorf("subscribe topic '%s' failed: %w", topic, err)
+		}
+		e.topics[topic] = struct{}{}
+	}
+	return nil
+}
+
+// Notify 通知该数据源上运行中的引擎同步订阅
+func Notify(db *xorm.Engine) error {
+	if v, ok := engines.Load(meta.DataSourceHash(db.DataSourceName())); ok {
+		return v.(*Engine).Sync()
+	}
+	return nil
+}
+
+func (e *Engine) handler(topic string) func(*event.Event) error {
+	return func(evt *event.Event) error {
+		if evt.Topic == "" {
+			evt.Topic = topic
+		}
+		return e.HandleEvent(evt)
+	}
+}
+
+// HandleEvent 对事件执行所有匹配的规则；单个规则失败只记录在执行历史中，不影响事件的确认
+func (e *Engine) HandleEvent(evt *event.Event) error {
+	rules, err := matchRules(e.db, evt.Topic, evt.Type)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		exec, matched := e.execute(r, evt)
+		if !matched {
+			continue
+		}
+		if _, err = e.db.Insert(exec); err != nil {
+			logger.Error("save workflow execution failed", zap.String("rule", r.RuleName), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// execute 求值条件并执行动作，条件不满足时不产生执行记录
+func (e *Engine) execute(r *Rule, evt *event.Event) (*Execution, bool) {
+	exec := &Execution{
+		RuleIdx:   r.RuleIdx,
+		RuleName:  r.RuleName,
+		EventId:   evt.ID,
+		EventType: evt.Type,
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		exec.Duration = time.Since(exec.StartedAt).Milliseconds()
+	}()
+
+	if len(r.Condition) > 0 {
+		ok, err := query.MatchWheres(r.Condition, evt.Data)
+		if err != nil {
+			exec.Status, exec.Error = ExecStatusFailed, fmt.Sprintf("condition: %v", err)
+			return exec, true
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+
+	ctx := e.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ac := &ActionContext{Ctx: ctx, DB: e.db, Bus: e.bus, Rule: r, Event: evt}
+	for i, a := range r.Actions {
+		fn, ok := getActionExecutor(a.Type)
+		if !ok {
+			exec.Status, exec.Error = ExecStatusFailed, fmt.Sprintf("action %d: unknown action type '%s'", i, a.Type)
+			return exec, true
+		}
+		ret, err := fn(ac, a, resolveValues(a.Values, evt))
+		if err != nil {
+			exec.Status, exec.Error = ExecStatusFailed, fmt.Sprintf("action %d (%s): %v", i, a.Type, err)
+			logger.Warn("workflow action failed", zap.String("rule", r.RuleName),
+				zap.Uint64("event", evt.ID), zap.Int("action", i), zap.Error(err))
+			return exec, true
+		}
+		exec.Results = append(exec.Results, ret)
+	}
+	exec.Status = ExecStatusSuccess
+	return exec, true
+}
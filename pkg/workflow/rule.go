@@ -0,0 +1,240 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/everpan/idig/pkg/core"
+	"github.com/everpan/idig/pkg/entity/meta"
+	"github.com/everpan/idig/pkg/entity/query"
+	"xorm.io/xorm"
+)
+
+// Rule status constants
+const (
+	RuleStatusEnabled  = 1
+	RuleStatusDisabled = 2
+)
+
+// Execution status constants
+const (
+	ExecStatusSuccess = "success"
+	ExecStatusFailed  = "failed"
+)
+
+// AnyEventType 规则监听 topic 上的所有事件类型
+const AnyEventType = "*"
+
+// Common errors
+var (
+	ErrRuleNotFound = errors.New("rule not found")
+)
+
+// Rule 事件驱动规则：监听 topic 上指定类型的事件，条件满足时依次执行动作
+type Rule struct {
+	RuleIdx     uint32         `json:"rule_idx" xorm:"pk autoincr"`
+	RuleName    string         `json:"rule_name" xorm:"unique notnull"`
+	Description string         `json:"desc" xorm:"desc_str"`
+	Topic       string         `json:"topic" xorm:"index"` // 订阅的 topic，为空时与 EventType 相同
+	EventType   string         `json:"event_type" xorm:"index notnull"`
+	Condition   []*query.Where `json:"condition,omitempty" xorm:"text"` // 与 query.Where 相同的条件，作用于 Event.Data
+	Actions     []*Action      `json:"actions" xorm:"text"`
+	Status      int            `json:"status" xorm:"default 1"` // RuleStatusEnabled or RuleStatusDisabled
+	UpdatedAt   time.Time      `json:"updated_at" xorm:"updated"`
+}
+
+func (r *Rule) TableName() string {
+	return "idig_workflow_rule"
+}
+
+// SubscribeTopic 规则实际订阅的 topic
+func (r *Rule) SubscribeTopic() string {
+	if r.Topic != "" {
+		return r.Topic
+	}
+	return r.EventType
+}
+
+// Verify 校验规则定义
+func (r *Rule) Verify() error {
+	if r.RuleName == "" {
+		return errors.New("rule name is required")
+	}
+	if r.EventType == "" {
+		return errors.New("rule event_type is required")
+	}
+	if r.EventType == AnyEventType && r.Topic == "" {
+		return errors.New("rule topic is required when event_type is '*'")
+	}
+	if r.Status == 0 {
+		r.Status = RuleStatusEnabled
+	}
+	if r.Status != RuleStatusEnabled && r.Status != RuleStatusDisabled {
+		return fmt.Errorf("invalid rule status %d", r.Status)
+	}
+	if len(r.Condition) > 0 {
+		if err := query.VerifyWhere(r.Condition); err != nil {
+			return fmt.Errorf("invalid condition: %w", err)
+		}
+		// 对空数据求值一次，提前发现内存中无法求值的操作符
+		if _, err := query.MatchWheres(r.Condition, map[string]any{}); err != nil {
+			return fmt.Errorf("invalid condition: %w", err)
+		}
+	}
+	if len(r.Actions) == 0 {
+		return errors.New("rule actions are required")
+	}
+	for i, a := range r.Actions {
+		if err := a.Verify(); err != nil {
+			return fmt.Errorf("action %d: %w", i, err)
+		}
+		if a.Type == ActionPublish && a.EventType == r.EventType &&
+			(a.Topic == "" || a.Topic == r.SubscribeTopic()) {
+			return fmt.Errorf("action %d: publishing '%s' would trigger the rule itself", i, a.EventType)
+		}
+	}
+	return nil
+}
+
+// Execution 规则执行记录
+type Execution struct {
+	ExecIdx   uint64    `json:"exec_idx" xorm:"pk autoincr"`
+	RuleIdx   uint32    `json:"rule_idx" xorm:"index"`
+	RuleName  string    `json:"rule_name" xorm:"index"`
+	EventId   uint64    `json:"event_id" xorm:"index"`
+	EventType string    `json:"event_type"`
+	Status    string    `json:"status" xorm:"index"` // ExecStatusSuccess or ExecStatusFailed
+	Error     string    `json:"error,omitempty" xorm:"text"`
+	Results   []any     `json:"results,omitempty" xorm:"text"` // 各动作的返回
+	StartedAt time.Time `json:"started_at" xorm:"index"`
+	Duration  int64     `json:"duration_ms"`
+}
+
+func (e *Execution) TableName() string {
+	return "idig_workflow_execution"
+}
+
+func InitWorkflowTable(engine *xorm.Engine) error {
+	if err := engine.Sync2(new(Rule), new(Execution)); err != nil {
+		return err
+	}
+	// 注册为实体后，可通过 /entity/dq 查询规则与执行历史
+	_, _ = meta.RegisterEntity(engine, "workflow_rule", "工作流规则", (&Rule{}).TableName(), "rule_idx")
+	_, _ = meta.RegisterEntity(engine, "workflow_execution", "工作流执行记录", (&Execution{}).TableName(), "exec_idx")
+	return nil
+}
+
+func init() {
+	core.RegisterInitTableFunction(InitWorkflowTable)
+}
+
+// CreateRule 新建规则
+func CreateRule(engine *xorm.Engine, r *Rule) error {
+	if err := r.Verify(); err != nil {
+		return err
+	}
+	r.RuleIdx = 0
+	_, err := engine.Insert(r)
+	return err
+}
+
+// UpdateRule 按规则名更新
+func UpdateRule(engine *xorm.Engine, name string, r *Rule) error {
+	old, err := GetRule(engine, name)
+	if err != nil {
+		return err
+	}
+	if r.RuleName == "" {
+		r.RuleName = name
+	}
+	if err = r.Verify(); err != nil {
+		return err
+	}
+	r.RuleIdx = old.RuleIdx
+	_, err = engine.ID(old.RuleIdx).AllCols().Update(r)
+	return err
+}
+
+// DeleteRule 按规则名删除，执行历史保留
+func DeleteRule(engine *xorm.Engine, name string) error {
+	af, err := engine.Where("rule_name = ?", name).Delete(new(Rule))
+	if err != nil {
+		return err
+	}
+	if af == 0 {
+		return fmt.Errorf("%w: '%s'", ErrRuleNotFound, name)
+	}
+	return nil
+}
+
+// GetRule 按规则名查询
+func GetRule(engine *xorm.Engine, name string) (*Rule, error) {
+	r := &Rule{}
+	ok, err := engine.Where("rule_name = ?", name).Get(r)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrRuleNotFound, name)
+	}
+	return r, nil
+}
+
+// ListRules 列出规则，eventType 为空时返回全部
+func ListRules(engine *xorm.Engine, eventType string) ([]*Rule, error) {
+	var rules []*Rule
+	sess := engine.OrderBy("rule_idx")
+	if eventType != "" {
+		sess = sess.Where("event_type = ?", eventType)
+	}
+	err := sess.Find(&rules)
+	return rules, err
+}
+
+// matchRules 查询 topic 上匹配事件类型的启用规则
+func matchRules(engine *xorm.Engine, topic, eventType string) ([]*Rule, error) {
+	var rules []*Rule
+	err := engine.Where("status = ? AND (event_type = ? OR event_type = ?)",
+		RuleStatusEnabled, eventType, AnyEventType).OrderBy("rule_idx").Find(&rules)
+	if err != nil {
+		return nil, err
+	}
+	ret := rules[:0]
+	for _, r := range rules {
+		if r.SubscribeTopic() == topic {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// ExecutionFilter 执行历史查询条件
+type ExecutionFilter struct {
+	RuleName string
+	EventId  uint64
+	Status   string
+	Limit    int
+	Offset   int
+}
+
+// ListExecutions 按时间倒序查询执行历史
+func ListExecutions(engine *xorm.Engine, f *ExecutionFilter) ([]*Execution, error) {
+	sess := engine.OrderBy("exec_idx DESC")
+	if f.RuleName != "" {
+		sess = sess.And("rule_name = ?", f.RuleName)
+	}
+	if f.EventId != 0 {
+		sess = sess.And("event_id = ?", f.EventId)
+	}
+	if f.Status != "" {
+		sess = sess.And("status = ?", f.Status)
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	var execs []*Execution
+	err := sess.Limit(limit, f.Offset).Find(&execs)
+	return execs, err
+}
@@ -0,0 +1,210 @@
+package workflow
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/everpan/idig/pkg/entity/query"
+	"github.com/everpan/idig/pkg/event"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"xorm.io/xorm"
+)
+
+// memBus 同步分发事件的内存总线
+type memBus struct {
+	mu       sync.Mutex
+	handlers map[string][]func(*event.Event) error
+	sent     []*event.Event
+}
+
+func newMemBus() *memBus {
+	return &memBus{handlers: map[string][]func(*event.Event) error{}}
+}
+
+func (b *memBus) Publish(_ context.Context, topic string, evt *event.Event) error {
+	b.mu.Lock()
+	evt.Topic = topic
+	b.sent = append(b.sent, evt)
+	hs := b.handlers[topic]
+	b.mu.Unlock()
+	for _, h := range hs {
+		_ = h(evt)
+	}
+	return nil
+}
+
+func (b *memBus) Subscribe(_ context.Context, topic string, handler func(*event.Event) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], handler)
+	return nil
+}
+
+func (b *memBus) Unsubscribe(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, topic)
+	return nil
+}
+
+func (b *memBus) Close() error { return nil }
+
+func newTestEngine(t *testing.T) (*xorm.Engine, *memBus, *Engine) {
+	db, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "workflow.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	bus := newMemBus()
+	e := NewEngine(db, bus)
+	require.NoError(t, e.Start(context.Background()))
+	t.Cleanup(func() { _ = e.Stop() })
+	return db, bus, e
+}
+
+func TestRuleVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		err  string
+	}{
+		{"no name", Rule{EventType: "a"}, "name is required"},
+		{"no actions", Rule{RuleName: "r", EventType: "a"}, "actions are required"},
+		{"unknown action", Rule{RuleName: "r", EventType: "a", Actions: []*Action{{Type: "nope"}}}, "unknown action type"},
+		{"wildcard without topic", Rule{RuleName: "r", EventType: "*"}, "topic is required"},
+		{"remote webhook", Rule{RuleName: "r", EventType: "a",
+			Actions: []*Action{{Type: ActionWebhook, URL: "http://example.com/hook"}}}, "not allowed"},
+		{"self trigger", Rule{RuleName: "r", EventType: "a",
+			Actions: []*Action{{Type: ActionPublish, EventType: "a"}}}, "trigger the rule itself"},
+		{"bad condition", Rule{RuleName: "r", EventType: "a",
+			Condition: []*query.Where{{Col: "x", Op: "nope"}},
+			Actions:   []*Action{{Type: ActionPublish, EventType: "b"}}}, "invalid condition"},
+		{"ok", Rule{RuleName: "r", EventType: "a",
+			Actions: []*Action{{Type: ActionWebhook, URL: "http://127.0.0.1:8080/hook"}}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Verify()
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestResolveValues(t *testing.T) {
+	evt := event.NewEvent(7, "order.created", "test", map[string]any{
+		"amount": float64(12),
+		"user":   map[string]any{"name": "tom"},
+	})
+	got := resolveValues(map[string]any{
+		"amount":  "${data.amount}",
+		"title":   "order ${event.id} by ${data.user.name}",
+		"missing": "${data.none}",
+		"nested":  []any{"${event.type}", 1},
+	}, evt)
+	assert.Equal(t, float64(12), got["amount"])
+	assert.Equal(t, "order 7 by tom", got["title"])
+	assert.Nil(t, got["missing"])
+	assert.Equal(t, []any{"order.created", 1}, got["nested"])
+}
+
+func TestEngineExecutesMatchingRules(t *testing.T) {
+	db, bus, _ := newTestEngine(t)
+
+	var mu sync.Mutex
+	var calls []map[string]any
+	RegisterActionExecutor("test.record", func(ac *ActionContext, a *Action, values map[string]any) (any, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, values)
+		return len(calls), nil
+	})
+
+	require.NoError(t, CreateRule(db, &Rule{
+		RuleName:  "big-order",
+		EventType: "order.created",
+		Condition: []*query.Where{{Col: "amount", Op: "gt", Val: 100}},
+		Actions: []*Action{
+			{Type: "test.record", Values: map[string]any{"id": "${event.id}", "amount": "${data.amount}"}},
+			{Type: ActionPublish, EventType: "order.big", Values: map[string]any{"order": "${event.id}"}},
+		},
+	}))
+	require.NoError(t, Notify(db))
+
+	ctx := context.Background()
+	require.NoError(t, bus.Publish(ctx, "order.created", event.NewEvent(1, "order.created", "test", map[string]any{"amount": 50})))
+	require.NoError(t, bus.Publish(ctx, "order.created", event.NewEvent(2, "order.created", "test", map[string]any{"amount": 500})))
+	require.NoError(t, bus.Publish(ctx, "order.created", event.NewEvent(3, "order.paid", "test", map[string]any{"amount": 500})))
+
+	assert.Equal(t, []map[string]any{{"id": uint64(2), "amount": 500}}, calls)
+	require.Len(t, bus.sent, 4)
+	// publish 动作在处理事件 2 时同步发出
+	assert.Equal(t, "order.big", bus.sent[2].Type)
+	assert.Equal(t, "workflow:big-order", bus.sent[2].Source)
+	assert.Equal(t, uint64(2), bus.sent[2].Data["order"])
+
+	execs, err := ListExecutions(db, &ExecutionFilter{RuleName: "big-order"})
+	require.NoError(t, err)
+	require.Len(t, execs, 1)
+	assert.Equal(t, ExecStatusSuccess, execs[0].Status)
+	assert.Equal(t, uint64(2), execs[0].EventId)
+	assert.Len(t, execs[0].Results, 2)
+}
+
+func TestEngineRecordsFailures(t *testing.T) {
+	db, bus, _ := newTestEngine(t)
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		body, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(body), `"rule":"hook"`)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	require.NoError(t, CreateRule(db, &Rule{
+		RuleName:  "hook",
+		Topic:     "orders",
+		EventType: AnyEventType,
+		Actions:   []*Action{{Type: ActionWebhook, URL: srv.URL}},
+	}))
+	require.NoError(t, Notify(db))
+	require.NoError(t, bus.Publish(context.Background(), "orders",
+		event.NewEvent(9, "order.cancelled", "test", map[string]any{})))
+	assert.Equal(t, 1, hits)
+
+	execs, err := ListExecutions(db, &ExecutionFilter{Status: ExecStatusFailed})
+	require.NoError(t, err)
+	require.Len(t, execs, 1)
+	assert.Contains(t, execs[0].Error, "webhook returned 500")
+}
+
+func TestRuleCRUD(t *testing.T) {
+	db, _, _ := newTestEngine(t)
+	r := &Rule{RuleName: "r1", EventType: "a", Actions: []*Action{{Type: ActionPublish, EventType: "b"}}}
+	require.NoError(t, CreateRule(db, r))
+	assert.Error(t, CreateRule(db, &Rule{RuleName: "r1", EventType: "a",
+		Actions: []*Action{{Type: ActionPublish, EventType: "b"}}}))
+
+	require.NoError(t, UpdateRule(db, "r1", &Rule{EventType: "a", Status: RuleStatusDisabled,
+		Actions: []*Action{{Type: ActionPublish, EventType: "c"}}}))
+	got, err := GetRule(db, "r1")
+	require.NoError(t, err)
+	assert.Equal(t, RuleStatusDisabled, got.Status)
+	assert.Equal(t, "c", got.Actions[0].EventType)
+	assert.WithinDuration(t, time.Now(), got.UpdatedAt, time.Minute)
+
+	require.NoError(t, DeleteRule(db, "r1"))
+	_, err = GetRule(db, "r1")
+	assert.ErrorIs(t, err, ErrRuleNotFound)
+	assert.ErrorIs(t, DeleteRule(db, "r1"), ErrRuleNotFound)
+}
@@ -0,0 +1,304 @@
+// Package xlsx 提供不依赖 cgo 的最小 XLSX 读写，仅处理单元格值，不处理公式计算和格式
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSheetNotFound = errors.New("sheet not found")
+
+type xWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xRels struct {
+	Rels []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xRichText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (r *xRichText) text() string {
+	if len(r.R) == 0 {
+		return r.T
+	}
+	var sb strings.Builder
+	for _, run := range r.R {
+		sb.WriteString(run.T)
+	}
+	return sb.String()
+}
+
+type xSST struct {
+	SI []xRichText `xml:"si"`
+}
+
+type xStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+type xSheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R  string     `xml:"r,attr"`
+			T  string     `xml:"t,attr"`
+			S  int        `xml:"s,attr"`
+			V  string     `xml:"v"`
+			IS *xRichText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// Sheet 工作表数据，单元格值均为字符串，空单元格为空串
+type Sheet struct {
+	Name string
+	Rows [][]string
+}
+
+// Read 读取 sheet 指定的工作表，sheet 为空时读取第一个工作表
+func Read(r io.ReaderAt, size int64, sheet string) (*Sheet, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid xlsx file: %w", err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	wb := &xWorkbook{}
+	if err = decodeFile(files, "xl/workbook.xml", wb); err != nil {
+		return nil, err
+	}
+	rels := &xRels{}
+	if err = decodeFile(files, "xl/_rels/workbook.xml.rels", rels); err != nil {
+		return nil, err
+	}
+	if len(wb.Sheets) == 0 {
+		return nil, ErrSheetNotFound
+	}
+	idx := 0
+	if sheet != "" {
+		idx = -1
+		for i, s := range wb.Sheets {
+			if s.Name == sheet {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: '%s'", ErrSheetNotFound, sheet)
+		}
+	}
+	target := ""
+	for _, rel := range rels.Rels {
+		if rel.ID == wb.Sheets[idx].RID {
+			target = rel.Target
+			break
+		}
+	}
+	if target == "" {
+		return nil, fmt.Errorf("%w: '%s'", ErrSheetNotFound, wb.Sheets[idx].Name)
+	}
+	if strings.HasPrefix(target, "/") {
+		target = strings.TrimPrefix(target, "/")
+	} else {
+		target = path.Join("xl", target)
+	}
+
+	sst := &xSST{}
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err = decodeFile(files, "xl/sharedStrings.xml", sst); err != nil {
+			return nil, err
+		}
+	}
+	styles := &xStyles{}
+	if _, ok := files["xl/styles.xml"]; ok {
+		if err = decodeFile(files, "xl/styles.xml", styles); err != nil {
+			return nil, err
+		}
+	}
+	dateStyles := dateStyleSet(styles)
+
+	xs := &xSheet{}
+	if err = decodeFile(files, target, xs); err != nil {
+		return nil, err
+	}
+	ret := &Sheet{Name: wb.Sheets[idx].Name}
+	for _, row := range xs.Rows {
+		rowIdx := row.R - 1
+		if rowIdx < len(ret.Rows) {
+			rowIdx = len(ret.Rows)
+		}
+		for len(ret.Rows) <= rowIdx {
+			ret.Rows = append(ret.Rows, nil)
+		}
+		var vals []string
+		for i, c := range row.Cells {
+			col := i
+			if c.R != "" {
+				if col, _, err = CellIndex(c.R); err != nil {
+					return nil, err
+				}
+			}
+			for len(vals) <= col {
+				vals = append(vals, "")
+			}
+			var v string
+			switch c.T {
+			case "s":
+				n, err1 := strconv.Atoi(c.V)
+				if err1 != nil || n < 0 || n >= len(sst.SI) {
+					return nil, fmt.Errorf("cell %s: invalid shared string index '%s'", c.R, c.V)
+				}
+				v = sst.SI[n].text()
+			case "inlineStr":
+				if c.IS != nil {
+					v = c.IS.text()
+				}
+			case "b":
+				v = map[string]string{"1": "true", "0": "false"}[c.V]
+			case "", "n":
+				v = c.V
+				if _, ok := dateStyles[c.S]; ok && v != "" {
+					if f, err1 := strconv.ParseFloat(v, 64); err1 == nil {
+						v = formatSerialDate(f)
+					}
+				}
+			default: // str, e
+				v = c.V
+			}
+			vals[col] = v
+		}
+		ret.Rows[rowIdx] = vals
+	}
+	return ret, nil
+}
+
+// ReadBytes 读取内存中的 xlsx
+func ReadBytes(data []byte, sheet string) (*Sheet, error) {
+	return Read(bytes.NewReader(data), int64(len(data)), sheet)
+}
+
+func decodeFile(files map[string]*zip.File, name string, v any) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("invalid xlsx file: missing %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err = xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("invalid xlsx file: %s: %w", name, err)
+	}
+	return nil
+}
+
+// dateStyleSet 返回数字格式为日期时间的样式下标
+func dateStyleSet(s *xStyles) map[int]struct{} {
+	custom := map[int]string{}
+	for _, f := range s.NumFmts {
+		custom[f.ID] = f.Code
+	}
+	ret := map[int]struct{}{}
+	for i, xf := range s.CellXfs {
+		id := xf.NumFmtID
+		if (id >= 14 && id <= 22) || (id >= 45 && id <= 47) {
+			ret[i] = struct{}{}
+			continue
+		}
+		if code, ok := custom[id]; ok && isDateFormat(code) {
+			ret[i] = struct{}{}
+		}
+	}
+	return ret
+}
+
+func isDateFormat(code string) bool {
+	// 去掉引号中的字面量和 [Red] 之类的修饰
+	var sb strings.Builder
+	quoted, bracket := false, false
+	for _, r := range code {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '[' && !quoted:
+			bracket = true
+		case r == ']' && !quoted:
+			bracket = false
+		case !quoted && !bracket:
+			sb.WriteRune(r)
+		}
+	}
+	c := strings.ToLower(sb.String())
+	return strings.ContainsAny(c, "ymdh") || strings.Contains(c, "ss")
+}
+
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// formatSerialDate 将 Excel 序列日期转换为 2006-01-02 或 2006-01-02 15:04:05
+func formatSerialDate(f float64) string {
+	days := math.Floor(f)
+	secs := math.Round((f - days) * 86400)
+	t := excelEpoch.AddDate(0, 0, int(days)).Add(time.Duration(secs) * time.Second)
+	if secs == 0 {
+		return t.Format(time.DateOnly)
+	}
+	return t.Format(time.DateTime)
+}
+
+// CellIndex 将 A1 形式的单元格引用转换为从 0 开始的列、行下标
+func CellIndex(ref string) (col, row int, err error) {
+	i := 0
+	for i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z' {
+		col = col*26 + int(ref[i]-'A'+1)
+		i++
+	}
+	if i == 0 {
+		return 0, 0, fmt.Errorf("invalid cell reference '%s'", ref)
+	}
+	if i < len(ref) {
+		if row, err = strconv.Atoi(ref[i:]); err != nil {
+			return 0, 0, fmt.Errorf("invalid cell reference '%s'", ref)
+		}
+	}
+	return col - 1, row - 1, nil
+}
+
+// ColumnName 将从 0 开始的列下标转换为 A、B…AA 形式
+func ColumnName(col int) string {
+	var b []byte
+	for col++; col > 0; col = (col - 1) / 26 {
+		b = append([]byte{byte('A' + (col-1)%26)}, b...)
+	}
+	return string(b)
+}
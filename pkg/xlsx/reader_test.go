@@ -0,0 +1,84 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildXLSX(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	data := buildXLSX(t, map[string]string{
+		"xl/workbook.xml": `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="first" r:id="rId1"/><sheet name="data" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships>
+<Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Target="worksheets/sheet2.xml"/></Relationships>`,
+		"xl/sharedStrings.xml":     `<sst><si><t>name</t></si><si><t>born</t></si><si><r><t>to</t></r><r><t>m</t></r></si></sst>`,
+		"xl/styles.xml":            `<styleSheet><cellXfs><xf numFmtId="0"/><xf numFmtId="14"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row r="1"><c r="A1" t="inlineStr"><is><t>x</t></is></c></row></sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="D1" t="inlineStr"><is><t>ok</t></is></c></row>
+<row r="3"><c r="A3" t="s"><v>2</v></c><c r="B3" s="1"><v>45292</v></c><c r="C3"><v>1.5</v></c><c r="D3" t="b"><v>1</v></c></row>
+</sheetData></worksheet>`,
+	})
+
+	sh, err := ReadBytes(data, "")
+	require.NoError(t, err)
+	assert.Equal(t, "first", sh.Name)
+	assert.Equal(t, [][]string{{"x"}}, sh.Rows)
+
+	sh, err = ReadBytes(data, "data")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"name", "born", "", "ok"},
+		nil,
+		{"tom", "2024-01-01", "1.5", "true"},
+	}, sh.Rows)
+
+	_, err = ReadBytes(data, "missing")
+	assert.ErrorIs(t, err, ErrSheetNotFound)
+}
+
+func TestCellIndex(t *testing.T) {
+	c, r, err := CellIndex("AB12")
+	require.NoError(t, err)
+	assert.Equal(t, 27, c)
+	assert.Equal(t, 11, r)
+	assert.Equal(t, "AB", ColumnName(27))
+	assert.Equal(t, "A", ColumnName(0))
+	_, _, err = CellIndex("12")
+	assert.Error(t, err)
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "导出 <1>")
+	require.NoError(t, err)
+	require.NoError(t, w.WriteRow([]any{"name", "amount", "ok", "note"}))
+	require.NoError(t, w.WriteRow([]any{"a&b", int64(3), true, nil}))
+	require.NoError(t, w.WriteRow([]any{[]byte("c"), 1.5, false, "x\x01y"}))
+	require.NoError(t, w.Close())
+
+	sh, err := ReadBytes(buf.Bytes(), "导出 <1>")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"name", "amount", "ok", "note"},
+		{"a&b", "3", "true"},
+		{"c", "1.5", "false", "xy"},
+	}, sh.Rows)
+}
@@ -0,0 +1,179 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxRows 单个工作表的最大行数
+const MaxRows = 1048576
+
+var ErrTooManyRows = errors.New("xlsx sheet row limit exceeded")
+
+const (
+	contentTypesXML = xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`
+	rootRelsXML = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	workbookRelsXML = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`
+	workbookXML = xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	sheetHeader = xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	sheetFooter = `</sheetData></worksheet>`
+)
+
+// Writer 流式写出只有一个工作表的 xlsx，行数据直接写入 zip 流，不在内存中保留；
+// 字符串使用内联字符串，不生成 sharedStrings
+type Writer struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	rows  int
+	buf   []byte
+}
+
+// NewWriter 创建 Writer，sheet 为工作表名，为空时为 Sheet1
+func NewWriter(w io.Writer, sheet string) (*Writer, error) {
+	if sheet == "" {
+		sheet = "Sheet1"
+	}
+	zw := zip.NewWriter(w)
+	var name strings.Builder
+	_ = xml.EscapeText(&name, []byte(sheet))
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", contentTypesXML},
+		{"_rels/.rels", rootRelsXML},
+		{"xl/workbook.xml", fmt.Sprintf(workbookXML, name.String())},
+		{"xl/_rels/workbook.xml.rels", workbookRelsXML},
+	}
+	for _, p := range parts {
+		f, err := zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(f, p.body); err != nil {
+			return nil, err
+		}
+	}
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.WriteString(f, sheetHeader); err != nil {
+		return nil, err
+	}
+	return &Writer{zw: zw, sheet: f}, nil
+}
+
+// WriteRow 写入一行；数值写为数字单元格，bool 写为布尔单元格，nil 为空单元格，其余写为文本
+func (w *Writer) WriteRow(vals []any) error {
+	if w.rows >= MaxRows {
+		return ErrTooManyRows
+	}
+	w.rows++
+	b := append(w.buf[:0], `<row r="`...)
+	b = strconv.AppendInt(b, int64(w.rows), 10)
+	b = append(b, `">`...)
+	for i, v := range vals {
+		if v == nil {
+			continue
+		}
+		b = append(b, `<c r="`...)
+		b = append(b, ColumnName(i)...)
+		b = strconv.AppendInt(b, int64(w.rows), 10)
+		b = append(b, '"')
+		b = appendCell(b, v)
+		b = append(b, `</c>`...)
+	}
+	b = append(b, `</row>`...)
+	w.buf = b
+	_, err := w.sheet.Write(b)
+	return err
+}
+
+func appendCell(b []byte, v any) []byte {
+	var n []byte
+	switch t := v.(type) {
+	case int:
+		n = strconv.AppendInt(nil, int64(t), 10)
+	case int32:
+		n = strconv.AppendInt(nil, int64(t), 10)
+	case int64:
+		n = strconv.AppendInt(nil, t, 10)
+	case uint32:
+		n = strconv.AppendUint(nil, uint64(t), 10)
+	case uint64:
+		n = strconv.AppendUint(nil, t, 10)
+	case float32:
+		n = strconv.AppendFloat(nil, float64(t), 'g', -1, 32)
+	case float64:
+		n = strconv.AppendFloat(nil, t, 'g', -1, 64)
+	case bool:
+		if t {
+			return append(b, ` t="b"><v>1</v>`...)
+		}
+		return append(b, ` t="b"><v>0</v>`...)
+	}
+	if n != nil {
+		b = append(b, `><v>`...)
+		b = append(b, n...)
+		return append(b, `</v>`...)
+	}
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	case []byte:
+		s = string(t)
+	case time.Time:
+		s = t.Format(time.DateTime)
+	default:
+		s = fmt.Sprint(v)
+	}
+	b = append(b, ` t="inlineStr"><is><t xml:space="preserve">`...)
+	b = appendEscaped(b, s)
+	return append(b, `</t></is>`...)
+}
+
+func appendEscaped(b []byte, s string) []byte {
+	for _, r := range s {
+		switch r {
+		case '<':
+			b = append(b, "&lt;"...)
+		case '>':
+			b = append(b, "&gt;"...)
+		case '&':
+			b = append(b, "&amp;"...)
+		case '\t', '\n', '\r':
+			b = append(b, string(r)...)
+		default:
+			// XML 1.0 不允许的控制字符直接丢弃
+			if r < 0x20 || r == 0xFFFE || r == 0xFFFF {
+				continue
+			}
+			b = append(b, string(r)...)
+		}
+	}
+	return b
+}
+
+// Close 结束工作表并写出 zip 目录，不关闭底层 io.Writer
+func (w *Writer) Close() error {
+	if _, err := io.WriteString(w.sheet, sheetFooter); err != nil {
+		return err
+	}
+	return w.zw.Close()
+}